@@ -0,0 +1,4 @@
+// Package fileserverv1 contains the gRPC API of the file server.
+package fileserverv1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative fileserver.proto
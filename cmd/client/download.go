@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/spf13/cobra"
@@ -8,6 +9,11 @@ import (
 	"github.com/zale144/fileserver/internal/client"
 )
 
+var (
+	downloadAll bool
+	archiveOpts client.ArchiveOptions
+)
+
 // DownloadCmd represents the download command
 var DownloadCmd = &cobra.Command{
 	Use:   "download [fileID] [url]", // TODO: get url from config
@@ -15,16 +21,49 @@ var DownloadCmd = &cobra.Command{
 	Long: `Download requests a file and its Merkle proof from the server.
 For example:
 
-fileserver download file123`,
-	Args: cobra.ExactArgs(2),
+fileserver download file123
+
+With --all, all the files are downloaded as a single archive and verified while unpacking:
+
+fileserver download --all http://localhost:8080/files/archive --root ./merkle_root`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if downloadAll {
+			return cobra.ExactArgs(1)(cmd, args)
+		}
+		return cobra.ExactArgs(2)(cmd, args)
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		fileID := args[0]
-		url := args[1]
-		err := client.DownloadFile(fileID, url)
+		return traced(cmd, func(ctx context.Context) error {
+			return download(ctx, args)
+		})
+	},
+}
+
+func download(ctx context.Context, args []string) error {
+	if downloadAll {
+		url := args[0]
+		count, err := client.DownloadArchive(ctx, url, archiveOpts)
 		if err != nil {
-			return fmt.Errorf("failed to download file: %w", err)
+			return fmt.Errorf("failed to download archive: %w", err)
 		}
-		fmt.Printf("Successfully downloaded file with ID %s\n", fileID)
+		fmt.Printf("Successfully downloaded and verified %d files\n", count)
 		return nil
-	},
+	}
+
+	fileID := args[0]
+	url := args[1]
+	err := client.DownloadFile(ctx, fileID, url)
+	if err != nil {
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+	fmt.Printf("Successfully downloaded file with ID %s\n", fileID)
+	return nil
+}
+
+func init() {
+	DownloadCmd.Flags().BoolVar(&downloadAll, "all", false, "download all files as an archive")
+	DownloadCmd.Flags().IntVar(&archiveOpts.From, "from", 0, "first file index to download with --all")
+	DownloadCmd.Flags().IntVar(&archiveOpts.To, "to", -1, "last file index to download with --all")
+	DownloadCmd.Flags().StringVar(&archiveOpts.RootPath, "root", "", "Merkle root file to verify against with --all")
+	DownloadCmd.Flags().StringVar(&archiveOpts.OutDir, "out", ".", "output directory with --all")
 }
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+
+	"github.com/zale144/fileserver/internal/tracing"
+)
+
+// traced runs fn within a span named after the command, exported as set by the TRACING_* variables,
+// so that the requests sent by the command belong to the same trace as their handling on the server.
+func traced(cmd *cobra.Command, fn func(ctx context.Context) error) (err error) {
+	var cfg tracing.Config
+	if err = envconfig.Process("", &cfg); err != nil {
+		return fmt.Errorf("failed to process tracing env vars: %w", err)
+	}
+	shutdown, err := tracing.Setup(cmd.Context(), cfg, "fileserver-cli")
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	defer func() {
+		_ = shutdown(context.Background())
+	}()
+
+	ctx, span := otel.Tracer("github.com/zale144/fileserver/cmd/client").Start(cmd.Context(), cmd.CommandPath())
+	defer tracing.End(span, &err)
+	return fn(ctx)
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/spf13/cobra"
@@ -19,10 +20,12 @@ fileserver upload ./directory http://localhost:8080/file`, // TODO: get url from
 	RunE: func(cmd *cobra.Command, args []string) error {
 		dirPath := args[0]
 		url := args[1]
-		if err := client.UploadDirectory(dirPath, url); err != nil {
-			return fmt.Errorf("failed to upload %s: %w", dirPath, err)
-		}
-		fmt.Printf("Successfully uploaded %s\n", dirPath)
-		return nil
+		return traced(cmd, func(ctx context.Context) error {
+			if err := client.UploadDirectory(ctx, dirPath, url); err != nil {
+				return fmt.Errorf("failed to upload %s: %w", dirPath, err)
+			}
+			fmt.Printf("Successfully uploaded %s\n", dirPath)
+			return nil
+		})
 	},
 }
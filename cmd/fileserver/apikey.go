@@ -0,0 +1,116 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/database"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/repository"
+)
+
+var (
+	apiKeyTenant string
+	apiKeyName   string
+	apiKeyRoles  []string
+)
+
+// APIKeyCmd groups the API key management commands
+var APIKeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "manage the API keys of the tenants",
+}
+
+var apiKeyCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "create a new API key for a tenant",
+	Long: `create a new API key for a tenant, the key is printed once and only its hash is stored.
+For example:
+
+fileserver apikey create --tenant acme --name ci --roles uploader,auditor`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !auth.ValidTenant(apiKeyTenant) {
+			return fmt.Errorf("invalid tenant ID %q", apiKeyTenant)
+		}
+
+		key, err := auth.GenerateAPIKey()
+		if err != nil {
+			return err
+		}
+
+		err = withAPIKeyRepo(func(repo *repository.APIKey) error {
+			return repo.Create(context.Background(), &model.APIKey{
+				KeyHash:  auth.HashAPIKey(key),
+				TenantID: apiKeyTenant,
+				Name:     apiKeyName,
+				Roles:    apiKeyRoles,
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create API key: %w", err)
+		}
+
+		fmt.Println(key)
+		return nil
+	},
+}
+
+var apiKeyRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "revoke the API keys of a tenant with the given name",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var revoked int64
+		err := withAPIKeyRepo(func(repo *repository.APIKey) (err error) {
+			revoked, err = repo.Revoke(context.Background(), apiKeyTenant, apiKeyName)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to revoke API key: %w", err)
+		}
+
+		fmt.Printf("Revoked %d API keys\n", revoked)
+		return nil
+	},
+}
+
+func withAPIKeyRepo(fn func(repo *repository.APIKey) error) error {
+	return withDB(func(db *sql.DB) error {
+		return fn(repository.NewAPIKey(db))
+	})
+}
+
+// withDB connects to the migrated database for the management commands.
+func withDB(fn func(db *sql.DB) error) error {
+	var cfg database.Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		return fmt.Errorf("failed to process env var: %w", err)
+	}
+
+	db, err := database.NewDBConnection(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	if err = database.MigrateDB(db, "migrations", database.EmbedMigrations); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return fn(db)
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{apiKeyCreateCmd, apiKeyRevokeCmd} {
+		cmd.Flags().StringVar(&apiKeyTenant, "tenant", "", "tenant ID")
+		cmd.Flags().StringVar(&apiKeyName, "name", "", "name of the key")
+		_ = cmd.MarkFlagRequired("tenant")
+		_ = cmd.MarkFlagRequired("name")
+		APIKeyCmd.AddCommand(cmd)
+	}
+	apiKeyCreateCmd.Flags().StringSliceVar(&apiKeyRoles, "roles", nil, "comma separated roles of the key")
+}
@@ -0,0 +1,78 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/config"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/repository"
+	"github.com/zale144/fileserver/internal/server/service"
+	"github.com/zale144/fileserver/internal/server/storage"
+)
+
+var (
+	gcDryRun      bool
+	gcQuarantine  bool
+	gcGracePeriod time.Duration
+)
+
+// GCCmd collects the orphaned objects on demand
+var GCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "delete the stored objects no file refers to",
+	Long: `delete, or quarantine, the stored objects that neither a file nor a pending upload
+refers to and that are older than the grace period. The uploads pending for longer than
+the grace period are marked failed and their quota is released. For example:
+
+fileserver gc --dry-run --grace-period 48h`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var cfg config.Config
+		if err := envconfig.Process("", &cfg); err != nil {
+			return fmt.Errorf("failed to process env var: %w", err)
+		}
+		opts := cfg.Service.GCOptions()
+		opts.DryRun = gcDryRun
+		if cmd.Flags().Changed("quarantine") {
+			opts.Quarantine = gcQuarantine
+		}
+		if cmd.Flags().Changed("grace-period") {
+			opts.GracePeriod = gcGracePeriod
+		}
+
+		return withDB(func(db *sql.DB) error {
+			repo := repository.NewFile(db)
+			store, err := storage.New(cfg.Storage, storage.WithShardIndex(repo))
+			if err != nil {
+				return fmt.Errorf("failed to create storage: %w", err)
+			}
+
+			svc := service.NewFile(repo, store, zap.NewNop())
+			report, err := svc.CollectGarbage(context.Background(), opts)
+			if err != nil {
+				return fmt.Errorf("failed to collect garbage: %w", err)
+			}
+
+			if report.DryRun {
+				for _, orphan := range report.Orphans {
+					fmt.Printf("%s\t%d\t%s\n", orphan.Key, orphan.Size, orphan.LastModified.Format(time.RFC3339))
+				}
+			}
+			fmt.Printf("scanned: %d, orphans: %d (%d bytes), collected: %d, kept: %d, abandoned uploads: %d\n",
+				report.Scanned, len(report.Orphans), report.OrphanBytes(), report.Collected, report.Kept, report.AbandonedUploads)
+			return nil
+		})
+	},
+}
+
+func init() {
+	GCCmd.Flags().BoolVar(&gcDryRun, "dry-run", false, "only list the orphans, without deleting them")
+	GCCmd.Flags().BoolVar(&gcQuarantine, "quarantine", false, "move the orphans under "+model.QuarantinePrefix+" instead of deleting them, defaults to GC_QUARANTINE")
+	GCCmd.Flags().DurationVar(&gcGracePeriod, "grace-period", 0, "age under which objects and pending uploads are kept, defaults to GC_GRACE_PERIOD")
+}
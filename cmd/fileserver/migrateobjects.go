@@ -0,0 +1,60 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/config"
+	"github.com/zale144/fileserver/internal/server/repository"
+	"github.com/zale144/fileserver/internal/server/service"
+	"github.com/zale144/fileserver/internal/server/storage"
+)
+
+// MigrateObjectsCmd moves the objects stored under their bare content hash to the keys of the default tenant
+var MigrateObjectsCmd = &cobra.Command{
+	Use:   "migrate-objects",
+	Short: "move the objects stored before the tenants were introduced to the default tenant",
+	Long: `move the objects stored under their bare content hash, before the object keys were scoped
+to the tenants, to the keys of the default tenant, which owns the files uploaded back then.
+The files of those objects cannot be downloaded until they are moved, so run it once when
+upgrading, before the server. It can be run again if some objects fail to move. For example:
+
+fileserver migrate-objects`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var cfg config.Config
+		if err := envconfig.Process("", &cfg); err != nil {
+			return fmt.Errorf("failed to process env var: %w", err)
+		}
+		// the objects that cannot be moved are logged
+		log, err := zap.NewProduction()
+		if err != nil {
+			return fmt.Errorf("failed to create logger: %w", err)
+		}
+		defer log.Sync()
+
+		return withDB(func(db *sql.DB) error {
+			repo := repository.NewFile(db)
+			store, err := storage.New(cfg.Storage, storage.WithShardIndex(repo), storage.WithLogger(log))
+			if err != nil {
+				return fmt.Errorf("failed to create storage: %w", err)
+			}
+
+			svc := service.NewFile(repo, store, log)
+			report, err := svc.MigrateObjectKeys(context.Background())
+			if err != nil {
+				return fmt.Errorf("failed to migrate object keys: %w", err)
+			}
+
+			fmt.Printf("scanned: %d, migrated: %d, failed: %d\n", report.Scanned, report.Migrated, report.Failed)
+			if report.Failed > 0 {
+				return fmt.Errorf("failed to migrate %d objects", report.Failed)
+			}
+			return nil
+		})
+	},
+}
@@ -0,0 +1,90 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+
+	"github.com/zale144/fileserver/internal/server/repository"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+var (
+	quotaTenant     string
+	quotaMaxBytes   int64
+	quotaMaxObjects int64
+)
+
+// QuotaCmd groups the quota management commands
+var QuotaCmd = &cobra.Command{
+	Use:   "quota",
+	Short: "manage the storage quotas of the tenants",
+}
+
+var quotaSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set the storage quota of a tenant",
+	Long: `set the storage quota of a tenant, the limits that are not given fall back to
+QUOTA_MAX_BYTES and QUOTA_MAX_OBJECTS, and a zero limit means there is no limit.
+For example:
+
+fileserver quota set --tenant acme --max-bytes 10737418240 --max-objects 100000`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var maxBytes, maxObjects *int64
+		if cmd.Flags().Changed("max-bytes") {
+			maxBytes = &quotaMaxBytes
+		}
+		if cmd.Flags().Changed("max-objects") {
+			maxObjects = &quotaMaxObjects
+		}
+
+		err := withDB(func(db *sql.DB) error {
+			return repository.NewFile(db).SetQuota(context.Background(), quotaTenant, maxBytes, maxObjects)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set quota: %w", err)
+		}
+		return nil
+	},
+}
+
+var quotaShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "show the storage usage and quota of a tenant",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var cfg service.Config
+		if err := envconfig.Process("", &cfg); err != nil {
+			return fmt.Errorf("failed to process env var: %w", err)
+		}
+
+		return withDB(func(db *sql.DB) error {
+			used, quota, err := repository.NewFile(db).GetQuota(context.Background(), quotaTenant, cfg.DefaultQuota())
+			if err != nil {
+				return fmt.Errorf("failed to get quota: %w", err)
+			}
+			fmt.Printf("bytes:   %d / %s\n", used.Bytes, formatLimit(quota.MaxBytes))
+			fmt.Printf("objects: %d / %s\n", used.Objects, formatLimit(quota.MaxObjects))
+			return nil
+		})
+	},
+}
+
+func formatLimit(limit int64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(limit)
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{quotaSetCmd, quotaShowCmd} {
+		cmd.Flags().StringVar(&quotaTenant, "tenant", "", "tenant ID")
+		_ = cmd.MarkFlagRequired("tenant")
+		QuotaCmd.AddCommand(cmd)
+	}
+	quotaSetCmd.Flags().Int64Var(&quotaMaxBytes, "max-bytes", 0, "maximum number of stored bytes")
+	quotaSetCmd.Flags().Int64Var(&quotaMaxObjects, "max-objects", 0, "maximum number of stored files")
+}
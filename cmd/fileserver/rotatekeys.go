@@ -0,0 +1,70 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/config"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/repository"
+	"github.com/zale144/fileserver/internal/server/storage"
+)
+
+// RotateKeysCmd re-wraps the data keys of the stored objects with the current master key
+var RotateKeysCmd = &cobra.Command{
+	Use:   "rotate-keys",
+	Short: "re-wrap the data keys of the stored objects with the current master key",
+	Long: `re-wrap the data key of every stored object wrapped by another master key than the current
+one, ENCRYPTION_KEY_ID or the last key given, with the current one. The content of the objects
+is not re-encrypted, only their headers are rewritten. The old master keys must still be
+given until the rotation succeeds, they can be dropped afterwards. For example:
+
+ENCRYPTION_KEY_FILE=keys fileserver rotate-keys`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var cfg config.Config
+		if err := envconfig.Process("", &cfg); err != nil {
+			return fmt.Errorf("failed to process env var: %w", err)
+		}
+		// the objects whose keys cannot be rotated are logged
+		log, err := zap.NewProduction()
+		if err != nil {
+			return fmt.Errorf("failed to create logger: %w", err)
+		}
+		defer log.Sync()
+
+		return withDB(func(db *sql.DB) error {
+			store, err := storage.New(cfg.Storage, storage.WithShardIndex(repository.NewFile(db)), storage.WithLogger(log))
+			if err != nil {
+				return fmt.Errorf("failed to create storage: %w", err)
+			}
+			backends := storage.Encryption(store)
+			if len(backends) == 0 {
+				return errors.New("the objects are not encrypted, set ENCRYPTION_KEYS or ENCRYPTION_KEY_FILE")
+			}
+
+			total := &model.KeyRotationReport{}
+			for i, backend := range backends {
+				report, err := backend.RotateKeys(context.Background())
+				if err != nil {
+					return fmt.Errorf("failed to rotate the keys of backend %d: %w", i, err)
+				}
+				total.Scanned += report.Scanned
+				total.Rotated += report.Rotated
+				total.Failed += report.Failed
+				total.Encrypted += report.Encrypted
+			}
+
+			fmt.Printf("scanned: %d, rotated: %d, encrypted: %d, failed: %d\n", total.Scanned, total.Rotated, total.Encrypted, total.Failed)
+			if total.Failed > 0 {
+				return fmt.Errorf("failed to rotate the keys of %d objects", total.Failed)
+			}
+			return nil
+		})
+	},
+}
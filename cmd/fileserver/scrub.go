@@ -0,0 +1,76 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/config"
+	"github.com/zale144/fileserver/internal/server/repository"
+	"github.com/zale144/fileserver/internal/server/service"
+	"github.com/zale144/fileserver/internal/server/storage"
+)
+
+var (
+	scrubTenant string
+	scrubRate   float64
+)
+
+// ScrubCmd scrubs the stored files on demand
+var ScrubCmd = &cobra.Command{
+	Use:   "scrub",
+	Short: "check the stored files against their hashes and proofs",
+	Long: `re-hash the stored object of every file, of one tenant or of all of them, and verify
+its stored Merkle proof against the root of the tenant. The outcome is recorded in the
+database like the one of the scrub runs of the server, and the command fails if any file
+is missing, corrupted or has an invalid proof. For example:
+
+fileserver scrub --tenant acme --rate 50`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var cfg config.Config
+		if err := envconfig.Process("", &cfg); err != nil {
+			return fmt.Errorf("failed to process env var: %w", err)
+		}
+		rate := cfg.Service.ScrubRate
+		if cmd.Flags().Changed("rate") {
+			rate = scrubRate
+		}
+
+		return withDB(func(db *sql.DB) error {
+			repo := repository.NewFile(db)
+			store, err := storage.New(cfg.Storage, storage.WithShardIndex(repo))
+			if err != nil {
+				return fmt.Errorf("failed to create storage: %w", err)
+			}
+			var opts []service.Option
+			if coded, ok := storage.ErasureCoding(store); ok {
+				opts = append(opts, service.WithShardRepair(coded))
+			}
+
+			svc := service.NewFile(repo, store, zap.NewNop(), opts...)
+			report, err := svc.Scrub(context.Background(), scrubTenant, rate)
+			if err != nil {
+				return fmt.Errorf("failed to scrub stored files: %w", err)
+			}
+
+			for _, failure := range report.Failures {
+				fmt.Printf("%s\t%d\t%s\n", failure.TenantID, failure.Index, failure.Status)
+			}
+			fmt.Printf("checked: %d, failed: %d, errors: %d, repaired shards: %d\n",
+				report.Checked, len(report.Failures), report.Errors, report.RepairedShards)
+			if len(report.Failures) > 0 {
+				return fmt.Errorf("%d stored files failed the scrub", len(report.Failures))
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	ScrubCmd.Flags().StringVar(&scrubTenant, "tenant", "", "tenant ID, all tenants when not given")
+	ScrubCmd.Flags().Float64Var(&scrubRate, "rate", 0, "maximum number of files checked per second, defaults to SCRUB_RATE")
+}
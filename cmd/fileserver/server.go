@@ -1,16 +1,26 @@
 package fileserver
 
 import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 
+	"github.com/zale144/fileserver/internal/server/auth"
 	"github.com/zale144/fileserver/internal/server/config"
 	"github.com/zale144/fileserver/internal/server/database"
+	"github.com/zale144/fileserver/internal/server/metrics"
 	"github.com/zale144/fileserver/internal/server/repository"
 	"github.com/zale144/fileserver/internal/server/server"
 	"github.com/zale144/fileserver/internal/server/service"
 	"github.com/zale144/fileserver/internal/server/storage"
+	"github.com/zale144/fileserver/internal/tlsconfig"
+	"github.com/zale144/fileserver/internal/tracing"
 )
 
 var ServerCmd = &cobra.Command{
@@ -33,32 +43,171 @@ func start() {
 		log.Fatal("Failed to process env var", zap.Error(err))
 	}
 
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "fileserver")
+	if err != nil {
+		log.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error("Failed to flush traces", zap.Error(err))
+		}
+	}()
+
 	db, err := database.NewDBConnection(cfg.Database)
 	if err != nil {
 		log.Fatal("Failed to connect to database", zap.Error(err))
 	}
-	defer db.Close()
 
 	if err = database.MigrateDB(db, "migrations", database.EmbedMigrations); err != nil {
 		log.Fatal("Failed to migrate database", zap.Error(err))
 	}
+	// the readiness probe compares the database against the migrations the server was built with
+	migrationVersion, err := database.LatestMigration("migrations", database.EmbedMigrations)
+	if err != nil {
+		log.Fatal("Failed to collect migrations", zap.Error(err))
+	}
 
 	log.Debug("Connected to database")
 
-	repo := repository.NewFile(db)
-	store, err := storage.NewFile(cfg.Storage)
+	m := metrics.New(metrics.NewRegistry())
+
+	repo := repository.NewFile(db, repository.WithMetrics(m))
+	storeOpts := []storage.Option{storage.WithMetrics(m), storage.WithLogger(log), storage.WithShardIndex(repo),
+		storage.WithReferences(repo)}
+	store, err := storage.New(cfg.Storage, storeOpts...)
 	if err != nil {
 		log.Fatal("Failed to create storage", zap.Error(err))
 	}
-	if err = store.MakeBucket(); err != nil {
-		log.Fatal("Failed to create bucket", zap.Error(err))
+	for _, backend := range storage.Backends(store) {
+		if bucket, ok := backend.(*storage.File); ok {
+			if err = bucket.MakeBucket(); err != nil {
+				log.Fatal("Failed to create bucket", zap.Error(err))
+			}
+		}
+	}
+
+	svcOpts := []service.Option{
+		service.WithDefaultQuota(cfg.Service.DefaultQuota()),
+		service.WithMetrics(m),
+		service.WithSpoolDir(cfg.Service.UploadSpoolDir),
+	}
+	if replicaCfg, ok := cfg.Storage.Replica(); ok {
+		replica, err := storage.New(replicaCfg, storeOpts...)
+		if err != nil {
+			log.Fatal("Failed to create replica storage", zap.Error(err))
+		}
+		svcOpts = append(svcOpts, service.WithReplica(replica))
+	}
+	if tiered, ok := store.(*storage.Tiered); ok {
+		svcOpts = append(svcOpts, service.WithTiers(tiered))
+	}
+	if coded, ok := storage.ErasureCoding(store); ok {
+		svcOpts = append(svcOpts, service.WithShardRepair(coded))
+	}
+	svc := service.NewFile(repo, store, log, svcOpts...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cfg.Service.ScrubInterval > 0 {
+		go svc.RunScrubber(ctx, cfg.Service.ScrubInterval, cfg.Service.ScrubRate)
+	}
+	if cfg.Service.GCInterval > 0 {
+		go svc.RunGC(ctx, cfg.Service.GCInterval, cfg.Service.GCOptions())
+	}
+	if cfg.Service.TierInterval > 0 {
+		go svc.RunTiering(ctx, cfg.Service.TierInterval, cfg.Service.TierOptions())
+	}
+	if replicated, ok := storage.Replication(store); ok {
+		go replicated.RunRepair(ctx, cfg.Storage.RepairInterval)
 	}
 
-	svc := service.NewFile(repo, store, log)
-	srv := server.NewServer(cfg.Server, svc, log)
+	authn, err := auth.NewAuthenticator(cfg.Auth, repository.NewAPIKey(db))
+	if err != nil {
+		log.Fatal("Failed to create authenticator", zap.Error(err))
+	}
+	// without authentication every caller can read and delete the files of the default tenant,
+	// so it is only allowed when the API cannot be reached from other hosts
+	if exposed := cfg.Server.ExposedAddresses(); !cfg.Auth.Enabled && len(exposed) > 0 {
+		log.Fatal("Authentication is disabled on addresses reachable from other hosts, set AUTH_ENABLED=true or listen on a loopback address",
+			zap.Strings("addresses", exposed))
+	}
+	if !cfg.Auth.Enabled {
+		log.Warn("Authentication is disabled, every caller shares the default tenant, set AUTH_ENABLED=true to isolate the tenants")
+	}
+
+	var policy *server.Policy
+	if cfg.Server.PolicyFile != "" {
+		if policy, err = server.LoadPolicy(cfg.Server.PolicyFile); err != nil {
+			log.Fatal("Failed to load authorization policy", zap.Error(err))
+		}
+	}
+
+	opts := []server.Option{
+		server.WithAuthenticator(authn),
+		server.WithPolicy(policy),
+		server.WithMetrics(m),
+	}
+	if cfg.Server.TLS.Enabled() {
+		reloader, err := tlsconfig.NewReloader(cfg.Server.TLS, log)
+		if err != nil {
+			log.Fatal("Failed to load TLS certificates", zap.Error(err))
+		}
+		go reloader.Run(ctx, cfg.Server.TLS.ReloadInterval)
+		opts = append(opts, server.WithTLS(reloader.TLSConfig()))
+	}
+	lis, err := net.Listen("tcp", cfg.Server.GRPCAddress)
+	if err != nil {
+		log.Fatal("Failed to listen for gRPC", zap.String("address", cfg.Server.GRPCAddress), zap.Error(err))
+	}
+	// both servers share the authenticator, the policy and the limits of the callers
+	deps := server.NewDependencies(cfg.Server, svc, log, opts...)
+	grpcSrv := server.NewGRPCServer(deps)
+	go func() {
+		if err := grpcSrv.Serve(lis); err != nil {
+			log.Fatal("Failed to serve gRPC", zap.Error(err))
+		}
+	}()
+
+	// the gRPC server, and the metrics one, are stopped along with the HTTP one, once the uploads are drained
+	srvOpts := []server.ServerOption{
+		server.WithScrubRate(cfg.Service.ScrubRate),
+		server.WithReadinessChecks(
+			server.HealthCheck{Name: "database", Check: db.PingContext},
+			server.HealthCheck{Name: "migrations", Check: func(ctx context.Context) error {
+				return database.CheckMigrations(ctx, db, migrationVersion)
+			}},
+			server.HealthCheck{Name: "storage", Check: store.Ping},
+		),
+		server.WithShutdownHook(grpcSrv.Shutdown),
+	}
+	// the metrics are served apart from the API, so that its callers cannot scrape them
+	if cfg.Server.MetricsAddress != "" {
+		metricsSrv := &http.Server{
+			Addr:              cfg.Server.MetricsAddress,
+			Handler:           server.MetricsRouter(m),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal("Failed to serve metrics", zap.String("address", cfg.Server.MetricsAddress), zap.Error(err))
+			}
+		}()
+		srvOpts = append(srvOpts, server.WithShutdownHook(func(ctx context.Context) {
+			if err := metricsSrv.Shutdown(ctx); err != nil {
+				log.Warn("Failed to stop metrics server", zap.Error(err))
+			}
+		}))
+	}
+	srv := server.NewServer(deps, srvOpts...)
 	router := server.Router(srv)
 
 	if err = srv.StartServer(router); err != nil {
-		log.Fatal("Failed to start server", zap.Error(err))
+		log.Error("Failed to stop server", zap.Error(err))
+	}
+
+	cancel()
+	if err = db.Close(); err != nil {
+		log.Error("Failed to close database", zap.Error(err))
 	}
+	log.Info("Database connections closed")
 }
@@ -0,0 +1,90 @@
+package fileserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/config"
+	"github.com/zale144/fileserver/internal/server/repository"
+	"github.com/zale144/fileserver/internal/server/service"
+	"github.com/zale144/fileserver/internal/server/storage"
+)
+
+var (
+	tierDryRun bool
+	tierAge    time.Duration
+	tierIdle   time.Duration
+	tierLimit  int
+)
+
+// TierCmd migrates the old and idle objects to the cold storage tier on demand
+var TierCmd = &cobra.Command{
+	Use:   "tier",
+	Short: "migrate the old and idle objects to the cold storage tier",
+	Long: `migrate the objects of the hot storage tier created longer ago than the age, or not read
+for longer than the idle period, to the cold tier configured with STORAGE_COLD_BACKEND. For example:
+
+fileserver tier --dry-run --idle 720h`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var cfg config.Config
+		if err := envconfig.Process("", &cfg); err != nil {
+			return fmt.Errorf("failed to process env var: %w", err)
+		}
+		opts := cfg.Service.TierOptions()
+		opts.DryRun = tierDryRun
+		if cmd.Flags().Changed("age") {
+			opts.Age = tierAge
+		}
+		if cmd.Flags().Changed("idle") {
+			opts.Idle = tierIdle
+		}
+		if cmd.Flags().Changed("limit") {
+			opts.Limit = tierLimit
+		}
+
+		if _, ok := cfg.Storage.Cold(); !ok {
+			return errors.New("no cold storage tier configured, set STORAGE_COLD_BACKEND")
+		}
+
+		return withDB(func(db *sql.DB) error {
+			repo := repository.NewFile(db)
+			store, err := storage.New(cfg.Storage, storage.WithShardIndex(repo))
+			if err != nil {
+				return fmt.Errorf("failed to create storage: %w", err)
+			}
+			tiered := store.(*storage.Tiered)
+
+			svc := service.NewFile(repo, store, zap.NewNop(), service.WithTiers(tiered))
+			report, err := svc.MigrateObjects(context.Background(), opts)
+			if err != nil {
+				return fmt.Errorf("failed to migrate objects: %w", err)
+			}
+
+			if report.DryRun {
+				for _, object := range report.Candidates {
+					fmt.Printf("%s\t%d\n", object.Key(), object.Size)
+				}
+			}
+			fmt.Printf("candidates: %d, migrated: %d (%d bytes), failed: %d\n",
+				len(report.Candidates), report.Migrated, report.Bytes, report.Failed)
+			if report.Failed > 0 {
+				return fmt.Errorf("%d objects could not be migrated", report.Failed)
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	TierCmd.Flags().BoolVar(&tierDryRun, "dry-run", false, "only list the objects to migrate, without migrating them")
+	TierCmd.Flags().DurationVar(&tierAge, "age", 0, "age over which objects are migrated, zero disables it, defaults to TIER_AGE")
+	TierCmd.Flags().DurationVar(&tierIdle, "idle", 0, "time without a read over which objects are migrated, zero disables it, defaults to TIER_IDLE")
+	TierCmd.Flags().IntVar(&tierLimit, "limit", 0, "maximum number of objects migrated, defaults to TIER_BATCH_SIZE")
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/spf13/viper"
 	"github.com/zale144/fileserver/cmd/client"
 	"github.com/zale144/fileserver/cmd/fileserver"
+	internalclient "github.com/zale144/fileserver/internal/client"
+	"github.com/zale144/fileserver/internal/tlsconfig"
 )
 
 var cfgFile string
@@ -16,6 +18,18 @@ var RootCmd = &cobra.Command{
 	Use:   "fileserver",
 	Short: "fileserver is a CLI application for file management with Merkle tree verification",
 	Long:  `Fast and Flexible.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return internalclient.Configure(internalclient.Config{
+			APIKey:     viper.GetString("api_key"),
+			Token:      viper.GetString("token"),
+			MaxRetries: viper.GetInt("max_retries"),
+			TLS: tlsconfig.Client{
+				CAFile:   viper.GetString("ca_cert"),
+				CertFile: viper.GetString("cert"),
+				KeyFile:  viper.GetString("key"),
+			},
+		})
+	},
 }
 
 func Execute() {
@@ -32,7 +46,31 @@ func init() {
 	RootCmd.AddCommand(client.DownloadCmd)
 	RootCmd.AddCommand(client.VerifyCmd)
 	RootCmd.AddCommand(client.MerkleRootCmd)
+	RootCmd.AddCommand(fileserver.APIKeyCmd)
+	RootCmd.AddCommand(fileserver.QuotaCmd)
+	RootCmd.AddCommand(fileserver.ScrubCmd)
+	RootCmd.AddCommand(fileserver.GCCmd)
+	RootCmd.AddCommand(fileserver.TierCmd)
+	RootCmd.AddCommand(fileserver.RotateKeysCmd)
+	RootCmd.AddCommand(fileserver.MigrateObjectsCmd)
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.client.yaml)")
+	RootCmd.PersistentFlags().String("api-key", "", "API key to authenticate with (env FILESERVER_API_KEY)")
+	RootCmd.PersistentFlags().String("token", "", "JWT to authenticate with (env FILESERVER_TOKEN)")
+	RootCmd.PersistentFlags().Int("max-retries", 3, "how many times to retry a request throttled by the server")
+	RootCmd.PersistentFlags().String("ca-cert", "", "CA bundle to verify the server certificate with (env FILESERVER_CA_CERT)")
+	RootCmd.PersistentFlags().String("cert", "", "client certificate for mutual TLS (env FILESERVER_CERT)")
+	RootCmd.PersistentFlags().String("key", "", "key of the client certificate (env FILESERVER_KEY)")
+	cobra.CheckErr(viper.BindPFlag("api_key", RootCmd.PersistentFlags().Lookup("api-key")))
+	cobra.CheckErr(viper.BindPFlag("token", RootCmd.PersistentFlags().Lookup("token")))
+	cobra.CheckErr(viper.BindPFlag("max_retries", RootCmd.PersistentFlags().Lookup("max-retries")))
+	cobra.CheckErr(viper.BindPFlag("ca_cert", RootCmd.PersistentFlags().Lookup("ca-cert")))
+	cobra.CheckErr(viper.BindPFlag("cert", RootCmd.PersistentFlags().Lookup("cert")))
+	cobra.CheckErr(viper.BindPFlag("key", RootCmd.PersistentFlags().Lookup("key")))
+	cobra.CheckErr(viper.BindEnv("api_key", "FILESERVER_API_KEY"))
+	cobra.CheckErr(viper.BindEnv("token", "FILESERVER_TOKEN"))
+	cobra.CheckErr(viper.BindEnv("ca_cert", "FILESERVER_CA_CERT"))
+	cobra.CheckErr(viper.BindEnv("cert", "FILESERVER_CERT"))
+	cobra.CheckErr(viper.BindEnv("key", "FILESERVER_KEY"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/zale144/fileserver/internal/merkle"
+)
+
+const manifestName = "manifest.json"
+
+type ArchiveManifest struct {
+	Root  string                 `json:"root"`
+	Files []ArchiveManifestEntry `json:"files"`
+}
+
+type ArchiveManifestEntry struct {
+	Index int      `json:"index"`
+	Name  string   `json:"name"`
+	Hash  string   `json:"hash"`
+	Proof []string `json:"proof"`
+}
+
+// ArchiveOptions configures DownloadArchive.
+type ArchiveOptions struct {
+	// From and To limit the downloaded indexes, a negative To means there is no upper bound.
+	From int
+	To   int
+	// RootPath is the path of the locally saved Merkle root, if empty the root from the manifest is trusted.
+	RootPath string
+	// OutDir is the directory the files and their proofs are written to.
+	OutDir string
+}
+
+// DownloadArchive downloads the files as a tar archive, verifying each of them against its proof while unpacking.
+// It returns the number of verified files.
+func DownloadArchive(ctx context.Context, archiveURL string, opts ArchiveOptions) (int, error) {
+	u, err := url.Parse(archiveURL)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse url: %w", err)
+	}
+	q := u.Query()
+	q.Set("format", "tar")
+	q.Set("from", strconv.Itoa(opts.From))
+	if opts.To >= 0 {
+		q.Set("to", strconv.Itoa(opts.To))
+	}
+	u.RawQuery = q.Encode()
+
+	response, err := get(ctx, u.String())
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, statusError(response)
+	}
+
+	if err = os.MkdirAll(opts.OutDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	tr := tar.NewReader(response.Body)
+	manifest, err := readManifest(tr)
+	if err != nil {
+		return 0, err
+	}
+
+	root, err := hex.DecodeString(manifest.Root)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode manifest root: %w", err)
+	}
+	if opts.RootPath != "" {
+		localRoot, err := getMerkleRoot(opts.RootPath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get root: %w", err)
+		}
+		if !bytes.Equal(localRoot, root) {
+			return 0, fmt.Errorf("manifest root %s does not match the local root %x", manifest.Root, localRoot)
+		}
+	}
+
+	entries := make(map[string]ArchiveManifestEntry, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		entries[entry.Name] = entry
+	}
+
+	verified := 0
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return verified, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		entry, ok := entries[hdr.Name]
+		if !ok {
+			return verified, fmt.Errorf("file %s is not listed in the manifest", hdr.Name)
+		}
+		if err = unpackFile(tr, entry, root, opts.OutDir); err != nil {
+			return verified, err
+		}
+		delete(entries, hdr.Name)
+		verified++
+	}
+
+	if len(entries) > 0 {
+		return verified, fmt.Errorf("archive is missing %d files listed in the manifest", len(entries))
+	}
+	return verified, nil
+}
+
+func readManifest(tr *tar.Reader) (*ArchiveManifest, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if hdr.Name != manifestName {
+		return nil, fmt.Errorf("expected %s as the first archive entry, got %s", manifestName, hdr.Name)
+	}
+
+	manifest := new(ArchiveManifest)
+	if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// unpackFile writes the file while hashing it, and removes it again if it fails the verification.
+func unpackFile(r io.Reader, entry ArchiveManifestEntry, root []byte, outDir string) error {
+	proof := &MerkleProof{
+		Index: int64(entry.Index),
+		Proof: entry.Proof,
+	}
+	proofBytes := make([][]byte, len(entry.Proof))
+	for i, p := range entry.Proof {
+		decoded, err := hex.DecodeString(p)
+		if err != nil {
+			return fmt.Errorf("failed to decode proof of file %s: %w", entry.Name, err)
+		}
+		proofBytes[i] = decoded
+	}
+
+	path := filepath.Join(outDir, filepath.Base(entry.Name))
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer out.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(out, hasher), r); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", entry.Name, err)
+	}
+
+	if !merkle.VerifyProof(entry.Index, hasher.Sum(nil), proofBytes, root) {
+		_ = out.Close()
+		_ = os.Remove(path)
+		return fmt.Errorf("file %s verification failed", entry.Name)
+	}
+
+	proofJsn, err := json.Marshal(proof)
+	if err != nil {
+		return fmt.Errorf("failed to marshal proof: %w", err)
+	}
+	if err = os.WriteFile(path+".proof", proofJsn, 0644); err != nil {
+		return fmt.Errorf("failed to write proof: %w", err)
+	}
+	return nil
+}
@@ -2,73 +2,66 @@ package client
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"strconv"
 )
 
-type File struct {
-	FileName    string   `json:"fileName"`
-	FileContent string   `json:"fileContent"`
-	MerkleProof []string `json:"merkleProof"`
-}
-
 type MerkleProof struct {
 	Index int64    `json:"index"`
 	Proof []string `json:"proof"`
 }
 
-func DownloadFile(fileID, url string) error {
-	response, err := http.Get(fmt.Sprintf("%s/%s", url, fileID))
+// FileProof is the stored hash and Merkle proof of a file, the bytes are base64 encoded in JSON.
+type FileProof struct {
+	Index       int64    `json:"index"`
+	Hash        []byte   `json:"hash"`
+	MerkleProof [][]byte `json:"merkleProof"`
+}
+
+// DownloadFile downloads the file with the given ID next to its proof. The content is streamed to the file
+// and checked against the stored hash, the file is removed if it does not match.
+func DownloadFile(ctx context.Context, fileID, url string) error {
+	stored, err := getFileProof(ctx, fmt.Sprintf("%s/%s/proof", url, fileID))
 	if err != nil {
 		return err
 	}
-	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
-		return fmt.Errorf("server error: %v", response.Status)
+	response, err := get(ctx, fmt.Sprintf("%s/%s/content", url, fileID))
+	if err != nil {
+		return err
 	}
+	defer response.Body.Close()
 
-	file := new(File)
-	if err := json.NewDecoder(response.Body).Decode(file); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+	if response.StatusCode != http.StatusOK {
+		return statusError(response)
 	}
 
 	// Create the file
-	out, err := os.Create(file.FileName)
+	out, err := os.Create(fileID)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
 	defer out.Close()
 
-	decoded, err := base64.StdEncoding.DecodeString(file.FileContent)
-	if err != nil {
-		return fmt.Errorf("failed to decode file: %w", err)
-	}
-
 	// Write the body to file
-	_, err = io.Copy(out, bytes.NewBuffer(decoded))
-	if err != nil {
+	hasher := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(out, hasher), response.Body); err != nil {
+		_ = os.Remove(fileID)
 		return fmt.Errorf("failed to write file: %w", err)
 	}
-
-	proof := new(MerkleProof)
-	proof.Proof = make([]string, len(file.MerkleProof))
-	for i, p := range file.MerkleProof {
-		decodedProof, err := base64.StdEncoding.DecodeString(p)
-		if err != nil {
-			return fmt.Errorf("failed to decode proof: %w", err)
-		}
-		proof.Proof[i] = fmt.Sprintf("%x", decodedProof)
+	if !bytes.Equal(hasher.Sum(nil), stored.Hash) {
+		_ = os.Remove(fileID)
+		return fmt.Errorf("file %s does not match its stored hash", fileID)
 	}
 
-	proof.Index, err = strconv.ParseInt(file.FileName, 10, 64)
-	if err != nil {
-		return fmt.Errorf("failed to parse index: %w", err)
+	proof := &MerkleProof{Index: stored.Index, Proof: make([]string, len(stored.MerkleProof))}
+	for i, p := range stored.MerkleProof {
+		proof.Proof[i] = fmt.Sprintf("%x", p)
 	}
 
 	// Write the proof to file
@@ -77,9 +70,28 @@ func DownloadFile(fileID, url string) error {
 		return fmt.Errorf("failed to marshal proof: %w", err)
 	}
 
-	if err := os.WriteFile(fmt.Sprintf("%s.proof", file.FileName), proofJsn, 0644); err != nil {
+	if err := os.WriteFile(fmt.Sprintf("%s.proof", fileID), proofJsn, 0644); err != nil {
 		return fmt.Errorf("failed to write proof: %w", err)
 	}
 
 	return nil
 }
+
+// getFileProof gets the stored hash and proof of a file from the server.
+func getFileProof(ctx context.Context, url string) (*FileProof, error) {
+	response, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, statusError(response)
+	}
+
+	proof := new(FileProof)
+	if err := json.NewDecoder(response.Body).Decode(proof); err != nil {
+		return nil, fmt.Errorf("failed to decode proof: %w", err)
+	}
+	return proof, nil
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "Content matching its hash",
+			content: "test1",
+		}, {
+			name:    "Content not matching its hash",
+			content: "corrupt",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := sha256.Sum256([]byte("test1"))
+			mux := http.NewServeMux()
+			mux.HandleFunc("/file/1/proof", func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(FileProof{Index: 1, Hash: hash[:], MerkleProof: [][]byte{{0xab, 0xcd}}})
+			})
+			mux.HandleFunc("/file/1/content", func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.content))
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			dir := t.TempDir()
+			wd, err := os.Getwd()
+			require.NoError(t, err)
+			require.NoError(t, os.Chdir(dir))
+			t.Cleanup(func() { _ = os.Chdir(wd) })
+
+			err = DownloadFile(context.Background(), "1", srv.URL+"/file")
+			if tt.wantErr {
+				require.Error(t, err)
+				require.NoFileExists(t, filepath.Join(dir, "1"))
+				require.NoFileExists(t, filepath.Join(dir, "1.proof"))
+				return
+			}
+			require.NoError(t, err)
+			content, err := os.ReadFile(filepath.Join(dir, "1"))
+			require.NoError(t, err)
+			require.Equal(t, tt.content, string(content))
+			proof, err := os.ReadFile(filepath.Join(dir, "1.proof"))
+			require.NoError(t, err)
+			require.JSONEq(t, `{"index":1,"proof":["abcd"]}`, string(proof))
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/zale144/fileserver/internal/tlsconfig"
+)
+
+// maxRetryAfter caps how long the client waits before retrying a throttled request.
+const maxRetryAfter = time.Minute
+
+// Config holds the settings shared by all the requests to the server.
+type Config struct {
+	APIKey string
+	Token  string
+	// MaxRetries is how many times a request throttled by the server is retried after the delay it asked for.
+	MaxRetries int
+	// TLS holds the CAs trusted to verify the server and the client certificate for mutual TLS.
+	TLS tlsconfig.Client
+}
+
+var (
+	cfg Config
+	// the transport traces the requests and propagates the trace context in the W3C traceparent header
+	httpClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+)
+
+// Configure sets the settings used by all the subsequent requests.
+func Configure(c Config) error {
+	tlsCfg, err := c.TLS.Config()
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %w", err)
+	}
+	transport := http.DefaultTransport
+	if tlsCfg != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsCfg
+		transport = t
+	}
+
+	cfg = c
+	httpClient = &http.Client{Transport: otelhttp.NewTransport(transport)}
+	return nil
+}
+
+// do sends the request, retrying it as long as the server throttles it with a Retry-After header.
+// Requests with a body are only retried if the body can be recreated with GetBody.
+func do(req *http.Request) (*http.Response, error) {
+	if cfg.APIKey != "" {
+		req.Header.Set("X-API-Key", cfg.APIKey)
+	}
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		wait, ok := retryAfter(resp)
+		if !ok || attempt >= cfg.MaxRetries {
+			return resp, nil
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, nil
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			req.Body = body
+		}
+		_ = resp.Body.Close()
+
+		fmt.Printf("Server is busy (%s), retrying in %v...\n", resp.Status, wait)
+		time.Sleep(wait)
+	}
+}
+
+// retryAfter returns the delay the server asked for before retrying, if the response is a throttling one.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(header); err == nil {
+		wait = time.Until(at)
+	} else {
+		return 0, false
+	}
+	return min(max(wait, 0), maxRetryAfter), true
+}
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return do(req)
+}
+
+// ProblemError is an error response of the server, decoded from its problem details body.
+type ProblemError struct {
+	Status    int    `json:"status"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Detail    string `json:"detail"`
+	RequestID string `json:"requestId"`
+}
+
+func (e *ProblemError) Error() string {
+	msg := e.Title
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.RequestID != "" {
+		msg += " (request ID " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// statusError describes an unexpected response, decoding the problem details if the server sent them.
+func statusError(resp *http.Response) error {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/problem+json" {
+		problem := &ProblemError{}
+		if err := json.NewDecoder(resp.Body).Decode(problem); err == nil && problem.Title != "" {
+			problem.Status = resp.StatusCode
+			return problem
+		}
+	}
+	return fmt.Errorf("bad status: %s", resp.Status)
+}
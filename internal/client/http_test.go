@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRetries   int
+		throttled    int
+		retryAfter   string
+		wantStatus   int
+		wantAttempts int32
+	}{
+		{
+			name:         "Retried until accepted",
+			maxRetries:   3,
+			throttled:    2,
+			retryAfter:   "0",
+			wantStatus:   http.StatusOK,
+			wantAttempts: 3,
+		}, {
+			name:         "Out of retries",
+			maxRetries:   1,
+			throttled:    2,
+			retryAfter:   "0",
+			wantStatus:   http.StatusTooManyRequests,
+			wantAttempts: 2,
+		}, {
+			name:         "No Retry-After",
+			maxRetries:   3,
+			throttled:    1,
+			wantStatus:   http.StatusTooManyRequests,
+			wantAttempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, Configure(Config{MaxRetries: tt.maxRetries}))
+			t.Cleanup(func() { _ = Configure(Config{}) })
+
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if int(attempts.Add(1)) <= tt.throttled {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+			}))
+			defer srv.Close()
+
+			resp, err := get(context.Background(), srv.URL)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+			require.Equal(t, tt.wantAttempts, attempts.Load())
+		})
+	}
+}
+
+func TestUploadDirectoryRetry(t *testing.T) {
+	require.NoError(t, Configure(Config{MaxRetries: 1}))
+	t.Cleanup(func() { _ = Configure(Config{}) })
+
+	dir := t.TempDir()
+	for _, name := range []string{"0", "1", "2"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("test"+name), 0644))
+	}
+
+	var attempts atomic.Int32
+	var files int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		require.NoError(t, r.ParseMultipartForm(1024))
+		files = len(r.MultipartForm.File["files"])
+	}))
+	defer srv.Close()
+
+	require.NoError(t, UploadDirectory(context.Background(), dir, srv.URL))
+	require.Equal(t, int32(2), attempts.Load())
+	require.Equal(t, 3, files)
+}
+
+func TestTracePropagation(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator()) })
+
+	traceID := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	resp, err := get(ctx, srv.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Contains(t, traceparent, "-"+traceID.String()+"-")
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantErr     string
+		wantProblem bool
+	}{
+		{
+			name:        "Problem details",
+			contentType: "application/problem+json",
+			body:        `{"type":"urn:fileserver:problem:not_found","title":"Not found","status":404,"detail":"file 99: not found","requestId":"request-1"}`,
+			wantErr:     "Not found: file 99: not found (request ID request-1)",
+			wantProblem: true,
+		}, {
+			name:        "Problem without detail",
+			contentType: "application/problem+json",
+			body:        `{"type":"urn:fileserver:problem:internal_error","title":"Internal server error","status":500}`,
+			wantErr:     "Internal server error",
+			wantProblem: true,
+		}, {
+			name:        "Plain text",
+			contentType: "text/plain",
+			body:        "404 page not found",
+			wantErr:     "bad status: 404 Not Found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			err := DownloadFile(context.Background(), "99", srv.URL)
+			require.EqualError(t, err, tt.wantErr)
+
+			var problem *ProblemError
+			require.Equal(t, tt.wantProblem, errors.As(err, &problem))
+		})
+	}
+}
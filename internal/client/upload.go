@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -10,7 +11,7 @@ import (
 	"path/filepath"
 )
 
-func UploadFile(filePath, url string) error {
+func UploadFile(ctx context.Context, filePath, url string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
@@ -29,86 +30,62 @@ func UploadFile(filePath, url string) error {
 	}
 	writer.Close()
 
-	request, err := http.NewRequest("POST", url, body)
+	request, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 	request.Header.Add("Content-Type", writer.FormDataContentType())
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, err := do(request)
 	if err != nil {
 		return err
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return fmt.Errorf("server error: %v", response.Status)
+		return statusError(response)
 	}
 
 	return nil
 }
 
-func UploadDirectory(directoryPath, url string) error {
-	// Setup a pipe - this will allow us to pass the multipart writer directly into the request
-	pr, pw := io.Pipe()
-	w := multipart.NewWriter(pw)
-	done := make(chan error)
-
-	go func() {
-		defer func() {
-			pw.Close()
-			w.Close()
-			close(done)
-		}()
-
-		// Walk through the directory and upload all files
-		err := filepath.Walk(directoryPath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				file, err := os.Open(path)
-				if err != nil {
-					return fmt.Errorf("cannot open file %v: %w", path, err)
-				}
-				defer file.Close()
-
-				fw, err := w.CreateFormFile("files", filepath.Base(path))
-				if err != nil {
-					return fmt.Errorf("cannot create form file: %w", err)
-				}
-
-				if _, err = io.Copy(fw, file); err != nil {
-					return fmt.Errorf("cannot write file to form: %w", err)
-				}
-				fmt.Printf("file %v uploaded\n", path)
-			}
-			return nil
-		})
-
-		if err != nil {
-			done <- fmt.Errorf("error walking through files: %w", err)
-			return
+func UploadDirectory(ctx context.Context, directoryPath, url string) error {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+
+	// the body is written by a goroutine walking the directory, and rewritten from scratch if the request is retried
+	var done chan error
+	newBody := func() (io.ReadCloser, error) {
+		// Setup a pipe - this will allow us to pass the multipart writer directly into the request
+		pr, pw := io.Pipe()
+		w := multipart.NewWriter(pw)
+		if err := w.SetBoundary(boundary); err != nil {
+			return nil, err
 		}
-	}()
+		done = make(chan error, 1)
+		go writeDirectory(directoryPath, pw, w, done)
+		return pr, nil
+	}
 
-	req, err := http.NewRequest("POST", url, pr)
+	body, err := newBody()
+	if err != nil {
+		return fmt.Errorf("cannot create request body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return fmt.Errorf("cannot create request: %w", err)
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.GetBody = newBody
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
 
-	client := &http.Client{}
 	fmt.Println("Uploading directory...")
-	resp, err := client.Do(req)
+	resp, err := do(req)
 	if err != nil {
 		return fmt.Errorf("failed to do request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+		return statusError(resp)
 	}
 
 	if err := <-done; err != nil {
@@ -116,3 +93,41 @@ func UploadDirectory(directoryPath, url string) error {
 	}
 	return nil
 }
+
+func writeDirectory(directoryPath string, pw *io.PipeWriter, w *multipart.Writer, done chan<- error) {
+	defer func() {
+		w.Close()
+		pw.Close()
+		close(done)
+	}()
+
+	// Walk through the directory and upload all files
+	err := filepath.Walk(directoryPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			file, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("cannot open file %v: %w", path, err)
+			}
+			defer file.Close()
+
+			fw, err := w.CreateFormFile("files", filepath.Base(path))
+			if err != nil {
+				return fmt.Errorf("cannot create form file: %w", err)
+			}
+
+			if _, err = io.Copy(fw, file); err != nil {
+				return fmt.Errorf("cannot write file to form: %w", err)
+			}
+			fmt.Printf("file %v uploaded\n", path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		done <- fmt.Errorf("error walking through files: %w", err)
+		pw.CloseWithError(err)
+	}
+}
@@ -0,0 +1,179 @@
+// Package envelope implements envelope encryption: the content is encrypted with data keys of its own, which are
+// wrapped, i.e. encrypted, by master keys. The master keys have IDs, so that they can be rotated by re-wrapping
+// the data keys with a new master key, without re-encrypting the content.
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// KeySize is the size of the master keys and of the data keys, AES-256 keys.
+	KeySize = 32
+	// MaxKeyIDLength is the maximum length of the IDs of the master keys.
+	MaxKeyIDLength = 32
+	// WrappedSize is the size of a wrapped data key: its nonce, the encrypted key and its tag.
+	WrappedSize = 12 + KeySize + 16
+)
+
+// ErrUnknownKey is returned when a data key is wrapped by a master key missing from the keyring.
+var ErrUnknownKey = errors.New("unknown master key")
+
+// Keyring holds the master keys by ID, and the ID of the current one, which wraps the new data keys.
+type Keyring struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// NewKeyring creates the keyring of the master keys, wrapping the data keys with the one of the current ID.
+func NewKeyring(keys map[string][]byte, current string) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current master key %q: %w", current, ErrUnknownKey)
+	}
+	k := &Keyring{keys: make(map[string]cipher.AEAD, len(keys)), current: current}
+	for id, key := range keys {
+		if id == "" || len(id) > MaxKeyIDLength || strings.ContainsAny(id, "\x00:") {
+			return nil, fmt.Errorf("invalid master key ID %q, it must have 1 to %d characters besides NUL and ':'", id, MaxKeyIDLength)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("master key %q has %d bytes instead of %d", id, len(key), KeySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// ParseKeyring creates the keyring of the master keys given as "<ID>:<base64 key>" entries. The current key
+// is the one of the current ID, or the last one if current is empty.
+func ParseKeyring(entries []string, current string) (*Keyring, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("no master keys")
+	}
+	keys := make(map[string][]byte, len(entries))
+	last := ""
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, errors.New("invalid master key entry, expected <ID>:<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %q: %w", id, err)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("duplicate master key %q", id)
+		}
+		keys[id] = key
+		last = id
+	}
+	if current == "" {
+		current = last
+	}
+	return NewKeyring(keys, current)
+}
+
+// ReadKeyEntries reads the "<ID>:<base64 key>" entries of the file, one per line.
+// The blank lines and the ones starting with # are skipped.
+func ReadKeyEntries(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open master key file: %w", err)
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %w", err)
+	}
+	return entries, nil
+}
+
+// CurrentID returns the ID of the master key wrapping the new data keys.
+func (k *Keyring) CurrentID() string {
+	return k.current
+}
+
+// NewDataKey generates a data key, and returns it along with its wrapping by the current master key.
+func (k *Keyring) NewDataKey() (key, wrapped []byte, err error) {
+	key = make([]byte, KeySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	if wrapped, err = k.wrap(k.current, key); err != nil {
+		return nil, nil, err
+	}
+	return key, wrapped, nil
+}
+
+// Unwrap returns the data key wrapped by the master key of the ID.
+func (k *Keyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q: %w", keyID, ErrUnknownKey)
+	}
+	if len(wrapped) != WrappedSize {
+		return nil, fmt.Errorf("wrapped data key has %d bytes instead of %d", len(wrapped), WrappedSize)
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	// the ID is authenticated along with the key, so that a data key cannot be passed off as wrapped by another master key
+	key, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with master key %q: %w", keyID, err)
+	}
+	return key, nil
+}
+
+// Rewrap unwraps the data key wrapped by the master key of the ID, and wraps it with the current master key.
+func (k *Keyring) Rewrap(keyID string, wrapped []byte) ([]byte, error) {
+	key, err := k.Unwrap(keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return k.wrap(k.current, key)
+}
+
+func (k *Keyring) wrap(keyID string, key []byte) ([]byte, error) {
+	aead := k.keys[keyID]
+	nonce := make([]byte, aead.NonceSize(), WrappedSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, key, []byte(keyID)), nil
+}
+
+// NewAEAD returns the AES-256-GCM cipher of the data key.
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("data key has %d bytes instead of %d", len(key), KeySize)
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
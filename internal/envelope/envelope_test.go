@@ -0,0 +1,97 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyring(t *testing.T) {
+	key1, key2 := testKey(1), testKey(2)
+	tests := []struct {
+		name        string
+		entries     []string
+		current     string
+		wantCurrent string
+		wantErr     bool
+	}{
+		{name: "Last key is current", entries: []string{"k1:" + key1, "k2:" + key2}, wantCurrent: "k2"},
+		{name: "Current key", entries: []string{"k1:" + key1, " k2:" + key2 + " "}, current: "k1", wantCurrent: "k1"},
+		{name: "No keys", wantErr: true},
+		{name: "Unknown current key", entries: []string{"k1:" + key1}, current: "k2", wantErr: true},
+		{name: "Missing ID", entries: []string{key1}, wantErr: true},
+		{name: "Empty ID", entries: []string{":" + key1}, wantErr: true},
+		{name: "Long ID", entries: []string{"0123456789abcdef0123456789abcdef0:" + key1}, wantErr: true},
+		{name: "Duplicate ID", entries: []string{"k1:" + key1, "k1:" + key2}, wantErr: true},
+		{name: "Invalid base64", entries: []string{"k1:not base64"}, wantErr: true},
+		{name: "Short key", entries: []string{"k1:" + base64.StdEncoding.EncodeToString([]byte("short"))}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := ParseKeyring(tt.entries, tt.current)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantCurrent, keyring.CurrentID())
+		})
+	}
+}
+
+func TestReadKeyEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# rotated 2023-11-01\nk1:"+testKey(1)+"\n\nk2:"+testKey(2)+"\n"), 0o600))
+
+	entries, err := ReadKeyEntries(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"k1:" + testKey(1), "k2:" + testKey(2)}, entries)
+
+	_, err = ReadKeyEntries(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	old, err := ParseKeyring([]string{"k1:" + testKey(1)}, "")
+	require.NoError(t, err)
+	key, wrapped, err := old.NewDataKey()
+	require.NoError(t, err)
+	require.Len(t, key, KeySize)
+	require.Len(t, wrapped, WrappedSize)
+	require.False(t, bytes.Contains(wrapped, key))
+
+	unwrapped, err := old.Unwrap("k1", wrapped)
+	require.NoError(t, err)
+	require.Equal(t, key, unwrapped)
+
+	// a rotated keyring re-wraps the data key with the new master key, and still unwraps it with the old one
+	rotated, err := ParseKeyring([]string{"k1:" + testKey(1), "k2:" + testKey(2)}, "")
+	require.NoError(t, err)
+	rewrapped, err := rotated.Rewrap("k1", wrapped)
+	require.NoError(t, err)
+	unwrapped, err = rotated.Unwrap("k2", rewrapped)
+	require.NoError(t, err)
+	require.Equal(t, key, unwrapped)
+
+	// the ID of the master key is authenticated along with the data key
+	_, err = rotated.Unwrap("k1", rewrapped)
+	require.Error(t, err)
+	_, err = old.Unwrap("k2", rewrapped)
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	tampered := bytes.Clone(wrapped)
+	tampered[len(tampered)-1] ^= 1
+	_, err = old.Unwrap("k1", tampered)
+	require.Error(t, err)
+	_, err = old.Unwrap("k1", wrapped[1:])
+	require.Error(t, err)
+}
+
+func testKey(seed byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{seed}, KeySize))
+}
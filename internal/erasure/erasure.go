@@ -0,0 +1,148 @@
+// Package erasure implements a systematic Reed-Solomon erasure code over GF(2^8): the data shards are stored as they are,
+// and any data shards out of the data and parity shards are enough to reconstruct the others.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the maximum number of data and parity shards, the number of elements of the field.
+const MaxShards = 256
+
+// ErrTooFewShards is returned when fewer shards than the data shards are left to reconstruct the others from.
+var ErrTooFewShards = errors.New("too few shards to reconstruct the missing ones")
+
+// Coder encodes and reconstructs the shards of a fixed number of data and parity shards.
+type Coder struct {
+	dataShards   int
+	parityShards int
+	// matrix has a row per shard: the rows of the data shards are the identity, and any dataShards rows
+	// of it are linearly independent.
+	matrix matrix
+}
+
+// New creates the coder of dataShards data shards and parityShards parity shards.
+func New(dataShards, parityShards int) (*Coder, error) {
+	if dataShards <= 0 || parityShards < 0 {
+		return nil, fmt.Errorf("invalid number of shards: %d data and %d parity shards", dataShards, parityShards)
+	}
+	if dataShards+parityShards > MaxShards {
+		return nil, fmt.Errorf("%d shards, more than the maximum of %d", dataShards+parityShards, MaxShards)
+	}
+
+	// a Vandermonde matrix times the inverse of its top square is systematic, and keeps its rows independent
+	vandermonde := newVandermonde(dataShards+parityShards, dataShards)
+	top, err := vandermonde[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Coder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       vandermonde.multiply(top),
+	}, nil
+}
+
+// DataShards returns the number of data shards.
+func (c *Coder) DataShards() int {
+	return c.dataShards
+}
+
+// ParityShards returns the number of parity shards.
+func (c *Coder) ParityShards() int {
+	return c.parityShards
+}
+
+// Encode computes the parity shards from the data shards. The shards hold the data shards followed by
+// the parity shards, which are allocated if they are nil, and all have the same size.
+func (c *Coder) Encode(shards [][]byte) error {
+	if err := c.check(shards, false); err != nil {
+		return err
+	}
+	size := len(shards[0])
+	for i := c.dataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+		}
+		c.matrix[i].combine(shards[:c.dataShards], shards[i])
+	}
+	return nil
+}
+
+// Reconstruct recomputes the missing shards, the nil ones, from the others. With dataOnly set only the missing
+// data shards are recomputed. It returns ErrTooFewShards if fewer shards than the data shards are left.
+func (c *Coder) Reconstruct(shards [][]byte, dataOnly bool) error {
+	if err := c.check(shards, true); err != nil {
+		return err
+	}
+
+	// the rows of the first data shards present form an invertible matrix, the inverse of which
+	// recomputes the data shards from them
+	var present []int
+	size := 0
+	for i, shard := range shards {
+		if shard != nil && len(present) < c.dataShards {
+			present = append(present, i)
+			size = len(shard)
+		}
+	}
+	if len(present) < c.dataShards {
+		return ErrTooFewShards
+	}
+
+	missingData := false
+	for i := 0; i < c.dataShards; i++ {
+		missingData = missingData || shards[i] == nil
+	}
+	if missingData {
+		sub := make(matrix, c.dataShards)
+		inputs := make([][]byte, c.dataShards)
+		for i, row := range present {
+			sub[i] = c.matrix[row]
+			inputs[i] = shards[row]
+		}
+		decode, err := sub.invert()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < c.dataShards; i++ {
+			if shards[i] == nil {
+				shards[i] = make([]byte, size)
+				decode[i].combine(inputs, shards[i])
+			}
+		}
+	}
+
+	if !dataOnly {
+		for i := c.dataShards; i < len(shards); i++ {
+			if shards[i] == nil {
+				shards[i] = make([]byte, size)
+				c.matrix[i].combine(shards[:c.dataShards], shards[i])
+			}
+		}
+	}
+	return nil
+}
+
+// check returns an error if the shards are not of the coder, or if their sizes differ.
+// The missing shards, the nil ones, are only allowed when reconstructing.
+func (c *Coder) check(shards [][]byte, missing bool) error {
+	if len(shards) != c.dataShards+c.parityShards {
+		return fmt.Errorf("%d shards instead of %d", len(shards), c.dataShards+c.parityShards)
+	}
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			if !missing && i < c.dataShards {
+				return fmt.Errorf("data shard %d is missing", i)
+			}
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return fmt.Errorf("shard %d has %d bytes instead of %d", i, len(shard), size)
+		}
+		size = len(shard)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package erasure
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name         string
+		data, parity int
+		wantErr      bool
+	}{
+		{name: "Data and parity", data: 4, parity: 2},
+		{name: "No parity", data: 3, parity: 0},
+		{name: "Maximum", data: 200, parity: 56},
+		{name: "No data", data: 0, parity: 2, wantErr: true},
+		{name: "Negative parity", data: 4, parity: -1, wantErr: true},
+		{name: "Too many shards", data: 200, parity: 57, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coder, err := New(tt.data, tt.parity)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.data, coder.DataShards())
+			require.Equal(t, tt.parity, coder.ParityShards())
+		})
+	}
+}
+
+func TestEncodeReconstruct(t *testing.T) {
+	tests := []struct {
+		data, parity int
+		size         int
+	}{
+		{data: 4, parity: 2, size: 1024},
+		{data: 3, parity: 3, size: 17},
+		{data: 6, parity: 3, size: 1},
+		{data: 1, parity: 2, size: 64},
+		{data: 10, parity: 4, size: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d+%d", tt.data, tt.parity), func(t *testing.T) {
+			coder, err := New(tt.data, tt.parity)
+			require.NoError(t, err)
+			shards := randomShards(tt.data, tt.parity, tt.size)
+			require.NoError(t, coder.Encode(shards))
+
+			// every combination of up to parity missing shards is reconstructed
+			total := tt.data + tt.parity
+			for missing := 0; missing < 1<<total; missing++ {
+				lost := bitCount(missing)
+				if lost > tt.parity || total > 10 && lost > 2 {
+					continue
+				}
+				damaged := make([][]byte, total)
+				for i := range shards {
+					if missing&(1<<i) == 0 {
+						damaged[i] = bytes.Clone(shards[i])
+					}
+				}
+				require.NoError(t, coder.Reconstruct(damaged, false), "missing %b", missing)
+				require.Equal(t, shards, damaged, "missing %b", missing)
+			}
+		})
+	}
+}
+
+func TestReconstructDataOnly(t *testing.T) {
+	coder, err := New(4, 2)
+	require.NoError(t, err)
+	shards := randomShards(4, 2, 100)
+	require.NoError(t, coder.Encode(shards))
+
+	damaged := [][]byte{shards[0], nil, shards[2], shards[3], nil, shards[5]}
+	require.NoError(t, coder.Reconstruct(damaged, true))
+	require.Equal(t, shards[:4], damaged[:4])
+	require.Nil(t, damaged[4])
+}
+
+func TestReconstructErrors(t *testing.T) {
+	coder, err := New(4, 2)
+	require.NoError(t, err)
+	shards := randomShards(4, 2, 100)
+	require.NoError(t, coder.Encode(shards))
+
+	// more shards missing than the parity shards
+	damaged := [][]byte{shards[0], nil, nil, shards[3], nil, shards[5]}
+	require.ErrorIs(t, coder.Reconstruct(damaged, false), ErrTooFewShards)
+
+	// shards of different sizes
+	damaged = [][]byte{shards[0], shards[1][:50], shards[2], shards[3], shards[4], shards[5]}
+	require.Error(t, coder.Reconstruct(damaged, false))
+
+	// shards of another coder
+	require.Error(t, coder.Reconstruct(shards[:5], false))
+	require.Error(t, coder.Encode([][]byte{shards[0], nil, shards[2], shards[3], nil, nil}))
+}
+
+func TestInvert(t *testing.T) {
+	m := newVandermonde(5, 5)
+	inverse, err := m.invert()
+	require.NoError(t, err)
+	product := m.multiply(inverse)
+	for r := range product {
+		for c := range product[r] {
+			want := byte(0)
+			if r == c {
+				want = 1
+			}
+			require.Equal(t, want, product[r][c], "element %d, %d", r, c)
+		}
+	}
+
+	_, err = matrix{{1, 2}, {1, 2}}.invert()
+	require.ErrorIs(t, err, errSingular)
+}
+
+func randomShards(data, parity, size int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	shards := make([][]byte, data+parity)
+	for i := 0; i < data; i++ {
+		shards[i] = make([]byte, size)
+		rnd.Read(shards[i])
+	}
+	return shards
+}
+
+func bitCount(n int) int {
+	count := 0
+	for ; n > 0; n &= n - 1 {
+		count++
+	}
+	return count
+}
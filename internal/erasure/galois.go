@@ -0,0 +1,143 @@
+package erasure
+
+import "errors"
+
+// The field is GF(2^8) built with the polynomial x^8 + x^4 + x^3 + x^2 + 1, which 2 generates.
+const polynomial = 0x11d
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+	// mulTable holds the product of every pair of elements.
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func mul(a, b byte) byte {
+	return mulTable[a][b]
+}
+
+// inverse returns the multiplicative inverse of a non-zero element.
+func inverse(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// pow returns a to the power of n, with 0^0 = 1.
+func pow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// row is a row of a matrix over the field.
+type row []byte
+
+// combine sets out to the linear combination of the inputs with the coefficients of the row.
+func (r row) combine(inputs [][]byte, out []byte) {
+	clear(out)
+	for i, coefficient := range r {
+		if coefficient == 0 {
+			continue
+		}
+		table := &mulTable[coefficient]
+		for j, b := range inputs[i] {
+			out[j] ^= table[b]
+		}
+	}
+}
+
+type matrix []row
+
+var errSingular = errors.New("singular matrix")
+
+// newVandermonde returns the matrix whose element at row r and column c is r^c.
+func newVandermonde(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make(row, cols)
+		for c := range m[r] {
+			m[r][c] = pow(byte(r), c)
+		}
+	}
+	return m
+}
+
+// multiply returns the product of the matrix and the other one.
+func (m matrix) multiply(other matrix) matrix {
+	product := make(matrix, len(m))
+	for r := range m {
+		product[r] = make(row, len(other[0]))
+		for c := range product[r] {
+			var sum byte
+			for i := range m[r] {
+				sum ^= mul(m[r][i], other[i][c])
+			}
+			product[r][c] = sum
+		}
+	}
+	return product
+}
+
+// invert returns the inverse of the square matrix by the Gauss-Jordan elimination.
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	// work is the matrix augmented with the identity, which the elimination turns into the inverse
+	work := make(matrix, n)
+	for r := range m {
+		work[r] = make(row, 2*n)
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := inverse(work[c][c])
+		for i := range work[c] {
+			work[c][i] = mul(work[c][i], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= mul(factor, work[c][i])
+			}
+		}
+	}
+
+	result := make(matrix, n)
+	for r := range work {
+		result[r] = work[r][n:]
+	}
+	return result, nil
+}
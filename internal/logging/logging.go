@@ -0,0 +1,23 @@
+// Package logging carries the request-scoped logger through the context, from the server middleware down to the service.
+package logging
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of the context carrying the logger.
+func WithLogger(ctx context.Context, log *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// FromContext returns the logger carried by the context, or the fallback if there is none.
+func FromContext(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if log, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return log
+	}
+	return fallback
+}
@@ -1,8 +1,10 @@
 package merkle
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"hash"
 	"runtime"
 	"sync"
 )
@@ -47,7 +49,22 @@ type proofResult struct {
 var defaultNumWorkers = runtime.NumCPU() * 8
 
 func NewTree(dataBlocks [][]byte) *Tree {
-	dataBlocks = padDataBlocks(dataBlocks)
+	return newTree(padDataBlocks(dataBlocks), newLeafNode)
+}
+
+// NewTreeFromHashes builds the same tree as NewTree from the hashes of the data blocks,
+// so that the blocks themselves need not be held in memory.
+func NewTreeFromHashes(hashes [][]byte) *Tree {
+	count := len(hashes)
+	padded := make([][]byte, nextPowerOfTwo(count))
+	copy(padded, hashes)
+	for ; count < len(padded); count++ {
+		padded[count] = HashData([]byte{})
+	}
+	return newTree(padded, newLeafNodeFromHash)
+}
+
+func newTree(dataBlocks [][]byte, leafFn nodeFunc) *Tree {
 	depth := 0
 	lenData := len(dataBlocks)
 
@@ -68,7 +85,7 @@ func NewTree(dataBlocks [][]byte) *Tree {
 		numWorkers: numWorkers,
 	}
 
-	t.buildTree(dataBlocks)
+	t.buildTree(dataBlocks, leafFn)
 	t.generateProofs()
 	return t
 }
@@ -99,12 +116,12 @@ func NewTreeFromStream(dataBlocks <-chan []byte, lenData int) *Tree {
 	return t
 }
 
-func (t *Tree) buildTree(dataBlocks [][]byte) {
+func (t *Tree) buildTree(dataBlocks [][]byte, leafFn nodeFunc) {
 	if len(dataBlocks) == 0 {
 		return
 	}
 
-	t.buildLeaves(dataBlocks)
+	t.buildLeaves(dataBlocks, leafFn)
 	t.buildBranches()
 }
 
@@ -113,7 +130,7 @@ func (t *Tree) buildTreeFromStream(dataBlocks <-chan []byte, dataSize int) {
 	t.buildBranches()
 }
 
-func (t *Tree) buildLeaves(dataBlocks [][]byte) {
+func (t *Tree) buildLeaves(dataBlocks [][]byte, leafFn nodeFunc) {
 	// Hash the data blocks concurrently using worker pool
 	numWorkers := t.numWorkers
 	hashResults := make(chan *nodeResultBatch, numWorkers)
@@ -124,7 +141,7 @@ func (t *Tree) buildLeaves(dataBlocks [][]byte) {
 		wg.Add(1)
 		start := i * batchSize
 		end := start + batchSize
-		go leafWorker(newLeafNode, dataBlocks[start:end], start, hashResults, &wg)
+		go leafWorker(leafFn, dataBlocks[start:end], start, hashResults, &wg)
 	}
 
 	go func() {
@@ -271,6 +288,11 @@ func HashData(data []byte) []byte {
 	return bytes[:]
 }
 
+// NewHasher returns the hash HashData computes, for hashing content as it is streamed.
+func NewHasher() hash.Hash {
+	return sha256.New()
+}
+
 func (t *Tree) generateProofs() {
 	numWorkers := t.numWorkers
 	proofChan := make(chan *proofResultBatch, numWorkers)
@@ -334,6 +356,14 @@ func (t *Tree) RootHash() string {
 }
 
 func VerifyProof(index int, hash []byte, proof [][]byte, rootHash []byte) bool {
+	if len(rootHash) != sha256.Size {
+		return false
+	}
+	return bytes.Equal(RootFromProof(index, hash, proof), rootHash)
+}
+
+// RootFromProof computes the root hash implied by the leaf hash at index and its proof
+func RootFromProof(index int, hash []byte, proof [][]byte) []byte {
 	for _, step := range proof {
 		if index%2 == 0 {
 			hash = merkleHash(hash, step)
@@ -343,7 +373,7 @@ func VerifyProof(index int, hash []byte, proof [][]byte, rootHash []byte) bool {
 			index = (index - 1) / 2
 		}
 	}
-	return [32]byte(hash) == [32]byte(rootHash)
+	return hash
 }
 
 func (t *Tree) padLeafs() {
@@ -1,6 +1,7 @@
 package merkle
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,6 +39,24 @@ func TestNewTree(t *testing.T) {
 	}
 }
 
+func TestNewTreeFromHashes(t *testing.T) {
+	for _, size := range []int{1, 3, 4, 5, 17} {
+		t.Run(fmt.Sprintf("%d blocks", size), func(t *testing.T) {
+			data := make([][]byte, size)
+			hashes := make([][]byte, size)
+			for i := range data {
+				data[i] = []byte(fmt.Sprintf("test%d", i))
+				hashes[i] = HashData(data[i])
+			}
+
+			want := NewTree(data)
+			got := NewTreeFromHashes(hashes)
+			require.Equal(t, want.RootHash(), got.RootHash())
+			require.Equal(t, want.Proofs, got.Proofs)
+		})
+	}
+}
+
 func TestNewTreeFromStream(t *testing.T) {
 	type args struct {
 		dataBlocks <-chan []byte
@@ -76,3 +95,18 @@ func TestNewTreeFromStream(t *testing.T) {
 		})
 	}
 }
+
+func TestRootFromProof(t *testing.T) {
+	dataBlocks := [][]byte{
+		[]byte("test1"),
+		[]byte("test2"),
+		[]byte("test3"),
+	}
+	tree := NewTree(dataBlocks)
+	for i, data := range dataBlocks {
+		root := RootFromProof(i, HashData(data), tree.Proofs[i])
+		assert.Equal(t, tree.RootHash(), fmt.Sprintf("%x", root))
+		assert.True(t, VerifyProof(i, HashData(data), tree.Proofs[i], root))
+	}
+	assert.False(t, VerifyProof(0, HashData([]byte("test2")), tree.Proofs[0], tree.Root.Hash))
+}
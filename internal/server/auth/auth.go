@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// DefaultTenant is the tenant of the anonymous callers when authentication is disabled.
+const DefaultTenant = "default"
+
+var (
+	// ErrUnauthenticated is returned when the credentials are missing or invalid.
+	ErrUnauthenticated = errors.New("unauthenticated")
+
+	tenantPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+// Config is the configuration for the authentication.
+type Config struct {
+	Enabled     bool   `envconfig:"AUTH_ENABLED" default:"false"`
+	JWKSFile    string `envconfig:"AUTH_JWKS_FILE"`
+	Issuer      string `envconfig:"AUTH_JWT_ISSUER"`
+	Audience    string `envconfig:"AUTH_JWT_AUDIENCE"`
+	TenantClaim string `envconfig:"AUTH_JWT_TENANT_CLAIM" default:"tenant_id"`
+	RolesClaim  string `envconfig:"AUTH_JWT_ROLES_CLAIM" default:"roles"`
+}
+
+// Identity is the authenticated caller.
+type Identity struct {
+	TenantID string
+	Subject  string
+	Roles    []string
+}
+
+// Credentials are the credentials presented by a caller, at most one of them is expected to be set.
+type Credentials struct {
+	APIKey      string
+	BearerToken string
+}
+
+type keyStore interface {
+	GetAPIKey(ctx context.Context, keyHash []byte) (*model.APIKey, error)
+}
+
+// Authenticator resolves credentials into identities.
+type Authenticator struct {
+	cfg    Config
+	keys   keyStore
+	jwks   *JWKS
+	parser *jwt.Parser
+}
+
+// NewAuthenticator creates a new authenticator, loading the JWKS file if one is configured.
+func NewAuthenticator(cfg Config, keys keyStore) (*Authenticator, error) {
+	a := &Authenticator{
+		cfg:  cfg,
+		keys: keys,
+	}
+	if !cfg.Enabled || cfg.JWKSFile == "" {
+		return a, nil
+	}
+
+	jwks, err := LoadJWKS(cfg.JWKSFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWKS: %w", err)
+	}
+	a.jwks = jwks
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	a.parser = jwt.NewParser(opts...)
+	return a, nil
+}
+
+// Authenticate resolves the credentials into an identity.
+// When authentication is disabled every caller is anonymous and belongs to the default tenant.
+func (a *Authenticator) Authenticate(ctx context.Context, creds Credentials) (*Identity, error) {
+	if !a.cfg.Enabled {
+		return &Identity{TenantID: DefaultTenant}, nil
+	}
+
+	switch {
+	case creds.APIKey != "":
+		return a.authenticateAPIKey(ctx, creds.APIKey)
+	case creds.BearerToken != "":
+		return a.authenticateJWT(creds.BearerToken)
+	default:
+		return nil, fmt.Errorf("missing credentials: %w", ErrUnauthenticated)
+	}
+}
+
+func (a *Authenticator) authenticateAPIKey(ctx context.Context, key string) (*Identity, error) {
+	apiKey, err := a.keys.GetAPIKey(ctx, HashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("unknown API key: %w", ErrUnauthenticated)
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+	if apiKey.RevokedAt != nil {
+		return nil, fmt.Errorf("revoked API key: %w", ErrUnauthenticated)
+	}
+
+	return &Identity{
+		TenantID: apiKey.TenantID,
+		Subject:  apiKey.Name,
+		Roles:    apiKey.Roles,
+	}, nil
+}
+
+func (a *Authenticator) authenticateJWT(token string) (*Identity, error) {
+	if a.parser == nil {
+		return nil, fmt.Errorf("JWT authentication is not configured: %w", ErrUnauthenticated)
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.jwks.Keyfunc); err != nil {
+		return nil, fmt.Errorf("invalid token: %v: %w", err, ErrUnauthenticated)
+	}
+
+	tenantID, _ := claims[a.cfg.TenantClaim].(string)
+	if !ValidTenant(tenantID) {
+		return nil, fmt.Errorf("invalid tenant claim %q: %w", a.cfg.TenantClaim, ErrUnauthenticated)
+	}
+	subject, _ := claims.GetSubject()
+
+	return &Identity{
+		TenantID: tenantID,
+		Subject:  subject,
+		Roles:    rolesClaim(claims[a.cfg.RolesClaim]),
+	}, nil
+}
+
+// rolesClaim accepts the roles either as an array or as a space separated string.
+func rolesClaim(claim any) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []any:
+		roles := make([]string, 0, len(claim))
+		for _, role := range claim {
+			if role, ok := role.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+		return roles
+	default:
+		return nil
+	}
+}
+
+// ValidTenant reports whether the tenant ID is safe to be used in object keys.
+func ValidTenant(tenantID string) bool {
+	return tenantPattern.MatchString(tenantID)
+}
+
+// HashAPIKey returns the hash under which the API key is stored.
+func HashAPIKey(key string) []byte {
+	hash := sha256.Sum256([]byte(key))
+	return hash[:]
+}
+
+// GenerateAPIKey returns a new random API key.
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of the context carrying the identity.
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity carried by the context.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// TenantID returns the tenant of the identity carried by the context, or the default tenant if there is none.
+func TenantID(ctx context.Context) string {
+	if identity, ok := FromContext(ctx); ok {
+		return identity.TenantID
+	}
+	return DefaultTenant
+}
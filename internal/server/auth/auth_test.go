@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+type mockKeyStore map[string]*model.APIKey
+
+func (m mockKeyStore) GetAPIKey(_ context.Context, keyHash []byte) (*model.APIKey, error) {
+	key, ok := m[string(keyHash)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwksFile := writeJWKS(t, rsaKey, ecKey)
+	revokedAt := time.Now()
+	keys := mockKeyStore{
+		string(HashAPIKey("key-a")):       {TenantID: "tenant-a", Name: "ci"},
+		string(HashAPIKey("key-revoked")): {TenantID: "tenant-a", Name: "old", RevokedAt: &revokedAt},
+	}
+
+	sign := func(method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+	claims := func(tenant string, exp time.Duration) jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":       "alice",
+			"iss":       "issuer",
+			"tenant_id": tenant,
+			"exp":       time.Now().Add(exp).Unix(),
+		}
+	}
+
+	tests := []struct {
+		name       string
+		cfg        Config
+		creds      Credentials
+		wantTenant string
+		wantErr    bool
+	}{
+		{
+			name:       "Disabled",
+			cfg:        Config{},
+			wantTenant: DefaultTenant,
+		}, {
+			name:    "Missing credentials",
+			cfg:     Config{Enabled: true},
+			wantErr: true,
+		}, {
+			name:       "Valid API key",
+			cfg:        Config{Enabled: true},
+			creds:      Credentials{APIKey: "key-a"},
+			wantTenant: "tenant-a",
+		}, {
+			name:    "Unknown API key",
+			cfg:     Config{Enabled: true},
+			creds:   Credentials{APIKey: "key-b"},
+			wantErr: true,
+		}, {
+			name:    "Revoked API key",
+			cfg:     Config{Enabled: true},
+			creds:   Credentials{APIKey: "key-revoked"},
+			wantErr: true,
+		}, {
+			name:       "Valid RSA JWT",
+			cfg:        Config{Enabled: true, JWKSFile: jwksFile, Issuer: "issuer", TenantClaim: "tenant_id"},
+			creds:      Credentials{BearerToken: sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims("tenant-b", time.Hour))},
+			wantTenant: "tenant-b",
+		}, {
+			name:       "Valid EC JWT",
+			cfg:        Config{Enabled: true, JWKSFile: jwksFile, TenantClaim: "tenant_id"},
+			creds:      Credentials{BearerToken: sign(jwt.SigningMethodES256, "ec", ecKey, claims("tenant-c", time.Hour))},
+			wantTenant: "tenant-c",
+		}, {
+			name:    "JWT not configured",
+			cfg:     Config{Enabled: true, TenantClaim: "tenant_id"},
+			creds:   Credentials{BearerToken: sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims("tenant-b", time.Hour))},
+			wantErr: true,
+		}, {
+			name:    "Expired JWT",
+			cfg:     Config{Enabled: true, JWKSFile: jwksFile, TenantClaim: "tenant_id"},
+			creds:   Credentials{BearerToken: sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims("tenant-b", -time.Hour))},
+			wantErr: true,
+		}, {
+			name:    "JWT signed by unknown key",
+			cfg:     Config{Enabled: true, JWKSFile: jwksFile, TenantClaim: "tenant_id"},
+			creds:   Credentials{BearerToken: sign(jwt.SigningMethodRS256, "rsa", otherKey, claims("tenant-b", time.Hour))},
+			wantErr: true,
+		}, {
+			name:    "JWT with wrong issuer",
+			cfg:     Config{Enabled: true, JWKSFile: jwksFile, Issuer: "other", TenantClaim: "tenant_id"},
+			creds:   Credentials{BearerToken: sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims("tenant-b", time.Hour))},
+			wantErr: true,
+		}, {
+			name:    "JWT with unsafe tenant",
+			cfg:     Config{Enabled: true, JWKSFile: jwksFile, TenantClaim: "tenant_id"},
+			creds:   Credentials{BearerToken: sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims("../tenant-a", time.Hour))},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authn, err := NewAuthenticator(tt.cfg, keys)
+			require.NoError(t, err)
+
+			identity, err := authn.Authenticate(context.Background(), tt.creds)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrUnauthenticated)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantTenant, identity.TenantID)
+		})
+	}
+}
+
+func TestTenantID(t *testing.T) {
+	require.Equal(t, DefaultTenant, TenantID(context.Background()))
+
+	ctx := WithIdentity(context.Background(), &Identity{TenantID: "tenant-a"})
+	require.Equal(t, "tenant-a", TenantID(ctx))
+}
+
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string]any{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"use": "sig",
+				"n":   encode(rsaKey.N.Bytes()),
+				"e":   encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+			}, {
+				"kty": "EC",
+				"kid": "ec",
+				"crv": "P-256",
+				"x":   encode(ecKey.X.Bytes()),
+				"y":   encode(ecKey.Y.Bytes()),
+			},
+		},
+	}
+	b, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, b, 0600))
+	return path
+}
@@ -1,14 +1,20 @@
 package config
 
 import (
+	"github.com/zale144/fileserver/internal/server/auth"
 	"github.com/zale144/fileserver/internal/server/database"
 	"github.com/zale144/fileserver/internal/server/server"
+	"github.com/zale144/fileserver/internal/server/service"
 	"github.com/zale144/fileserver/internal/server/storage"
+	"github.com/zale144/fileserver/internal/tracing"
 )
 
 // Config is the configuration for the server.
 type Config struct {
+	Auth     auth.Config
 	Database database.Config
 	Storage  storage.Config
 	Server   server.Config
+	Service  service.Config
+	Tracing  tracing.Config
 }
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"fmt"
@@ -19,13 +20,33 @@ type Config struct {
 	DBName   string `envconfig:"POSTGRES_DB" required:"true" default:"fileserver"`
 	Host     string `envconfig:"POSTGRES_HOST" required:"true" default:"localhost"`
 	Port     string `envconfig:"POSTGRES_PORT" required:"true" default:"5432"`
+	// SSLMode is the libpq sslmode, e.g. require or verify-full, the CA and the client certificate
+	// are only needed to verify the server and to authenticate with a certificate respectively.
+	SSLMode     string `envconfig:"POSTGRES_SSLMODE" default:"disable"`
+	SSLRootCert string `envconfig:"POSTGRES_SSLROOTCERT"`
+	SSLCert     string `envconfig:"POSTGRES_SSLCERT"`
+	SSLKey      string `envconfig:"POSTGRES_SSLKEY"`
+}
+
+// ConnString returns the connection string of the database.
+func (cfg Config) ConnString() string {
+	connStr := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=%s password=%s port=%s",
+		cfg.Host, cfg.User, cfg.DBName, cfg.SSLMode, cfg.Password, cfg.Port)
+	if cfg.SSLRootCert != "" {
+		connStr += " sslrootcert=" + cfg.SSLRootCert
+	}
+	if cfg.SSLCert != "" {
+		connStr += " sslcert=" + cfg.SSLCert
+	}
+	if cfg.SSLKey != "" {
+		connStr += " sslkey=" + cfg.SSLKey
+	}
+	return connStr
 }
 
 // NewDBConnection creates a new database connection.
 func NewDBConnection(cfg Config) (*sql.DB, error) {
-	connStr := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=disable password=%s port=%s",
-		cfg.Host, cfg.User, cfg.DBName, cfg.Password, cfg.Port)
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", cfg.ConnString())
 	if err != nil {
 		return nil, fmt.Errorf("error opening database: %w", err)
 	}
@@ -48,3 +69,30 @@ func MigrateDB(db *sql.DB, migrationsName string, fs embed.FS) error {
 
 	return nil
 }
+
+// LatestMigration returns the version of the latest of the migrations, which the database is expected to be at.
+// It is meant to be called once at startup, as goose collects the migrations from a global file system.
+func LatestMigration(migrationsName string, fs embed.FS) (int64, error) {
+	goose.SetBaseFS(fs)
+	migrations, err := goose.CollectMigrations(migrationsName, 0, goose.MaxVersion)
+	if err != nil {
+		return 0, fmt.Errorf("error collecting migrations: %w", err)
+	}
+	latest, err := migrations.Last()
+	if err != nil {
+		return 0, fmt.Errorf("error getting latest migration: %w", err)
+	}
+	return latest.Version, nil
+}
+
+// CheckMigrations returns an error if the database is not migrated to the expected version.
+func CheckMigrations(ctx context.Context, db *sql.DB, expected int64) error {
+	current, err := goose.GetDBVersionContext(ctx, db)
+	if err != nil {
+		return fmt.Errorf("error getting database version: %w", err)
+	}
+	if current < expected {
+		return fmt.Errorf("database is at version %d, expected %d", current, expected)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE file_metadata ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE file_metadata DROP CONSTRAINT file_metadata_pkey;
+ALTER TABLE file_metadata ADD PRIMARY KEY (tenant_id, index);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    key_hash BYTEA PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_tenant_id_idx ON api_keys (tenant_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS api_keys;
+
+DELETE FROM file_metadata WHERE tenant_id <> 'default';
+ALTER TABLE file_metadata DROP CONSTRAINT file_metadata_pkey;
+ALTER TABLE file_metadata ADD PRIMARY KEY (index);
+ALTER TABLE file_metadata DROP COLUMN tenant_id;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE file_metadata ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS tenant_quotas (
+    tenant_id TEXT PRIMARY KEY,
+    used_bytes BIGINT NOT NULL DEFAULT 0,
+    used_objects BIGINT NOT NULL DEFAULT 0,
+    max_bytes BIGINT,
+    max_objects BIGINT
+);
+
+INSERT INTO tenant_quotas (tenant_id, used_objects)
+SELECT tenant_id, COUNT(*) FROM file_metadata GROUP BY tenant_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS tenant_quotas;
+ALTER TABLE file_metadata DROP COLUMN size;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE file_metadata ADD COLUMN scrubbed_at TIMESTAMPTZ;
+ALTER TABLE file_metadata ADD COLUMN scrub_status TEXT;
+
+CREATE TABLE IF NOT EXISTS scrub_runs (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ,
+    checked BIGINT NOT NULL DEFAULT 0,
+    missing BIGINT NOT NULL DEFAULT 0,
+    corrupted BIGINT NOT NULL DEFAULT 0,
+    invalid_proof BIGINT NOT NULL DEFAULT 0,
+    errors BIGINT NOT NULL DEFAULT 0,
+    error TEXT
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS scrub_runs;
+ALTER TABLE file_metadata DROP COLUMN scrub_status;
+ALTER TABLE file_metadata DROP COLUMN scrubbed_at;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS objects (
+    tenant_id TEXT NOT NULL,
+    hash BYTEA NOT NULL,
+    size BIGINT NOT NULL,
+    refcount BIGINT NOT NULL DEFAULT 0 CHECK (refcount >= 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, hash)
+);
+
+INSERT INTO objects (tenant_id, hash, size, refcount)
+SELECT tenant_id, hash, max(size), count(*) FROM file_metadata GROUP BY tenant_id, hash
+ON CONFLICT (tenant_id, hash) DO NOTHING;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS objects;
+-- +goose StatementEnd
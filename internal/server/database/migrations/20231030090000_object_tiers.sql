@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE objects
+    ADD COLUMN IF NOT EXISTS tier TEXT NOT NULL DEFAULT 'hot' CHECK (tier IN ('hot', 'cold')),
+    ADD COLUMN IF NOT EXISTS accessed_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS objects_hot_idx ON objects (created_at) WHERE tier = 'hot' AND refcount > 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS objects_hot_idx;
+ALTER TABLE objects DROP COLUMN IF EXISTS accessed_at, DROP COLUMN IF EXISTS tier;
+-- +goose StatementEnd
@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS coded_objects (
+    key TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    data_shards INT NOT NULL,
+    parity_shards INT NOT NULL,
+    block_size INT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS object_shards (
+    object_key TEXT NOT NULL REFERENCES coded_objects (key) ON DELETE CASCADE,
+    shard INT NOT NULL,
+    location INT NOT NULL,
+    size BIGINT NOT NULL,
+    hash BYTEA NOT NULL,
+    PRIMARY KEY (object_key, shard)
+);
+
+ALTER TABLE scrub_runs ADD COLUMN IF NOT EXISTS repaired_shards BIGINT NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE scrub_runs DROP COLUMN IF EXISTS repaired_shards;
+DROP TABLE IF EXISTS object_shards;
+DROP TABLE IF EXISTS coded_objects;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS root BYTEA;
+
+CREATE INDEX IF NOT EXISTS uploads_tenant_committed_idx ON uploads (tenant_id, id DESC) WHERE state = 'committed' AND root IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS uploads_tenant_committed_idx;
+ALTER TABLE uploads DROP COLUMN IF EXISTS root;
+-- +goose StatementEnd
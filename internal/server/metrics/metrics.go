@@ -0,0 +1,402 @@
+// Package metrics holds the Prometheus metrics shared by the server, service, storage and repository packages.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "fileserver"
+
+// Metrics are the collectors of the fileserver, all registered on the same registry.
+// A nil *Metrics is valid and records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	uploadBytes          prometheus.Histogram
+	uploadFiles          prometheus.Histogram
+	uploadsInFlight      prometheus.Gauge
+	dedupFiles           prometheus.Counter
+	dedupBytes           prometheus.Counter
+	treeBuildDuration    prometheus.Histogram
+	storageDuration      *prometheus.HistogramVec
+	repositoryDuration   *prometheus.HistogramVec
+	verificationFailures *prometheus.CounterVec
+	integrityFailures    *prometheus.CounterVec
+	scrubbedFiles        *prometheus.CounterVec
+	scrubLastCompletion  prometheus.Gauge
+	gcOrphans            *prometheus.CounterVec
+	tierMigratedObjects  prometheus.Counter
+	tierMigratedBytes    prometheus.Counter
+	tierReads            *prometheus.CounterVec
+	replicaReads         *prometheus.CounterVec
+	degradedWrites       prometheus.Counter
+	replicaRepairs       *prometheus.CounterVec
+	reconstructedReads   prometheus.Counter
+	shardRepairs         *prometheus.CounterVec
+	unencryptedReads     prometheus.Counter
+	errors               *prometheus.CounterVec
+	throttledRequests    *prometheus.CounterVec
+}
+
+// New creates the metrics and registers them on the registry.
+// Tests inject a registry of their own to inspect the metrics in isolation.
+func New(registry *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		registry: registry,
+		uploadBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upload_bytes",
+			Help:      "Total size of the files in an upload.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 12),
+		}),
+		uploadFiles: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upload_files",
+			Help:      "Number of files in an upload.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+		}),
+		uploadsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "uploads_in_flight",
+			Help:      "Number of uploads in progress.",
+		}),
+		dedupFiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dedup_files_total",
+			Help:      "Number of uploaded files whose content was already stored.",
+		}),
+		dedupBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dedup_bytes_total",
+			Help:      "Number of uploaded bytes not sent to the storage because their content was already stored.",
+		}),
+		treeBuildDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "merkle_tree_build_duration_seconds",
+			Help:      "Time spent building the Merkle tree of an upload, along with its proofs.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Latency of the object storage operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation", "status"}),
+		repositoryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "repository_operation_duration_seconds",
+			Help:      "Latency of the database operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation", "status"}),
+		verificationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "verification_failures_total",
+			Help:      "Number of stored files that failed the verification.",
+		}, []string{"reason"}),
+		integrityFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "integrity_failures_total",
+			Help:      "Number of downloaded objects whose content did not match the hash of their file, by storage backend.",
+		}, []string{"backend"}),
+		scrubbedFiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scrub_files_total",
+			Help:      "Number of stored files checked by the scrubber by outcome.",
+		}, []string{"status"}),
+		scrubLastCompletion: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scrub_last_completion_timestamp_seconds",
+			Help:      "Time the last scrub run completed, in seconds since the epoch.",
+		}),
+		gcOrphans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "gc_orphans_total",
+			Help:      "Number of orphaned objects collected by the garbage collection, by action.",
+		}, []string{"action"}),
+		tierMigratedObjects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_migrated_objects_total",
+			Help:      "Number of objects migrated from the hot to the cold storage tier.",
+		}),
+		tierMigratedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_migrated_bytes_total",
+			Help:      "Number of bytes migrated from the hot to the cold storage tier.",
+		}),
+		tierReads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tier_reads_total",
+			Help:      "Number of objects read from the tiered storage, by the tier holding them.",
+		}, []string{"tier"}),
+		replicaReads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replica_reads_total",
+			Help:      "Number of objects read from the replicated storage, by the replica serving them.",
+		}, []string{"replica"}),
+		degradedWrites: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replica_degraded_writes_total",
+			Help:      "Number of objects written to the write quorum but not to every replica.",
+		}),
+		replicaRepairs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replica_repairs_total",
+			Help:      "Number of missing or divergent replicas of objects repaired, by status.",
+		}, []string{"status"}),
+		reconstructedReads: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "erasure_reconstructed_reads_total",
+			Help:      "Number of erasure-coded objects read by reconstructing missing data shards.",
+		}),
+		shardRepairs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "erasure_shard_repairs_total",
+			Help:      "Number of missing or damaged shards of erasure-coded objects rebuilt, by status.",
+		}, []string{"status"}),
+		unencryptedReads: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "unencrypted_reads_total",
+			Help:      "Number of objects read as plaintext because they were stored before the encryption was enabled.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Number of failed operations by error type.",
+		}, []string{"operation", "type"}),
+		throttledRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "throttled_requests_total",
+			Help:      "Number of requests rejected by the rate or the concurrency limits.",
+		}, []string{"reason", "route"}),
+	}
+
+	registry.MustRegister(
+		m.uploadBytes,
+		m.uploadFiles,
+		m.uploadsInFlight,
+		m.dedupFiles,
+		m.dedupBytes,
+		m.treeBuildDuration,
+		m.storageDuration,
+		m.repositoryDuration,
+		m.verificationFailures,
+		m.integrityFailures,
+		m.scrubbedFiles,
+		m.scrubLastCompletion,
+		m.gcOrphans,
+		m.tierMigratedObjects,
+		m.tierMigratedBytes,
+		m.tierReads,
+		m.replicaReads,
+		m.degradedWrites,
+		m.replicaRepairs,
+		m.reconstructedReads,
+		m.shardRepairs,
+		m.unencryptedReads,
+		m.errors,
+		m.throttledRequests,
+	)
+	return m
+}
+
+// NewRegistry creates a registry with the Go runtime and process collectors.
+func NewRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return registry
+}
+
+// Handler serves the metrics of the registry.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return promhttp.HandlerFor(prometheus.NewRegistry(), promhttp.HandlerOpts{})
+	}
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveUpload records the number of files and the total size of an upload.
+func (m *Metrics) ObserveUpload(files int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.uploadFiles.Observe(float64(files))
+	m.uploadBytes.Observe(float64(bytes))
+}
+
+// ObserveDedup counts the files of an upload, and their bytes, that were not stored again.
+func (m *Metrics) ObserveDedup(files int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.dedupFiles.Add(float64(files))
+	m.dedupBytes.Add(float64(bytes))
+}
+
+// TrackUpload counts an upload as in flight until the returned function is called.
+func (m *Metrics) TrackUpload() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.uploadsInFlight.Inc()
+	return m.uploadsInFlight.Dec
+}
+
+// ObserveTree records the time spent building a Merkle tree and its proofs, started at start.
+func (m *Metrics) ObserveTree(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.treeBuildDuration.Observe(time.Since(start).Seconds())
+}
+
+// ObserveStorage records the latency of a storage operation started at start.
+func (m *Metrics) ObserveStorage(operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.storageDuration.WithLabelValues(operation, status(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveRepository records the latency of a repository operation started at start.
+func (m *Metrics) ObserveRepository(operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.repositoryDuration.WithLabelValues(operation, status(err)).Observe(time.Since(start).Seconds())
+}
+
+// VerificationFailed counts a file that failed the verification for the reason.
+func (m *Metrics) VerificationFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.verificationFailures.WithLabelValues(reason).Inc()
+}
+
+// IntegrityFailure counts a downloaded object of the backend whose content did not match the hash of its file.
+func (m *Metrics) IntegrityFailure(backend string) {
+	if m == nil {
+		return
+	}
+	m.integrityFailures.WithLabelValues(backend).Inc()
+}
+
+// FileScrubbed counts a stored file checked by the scrubber with the status.
+func (m *Metrics) FileScrubbed(status string) {
+	if m == nil {
+		return
+	}
+	m.scrubbedFiles.WithLabelValues(status).Inc()
+}
+
+// ScrubCompleted records the time a scrub run completed.
+func (m *Metrics) ScrubCompleted(at time.Time) {
+	if m == nil {
+		return
+	}
+	m.scrubLastCompletion.Set(float64(at.Unix()))
+}
+
+// OrphansCollected counts the orphaned objects deleted or quarantined by the garbage collection.
+func (m *Metrics) OrphansCollected(action string, count int) {
+	if m == nil {
+		return
+	}
+	m.gcOrphans.WithLabelValues(action).Add(float64(count))
+}
+
+// ObjectsMigrated counts the objects, and their bytes, migrated to the cold storage tier.
+func (m *Metrics) ObjectsMigrated(objects int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.tierMigratedObjects.Add(float64(objects))
+	m.tierMigratedBytes.Add(float64(bytes))
+}
+
+// TierRead counts an object read from the given storage tier.
+func (m *Metrics) TierRead(tier string) {
+	if m == nil {
+		return
+	}
+	m.tierReads.WithLabelValues(tier).Inc()
+}
+
+// ReplicaRead counts an object read from the given replica.
+func (m *Metrics) ReplicaRead(replica string) {
+	if m == nil {
+		return
+	}
+	m.replicaReads.WithLabelValues(replica).Inc()
+}
+
+// DegradedWrite counts an object written to fewer replicas than configured.
+func (m *Metrics) DegradedWrite() {
+	if m == nil {
+		return
+	}
+	m.degradedWrites.Inc()
+}
+
+// ReplicaRepair counts a replica of an object repaired, status being repaired or failed.
+func (m *Metrics) ReplicaRepair(status string) {
+	if m == nil {
+		return
+	}
+	m.replicaRepairs.WithLabelValues(status).Inc()
+}
+
+// ReconstructedRead counts an erasure-coded object read by reconstructing missing data shards.
+func (m *Metrics) ReconstructedRead() {
+	if m == nil {
+		return
+	}
+	m.reconstructedReads.Inc()
+}
+
+// UnencryptedRead counts an object read as plaintext because it was stored before the encryption was enabled.
+func (m *Metrics) UnencryptedRead() {
+	if m == nil {
+		return
+	}
+	m.unencryptedReads.Inc()
+}
+
+// ShardRepair counts a shard of an erasure-coded object rebuilt, status being repaired or failed.
+func (m *Metrics) ShardRepair(status string) {
+	if m == nil {
+		return
+	}
+	m.shardRepairs.WithLabelValues(status).Inc()
+}
+
+// Error counts a failed operation by the type of its error.
+func (m *Metrics) Error(operation, errType string) {
+	if m == nil {
+		return
+	}
+	m.errors.WithLabelValues(operation, errType).Inc()
+}
+
+// Throttled counts a request rejected by the rate or the concurrency limits.
+func (m *Metrics) Throttled(reason, route string) {
+	if m == nil {
+		return
+	}
+	m.throttledRequests.WithLabelValues(reason, route).Inc()
+}
+
+func status(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
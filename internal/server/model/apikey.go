@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+type APIKey struct {
+	KeyHash   []byte     `db:"key_hash"`
+	TenantID  string     `db:"tenant_id"`
+	Name      string     `db:"name"`
+	Roles     []string   `db:"roles"`
+	CreatedAt time.Time  `db:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
@@ -0,0 +1,11 @@
+package model
+
+// KeyRotationReport summarizes a rotation of the master key wrapping the data keys of the stored objects.
+type KeyRotationReport struct {
+	Scanned int
+	// Rotated is the number of data keys re-wrapped with the current master key, and Failed the number that could not be.
+	Rotated int
+	Failed  int
+	// Encrypted is the number of objects stored before the encryption was enabled, encrypted by the rotation.
+	Encrypted int
+}
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of errors returned by the file service, told apart with errors.Is.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrConflict      = errors.New("conflict")
+	ErrIntegrity     = errors.New("integrity check failed")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrInvalidInput  = errors.New("invalid input")
+	// ErrUnavailable is returned for the requests the service cannot take on, e.g. while it is shutting down.
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// IntegrityError is returned when the content of a stored object does not hash to the hash in the metadata of its file,
+// e.g. because it was corrupted or swapped with another one.
+type IntegrityError struct {
+	Key      string
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("object %s hashes to %x instead of %x", e.Key, e.Actual, e.Expected)
+}
+
+// Is makes every IntegrityError match ErrIntegrity.
+func (e *IntegrityError) Is(target error) bool {
+	return target == ErrIntegrity
+}
@@ -3,23 +3,72 @@ package model
 import (
 	"encoding/hex"
 	"fmt"
+	"io"
 	"strings"
 )
 
+// File is a stored file, whose content is streamed from the storage. The content must be closed.
 type File struct {
-	Data     []byte
+	Content  io.ReadCloser
 	Metadata *FileMetadata
 }
 
+// Object is the content of a file sent to the storage.
+type Object struct {
+	Key string
+	// Size and Hash are the expected size and hash of the content, the storage rejects a content that does not match them.
+	// A negative size is unknown, and so is a nil hash.
+	Size    int64
+	Hash    []byte
+	Content io.Reader
+}
+
 type FileMetadata struct {
+	TenantID    string     `db:"tenant_id"`
 	Index       int        `db:"index"`
 	Hash        []byte     `db:"hash"`
 	MerkleProof ByteaArray `db:"merkle_proof"`
+	Size        int64      `db:"size"`
+}
+
+// ObjectKey returns the key the file content is stored under, scoped to the tenant owning the file.
+func (m *FileMetadata) ObjectKey() string {
+	return ObjectKey(m.TenantID, m.Hash)
+}
+
+// ObjectKey returns the key the content with the given hash is stored under for the tenant.
+func ObjectKey(tenantID string, hash []byte) string {
+	return fmt.Sprintf("%s/%x", tenantID, hash)
 }
 
+// KeyMigrationReport summarizes a migration of the objects stored under their bare content hash
+// to the object keys of the default tenant.
+type KeyMigrationReport struct {
+	Scanned int
+	// Migrated is the number of objects moved to the key of the default tenant, and Failed the number that could not be.
+	Migrated int
+	Failed   int
+}
+
+// IndexedFileInput is an uploaded file. Its content is written as it is read, so the receiver reads it to its end,
+// or closes it to give up on it, before it receives the next file.
 type IndexedFileInput struct {
-	Index int
-	Data  []byte
+	Index   int
+	Content io.ReadCloser
+}
+
+// ShutdownReport summarizes what happened to the uploads in progress when the service shut down.
+type ShutdownReport struct {
+	// Finished is the number of uploads that finished before the deadline, successfully or not.
+	Finished int
+	Aborted  []AbortedUpload
+}
+
+// AbortedUpload describes an upload aborted by the shutdown, whose stored objects were rolled back.
+type AbortedUpload struct {
+	TenantID string
+	Files    int
+	Bytes    int64
 }
 
 type ByteaArray [][]byte
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// QuarantinePrefix is the prefix of the keys the orphaned objects are moved under when they are quarantined
+// instead of deleted.
+const QuarantinePrefix = "_quarantine/"
+
+// StoredObject describes an object of the storage.
+type StoredObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// ParseObjectKey returns the tenant and the content hash of the object key, and false if the key is not
+// the key of a file's content.
+func ParseObjectKey(key string) (tenantID string, hash []byte, ok bool) {
+	i := strings.LastIndex(key, "/")
+	if i <= 0 {
+		return "", nil, false
+	}
+	hash, err := hex.DecodeString(key[i+1:])
+	if err != nil || len(hash) == 0 {
+		return "", nil, false
+	}
+	return key[:i], hash, true
+}
+
+// GCReport summarizes a garbage collection run over the stored objects.
+type GCReport struct {
+	DryRun  bool
+	Scanned int
+	// Orphans are the objects no file nor pending upload refers to, older than the grace period.
+	Orphans []StoredObject
+	// Collected is the number of orphans deleted or quarantined, zero on a dry run.
+	Collected int
+	// Kept is the number of orphans left alone because they were referenced, modified or removed again by the time
+	// they were to be collected, e.g. uploaded again.
+	Kept int
+	// AbandonedUploads is the number of uploads pending for longer than the grace period, marked failed by the run.
+	AbandonedUploads int
+}
+
+// OrphanBytes returns the total size of the orphans.
+func (r *GCReport) OrphanBytes() int64 {
+	var size int64
+	for _, orphan := range r.Orphans {
+		size += orphan.Size
+	}
+	return size
+}
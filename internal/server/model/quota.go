@@ -0,0 +1,43 @@
+package model
+
+import "fmt"
+
+// Quota limits the storage used by a tenant, a zero limit means there is no limit.
+type Quota struct {
+	MaxBytes   int64 `db:"max_bytes"`
+	MaxObjects int64 `db:"max_objects"`
+}
+
+// Usage is the storage used by a tenant, or requested by an upload.
+type Usage struct {
+	Bytes   int64 `db:"used_bytes"`
+	Objects int64 `db:"used_objects"`
+}
+
+// Check returns a QuotaError if adding the requested usage to the used one exceeds the quota.
+func (q Quota) Check(used, requested Usage) error {
+	if q.MaxBytes > 0 && used.Bytes+requested.Bytes > q.MaxBytes {
+		return &QuotaError{Limit: "max_bytes", Max: q.MaxBytes, Used: used.Bytes, Requested: requested.Bytes}
+	}
+	if q.MaxObjects > 0 && used.Objects+requested.Objects > q.MaxObjects {
+		return &QuotaError{Limit: "max_objects", Max: q.MaxObjects, Used: used.Objects, Requested: requested.Objects}
+	}
+	return nil
+}
+
+// QuotaError is returned when an upload would exceed the storage quota of the tenant.
+type QuotaError struct {
+	Limit     string
+	Max       int64
+	Used      int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota %s exceeded: %d used, %d requested, %d allowed", e.Limit, e.Used, e.Requested, e.Max)
+}
+
+// Is makes every QuotaError match ErrQuotaExceeded.
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
@@ -0,0 +1,14 @@
+package model
+
+// RepairReport summarizes a reconciliation of the replicas of the stored objects.
+type RepairReport struct {
+	Scanned int
+	// Divergent is the number of objects missing from a replica, or whose size differs between the replicas.
+	Divergent int
+	// Repaired is the number of copies replaced by a verified one, and Failed the number that could not be.
+	Repaired int
+	Failed   int
+	// Unreferenced is the number of divergent objects left as they are because no file nor pending upload refers
+	// to them, they are collected by the garbage collection.
+	Unreferenced int
+}
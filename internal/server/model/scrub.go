@@ -0,0 +1,49 @@
+package model
+
+import "time"
+
+// ScrubStatus is the outcome of scrubbing a stored file.
+type ScrubStatus string
+
+const (
+	ScrubOK ScrubStatus = "ok"
+	// ScrubMissing is the status of a file whose object is not in storage anymore.
+	ScrubMissing ScrubStatus = "missing"
+	// ScrubCorrupted is the status of a file whose object does not hash to the hash in its metadata.
+	ScrubCorrupted ScrubStatus = "corrupted"
+	// ScrubInvalidProof is the status of a file whose stored proof does not lead to the stored root.
+	ScrubInvalidProof ScrubStatus = "proof"
+)
+
+// ScrubReport summarizes a scrub run over the stored files.
+type ScrubReport struct {
+	ID int64
+	// TenantID is the tenant whose files were scrubbed, empty when the files of every tenant were.
+	TenantID   string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Checked    int
+	Failures   []ScrubFailure
+	// Errors is the number of files that could not be checked, e.g. because the storage was unreachable.
+	Errors int
+	// RepairedShards is the number of missing or damaged shards of erasure-coded objects rebuilt by the run.
+	RepairedShards int
+}
+
+// Count returns the number of files that failed the scrub with the status.
+func (r *ScrubReport) Count(status ScrubStatus) int {
+	count := 0
+	for _, failure := range r.Failures {
+		if failure.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// ScrubFailure is a stored file that failed the scrub.
+type ScrubFailure struct {
+	TenantID string
+	Index    int
+	Status   ScrubStatus
+}
@@ -0,0 +1,30 @@
+package model
+
+import "time"
+
+// CodedObject is the layout of an erasure-coded object: the object is cut in stripes of DataShards blocks of BlockSize
+// bytes, the last one padded with zeros, and every stripe is completed by ParityShards parity blocks.
+// The shard i holds the block i of every stripe.
+type CodedObject struct {
+	Key          string
+	Size         int64
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+	Shards       []Shard
+	UpdatedAt    time.Time
+}
+
+// Stripes returns the number of stripes of the object.
+func (o *CodedObject) Stripes() int64 {
+	stripe := int64(o.DataShards) * int64(o.BlockSize)
+	return (o.Size + stripe - 1) / stripe
+}
+
+// Shard is a shard of an erasure-coded object, stored by the backend at Location.
+type Shard struct {
+	Index    int
+	Location int
+	Size     int64
+	Hash     []byte
+}
@@ -0,0 +1,31 @@
+package model
+
+// The storage tiers of the objects: they are written to the hot tier and migrated to the cold one once they get old or idle.
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
+// ObjectRef is an object recorded in the repository, the content of the files of a tenant with the same hash.
+type ObjectRef struct {
+	TenantID string
+	Hash     []byte
+	Size     int64
+}
+
+// Key returns the key of the object in the storage.
+func (o ObjectRef) Key() string {
+	return ObjectKey(o.TenantID, o.Hash)
+}
+
+// TierReport summarizes a migration run of the objects to the cold tier.
+type TierReport struct {
+	DryRun bool
+	// Candidates are the objects of the hot tier older or idle for longer than allowed.
+	Candidates []ObjectRef
+	// Migrated is the number of candidates moved to the cold tier, and Bytes their total size, zero on a dry run.
+	Migrated int
+	Bytes    int64
+	// Failed is the number of candidates that could not be moved, they are left in the hot tier.
+	Failed int
+}
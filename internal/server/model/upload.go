@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+// UploadState is the state of an upload in its lifecycle, it starts pending and ends either committed or failed.
+type UploadState string
+
+const (
+	// UploadPending is the state of an upload whose objects are being stored, none of its files is visible yet.
+	UploadPending UploadState = "pending"
+	// UploadCommitted is the state of an upload whose metadata was committed, its files are visible.
+	UploadCommitted UploadState = "committed"
+	// UploadFailed is the state of an upload that was given up, its reserved quota is released
+	// and the objects only it referred to are deleted.
+	UploadFailed UploadState = "failed"
+)
+
+// Upload records an upload of files of a tenant, so that the objects it staged can be found
+// and compensated for when it fails.
+type Upload struct {
+	ID       int64
+	TenantID string
+	State    UploadState
+	// Hashes are the hashes of the uploaded files, their objects are keyed by them.
+	Hashes [][]byte
+	// Root is the Merkle root of the uploaded files, it is the root of the tenant once the upload is committed.
+	Root      []byte
+	Usage     Usage
+	CreatedAt time.Time
+}
+
+// UploadResult summarizes a committed upload.
+type UploadResult struct {
+	Files int
+	Bytes int64
+	// DedupFiles are the files whose content was already stored, by a file of the tenant or an earlier file
+	// of the upload, and was not sent to the storage again. DedupBytes is their total size.
+	DedupFiles int
+	DedupBytes int64
+}
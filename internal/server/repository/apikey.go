@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+type APIKey struct {
+	db *sql.DB
+}
+
+func NewAPIKey(db *sql.DB) *APIKey {
+	return &APIKey{
+		db: db,
+	}
+}
+
+func (repo *APIKey) GetAPIKey(ctx context.Context, keyHash []byte) (*model.APIKey, error) {
+	query := `SELECT key_hash, tenant_id, name, roles, created_at, revoked_at FROM api_keys WHERE key_hash = $1;`
+	row := repo.db.QueryRowContext(ctx, query, keyHash)
+
+	var key model.APIKey
+	err := row.Scan(&key.KeyHash, &key.TenantID, &key.Name, pq.Array(&key.Roles), &key.CreatedAt, &key.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (repo *APIKey) Create(ctx context.Context, key *model.APIKey) error {
+	query := `INSERT INTO api_keys (key_hash, tenant_id, name, roles) VALUES ($1, $2, $3, $4);`
+	_, err := repo.db.ExecContext(ctx, query, key.KeyHash, key.TenantID, key.Name, pq.Array(key.Roles))
+	return err
+}
+
+// Revoke marks the keys with the given name of the tenant as revoked, returning the number of revoked keys.
+func (repo *APIKey) Revoke(ctx context.Context, tenantID, name string) (int64, error) {
+	query := `UPDATE api_keys SET revoked_at = now() WHERE tenant_id = $1 AND name = $2 AND revoked_at IS NULL;`
+	res, err := repo.db.ExecContext(ctx, query, tenantID, name)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
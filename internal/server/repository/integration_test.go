@@ -0,0 +1,297 @@
+//go:build integration
+
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/database"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// The integration tests run against the PostgreSQL configured by the POSTGRES_* variables, e.g. the one of docker-compose:
+//
+//	go test -tags integration ./internal/server/repository/
+//
+// The database is migrated to the latest version, and every test works on a tenant of its own,
+// so that the rows of other runs do not get in the way.
+
+func newTestRepo(t *testing.T) (*File, *sql.DB) {
+	var cfg database.Config
+	require.NoError(t, envconfig.Process("", &cfg))
+	db, err := database.NewDBConnection(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(t, database.MigrateDB(db, "migrations", database.EmbedMigrations))
+	return NewFile(db), db
+}
+
+func newTestTenant() string {
+	return fmt.Sprintf("integration-%d", time.Now().UnixNano())
+}
+
+// newTestFiles returns the metadata of files of the tenant with the contents, indexed in order.
+func newTestFiles(tenantID string, contents ...string) []*model.FileMetadata {
+	files := make([]*model.FileMetadata, len(contents))
+	for i, content := range contents {
+		files[i] = &model.FileMetadata{
+			TenantID:    tenantID,
+			Index:       i,
+			Hash:        merkle.HashData([]byte(content)),
+			MerkleProof: model.ByteaArray{[]byte(content)},
+			Size:        int64(len(content)),
+		}
+	}
+	return files
+}
+
+func beginTestUpload(repo *File, files []*model.FileMetadata, defaults model.Quota) (*model.Upload, error) {
+	upload := &model.Upload{TenantID: files[0].TenantID, Root: []byte("root"), Usage: model.Usage{Objects: int64(len(files))}}
+	for _, file := range files {
+		upload.Hashes = append(upload.Hashes, file.Hash)
+		upload.Usage.Bytes += file.Size
+	}
+	return upload, repo.BeginUpload(context.Background(), upload, defaults)
+}
+
+func commitTestUpload(t *testing.T, repo *File, files []*model.FileMetadata) {
+	upload, err := beginTestUpload(repo, files, model.Quota{})
+	require.NoError(t, err)
+	require.NoError(t, repo.CommitUpload(context.Background(), upload, files))
+}
+
+func requireUsage(t *testing.T, repo *File, tenantID string, want model.Usage) {
+	t.Helper()
+	used, _, err := repo.GetQuota(context.Background(), tenantID, model.Quota{})
+	require.NoError(t, err)
+	require.Equal(t, want, used)
+}
+
+func requireRefcount(t *testing.T, db *sql.DB, file *model.FileMetadata, want int64) {
+	t.Helper()
+	var refcount int64
+	err := db.QueryRow(`SELECT refcount FROM objects WHERE tenant_id = $1 AND hash = $2;`, file.TenantID, file.Hash).Scan(&refcount)
+	if errors.Is(err, sql.ErrNoRows) {
+		refcount = 0
+	} else {
+		require.NoError(t, err)
+	}
+	require.Equal(t, want, refcount)
+}
+
+func requireUploadState(t *testing.T, db *sql.DB, upload *model.Upload, want model.UploadState) {
+	t.Helper()
+	var state model.UploadState
+	require.NoError(t, db.QueryRow(`SELECT state FROM uploads WHERE id = $1;`, upload.ID).Scan(&state))
+	require.Equal(t, want, state)
+}
+
+func TestIntegrationCommitUpload(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newTestRepo(t)
+	tenantID := newTestTenant()
+	files := newTestFiles(tenantID, "test0", "test1")
+
+	upload, err := beginTestUpload(repo, files, model.Quota{})
+	require.NoError(t, err)
+	requireUploadState(t, db, upload, model.UploadPending)
+	require.NoError(t, repo.CommitUpload(ctx, upload, files))
+	requireUploadState(t, db, upload, model.UploadCommitted)
+
+	stored, err := repo.List(ctx, tenantID, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	require.Equal(t, files[1].Hash, stored[1].Hash)
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 10, Objects: 2})
+	requireRefcount(t, db, files[0], 1)
+	root, err := repo.Root(ctx, tenantID)
+	require.NoError(t, err)
+	require.Equal(t, []byte("root"), root)
+
+	// a committed upload cannot be committed or failed again
+	require.ErrorIs(t, repo.CommitUpload(ctx, upload, files), model.ErrConflict)
+	require.NoError(t, repo.FailUpload(ctx, upload, errors.New("too late")))
+	requireUploadState(t, db, upload, model.UploadCommitted)
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 10, Objects: 2})
+}
+
+func TestIntegrationCommitUploadConflict(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newTestRepo(t)
+	tenantID := newTestTenant()
+	commitTestUpload(t, repo, newTestFiles(tenantID, "test0"))
+
+	// the file at index 0 is stored with another content, none of the files of the upload is inserted
+	files := newTestFiles(tenantID, "other0", "other1")
+	upload, err := beginTestUpload(repo, files, model.Quota{})
+	require.NoError(t, err)
+	require.ErrorIs(t, repo.CommitUpload(ctx, upload, files), model.ErrConflict)
+
+	requireUploadState(t, db, upload, model.UploadPending)
+	stored, err := repo.List(ctx, tenantID, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	require.Equal(t, merkle.HashData([]byte("test0")), stored[0].Hash)
+	requireRefcount(t, db, files[1], 0)
+
+	// the compensation of the failed upload releases its reserved quota
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 17, Objects: 3})
+	require.NoError(t, repo.FailUpload(ctx, upload, errors.New("conflict")))
+	requireUploadState(t, db, upload, model.UploadFailed)
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 5, Objects: 1})
+
+	// the quota of a failed upload is only released once
+	require.NoError(t, repo.FailUpload(ctx, upload, errors.New("conflict")))
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 5, Objects: 1})
+}
+
+func TestIntegrationCommitUploadOtherSet(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newTestRepo(t)
+	tenantID := newTestTenant()
+	commitTestUpload(t, repo, newTestFiles(tenantID, "test0", "test1"))
+
+	// the file at index 0 has the same content but the proof of another set, nothing of the upload is inserted
+	files := newTestFiles(tenantID, "test0", "test1", "test2")
+	files[0].MerkleProof = model.ByteaArray{[]byte("other set")}
+	upload, err := beginTestUpload(repo, files, model.Quota{})
+	require.NoError(t, err)
+	require.ErrorIs(t, repo.CommitUpload(ctx, upload, files), model.ErrConflict)
+
+	stored, err := repo.List(ctx, tenantID, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	require.Equal(t, model.ByteaArray{[]byte("test0")}, stored[0].MerkleProof)
+	requireRefcount(t, db, files[2], 0)
+}
+
+func TestIntegrationCommitUploadPartial(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newTestRepo(t)
+	tenantID := newTestTenant()
+	first := newTestFiles(tenantID, "test0")
+	commitTestUpload(t, repo, first)
+
+	// the file already stored at index 0 is left as it is, only the new one is inserted and referenced
+	files := newTestFiles(tenantID, "test0", "test1")
+	commitTestUpload(t, repo, files)
+
+	stored, err := repo.List(ctx, tenantID, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	requireRefcount(t, db, files[0], 1)
+	requireRefcount(t, db, files[1], 1)
+	// the quota reserved for the file stored already is released
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 10, Objects: 2})
+}
+
+func TestIntegrationRefcount(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newTestRepo(t)
+	tenantID := newTestTenant()
+	// both files have the same content, so they share an object
+	files := newTestFiles(tenantID, "test0", "test0")
+	files[1].MerkleProof = model.ByteaArray{[]byte("proof1")}
+	commitTestUpload(t, repo, files)
+	requireRefcount(t, db, files[0], 2)
+
+	stored, err := repo.StoredObjects(ctx, tenantID, [][]byte{files[0].Hash})
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	keys, err := repo.ReferencedKeys(ctx, time.Now())
+	require.NoError(t, err)
+	require.True(t, keys[files[0].ObjectKey()])
+
+	// the object is referenced until both files are deleted
+	require.NoError(t, repo.Delete(ctx, tenantID, 0))
+	requireRefcount(t, db, files[0], 1)
+	require.NoError(t, repo.Delete(ctx, tenantID, 1))
+	requireRefcount(t, db, files[0], 0)
+	require.ErrorIs(t, repo.Delete(ctx, tenantID, 1), model.ErrNotFound)
+
+	stored, err = repo.StoredObjects(ctx, tenantID, [][]byte{files[0].Hash})
+	require.NoError(t, err)
+	require.Empty(t, stored)
+	keys, err = repo.ReferencedKeys(ctx, time.Now())
+	require.NoError(t, err)
+	require.False(t, keys[files[0].ObjectKey()])
+
+	// the unreferenced object is pruned once it has been unreferenced for long enough
+	_, err = repo.PruneObjects(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT count(*) FROM objects WHERE tenant_id = $1;`, tenantID).Scan(&count))
+	require.Zero(t, count)
+}
+
+func TestIntegrationQuota(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := newTestRepo(t)
+	tenantID := newTestTenant()
+	defaults := model.Quota{MaxBytes: 100, MaxObjects: 2}
+
+	// a tenant without a row of its own has the default quota
+	used, quota, err := repo.GetQuota(ctx, tenantID, defaults)
+	require.NoError(t, err)
+	require.Equal(t, model.Usage{}, used)
+	require.Equal(t, defaults, quota)
+
+	// an upload exceeding the quota is refused, and reserves nothing
+	_, err = beginTestUpload(repo, newTestFiles(tenantID, "test0", "test1", "test2"), defaults)
+	var quotaErr *model.QuotaError
+	require.ErrorAs(t, err, &quotaErr)
+	require.Equal(t, "max_objects", quotaErr.Limit)
+	requireUsage(t, repo, tenantID, model.Usage{})
+
+	// the limits set for the tenant override the defaults, a nil one falls back to its default
+	maxObjects := int64(3)
+	require.NoError(t, repo.SetQuota(ctx, tenantID, nil, &maxObjects))
+	_, quota, err = repo.GetQuota(ctx, tenantID, defaults)
+	require.NoError(t, err)
+	require.Equal(t, model.Quota{MaxBytes: 100, MaxObjects: 3}, quota)
+	files := newTestFiles(tenantID, "test0", "test1", "test2")
+	upload, err := beginTestUpload(repo, files, defaults)
+	require.NoError(t, err)
+	require.NoError(t, repo.CommitUpload(ctx, upload, files))
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 15, Objects: 3})
+
+	// deleting a file releases its share of the quota
+	_, err = beginTestUpload(repo, newTestFiles(tenantID, "test3"), defaults)
+	require.ErrorIs(t, err, model.ErrQuotaExceeded)
+	require.NoError(t, repo.Delete(ctx, tenantID, 2))
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 10, Objects: 2})
+
+	// a zero limit lifts it, a negative one is invalid
+	require.NoError(t, repo.SetQuota(ctx, tenantID, nil, new(int64)))
+	negative := int64(-1)
+	require.ErrorIs(t, repo.SetQuota(ctx, tenantID, &negative, nil), model.ErrInvalidInput)
+}
+
+func TestIntegrationFailAbandonedUploads(t *testing.T) {
+	ctx := context.Background()
+	repo, db := newTestRepo(t)
+	tenantID := newTestTenant()
+	upload, err := beginTestUpload(repo, newTestFiles(tenantID, "test0"), model.Quota{})
+	require.NoError(t, err)
+	requireUsage(t, repo, tenantID, model.Usage{Bytes: 5, Objects: 1})
+
+	// the pending upload holds its objects until it is abandoned
+	keys, err := repo.ReferencedKeys(ctx, upload.CreatedAt)
+	require.NoError(t, err)
+	require.True(t, keys[model.ObjectKey(tenantID, upload.Hashes[0])])
+
+	failed, err := repo.FailAbandonedUploads(ctx, upload.CreatedAt.Add(time.Microsecond))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, failed, 1)
+	requireUploadState(t, db, upload, model.UploadFailed)
+	requireUsage(t, repo, tenantID, model.Usage{})
+}
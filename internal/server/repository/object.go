@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// StoredObjects returns which of the hashes, keyed by their hex encoding, are the content of a file of the tenant.
+// Their objects are stored already and need not be uploaded again.
+func (repo *File) StoredObjects(ctx context.Context, tenantID string, hashes [][]byte) (_ map[string]bool, err error) {
+	ctx, end := repo.trace(ctx, "stored_objects")
+	defer end(&err)
+
+	rows, err := repo.db.QueryContext(ctx, `SELECT hash FROM objects WHERE tenant_id = $1 AND refcount > 0 AND hash = ANY($2);`,
+		tenantID, pq.ByteaArray(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var hash []byte
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		stored[hex.EncodeToString(hash)] = true
+	}
+	return stored, rows.Err()
+}
+
+// PruneObjects removes the objects no file has referred to since before the given time, and returns their number.
+// Their content is deleted from the storage by the garbage collection.
+func (repo *File) PruneObjects(ctx context.Context, before time.Time) (_ int, err error) {
+	ctx, end := repo.trace(ctx, "prune_objects")
+	defer end(&err)
+
+	res, err := repo.db.ExecContext(ctx, `DELETE FROM objects WHERE refcount = 0 AND updated_at < $1;`, before)
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
+
+// retainObjects counts the references of the newly inserted files to their objects within the transaction.
+// An object no file referred to was stored again by the upload, so it is back in the hot tier.
+func retainObjects(ctx context.Context, tx *sql.Tx, files []*model.FileMetadata) error {
+	type object struct {
+		tenantID string
+		hash     string
+	}
+	refs := make(map[object]int64)
+	sizes := make(map[object]int64)
+	var order []object
+	for _, file := range files {
+		key := object{tenantID: file.TenantID, hash: string(file.Hash)}
+		if refs[key] == 0 {
+			order = append(order, key)
+		}
+		refs[key]++
+		sizes[key] = file.Size
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	tenants := make([]string, len(order))
+	hashes := make([][]byte, len(order))
+	counts := make([]int64, len(order))
+	objectSizes := make([]int64, len(order))
+	for i, key := range order {
+		tenants[i], hashes[i], counts[i], objectSizes[i] = key.tenantID, []byte(key.hash), refs[key], sizes[key]
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO objects (tenant_id, hash, size, refcount)
+		SELECT * FROM unnest($1::text[], $2::bytea[], $3::bigint[], $4::bigint[])
+		ON CONFLICT (tenant_id, hash) DO UPDATE SET refcount = objects.refcount + EXCLUDED.refcount, updated_at = now(),
+			tier = CASE WHEN objects.refcount = 0 THEN 'hot' ELSE objects.tier END;`,
+		pq.StringArray(tenants), pq.ByteaArray(hashes), pq.Int64Array(objectSizes), pq.Int64Array(counts))
+	return err
+}
+
+// releaseObject drops the reference of a deleted file to its object within the transaction.
+func releaseObject(ctx context.Context, tx *sql.Tx, tenantID string, hash []byte) error {
+	_, err := tx.ExecContext(ctx, `UPDATE objects SET refcount = refcount - 1, updated_at = now()
+		WHERE tenant_id = $1 AND hash = $2 AND refcount > 0;`, tenantID, hash)
+	return err
+}
+
+// accessResolution is the precision of the access times of the objects, an object is not recorded as accessed again
+// until that long after its recorded access, so that the downloads of a popular object do not all write to the database.
+const accessResolution = time.Hour
+
+// RecordAccess records that the object of the tenant with the given hash was read.
+func (repo *File) RecordAccess(ctx context.Context, tenantID string, hash []byte) (err error) {
+	ctx, end := repo.trace(ctx, "record_access")
+	defer end(&err)
+
+	_, err = repo.db.ExecContext(ctx, `UPDATE objects SET accessed_at = now()
+		WHERE tenant_id = $1 AND hash = $2 AND (accessed_at IS NULL OR accessed_at < $3);`,
+		tenantID, hash, time.Now().Add(-accessResolution))
+	return err
+}
+
+// TierCandidates returns at most limit objects of the hot tier, the oldest first, that some file refers to and that
+// were created before createdBefore or have not been read since accessedBefore. A zero time disables its condition,
+// an object never read counts as accessed when it was created.
+func (repo *File) TierCandidates(ctx context.Context, createdBefore, accessedBefore time.Time, limit int) (_ []model.ObjectRef, err error) {
+	ctx, end := repo.trace(ctx, "tier_candidates")
+	defer end(&err)
+
+	rows, err := repo.db.QueryContext(ctx, `SELECT tenant_id, hash, size FROM objects
+		WHERE tier = 'hot' AND refcount > 0
+			AND (created_at < $1 OR COALESCE(accessed_at, created_at) < $2)
+		ORDER BY created_at
+		LIMIT $3;`,
+		nullTime(createdBefore), nullTime(accessedBefore), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []model.ObjectRef
+	for rows.Next() {
+		var object model.ObjectRef
+		if err = rows.Scan(&object.TenantID, &object.Hash, &object.Size); err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, rows.Err()
+}
+
+// SetObjectTier records the tier holding the object of the tenant with the given hash.
+func (repo *File) SetObjectTier(ctx context.Context, tenantID string, hash []byte, tier string) (err error) {
+	ctx, end := repo.trace(ctx, "set_object_tier")
+	defer end(&err)
+
+	_, err = repo.db.ExecContext(ctx, `UPDATE objects SET tier = $3 WHERE tenant_id = $1 AND hash = $2;`, tenantID, hash, tier)
+	return err
+}
+
+// nullTime maps the zero time to NULL, which no comparison holds for.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// GetQuota returns the usage of the tenant and its quota, falling back to the defaults for the limits not set for it.
+func (repo *File) GetQuota(ctx context.Context, tenantID string, defaults model.Quota) (_ model.Usage, _ model.Quota, err error) {
+	ctx, end := repo.trace(ctx, "get_quota")
+	defer end(&err)
+
+	tx, err := repo.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return model.Usage{}, model.Quota{}, err
+	}
+	defer tx.Rollback()
+
+	used, quota, err := getQuota(ctx, tx, tenantID, defaults, false)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Usage{}, defaults, nil
+	}
+	return used, quota, err
+}
+
+// SetQuota sets the quota of the tenant, a nil limit falls back to the default one.
+// It returns model.ErrInvalidInput for an empty tenant ID or a negative limit.
+func (repo *File) SetQuota(ctx context.Context, tenantID string, maxBytes, maxObjects *int64) (err error) {
+	ctx, end := repo.trace(ctx, "set_quota")
+	defer end(&err)
+
+	if tenantID == "" {
+		return fmt.Errorf("empty tenant ID: %w", model.ErrInvalidInput)
+	}
+	if (maxBytes != nil && *maxBytes < 0) || (maxObjects != nil && *maxObjects < 0) {
+		return fmt.Errorf("negative quota limit: %w", model.ErrInvalidInput)
+	}
+	_, err = repo.db.ExecContext(ctx, `INSERT INTO tenant_quotas (tenant_id, max_bytes, max_objects) VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id) DO UPDATE SET max_bytes = EXCLUDED.max_bytes, max_objects = EXCLUDED.max_objects;`,
+		tenantID, maxBytes, maxObjects)
+	return err
+}
+
+func getQuota(ctx context.Context, tx *sql.Tx, tenantID string, defaults model.Quota, lock bool) (model.Usage, model.Quota, error) {
+	query := `SELECT used_bytes, used_objects, max_bytes, max_objects FROM tenant_quotas WHERE tenant_id = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+
+	var (
+		used                 model.Usage
+		maxBytes, maxObjects sql.NullInt64
+	)
+	err := tx.QueryRowContext(ctx, query, tenantID).Scan(&used.Bytes, &used.Objects, &maxBytes, &maxObjects)
+	if err != nil {
+		return model.Usage{}, model.Quota{}, err
+	}
+
+	quota := defaults
+	if maxBytes.Valid {
+		quota.MaxBytes = maxBytes.Int64
+	}
+	if maxObjects.Valid {
+		quota.MaxObjects = maxObjects.Int64
+	}
+	return used, quota, nil
+}
+
+// reserveQuota adds the requested usage to the usage of the tenant if it stays within the tenant's quota,
+// otherwise it returns a *model.QuotaError. The limits that are not set for the tenant fall back to the defaults.
+func reserveQuota(ctx context.Context, tx *sql.Tx, tenantID string, requested model.Usage, defaults model.Quota) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO tenant_quotas (tenant_id) VALUES ($1) ON CONFLICT (tenant_id) DO NOTHING;`, tenantID)
+	if err != nil {
+		return err
+	}
+
+	used, quota, err := getQuota(ctx, tx, tenantID, defaults, true)
+	if err != nil {
+		return err
+	}
+	if err = quota.Check(used, requested); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tenant_quotas SET used_bytes = used_bytes + $2, used_objects = used_objects + $3
+		WHERE tenant_id = $1;`, tenantID, requested.Bytes, requested.Objects)
+	return err
+}
+
+func releaseQuota(ctx context.Context, db execer, tenantID string, usage model.Usage) error {
+	_, err := db.ExecContext(ctx, `UPDATE tenant_quotas
+		SET used_bytes = GREATEST(used_bytes - $2, 0), used_objects = GREATEST(used_objects - $3, 0)
+		WHERE tenant_id = $1;`, tenantID, usage.Bytes, usage.Objects)
+	return err
+}
@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestSetQuotaInvalid(t *testing.T) {
+	negative, limit := int64(-1), int64(10)
+	tests := []struct {
+		name       string
+		tenantID   string
+		maxBytes   *int64
+		maxObjects *int64
+	}{
+		{name: "Empty tenant ID", maxBytes: &limit},
+		{name: "Negative bytes", tenantID: "acme", maxBytes: &negative, maxObjects: &limit},
+		{name: "Negative objects", tenantID: "acme", maxObjects: &negative},
+	}
+
+	// the input is rejected before the database is queried
+	repo := NewFile(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := repo.SetQuota(context.Background(), tt.tenantID, tt.maxBytes, tt.maxObjects)
+			require.ErrorIs(t, err, model.ErrInvalidInput)
+		})
+	}
+}
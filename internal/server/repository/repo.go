@@ -3,30 +3,78 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
+	"github.com/zale144/fileserver/internal/server/metrics"
 	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/tracing"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type File struct {
-	db *sql.DB
+	db      *sql.DB
+	metrics *metrics.Metrics
 }
 
-func NewFile(db *sql.DB) *File {
-	return &File{
+// Option configures optional dependencies of the repository.
+type Option func(*File)
+
+// WithMetrics makes the repository record the latency of its operations.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(repo *File) {
+		repo.metrics = m
+	}
+}
+
+func NewFile(db *sql.DB, opts ...Option) *File {
+	repo := &File{
 		db: db,
 	}
+	for _, opt := range opts {
+		opt(repo)
+	}
+	return repo
 }
 
-func (repo *File) Get(index int) (*model.FileMetadata, error) {
-	query := `SELECT index, hash, merkle_proof FROM file_metadata WHERE index = $1;`
-	row := repo.db.QueryRow(query, index)
+var tracer = otel.Tracer("github.com/zale144/fileserver/internal/server/repository")
+
+// trace starts the span of the operation, the returned function ends it and records the latency of the operation.
+// A missing file, a conflicting one, an exceeded quota or an invalid input is not an error of the database.
+func (repo *File) trace(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	ctx, span := tracer.Start(ctx, "repository."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL))
+	start := time.Now()
+	return ctx, func(err *error) {
+		opErr := *err
+		if errors.Is(opErr, model.ErrNotFound) || errors.Is(opErr, model.ErrConflict) || errors.Is(opErr, model.ErrQuotaExceeded) ||
+			errors.Is(opErr, model.ErrInvalidInput) {
+			opErr = nil
+		}
+		repo.metrics.ObserveRepository(operation, start, opErr)
+		tracing.End(span, &opErr)
+	}
+}
+
+func (repo *File) Get(ctx context.Context, tenantID string, index int) (_ *model.FileMetadata, err error) {
+	ctx, end := repo.trace(ctx, "get")
+	defer end(&err)
+
+	query := `SELECT tenant_id, index, hash, merkle_proof, size FROM file_metadata WHERE tenant_id = $1 AND index = $2;`
+	row := repo.db.QueryRowContext(ctx, query, tenantID, index)
 
 	var metadata model.FileMetadata
-	err := row.Scan(&metadata.Index, &metadata.Hash, &metadata.MerkleProof)
+	err = row.Scan(&metadata.TenantID, &metadata.Index, &metadata.Hash, &metadata.MerkleProof, &metadata.Size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("file %d: %w", index, model.ErrNotFound)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -34,30 +82,132 @@ func (repo *File) Get(index int) (*model.FileMetadata, error) {
 	return &metadata, nil
 }
 
-const batchSize = 100
+// List returns the metadata of the files with indexes in the [from, to] range, ordered by index.
+// A negative to means there is no upper bound.
+func (repo *File) List(ctx context.Context, tenantID string, from, to int) (_ []*model.FileMetadata, err error) {
+	ctx, end := repo.trace(ctx, "list")
+	defer end(&err)
+
+	query := `SELECT tenant_id, index, hash, merkle_proof, size FROM file_metadata 
+		WHERE tenant_id = $1 AND index >= $2 AND ($3 < 0 OR index <= $3) ORDER BY index;`
+	rows, err := repo.db.QueryContext(ctx, query, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return scanMetadata(rows)
+}
+
+// GetMultiple returns the metadata of the files with the given indexes, ordered by index.
+func (repo *File) GetMultiple(ctx context.Context, tenantID string, indexes []int) (_ []*model.FileMetadata, err error) {
+	ctx, end := repo.trace(ctx, "get_multiple")
+	defer end(&err)
+
+	ids := make([]int64, len(indexes))
+	for i, index := range indexes {
+		ids[i] = int64(index)
+	}
+
+	query := `SELECT tenant_id, index, hash, merkle_proof, size FROM file_metadata 
+		WHERE tenant_id = $1 AND index = ANY($2) ORDER BY index;`
+	rows, err := repo.db.QueryContext(ctx, query, tenantID, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	return scanMetadata(rows)
+}
+
+// ListTenants returns the IDs of the tenants owning at least one file.
+func (repo *File) ListTenants(ctx context.Context) (_ []string, err error) {
+	ctx, end := repo.trace(ctx, "list_tenants")
+	defer end(&err)
+
+	rows, err := repo.db.QueryContext(ctx, `SELECT DISTINCT tenant_id FROM file_metadata ORDER BY tenant_id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []string
+	for rows.Next() {
+		var tenantID string
+		if err = rows.Scan(&tenantID); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenantID)
+	}
+	return tenants, rows.Err()
+}
+
+func scanMetadata(rows *sql.Rows) ([]*model.FileMetadata, error) {
+	defer rows.Close()
+
+	var result []*model.FileMetadata
+	for rows.Next() {
+		var metadata model.FileMetadata
+		if err := rows.Scan(&metadata.TenantID, &metadata.Index, &metadata.Hash, &metadata.MerkleProof, &metadata.Size); err != nil {
+			return nil, err
+		}
+		result = append(result, &metadata)
+	}
+	return result, rows.Err()
+}
+
+// Delete removes the metadata of the file, releases its share of the tenant's quota and drops its reference
+// to the stored object. The object is left untouched, the garbage collection deletes it once no file refers to it.
+func (repo *File) Delete(ctx context.Context, tenantID string, index int) (err error) {
+	ctx, end := repo.trace(ctx, "delete")
+	defer end(&err)
 
-func (repo *File) PutMultiple(ctx context.Context, md <-chan *model.FileMetadata) error {
 	tx, err := repo.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	values := make([]interface{}, 0, batchSize*3) // 3 fields per record
+	var (
+		hash []byte
+		size int64
+	)
+	err = tx.QueryRowContext(ctx, `DELETE FROM file_metadata WHERE tenant_id = $1 AND index = $2 RETURNING hash, size;`,
+		tenantID, index).Scan(&hash, &size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("file %d: %w", index, model.ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if err = releaseQuota(ctx, tx, tenantID, model.Usage{Bytes: size, Objects: 1}); err != nil {
+		return err
+	}
+	if err = releaseObject(ctx, tx, tenantID, hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const batchSize = 100
+
+// insertMetadata inserts the metadata of the files in batches within the transaction,
+// it returns the ones that were not stored already.
+func insertMetadata(ctx context.Context, tx *sql.Tx, files []*model.FileMetadata) ([]*model.FileMetadata, error) {
+	values := make([]interface{}, 0, batchSize*5) // 5 fields per record
 	valueStrings := make([]string, 0, batchSize)
 
+	var inserted []*model.FileMetadata
 	count := 0
-	for metadata := range md {
-		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d, $%d)", count*3+1, count*3+2, count*3+3))
+	for _, metadata := range files {
+		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)",
+			count*5+1, count*5+2, count*5+3, count*5+4, count*5+5))
 		merkleProofArray := byteSlicesToByteaArray(metadata.MerkleProof)
-		values = append(values, metadata.Index, metadata.Hash, pq.Array(merkleProofArray))
+		values = append(values, metadata.TenantID, metadata.Index, metadata.Hash, pq.Array(merkleProofArray), metadata.Size)
 		count++
 
 		if count >= batchSize {
-			err = executeBatchInsert(ctx, tx, values, valueStrings)
+			batch, err := executeBatchInsert(ctx, tx, values, valueStrings)
 			if err != nil {
-				return err
+				return nil, err
 			}
+			inserted = append(inserted, batch...)
 			values = values[:0]
 			valueStrings = valueStrings[:0]
 			count = 0
@@ -65,20 +215,55 @@ func (repo *File) PutMultiple(ctx context.Context, md <-chan *model.FileMetadata
 	}
 
 	if count > 0 {
-		err = executeBatchInsert(ctx, tx, values, valueStrings)
+		batch, err := executeBatchInsert(ctx, tx, values, valueStrings)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		inserted = append(inserted, batch...)
 	}
-
-	return tx.Commit()
+	return inserted, nil
 }
 
-func executeBatchInsert(ctx context.Context, tx *sql.Tx, values []interface{}, valueStrings []string) error {
-	stmt := fmt.Sprintf(`INSERT INTO file_metadata (index, hash, merkle_proof) 
-		VALUES %s ON CONFLICT (index) DO NOTHING;`, strings.Join(valueStrings, ","))
-	_, err := tx.ExecContext(ctx, stmt, values...)
-	return err
+// executeBatchInsert inserts the batch of metadata, a file already stored at the same index with the same hash and proof
+// is left as is, but one with a different hash or proof, i.e. uploaded as part of a different set of files, is a conflict.
+// It returns the files that were actually inserted.
+func executeBatchInsert(ctx context.Context, tx *sql.Tx, values []interface{}, valueStrings []string) ([]*model.FileMetadata, error) {
+	// xmax is zero for the rows the statement inserted, and set for the existing ones it left as they were
+	stmt := fmt.Sprintf(`INSERT INTO file_metadata (tenant_id, index, hash, merkle_proof, size) 
+		VALUES %s ON CONFLICT (tenant_id, index) DO UPDATE SET hash = file_metadata.hash
+		WHERE file_metadata.hash = EXCLUDED.hash AND file_metadata.merkle_proof = EXCLUDED.merkle_proof
+		RETURNING tenant_id, index, hash, size, xmax = 0;`, strings.Join(valueStrings, ","))
+	rows, err := tx.QueryContext(ctx, stmt, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		affected int
+		inserted []*model.FileMetadata
+	)
+	for rows.Next() {
+		var (
+			metadata model.FileMetadata
+			isNew    bool
+		)
+		if err = rows.Scan(&metadata.TenantID, &metadata.Index, &metadata.Hash, &metadata.Size, &isNew); err != nil {
+			return nil, err
+		}
+		affected++
+		if isNew {
+			inserted = append(inserted, &metadata)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if affected < len(valueStrings) {
+		return nil, fmt.Errorf("%d of %d files already stored with a different content or proof: %w",
+			len(valueStrings)-affected, len(valueStrings), model.ErrConflict)
+	}
+	return inserted, nil
 }
 
 func byteSlicesToByteaArray(byteSlices [][]byte) [][]byte {
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// BeginScrub records the start of the scrub run, the ID and start time of the run are set on the report.
+func (repo *File) BeginScrub(ctx context.Context, report *model.ScrubReport) (err error) {
+	ctx, end := repo.trace(ctx, "begin_scrub")
+	defer end(&err)
+
+	tenantID := sql.NullString{String: report.TenantID, Valid: report.TenantID != ""}
+	return repo.db.QueryRowContext(ctx, `INSERT INTO scrub_runs (tenant_id) VALUES ($1) RETURNING id, started_at;`,
+		tenantID).Scan(&report.ID, &report.StartedAt)
+}
+
+// RecordScrub records the outcome of scrubbing the file and when it was scrubbed.
+func (repo *File) RecordScrub(ctx context.Context, fileMD *model.FileMetadata, status model.ScrubStatus) (err error) {
+	ctx, end := repo.trace(ctx, "record_scrub")
+	defer end(&err)
+
+	_, err = repo.db.ExecContext(ctx, `UPDATE file_metadata SET scrub_status = $3, scrubbed_at = now()
+		WHERE tenant_id = $1 AND index = $2;`, fileMD.TenantID, fileMD.Index, status)
+	return err
+}
+
+// FinishScrub records the results of the scrub run, along with the error that stopped it if any.
+func (repo *File) FinishScrub(ctx context.Context, report *model.ScrubReport, runErr error) (err error) {
+	ctx, end := repo.trace(ctx, "finish_scrub")
+	defer end(&err)
+
+	var reason sql.NullString
+	if runErr != nil {
+		reason = sql.NullString{String: runErr.Error(), Valid: true}
+	}
+	_, err = repo.db.ExecContext(ctx, `UPDATE scrub_runs
+		SET finished_at = $2, checked = $3, missing = $4, corrupted = $5, invalid_proof = $6, errors = $7, error = $8,
+			repaired_shards = $9
+		WHERE id = $1;`,
+		report.ID, report.FinishedAt, report.Checked, report.Count(model.ScrubMissing), report.Count(model.ScrubCorrupted),
+		report.Count(model.ScrubInvalidProof), report.Errors, reason, report.RepairedShards)
+	return err
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// SaveCodedObject records the layout of the erasure-coded object and its shards, replacing the ones recorded already.
+func (repo *File) SaveCodedObject(ctx context.Context, object *model.CodedObject) (err error) {
+	ctx, end := repo.trace(ctx, "save_coded_object")
+	defer end(&err)
+
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO coded_objects (key, size, data_shards, parity_shards, block_size)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (key) DO UPDATE SET size = EXCLUDED.size, data_shards = EXCLUDED.data_shards,
+			parity_shards = EXCLUDED.parity_shards, block_size = EXCLUDED.block_size, updated_at = now()
+		RETURNING updated_at;`,
+		object.Key, object.Size, object.DataShards, object.ParityShards, object.BlockSize).Scan(&object.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM object_shards WHERE object_key = $1;`, object.Key); err != nil {
+		return err
+	}
+
+	indexes := make([]int64, len(object.Shards))
+	locations := make([]int64, len(object.Shards))
+	sizes := make([]int64, len(object.Shards))
+	hashes := make([][]byte, len(object.Shards))
+	for i, shard := range object.Shards {
+		indexes[i], locations[i], sizes[i], hashes[i] = int64(shard.Index), int64(shard.Location), shard.Size, shard.Hash
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO object_shards (object_key, shard, location, size, hash)
+		SELECT $1, * FROM unnest($2::int[], $3::int[], $4::bigint[], $5::bytea[]);`,
+		object.Key, pq.Int64Array(indexes), pq.Int64Array(locations), pq.Int64Array(sizes), pq.ByteaArray(hashes))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetCodedObject returns the layout of the erasure-coded object and its shards, ordered by their index.
+func (repo *File) GetCodedObject(ctx context.Context, key string) (_ *model.CodedObject, err error) {
+	ctx, end := repo.trace(ctx, "get_coded_object")
+	defer end(&err)
+
+	object := &model.CodedObject{Key: key}
+	err = repo.db.QueryRowContext(ctx, `SELECT size, data_shards, parity_shards, block_size, updated_at
+		FROM coded_objects WHERE key = $1;`, key).
+		Scan(&object.Size, &object.DataShards, &object.ParityShards, &object.BlockSize, &object.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("object %s: %w", key, model.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := repo.db.QueryContext(ctx, `SELECT shard, location, size, hash FROM object_shards
+		WHERE object_key = $1 ORDER BY shard;`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var shard model.Shard
+		if err = rows.Scan(&shard.Index, &shard.Location, &shard.Size, &shard.Hash); err != nil {
+			return nil, err
+		}
+		object.Shards = append(object.Shards, shard)
+	}
+	return object, rows.Err()
+}
+
+// DeleteCodedObjects removes the layouts of the erasure-coded objects and their shards, the ones that are not
+// recorded are ignored.
+func (repo *File) DeleteCodedObjects(ctx context.Context, keys []string) (err error) {
+	ctx, end := repo.trace(ctx, "delete_coded_objects")
+	defer end(&err)
+
+	_, err = repo.db.ExecContext(ctx, `DELETE FROM coded_objects WHERE key = ANY($1);`, pq.StringArray(keys))
+	return err
+}
@@ -0,0 +1,251 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// BeginUpload reserves the quota of the upload and records it as pending, along with its root, in the same transaction.
+// The ID of the recorded upload is set on it.
+func (repo *File) BeginUpload(ctx context.Context, upload *model.Upload, defaults model.Quota) (err error) {
+	ctx, end := repo.trace(ctx, "begin_upload")
+	defer end(&err)
+
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = reserveQuota(ctx, tx, upload.TenantID, upload.Usage, defaults); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `INSERT INTO uploads (tenant_id, state, hashes, root, bytes, objects)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at;`,
+		upload.TenantID, model.UploadPending, pq.ByteaArray(upload.Hashes), upload.Root, upload.Usage.Bytes, upload.Usage.Objects).
+		Scan(&upload.ID, &upload.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	upload.State = model.UploadPending
+	return nil
+}
+
+// CommitUpload inserts the metadata of the uploaded files, counts their references to the stored objects
+// and marks the upload committed in the same transaction, so that either all the files of the upload become visible
+// or none does. Only a pending upload can be committed. The quota reserved for the files that were already stored
+// is released, as they are not stored again.
+func (repo *File) CommitUpload(ctx context.Context, upload *model.Upload, files []*model.FileMetadata) (err error) {
+	ctx, end := repo.trace(ctx, "commit_upload")
+	defer end(&err)
+
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = setUploadState(ctx, tx, upload.ID, model.UploadCommitted, nil); err != nil {
+		return err
+	}
+	inserted, err := insertMetadata(ctx, tx, files)
+	if err != nil {
+		return err
+	}
+	if err = retainObjects(ctx, tx, inserted); err != nil {
+		return err
+	}
+	if skipped := skippedUsage(files, inserted); skipped.Objects > 0 {
+		if err = releaseQuota(ctx, tx, upload.TenantID, skipped); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	upload.State = model.UploadCommitted
+	return nil
+}
+
+// skippedUsage returns the usage of the files that were not inserted, because they were stored already.
+func skippedUsage(files, inserted []*model.FileMetadata) model.Usage {
+	skipped := model.Usage{Objects: int64(len(files) - len(inserted))}
+	for _, file := range files {
+		skipped.Bytes += file.Size
+	}
+	for _, file := range inserted {
+		skipped.Bytes -= file.Size
+	}
+	return skipped
+}
+
+// FailUpload marks the pending upload failed for the given cause and releases its reserved quota in the same transaction.
+// An upload that is not pending anymore is left as is, so that its quota is never released twice.
+func (repo *File) FailUpload(ctx context.Context, upload *model.Upload, cause error) (err error) {
+	ctx, end := repo.trace(ctx, "fail_upload")
+	defer end(&err)
+
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	reason := cause.Error()
+	err = setUploadState(ctx, tx, upload.ID, model.UploadFailed, &reason)
+	if errors.Is(err, model.ErrConflict) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = releaseQuota(ctx, tx, upload.TenantID, upload.Usage); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	upload.State = model.UploadFailed
+	return nil
+}
+
+// setUploadState moves the upload from pending to the given state,
+// it returns model.ErrConflict if the upload is not pending.
+func setUploadState(ctx context.Context, tx *sql.Tx, id int64, state model.UploadState, reason *string) error {
+	res, err := tx.ExecContext(ctx, `UPDATE uploads SET state = $2, error = $3, updated_at = now()
+		WHERE id = $1 AND state = $4;`, id, state, reason, model.UploadPending)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("upload %d is not %s: %w", id, model.UploadPending, model.ErrConflict)
+	}
+	return nil
+}
+
+// Root returns the Merkle root recorded by the last committed upload of the tenant,
+// it returns model.ErrNotFound if none recorded one.
+func (repo *File) Root(ctx context.Context, tenantID string) (_ []byte, err error) {
+	ctx, end := repo.trace(ctx, "root")
+	defer end(&err)
+
+	var root []byte
+	err = repo.db.QueryRowContext(ctx, `SELECT root FROM uploads WHERE tenant_id = $1 AND state = $2 AND root IS NOT NULL
+		ORDER BY id DESC LIMIT 1;`, tenantID, model.UploadCommitted).Scan(&root)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("root of tenant %s: %w", tenantID, model.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// HashesInUse returns which of the hashes, keyed by their hex encoding, the files of the tenant
+// or its other pending uploads refer to. The objects of those hashes must not be deleted.
+func (repo *File) HashesInUse(ctx context.Context, tenantID string, hashes [][]byte, uploadID int64) (_ map[string]bool, err error) {
+	ctx, end := repo.trace(ctx, "hashes_in_use")
+	defer end(&err)
+
+	rows, err := repo.db.QueryContext(ctx, `SELECT hash FROM objects WHERE tenant_id = $1 AND refcount > 0 AND hash = ANY($2)
+		UNION
+		SELECT hash FROM uploads, unnest(uploads.hashes) AS hash
+		WHERE tenant_id = $1 AND state = $3 AND id <> $4 AND hash = ANY($2);`,
+		tenantID, pq.ByteaArray(hashes), model.UploadPending, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inUse := make(map[string]bool)
+	for rows.Next() {
+		var hash []byte
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		inUse[hex.EncodeToString(hash)] = true
+	}
+	return inUse, rows.Err()
+}
+
+// ReferencedKeys returns the object keys the files refer to, along with the ones of the uploads pending since pendingSince.
+func (repo *File) ReferencedKeys(ctx context.Context, pendingSince time.Time) (_ map[string]bool, err error) {
+	ctx, end := repo.trace(ctx, "referenced_keys")
+	defer end(&err)
+
+	rows, err := repo.db.QueryContext(ctx, `SELECT tenant_id, hash FROM objects WHERE refcount > 0
+		UNION
+		SELECT tenant_id, unnest(hashes) FROM uploads WHERE state = $1 AND created_at >= $2;`,
+		model.UploadPending, pendingSince)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var (
+			tenantID string
+			hash     []byte
+		)
+		if err = rows.Scan(&tenantID, &hash); err != nil {
+			return nil, err
+		}
+		keys[model.ObjectKey(tenantID, hash)] = true
+	}
+	return keys, rows.Err()
+}
+
+// FailAbandonedUploads marks failed the uploads pending since before the given time, which were left behind
+// e.g. by a crash of the server, and releases their reserved quota. It returns the number of uploads marked failed.
+func (repo *File) FailAbandonedUploads(ctx context.Context, before time.Time) (_ int, err error) {
+	ctx, end := repo.trace(ctx, "fail_abandoned_uploads")
+	defer end(&err)
+
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `UPDATE uploads SET state = $1, error = 'abandoned', updated_at = now()
+		WHERE state = $2 AND created_at < $3 RETURNING tenant_id, bytes, objects;`,
+		model.UploadFailed, model.UploadPending, before)
+	if err != nil {
+		return 0, err
+	}
+	var abandoned []model.Upload
+	for rows.Next() {
+		var upload model.Upload
+		if err = rows.Scan(&upload.TenantID, &upload.Usage.Bytes, &upload.Usage.Objects); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		abandoned = append(abandoned, upload)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, upload := range abandoned {
+		if err = releaseQuota(ctx, tx, upload.TenantID, upload.Usage); err != nil {
+			return 0, err
+		}
+	}
+	return len(abandoned), tx.Commit()
+}
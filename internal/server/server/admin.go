@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/logging"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// ScrubResponse acknowledges a scrub started on demand.
+type ScrubResponse struct {
+	Status   string `json:"status"`
+	TenantID string `json:"tenantId"`
+}
+
+// Scrub starts a scrub of the files of the caller's tenant and responds without waiting for it to finish,
+// its results are recorded in the scrub_runs table and logged. Only one scrub runs at a time.
+func (s *Server) Scrub(w http.ResponseWriter, r *http.Request) {
+	if !s.scrubbing.CompareAndSwap(false, true) {
+		s.writeError(w, r, fmt.Errorf("a scrub is already running: %w", model.ErrConflict))
+		return
+	}
+
+	tenantID := auth.TenantID(r.Context())
+	// the scrub outlives the request until the server shuts down, keeping the logger of the request
+	ctx := logging.WithLogger(s.jobsCtx, s.logger(r.Context()))
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		defer s.scrubbing.Store(false)
+		_, err := s.fileSvc.Scrub(ctx, tenantID, s.scrubRate)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			s.logger(ctx).Info("scrub stopped by the shutdown", zap.String("tenant", tenantID))
+		case err != nil:
+			s.logger(ctx).Error("failed to scrub files", zap.String("tenant", tenantID), zap.Error(err))
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(ScrubResponse{Status: "started", TenantID: tenantID}); err != nil {
+		s.logger(r.Context()).Error("error encoding response", zap.Error(err))
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/model"
+	"go.uber.org/zap"
+)
+
+const (
+	archiveFormatTar = "tar"
+	archiveFormatZip = "zip"
+
+	// ManifestName is the name of the manifest entry, which is always the first entry of an archive.
+	ManifestName = "manifest.json"
+)
+
+// ArchiveManifest describes the files contained in an archive.
+type ArchiveManifest struct {
+	Root  string                 `json:"root"`
+	Files []ArchiveManifestEntry `json:"files"`
+}
+
+// ArchiveManifestEntry holds the hash and the Merkle proof of a single archived file.
+type ArchiveManifestEntry struct {
+	Index int      `json:"index"`
+	Name  string   `json:"name"`
+	Hash  string   `json:"hash"`
+	Proof []string `json:"proof"`
+}
+
+type ArchiveRequest struct {
+	Indexes []int `json:"indexes"`
+}
+
+// archiveWriter abstracts over the tar and zip writers.
+type archiveWriter interface {
+	// WriteFile writes the entry of the file of the given size, reading its content from r.
+	WriteFile(name string, size int64, r io.Reader) error
+	Close() error
+}
+
+// DownloadArchive streams the files with indexes in the optional [from, to] range as a tar or zip archive.
+func (s *Server) DownloadArchive(w http.ResponseWriter, r *http.Request) {
+	from, err := queryInt(r, "from", 0)
+	if err != nil || from < 0 {
+		s.writeError(w, r, invalidInput("invalid from %q", r.URL.Query().Get("from")))
+		return
+	}
+	to, err := queryInt(r, "to", -1)
+	if err != nil || (to >= 0 && to < from) {
+		s.writeError(w, r, invalidInput("invalid to %q", r.URL.Query().Get("to")))
+		return
+	}
+
+	files, err := s.fileSvc.List(r.Context(), from, to)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.writeArchive(w, r, files)
+}
+
+// DownloadArchiveIndexes streams the files with the indexes listed in the request body as a tar or zip archive.
+func (s *Server) DownloadArchiveIndexes(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req ArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, r, invalidInput("invalid request body: %v", err))
+		return
+	}
+	if len(req.Indexes) == 0 {
+		s.writeError(w, r, invalidInput("no indexes requested"))
+		return
+	}
+
+	files, err := s.fileSvc.GetMetadata(r.Context(), req.Indexes)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.writeArchive(w, r, files)
+}
+
+func (s *Server) writeArchive(w http.ResponseWriter, r *http.Request, files []*model.FileMetadata) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = archiveFormatTar
+	}
+	if format != archiveFormatTar && format != archiveFormatZip {
+		s.writeError(w, r, invalidInput("unknown archive format %q", format))
+		return
+	}
+
+	if len(files) == 0 {
+		s.writeError(w, r, fmt.Errorf("no files to archive: %w", model.ErrNotFound))
+		return
+	}
+
+	manifest, err := json.Marshal(newArchiveManifest(files))
+	if err != nil {
+		s.writeError(w, r, fmt.Errorf("failed to encode manifest: %w", err))
+		return
+	}
+
+	// the archive may take much longer to stream than the server write timeout allows
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	var aw archiveWriter
+	switch format {
+	case archiveFormatZip:
+		w.Header().Set("Content-Type", "application/zip")
+		aw = &zipArchiveWriter{zw: zip.NewWriter(w)}
+	default:
+		w.Header().Set("Content-Type", "application/x-tar")
+		aw = &tarArchiveWriter{tw: tar.NewWriter(w)}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="files.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+
+	// once the status is written errors can only be reported by aborting the stream
+	if err = aw.WriteFile(ManifestName, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		s.logger(r.Context()).Error("error writing manifest to archive", zap.Error(err))
+		return
+	}
+
+	for _, fileMD := range files {
+		if err = s.archiveFile(r.Context(), aw, fileMD); err != nil {
+			s.logger(r.Context()).Error("error writing file to archive", zap.Int("index", fileMD.Index), zap.Error(err))
+			return
+		}
+	}
+
+	if err = aw.Close(); err != nil {
+		s.logger(r.Context()).Error("error closing archive", zap.Error(err))
+	}
+}
+
+// archiveFile streams the content of the file from the storage to its entry.
+func (s *Server) archiveFile(ctx context.Context, aw archiveWriter, fileMD *model.FileMetadata) error {
+	file, err := s.fileSvc.Open(ctx, fileMD)
+	if err != nil {
+		return err
+	}
+	defer file.Content.Close()
+	return aw.WriteFile(strconv.Itoa(fileMD.Index), fileMD.Size, file.Content)
+}
+
+func newArchiveManifest(files []*model.FileMetadata) *ArchiveManifest {
+	manifest := &ArchiveManifest{
+		Files: make([]ArchiveManifestEntry, len(files)),
+	}
+	for i, fileMD := range files {
+		proof := make([]string, len(fileMD.MerkleProof))
+		for j, p := range fileMD.MerkleProof {
+			proof[j] = fmt.Sprintf("%x", p)
+		}
+		manifest.Files[i] = ArchiveManifestEntry{
+			Index: fileMD.Index,
+			Name:  strconv.Itoa(fileMD.Index),
+			Hash:  fmt.Sprintf("%x", fileMD.Hash),
+			Proof: proof,
+		}
+	}
+	// every proof leads to the same root, so any of the files can be used to derive it
+	first := files[0]
+	manifest.Root = fmt.Sprintf("%x", merkle.RootFromProof(first.Index, first.Hash, first.MerkleProof))
+	return manifest
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int(i), nil
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+}
+
+func (a *tarArchiveWriter) WriteFile(name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	return a.tw.Close()
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) WriteFile(name string, _ int64, r io.Reader) error {
+	fw, err := a.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+// Interface assertions.
+var (
+	_ http.HandlerFunc = (*Server)(nil).DownloadArchive
+	_ http.HandlerFunc = (*Server)(nil).DownloadArchiveIndexes
+)
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/service"
+	"go.uber.org/zap"
+)
+
+func TestDownloadArchive(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		query          string
+		body           string
+		wantIndexes    []int
+		wantStatusCode int
+	}{
+		{
+			name:           "All files as tar",
+			method:         http.MethodGet,
+			wantIndexes:    []int{0, 1, 2, 3, 4},
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Range as tar",
+			method:         http.MethodGet,
+			query:          "from=1&to=3",
+			wantIndexes:    []int{1, 2, 3},
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Range as zip",
+			method:         http.MethodGet,
+			query:          "from=2&format=zip",
+			wantIndexes:    []int{2, 3, 4},
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Indexes as tar",
+			method:         http.MethodPost,
+			body:           `{"indexes":[4,0]}`,
+			wantIndexes:    []int{0, 4},
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Indexes as zip",
+			method:         http.MethodPost,
+			query:          "format=zip",
+			body:           `{"indexes":[3]}`,
+			wantIndexes:    []int{3},
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Invalid range",
+			method:         http.MethodGet,
+			query:          "from=3&to=1",
+			wantStatusCode: http.StatusBadRequest,
+		}, {
+			name:           "Invalid format",
+			method:         http.MethodGet,
+			query:          "format=rar",
+			wantStatusCode: http.StatusBadRequest,
+		}, {
+			name:           "Empty indexes",
+			method:         http.MethodPost,
+			body:           `{"indexes":[]}`,
+			wantStatusCode: http.StatusBadRequest,
+		}, {
+			name:           "Range not found",
+			method:         http.MethodGet,
+			query:          "from=10",
+			wantStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+			root := saveTestFiles(t, fileSvc, 5)
+
+			req := httptest.NewRequest(tt.method, "/files/archive?"+tt.query, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			Router(&Server{Dependencies: &Dependencies{fileSvc: fileSvc, log: zap.NewNop()}}).ServeHTTP(rr, req)
+
+			require.Equal(t, tt.wantStatusCode, rr.Code)
+			if tt.wantStatusCode != http.StatusOK {
+				return
+			}
+
+			var entries map[string][]byte
+			if strings.Contains(tt.query, "format=zip") {
+				require.Equal(t, "application/zip", rr.Header().Get("Content-Type"))
+				entries = readZip(t, rr.Body.Bytes())
+			} else {
+				require.Equal(t, "application/x-tar", rr.Header().Get("Content-Type"))
+				entries = readTar(t, rr.Body)
+			}
+
+			manifest := new(ArchiveManifest)
+			require.NoError(t, json.Unmarshal(entries[ManifestName], manifest))
+			require.Equal(t, fmt.Sprintf("%x", root), manifest.Root)
+			require.Len(t, manifest.Files, len(tt.wantIndexes))
+			require.Len(t, entries, len(tt.wantIndexes)+1)
+
+			for i, entry := range manifest.Files {
+				require.Equal(t, tt.wantIndexes[i], entry.Index)
+				data, ok := entries[entry.Name]
+				require.True(t, ok)
+				require.Equal(t, fmt.Sprintf("test%d", entry.Index), string(data))
+
+				proof := make([][]byte, len(entry.Proof))
+				for j, p := range entry.Proof {
+					proof[j], _ = hex.DecodeString(p)
+				}
+				require.True(t, merkle.VerifyProof(entry.Index, merkle.HashData(data), proof, root))
+			}
+		})
+	}
+}
+
+func saveTestFiles(t *testing.T, fileSvc *service.File, numFiles int) []byte {
+	data := make([][]byte, numFiles)
+	for i := range data {
+		data[i] = []byte(fmt.Sprintf("test%d", i))
+	}
+	saveFiles(t, fileSvc, data)
+	return merkle.NewTree(data).Root.Hash
+}
+
+func saveFiles(t *testing.T, fileSvc *service.File, data [][]byte) [][]byte {
+	return saveTenantFiles(t, context.Background(), fileSvc, data)
+}
+
+func saveTenantFiles(t *testing.T, ctx context.Context, fileSvc *service.File, data [][]byte) [][]byte {
+	inCh := make(chan *model.IndexedFileInput)
+	go func() {
+		defer close(inCh)
+		for i, d := range data {
+			inCh <- fileInput(i, d)
+		}
+	}()
+	_, err := fileSvc.SaveStream(ctx, inCh)
+	require.NoError(t, err)
+	return data
+}
+
+func readTar(t *testing.T, r io.Reader) map[string][]byte {
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	first := true
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if first {
+			require.Equal(t, ManifestName, hdr.Name)
+			first = false
+		}
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		entries[hdr.Name] = data
+	}
+	return entries
+}
+
+func readZip(t *testing.T, b []byte) map[string][]byte {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	require.NoError(t, err)
+	require.NotEmpty(t, zr.File)
+	require.Equal(t, ManifestName, zr.File[0].Name)
+
+	entries := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		_ = rc.Close()
+		entries[f.Name] = data
+	}
+	return entries
+}
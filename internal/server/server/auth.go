@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+type authenticator interface {
+	Authenticate(ctx context.Context, creds auth.Credentials) (*auth.Identity, error)
+}
+
+// Authenticate is the middleware resolving the caller's identity, which scopes all the file operations to its tenant.
+func (s *Server) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creds := auth.Credentials{
+			APIKey:      r.Header.Get(apiKeyHeader),
+			BearerToken: bearerToken(r.Header.Get("Authorization")),
+		}
+
+		identity, err := identify(r.Context(), s.authn, creds)
+		if err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+
+		ctx := setLogIdentity(auth.WithIdentity(r.Context(), identity), s.log, identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *GRPCServer) unaryAuthInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticateContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) streamAuthInterceptor(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticateContext(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+func (s *GRPCServer) authenticateContext(ctx context.Context) (context.Context, error) {
+	var creds auth.Credentials
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(strings.ToLower(apiKeyHeader)); len(values) > 0 {
+			creds.APIKey = values[0]
+		}
+		if values := md.Get("authorization"); len(values) > 0 {
+			creds.BearerToken = bearerToken(values[0])
+		}
+	}
+
+	identity, err := identify(ctx, s.authn, creds)
+	if err != nil {
+		if errors.Is(err, auth.ErrUnauthenticated) {
+			return nil, status.Error(codes.Unauthenticated, "unauthenticated")
+		}
+		s.logger(ctx).Error("error authenticating request", zap.Error(err))
+		return nil, status.Error(codes.Internal, "internal server error")
+	}
+	return setLogIdentity(auth.WithIdentity(ctx, identity), s.log, identity), nil
+}
+
+// identify resolves the credentials, every caller belongs to the default tenant if there is no authenticator.
+func identify(ctx context.Context, authn authenticator, creds auth.Credentials) (*auth.Identity, error) {
+	if authn == nil {
+		return &auth.Identity{TenantID: auth.DefaultTenant}, nil
+	}
+	return authn.Authenticate(ctx, creds)
+}
+
+func bearerToken(header string) string {
+	const prefix = "Bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+// contextStream replaces the context of the stream with the one prepared by the interceptors.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
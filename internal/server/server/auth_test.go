@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	fileserverv1 "github.com/zale144/fileserver/api/fileserver/v1"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+type mockAuthenticator map[string]string
+
+func (m mockAuthenticator) Authenticate(_ context.Context, creds auth.Credentials) (*auth.Identity, error) {
+	tenantID, ok := m[creds.APIKey]
+	if !ok {
+		return nil, auth.ErrUnauthenticated
+	}
+	return &auth.Identity{TenantID: tenantID}, nil
+}
+
+func TestTenantIsolation(t *testing.T) {
+	authn := mockAuthenticator{"key-a": "tenant-a", "key-b": "tenant-b"}
+	storageSvc := newMockStorageService(false)
+	fileSvc := service.NewFile(newMockRepositoryService(), storageSvc, zap.NewNop())
+	router := Router(&Server{Dependencies: &Dependencies{fileSvc: fileSvc, authn: authn, log: zap.NewNop()}})
+
+	upload := func(apiKey string, numFiles int) int {
+		req := createFileUploadRequest(t, numFiles)
+		req.URL.Path = "/file"
+		req.Header.Set(apiKeyHeader, apiKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	download := func(apiKey string, index int) int {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/file/%d", index), nil)
+		req.Header.Set(apiKeyHeader, apiKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusUnauthorized, upload("", 1))
+	require.Equal(t, http.StatusUnauthorized, upload("key-c", 1))
+
+	require.Equal(t, http.StatusOK, upload("key-a", 3))
+	require.Equal(t, http.StatusOK, download("key-a", 2))
+	require.Equal(t, http.StatusNotFound, download("key-b", 2))
+	require.Equal(t, http.StatusUnauthorized, download("", 2))
+
+	// the same content uploaded by another tenant is stored under a separate key
+	require.Equal(t, http.StatusOK, upload("key-b", 1))
+	require.Equal(t, http.StatusOK, download("key-b", 0))
+	_, okA := storageSvc.m.Load(fmt.Sprintf("tenant-a/%x", merkle.HashData([]byte("test0"))))
+	_, okB := storageSvc.m.Load(fmt.Sprintf("tenant-b/%x", merkle.HashData([]byte("test0"))))
+	require.True(t, okA)
+	require.True(t, okB)
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	ctxA := auth.WithIdentity(context.Background(), &auth.Identity{TenantID: "tenant-a"})
+	saveTenantFiles(t, ctxA, fileSvc, [][]byte{[]byte("test0")})
+
+	client := newTestGRPCClient(t, fileSvc, WithAuthenticator(mockAuthenticator{"key-a": "tenant-a", "key-b": "tenant-b"}))
+
+	_, err := client.GetProof(context.Background(), &fileserverv1.GetProofRequest{Index: 0})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key-a")
+	_, err = client.GetProof(ctx, &fileserverv1.GetProofRequest{Index: 0})
+	require.NoError(t, err)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key-b")
+	_, err = client.GetProof(ctx, &fileserverv1.GetProofRequest{Index: 0})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err := client.Download(context.Background(), &fileserverv1.DownloadRequest{Index: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestExposedAddresses(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		expected []string
+	}{
+		{
+			name:     "All interfaces",
+			cfg:      Config{Address: ":8080", GRPCAddress: "0.0.0.0:9090"},
+			expected: []string{":8080", "0.0.0.0:9090"},
+		},
+		{
+			name: "Loopback",
+			cfg:  Config{Address: "127.0.0.1:8080", GRPCAddress: "localhost:9090"},
+		},
+		{
+			name:     "IPv6 loopback and a public address",
+			cfg:      Config{Address: "[::1]:8080", GRPCAddress: "10.0.0.1:9090"},
+			expected: []string{"10.0.0.1:9090"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, tt.cfg.ExposedAddresses())
+		})
+	}
+}
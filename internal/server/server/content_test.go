@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestDownloadContent(t *testing.T) {
+	content := "0123456789"
+	tests := []struct {
+		name             string
+		index            int
+		rangeHeader      string
+		wantStatusCode   int
+		wantBody         string
+		wantContentRange string
+		wantProblem      string
+	}{
+		{
+			name:           "Whole file",
+			wantStatusCode: http.StatusOK,
+			wantBody:       content,
+		}, {
+			name:             "Range",
+			rangeHeader:      "bytes=2-4",
+			wantStatusCode:   http.StatusPartialContent,
+			wantBody:         "234",
+			wantContentRange: "bytes 2-4/10",
+		}, {
+			name:             "Open range",
+			rangeHeader:      "bytes=7-",
+			wantStatusCode:   http.StatusPartialContent,
+			wantBody:         "789",
+			wantContentRange: "bytes 7-9/10",
+		}, {
+			name:             "Suffix range",
+			rangeHeader:      "bytes=-4",
+			wantStatusCode:   http.StatusPartialContent,
+			wantBody:         "6789",
+			wantContentRange: "bytes 6-9/10",
+		}, {
+			name:             "Range past the end",
+			rangeHeader:      "bytes=8-20",
+			wantStatusCode:   http.StatusPartialContent,
+			wantBody:         "89",
+			wantContentRange: "bytes 8-9/10",
+		}, {
+			name:             "Range of the whole file",
+			rangeHeader:      "bytes=0-",
+			wantStatusCode:   http.StatusPartialContent,
+			wantBody:         content,
+			wantContentRange: "bytes 0-9/10",
+		}, {
+			name:           "Multiple ranges are ignored",
+			rangeHeader:    "bytes=0-1,4-5",
+			wantStatusCode: http.StatusOK,
+			wantBody:       content,
+		}, {
+			name:           "Malformed range is ignored",
+			rangeHeader:    "bytes=4-2",
+			wantStatusCode: http.StatusOK,
+			wantBody:       content,
+		}, {
+			name:             "Unsatisfiable range",
+			rangeHeader:      "bytes=10-",
+			wantStatusCode:   http.StatusRequestedRangeNotSatisfiable,
+			wantContentRange: "bytes */10",
+			wantProblem:      "range_not_satisfiable",
+		}, {
+			name:           "File not found",
+			index:          99,
+			wantStatusCode: http.StatusNotFound,
+			wantProblem:    "not_found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+			saveFiles(t, fileSvc, [][]byte{[]byte(content)})
+			router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop())))
+
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/file/%d/content", tt.index), nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			require.Equal(t, tt.wantContentRange, rr.Header().Get("Content-Range"))
+			if tt.wantProblem != "" {
+				requireProblem(t, rr, tt.wantStatusCode, tt.wantProblem)
+				return
+			}
+			require.Equal(t, tt.wantStatusCode, rr.Code)
+			require.Equal(t, tt.wantBody, rr.Body.String())
+			require.Equal(t, fmt.Sprint(len(tt.wantBody)), rr.Header().Get("Content-Length"))
+			require.Equal(t, "bytes", rr.Header().Get("Accept-Ranges"))
+			require.Equal(t, fmt.Sprintf(`"%x"`, merkle.HashData([]byte(content))), rr.Header().Get("ETag"))
+		})
+	}
+}
+
+func TestDownloadContentCorrupted(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	storage := newMockStorageService(false)
+	fileSvc := service.NewFile(newMockRepositoryService(), storage, zap.NewNop(), service.WithMetrics(m))
+	saveTestFiles(t, fileSvc, 1)
+	storage.m.Store(model.ObjectKey(auth.DefaultTenant, merkle.HashData([]byte("test0"))), []byte("tset0"))
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop(), WithMetrics(m))))
+
+	// the corruption is only noticed once the content is streamed, which cuts it short of its announced length
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/file/0/content", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "5", rr.Header().Get("Content-Length"))
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP fileserver_integrity_failures_total Number of downloaded objects whose content did not match the hash of their file, by storage backend.
+# TYPE fileserver_integrity_failures_total counter
+fileserver_integrity_failures_total{backend="primary"} 1
+`), "fileserver_integrity_failures_total"))
+
+	// a part of the content cannot be verified
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/file/0/content", nil)
+	req.Header.Set("Range", "bytes=1-2")
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusPartialContent, rr.Code)
+	require.Equal(t, "se", rr.Body.String())
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestDedupResponse(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop(), service.WithMetrics(m))
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop(), WithMetrics(m))))
+
+	upload := func() FileUploadResponse {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, newUploadRequest(t, 3))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var response FileUploadResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+		return response
+	}
+
+	require.Equal(t, FileUploadResponse{Status: "Success", Files: 3, Bytes: 15}, upload())
+	require.Equal(t, FileUploadResponse{Status: "Success", Files: 3, Bytes: 15, DedupFiles: 3, DedupBytes: 15}, upload())
+
+	expected := `
+# HELP fileserver_dedup_bytes_total Number of uploaded bytes not sent to the storage because their content was already stored.
+# TYPE fileserver_dedup_bytes_total counter
+fileserver_dedup_bytes_total 15
+# HELP fileserver_dedup_files_total Number of uploaded files whose content was already stored.
+# TYPE fileserver_dedup_files_total counter
+fileserver_dedup_files_total 3
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"fileserver_dedup_bytes_total", "fileserver_dedup_files_total"))
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+const (
+	// problemContentType is the media type of the error responses.
+	problemContentType = "application/problem+json"
+	// problemTypePrefix prefixes the kind of the error in the type of the problem.
+	problemTypePrefix = "urn:fileserver:problem:"
+)
+
+// Problem is the body of the error responses, in the problem details format of RFC 9457.
+type Problem struct {
+	Type      string        `json:"type"`
+	Title     string        `json:"title"`
+	Status    int           `json:"status"`
+	Detail    string        `json:"detail,omitempty"`
+	Instance  string        `json:"instance,omitempty"`
+	RequestID string        `json:"requestId,omitempty"`
+	Limit     *LimitDetails `json:"limit,omitempty"`
+}
+
+// LimitDetails describes the limit that was hit.
+type LimitDetails struct {
+	Name      string `json:"name"`
+	Max       int64  `json:"max"`
+	Used      int64  `json:"used,omitempty"`
+	Requested int64  `json:"requested,omitempty"`
+}
+
+// problemKind is how a kind of error is reported over HTTP and gRPC.
+type problemKind struct {
+	name   string
+	title  string
+	status int
+	code   codes.Code
+}
+
+var (
+	problemInvalidInput        = problemKind{"invalid_input", "Invalid input", http.StatusBadRequest, codes.InvalidArgument}
+	problemUnauthenticated     = problemKind{"unauthenticated", "Unauthenticated", http.StatusUnauthorized, codes.Unauthenticated}
+	problemForbidden           = problemKind{"forbidden", "Forbidden", http.StatusForbidden, codes.PermissionDenied}
+	problemNotFound            = problemKind{"not_found", "Not found", http.StatusNotFound, codes.NotFound}
+	problemConflict            = problemKind{"conflict", "Conflict", http.StatusConflict, codes.AlreadyExists}
+	problemLimitExceeded       = problemKind{"limit_exceeded", "Limit exceeded", http.StatusRequestEntityTooLarge, codes.ResourceExhausted}
+	problemTooManyRequests     = problemKind{"too_many_requests", "Too many requests", http.StatusTooManyRequests, codes.ResourceExhausted}
+	problemQuotaExceeded       = problemKind{"quota_exceeded", "Quota exceeded", http.StatusInsufficientStorage, codes.ResourceExhausted}
+	problemCanceled            = problemKind{"canceled", "Request canceled", http.StatusRequestTimeout, codes.Canceled}
+	problemUnavailable         = problemKind{"unavailable", "Service unavailable", http.StatusServiceUnavailable, codes.Unavailable}
+	problemRangeNotSatisfiable = problemKind{"range_not_satisfiable", "Range not satisfiable", http.StatusRequestedRangeNotSatisfiable, codes.OutOfRange}
+	problemIntegrity           = problemKind{"integrity_error", "Stored file failed the integrity check", http.StatusInternalServerError, codes.DataLoss}
+	problemInternal            = problemKind{"internal_error", "Internal server error", http.StatusInternalServerError, codes.Internal}
+)
+
+// internal tells whether the error is a failure of the server, whose details are kept from the caller.
+func (k problemKind) internal() bool {
+	return k.status == http.StatusInternalServerError
+}
+
+// errForbidden is returned when the caller's roles do not allow the action.
+var errForbidden = errors.New("forbidden")
+
+// throttleError is returned for the requests rejected by the rate or the concurrency limits.
+type throttleError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *throttleError) Error() string {
+	return e.message
+}
+
+// rangeError is returned when the requested range starts past the end of the file.
+type rangeError struct {
+	size int64
+}
+
+func (e *rangeError) Error() string {
+	return fmt.Sprintf("range not satisfiable for %d bytes", e.size)
+}
+
+// classify maps the error to the kind it is reported as, it is the only place deciding the status of a failed request.
+func classify(err error) problemKind {
+	var limitErr *LimitError
+	var throttleErr *throttleError
+	var rangeErr *rangeError
+	switch {
+	case errors.As(err, &limitErr):
+		return problemLimitExceeded
+	case errors.As(err, &rangeErr):
+		return problemRangeNotSatisfiable
+	case errors.Is(err, model.ErrQuotaExceeded):
+		return problemQuotaExceeded
+	case errors.As(err, &throttleErr):
+		return problemTooManyRequests
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return problemUnauthenticated
+	case errors.Is(err, errForbidden):
+		return problemForbidden
+	case errors.Is(err, model.ErrInvalidInput):
+		return problemInvalidInput
+	case errors.Is(err, model.ErrNotFound):
+		return problemNotFound
+	case errors.Is(err, model.ErrConflict):
+		return problemConflict
+	case errors.Is(err, model.ErrIntegrity):
+		return problemIntegrity
+	case errors.Is(err, model.ErrUnavailable):
+		return problemUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return problemCanceled
+	default:
+		return problemInternal
+	}
+}
+
+// invalidInput describes a malformed request.
+func invalidInput(format string, args ...any) error {
+	return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), model.ErrInvalidInput)
+}
+
+// writeError responds with the problem details of the error.
+// The details of the server errors are only logged, the caller gets the request ID to look them up.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	kind := classify(err)
+	problem := Problem{
+		Type:      problemTypePrefix + kind.name,
+		Title:     kind.title,
+		Status:    kind.status,
+		Instance:  r.URL.Path,
+		RequestID: requestID(r.Context()),
+	}
+	if !kind.internal() {
+		problem.Detail = err.Error()
+	} else {
+		s.logger(r.Context()).Error("request failed",
+			zap.String("route", r.Method+" "+routeTemplate(r)),
+			zap.Error(err))
+	}
+
+	var limitErr *LimitError
+	var quotaErr *model.QuotaError
+	var throttleErr *throttleError
+	var rangeErr *rangeError
+	switch {
+	case errors.As(err, &limitErr):
+		problem.Limit = &LimitDetails{Name: limitErr.Limit, Max: limitErr.Max}
+	case errors.As(err, &quotaErr):
+		problem.Limit = &LimitDetails{
+			Name:      quotaErr.Limit,
+			Max:       quotaErr.Max,
+			Used:      quotaErr.Used,
+			Requested: quotaErr.Requested,
+		}
+	case errors.As(err, &throttleErr):
+		w.Header().Set("Retry-After", retryAfterSeconds(throttleErr.retryAfter))
+	case errors.As(err, &rangeErr):
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", rangeErr.size))
+	case kind == problemUnauthenticated:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fileserver"`)
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(problem.Status)
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		s.logger(r.Context()).Error("error encoding response", zap.Error(err))
+	}
+}
+
+// toStatus converts the error into a gRPC status, hiding the details of the server errors.
+func toStatus(err error) error {
+	kind := classify(err)
+	if kind.internal() {
+		return status.Error(kind.code, kind.title)
+	}
+	return status.Error(kind.code, err.Error())
+}
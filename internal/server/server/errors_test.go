@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantType   string
+		wantStatus int
+		wantCode   codes.Code
+		wantDetail bool
+	}{
+		{
+			name:       "Not found",
+			err:        fmt.Errorf("failed to get file: %w", model.ErrNotFound),
+			wantType:   "not_found",
+			wantStatus: http.StatusNotFound,
+			wantCode:   codes.NotFound,
+			wantDetail: true,
+		}, {
+			name:       "Conflict",
+			err:        fmt.Errorf("failed to save file: %w", model.ErrConflict),
+			wantType:   "conflict",
+			wantStatus: http.StatusConflict,
+			wantCode:   codes.AlreadyExists,
+			wantDetail: true,
+		}, {
+			name:       "Invalid input",
+			err:        invalidInput("invalid index %q", "abc"),
+			wantType:   "invalid_input",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codes.InvalidArgument,
+			wantDetail: true,
+		}, {
+			name:       "Quota exceeded",
+			err:        fmt.Errorf("failed to reserve quota: %w", &model.QuotaError{Limit: "max_bytes", Max: 10}),
+			wantType:   "quota_exceeded",
+			wantStatus: http.StatusInsufficientStorage,
+			wantCode:   codes.ResourceExhausted,
+			wantDetail: true,
+		}, {
+			name:       "Unauthenticated",
+			err:        auth.ErrUnauthenticated,
+			wantType:   "unauthenticated",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   codes.Unauthenticated,
+			wantDetail: true,
+		}, {
+			name:       "Range not satisfiable",
+			err:        &rangeError{size: 5},
+			wantType:   "range_not_satisfiable",
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+			wantCode:   codes.OutOfRange,
+			wantDetail: true,
+		}, {
+			name:       "Integrity failure",
+			err:        fmt.Errorf("file 1: %w", model.ErrIntegrity),
+			wantType:   "integrity_error",
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   codes.DataLoss,
+		}, {
+			name:       "Internal error",
+			err:        errors.New("connection refused"),
+			wantType:   "internal_error",
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   codes.Internal,
+		}, {
+			name:       "Canceled",
+			err:        fmt.Errorf("upload aborted: %w", context.Canceled),
+			wantType:   "canceled",
+			wantStatus: http.StatusRequestTimeout,
+			wantCode:   codes.Canceled,
+			wantDetail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{Dependencies: &Dependencies{log: zap.NewNop()}}
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/file/1", nil)
+			req = req.WithContext(withRequestID(req.Context(), "request-1"))
+			srv.writeError(rr, req, tt.err)
+
+			require.Equal(t, tt.wantStatus, rr.Code)
+			require.Equal(t, problemContentType, rr.Header().Get("Content-Type"))
+			var problem Problem
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&problem))
+			require.Equal(t, problemTypePrefix+tt.wantType, problem.Type)
+			require.Equal(t, tt.wantStatus, problem.Status)
+			require.Equal(t, "request-1", problem.RequestID)
+			if tt.wantDetail {
+				require.Equal(t, tt.err.Error(), problem.Detail)
+			} else {
+				require.Empty(t, problem.Detail, "the details of the server errors must not leak")
+			}
+
+			st := status.Convert(toStatus(tt.err))
+			require.Equal(t, tt.wantCode, st.Code())
+			require.Equal(t, tt.wantDetail, st.Message() == tt.err.Error())
+		})
+	}
+}
+
+func TestUploadOtherSet(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop())))
+	upload := func(numFiles int) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, newUploadRequest(t, numFiles))
+		return rr
+	}
+
+	// a tenant holds a single set of files: sending it again is fine
+	require.Equal(t, http.StatusOK, upload(3).Code)
+	require.Equal(t, http.StatusOK, upload(3).Code)
+
+	// but a smaller or larger set has other proofs for the same files, and conflicts with the stored one
+	requireProblem(t, upload(1), http.StatusConflict, "conflict")
+	requireProblem(t, upload(4), http.StatusConflict, "conflict")
+
+	// once the set is deleted, another one can be uploaded
+	for index := 0; index < 3; index++ {
+		require.NoError(t, fileSvc.Delete(context.Background(), index))
+	}
+	require.Equal(t, http.StatusOK, upload(1).Code)
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	fileserverv1 "github.com/zale144/fileserver/api/fileserver/v1"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+const downloadChunkSize = 64 * 1024
+
+// NewGRPCServer creates a new gRPC server, sharing its dependencies with the HTTP server.
+func NewGRPCServer(deps *Dependencies) *GRPCServer {
+	s := &GRPCServer{Dependencies: deps}
+	serverOpts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(s.unaryRequestLogInterceptor, s.unaryIPRateLimitInterceptor, s.unaryAuthInterceptor, s.unaryAuthzInterceptor, s.unaryRateLimitInterceptor),
+		grpc.ChainStreamInterceptor(s.streamRequestLogInterceptor, s.streamIPRateLimitInterceptor, s.streamAuthInterceptor, s.streamAuthzInterceptor, s.streamRateLimitInterceptor),
+	}
+	if deps.tls != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(deps.tls)))
+	}
+	s.srv = grpc.NewServer(serverOpts...)
+	fileserverv1.RegisterFileServiceServer(s.srv, s)
+	return s
+}
+
+// GRPCServer is the gRPC server, backed by the same file service as the HTTP server.
+type GRPCServer struct {
+	fileserverv1.UnimplementedFileServiceServer
+	*Dependencies
+	srv *grpc.Server
+}
+
+// Serve accepts connections on the listener until Stop is called.
+func (s *GRPCServer) Serve(lis net.Listener) error {
+	s.log.Info("gRPC server is ready to handle requests", zap.String("address", lis.Addr().String()))
+	if err := s.srv.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	return nil
+}
+
+// Stop stops the server, waiting for the pending RPCs to finish.
+func (s *GRPCServer) Stop() {
+	s.srv.GracefulStop()
+	s.log.Info("gRPC server stopped")
+}
+
+// Shutdown stops the server, waiting for the pending RPCs to finish until the context is done,
+// the connections are then closed and the remaining RPCs canceled.
+func (s *GRPCServer) Shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.log.Warn("gRPC server did not stop in time, closing the connections")
+		s.srv.Stop()
+		<-done
+	}
+	s.log.Info("gRPC server stopped")
+}
+
+func (s *GRPCServer) Upload(stream fileserverv1.FileService_UploadServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	fileCh := make(chan *model.IndexedFileInput)
+	recvErrCh := make(chan error, 1)
+	count := 0
+
+	// every file is sent as soon as its first chunk is received, and its chunks are written to it as they are received
+	go func() {
+		defer close(fileCh)
+		var (
+			current *io.PipeWriter
+			index   int64
+			size    int64
+		)
+		fail := func(err error) {
+			if current != nil {
+				current.CloseWithError(err)
+			}
+			recvErrCh <- err
+			cancel()
+		}
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					fail(err)
+					return
+				}
+				if current != nil {
+					current.Close()
+				}
+				return
+			}
+			if current != nil && index != req.GetIndex() {
+				current.Close()
+				current = nil
+			}
+			if current == nil {
+				if err = s.cfg.Limits.checkFileCount(count + 1); err != nil {
+					fail(err)
+					return
+				}
+				pr, pw := io.Pipe()
+				select {
+				case fileCh <- &model.IndexedFileInput{Index: int(req.GetIndex()), Content: pr}:
+					count++
+				case <-ctx.Done():
+					return
+				}
+				current, index, size = pw, req.GetIndex(), 0
+			}
+			size += int64(len(req.GetChunk()))
+			if err = s.cfg.Limits.checkFileSize(size); err != nil {
+				fail(err)
+				return
+			}
+			if _, err = current.Write(req.GetChunk()); err != nil {
+				// the upload stopped reading the file, it fails on its own
+				return
+			}
+		}
+	}()
+
+	result, err := s.fileSvc.SaveStream(ctx, fileCh)
+	select {
+	case recvErr := <-recvErrCh:
+		var limitErr *LimitError
+		if errors.As(recvErr, &limitErr) {
+			return toStatus(recvErr)
+		}
+		s.logger(ctx).Error("error receiving upload", zap.Error(recvErr))
+		return status.Error(codes.Canceled, "upload stream failed")
+	default:
+	}
+	if err != nil {
+		s.logger(ctx).Error("error saving file", zap.Error(err))
+		return toStatus(err)
+	}
+
+	return stream.SendAndClose(&fileserverv1.UploadResponse{
+		Status:     "Success",
+		Files:      int64(result.Files),
+		Bytes:      result.Bytes,
+		DedupFiles: int64(result.DedupFiles),
+		DedupBytes: result.DedupBytes,
+	})
+}
+
+func (s *GRPCServer) Download(req *fileserverv1.DownloadRequest, stream fileserverv1.FileService_DownloadServer) error {
+	ctx := stream.Context()
+	files, err := s.fileSvc.GetMetadata(ctx, []int{int(req.GetIndex())})
+	if err != nil {
+		s.logger(ctx).Error("error getting file metadata", zap.Error(err))
+		return toStatus(err)
+	}
+	if len(files) == 0 {
+		return toStatus(fmt.Errorf("file %d: %w", req.GetIndex(), model.ErrNotFound))
+	}
+	file, err := s.fileSvc.Open(ctx, files[0])
+	if err != nil {
+		s.logger(ctx).Error("error getting file", zap.Error(err))
+		return toStatus(err)
+	}
+	defer file.Content.Close()
+
+	// the hash and the proof are only sent along with the first chunk, the content is streamed from the storage
+	// and fails with an integrity error once it is read to its end if it is corrupted
+	first := &fileserverv1.DownloadResponse{
+		Hash:        file.Metadata.Hash,
+		MerkleProof: file.Metadata.MerkleProof,
+	}
+	buf := make([]byte, downloadChunkSize)
+	for {
+		n, err := io.ReadFull(file.Content, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			s.logger(ctx).Error("error reading file", zap.Error(err))
+			return toStatus(err)
+		}
+		if n > 0 || first != nil {
+			resp := &fileserverv1.DownloadResponse{}
+			if first != nil {
+				resp, first = first, nil
+			}
+			resp.Chunk = buf[:n]
+			if sendErr := stream.Send(resp); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (s *GRPCServer) GetProof(ctx context.Context, req *fileserverv1.GetProofRequest) (*fileserverv1.GetProofResponse, error) {
+	files, err := s.fileSvc.GetMetadata(ctx, []int{int(req.GetIndex())})
+	if err != nil {
+		s.logger(ctx).Error("error getting file metadata", zap.Error(err))
+		return nil, toStatus(err)
+	}
+	if len(files) == 0 {
+		return nil, toStatus(fmt.Errorf("file %d: %w", req.GetIndex(), model.ErrNotFound))
+	}
+
+	return &fileserverv1.GetProofResponse{
+		Index:       int64(files[0].Index),
+		Hash:        files[0].Hash,
+		MerkleProof: files[0].MerkleProof,
+	}, nil
+}
+
+func (s *GRPCServer) GetRoot(ctx context.Context, _ *fileserverv1.GetRootRequest) (*fileserverv1.GetRootResponse, error) {
+	root, err := s.fileSvc.Root(ctx)
+	if err != nil {
+		s.logger(ctx).Error("error getting root", zap.Error(err))
+		return nil, toStatus(err)
+	}
+	return &fileserverv1.GetRootResponse{Root: root}, nil
+}
+
+func (s *GRPCServer) List(ctx context.Context, req *fileserverv1.ListRequest) (*fileserverv1.ListResponse, error) {
+	to := -1
+	if req.To != nil {
+		to = int(req.GetTo())
+	}
+	if req.GetFrom() < 0 || (to >= 0 && to < int(req.GetFrom())) {
+		return nil, toStatus(invalidInput("invalid range [%d, %d]", req.GetFrom(), to))
+	}
+
+	files, err := s.fileSvc.List(ctx, int(req.GetFrom()), to)
+	if err != nil {
+		s.logger(ctx).Error("error listing files", zap.Error(err))
+		return nil, toStatus(err)
+	}
+
+	resp := &fileserverv1.ListResponse{
+		Files: make([]*fileserverv1.FileInfo, len(files)),
+	}
+	for i, file := range files {
+		resp.Files[i] = &fileserverv1.FileInfo{
+			Index: int64(file.Index),
+			Hash:  file.Hash,
+		}
+	}
+	return resp, nil
+}
+
+// Interface assertions.
+var _ fileserverv1.FileServiceServer = (*GRPCServer)(nil)
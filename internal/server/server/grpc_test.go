@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	fileserverv1 "github.com/zale144/fileserver/api/fileserver/v1"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func newTestGRPCClient(t *testing.T, fileSvc fileService, opts ...Option) fileserverv1.FileServiceClient {
+	return newTestGRPCClientWithConfig(t, Config{}, fileSvc, opts...)
+}
+
+func newTestGRPCClientWithConfig(t *testing.T, cfg Config, fileSvc fileService, opts ...Option) fileserverv1.FileServiceClient {
+	return newTestGRPCClientWithDependencies(t, NewDependencies(cfg, fileSvc, zap.NewNop(), opts...))
+}
+
+func newTestGRPCClientWithDependencies(t *testing.T, deps *Dependencies) fileserverv1.FileServiceClient {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := NewGRPCServer(deps)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return fileserverv1.NewFileServiceClient(conn)
+}
+
+func TestGRPCUpload(t *testing.T) {
+	tests := []struct {
+		name      string
+		numFiles  int
+		chunkSize int
+	}{
+		{
+			name:      "Single file single chunk",
+			numFiles:  1,
+			chunkSize: 1024,
+		}, {
+			name:      "Multiple files multiple chunks",
+			numFiles:  10,
+			chunkSize: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+			client := newTestGRPCClient(t, fileSvc)
+
+			stream, err := client.Upload(context.Background())
+			require.NoError(t, err)
+
+			data := make([][]byte, tt.numFiles)
+			for i := range data {
+				data[i] = []byte(fmt.Sprintf("test%d", i))
+				for chunk := data[i]; len(chunk) > 0; chunk = chunk[min(len(chunk), tt.chunkSize):] {
+					require.NoError(t, stream.Send(&fileserverv1.UploadRequest{
+						Index: int64(i),
+						Chunk: chunk[:min(len(chunk), tt.chunkSize)],
+					}))
+				}
+			}
+
+			resp, err := stream.CloseAndRecv()
+			require.NoError(t, err)
+			require.Equal(t, int64(tt.numFiles), resp.GetFiles())
+
+			for i := range data {
+				file, err := fileSvc.Get(context.Background(), i)
+				require.NoError(t, err)
+				require.Equal(t, data[i], readContent(t, file))
+			}
+		})
+	}
+}
+
+func TestGRPCDownload(t *testing.T) {
+	large := make([]byte, downloadChunkSize*2+10)
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	tests := []struct {
+		name       string
+		index      int64
+		wantChunks int
+		wantCode   codes.Code
+	}{
+		{
+			name:       "Small file",
+			index:      0,
+			wantChunks: 1,
+		}, {
+			name:       "Large file",
+			index:      1,
+			wantChunks: 3,
+		}, {
+			name:     "File not found",
+			index:    99,
+			wantCode: codes.NotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+			data := saveFiles(t, fileSvc, [][]byte{[]byte("test0"), large})
+			root := merkle.NewTree(data).Root.Hash
+			client := newTestGRPCClient(t, fileSvc)
+
+			stream, err := client.Download(context.Background(), &fileserverv1.DownloadRequest{Index: tt.index})
+			require.NoError(t, err)
+
+			var (
+				content []byte
+				first   *fileserverv1.DownloadResponse
+				chunks  int
+			)
+			for {
+				resp, err := stream.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if tt.wantCode != codes.OK {
+					require.Equal(t, tt.wantCode, status.Code(err))
+					return
+				}
+				require.NoError(t, err)
+				if first == nil {
+					first = resp
+				} else {
+					require.Empty(t, resp.GetMerkleProof())
+				}
+				content = append(content, resp.GetChunk()...)
+				chunks++
+			}
+
+			require.Equal(t, tt.wantChunks, chunks)
+			require.Equal(t, data[tt.index], content)
+			require.Equal(t, merkle.HashData(content), first.GetHash())
+			require.True(t, merkle.VerifyProof(int(tt.index), first.GetHash(), first.GetMerkleProof(), root))
+		})
+	}
+}
+
+func TestGRPCGetProofAndRoot(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	client := newTestGRPCClient(t, fileSvc)
+
+	_, err := client.GetRoot(context.Background(), &fileserverv1.GetRootRequest{})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	data := saveFiles(t, fileSvc, [][]byte{[]byte("test0"), []byte("test1"), []byte("test2")})
+	root := merkle.NewTree(data).Root.Hash
+
+	rootResp, err := client.GetRoot(context.Background(), &fileserverv1.GetRootRequest{})
+	require.NoError(t, err)
+	require.Equal(t, root, rootResp.GetRoot())
+
+	for i, d := range data {
+		proofResp, err := client.GetProof(context.Background(), &fileserverv1.GetProofRequest{Index: int64(i)})
+		require.NoError(t, err)
+		require.Equal(t, int64(i), proofResp.GetIndex())
+		require.Equal(t, merkle.HashData(d), proofResp.GetHash())
+		require.True(t, merkle.VerifyProof(i, proofResp.GetHash(), proofResp.GetMerkleProof(), root))
+	}
+
+	_, err = client.GetProof(context.Background(), &fileserverv1.GetProofRequest{Index: 99})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCGetRootRecorded(t *testing.T) {
+	repo := newMockRepositoryService()
+	fileSvc := service.NewFile(repo, newMockStorageService(false), zap.NewNop())
+	client := newTestGRPCClient(t, fileSvc)
+	data := saveFiles(t, fileSvc, [][]byte{[]byte("test0"), []byte("test1"), []byte("test2")})
+
+	// a tampered proof of the first file does not change the root, which was recorded on upload
+	fileMD, err := repo.Get(context.Background(), auth.DefaultTenant, 0)
+	require.NoError(t, err)
+	tampered := *fileMD
+	tampered.MerkleProof = model.ByteaArray{append([]byte{}, fileMD.MerkleProof[0]...)}
+	tampered.MerkleProof[0][0] ^= 0xff
+	repo.m.Store(mockRepositoryKey{tenantID: auth.DefaultTenant, index: 0}, &tampered)
+
+	rootResp, err := client.GetRoot(context.Background(), &fileserverv1.GetRootRequest{})
+	require.NoError(t, err)
+	require.Equal(t, merkle.NewTree(data).Root.Hash, rootResp.GetRoot())
+}
+
+func TestGRPCList(t *testing.T) {
+	tests := []struct {
+		name        string
+		req         *fileserverv1.ListRequest
+		wantIndexes []int64
+		wantCode    codes.Code
+	}{
+		{
+			name:        "All files",
+			req:         &fileserverv1.ListRequest{},
+			wantIndexes: []int64{0, 1, 2, 3},
+		}, {
+			name:        "Range",
+			req:         &fileserverv1.ListRequest{From: 1, To: proto.Int64(2)},
+			wantIndexes: []int64{1, 2},
+		}, {
+			name:     "Invalid range",
+			req:      &fileserverv1.ListRequest{From: 2, To: proto.Int64(1)},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+			data := saveFiles(t, fileSvc, [][]byte{[]byte("test0"), []byte("test1"), []byte("test2"), []byte("test3")})
+			client := newTestGRPCClient(t, fileSvc)
+
+			resp, err := client.List(context.Background(), tt.req)
+			require.Equal(t, tt.wantCode, status.Code(err))
+			if tt.wantCode != codes.OK {
+				return
+			}
+
+			require.Len(t, resp.GetFiles(), len(tt.wantIndexes))
+			for i, file := range resp.GetFiles() {
+				require.Equal(t, tt.wantIndexes[i], file.GetIndex())
+				require.Equal(t, merkle.HashData(data[file.GetIndex()]), file.GetHash())
+			}
+		})
+	}
+}
@@ -1,28 +1,54 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("github.com/zale144/fileserver/internal/server/server")
+
 type fileService interface {
 	Get(ctx context.Context, index int) (*model.File, error)
-	SaveStream(ctx context.Context, fileCh chan *model.IndexedFileInput) error
+	Open(ctx context.Context, fileMD *model.FileMetadata) (*model.File, error)
+	OpenRange(ctx context.Context, fileMD *model.FileMetadata, offset, length int64) (*model.File, error)
+	List(ctx context.Context, from, to int) ([]*model.FileMetadata, error)
+	GetMetadata(ctx context.Context, indexes []int) ([]*model.FileMetadata, error)
+	Root(ctx context.Context) ([]byte, error)
+	Delete(ctx context.Context, index int) error
+	SaveStream(ctx context.Context, fileCh chan *model.IndexedFileInput) (*model.UploadResult, error)
 	Verify(fileMD *model.File, fileHash, merkleRoot []byte) error
+	Shutdown(ctx context.Context) *model.ShutdownReport
+	Scrub(ctx context.Context, tenantID string, filesPerSecond float64) (*model.ScrubReport, error)
 }
 type FileUploadResponse struct {
 	Status string `json:"status"`
+	Files  int    `json:"files"`
+	Bytes  int64  `json:"bytes"`
+	// DedupFiles and DedupBytes are the files, and their total size, whose content was already stored.
+	DedupFiles int   `json:"dedupFiles"`
+	DedupBytes int64 `json:"dedupBytes"`
+}
+
+type FileProofResponse struct {
+	Index       int      `json:"index"`
+	Hash        []byte   `json:"hash"`
+	MerkleProof [][]byte `json:"merkleProof"`
 }
 
 type FileDownloadResponse struct {
@@ -32,108 +58,321 @@ type FileDownloadResponse struct {
 }
 
 func (s *Server) DownloadFile(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["index"], 10, 64)
+	id, err := pathIndex(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	// the content is embedded in the response, so it is read and verified as a whole before anything is written
+	file, err := s.fileSvc.Get(r.Context(), id)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	defer file.Content.Close()
+	name, err := json.Marshal(strconv.Itoa(id))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	proof, err := json.Marshal([][]byte(file.Metadata.MerkleProof))
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	// the file may take much longer to stream than the server write timeout allows
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// the response is the JSON encoding of FileDownloadResponse, with the content streamed to it in base64
+	// instead of being held in memory
+	w.Header().Set("Content-Type", "application/json")
+	if err = writeDownloadResponse(w, name, proof, file.Content); err != nil {
+		s.logger(r.Context()).Error("error streaming file", zap.Int("index", id), zap.Error(err))
+	}
+}
+
+// writeDownloadResponse writes the fields of FileDownloadResponse, the content last, as it is read.
+func writeDownloadResponse(w io.Writer, name, proof []byte, content io.Reader) error {
+	if _, err := fmt.Fprintf(w, `{"fileName":%s,"merkleProof":%s,"fileContent":"`, name, proof); err != nil {
+		return err
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(encoder, content); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\"}\n")
+	return err
+}
+
+// DownloadContent streams the raw content of a file, or the single byte range requested by the Range header.
+// The content is verified against the hash of the file as it is streamed, so a corrupted file is cut short.
+func (s *Server) DownloadContent(w http.ResponseWriter, r *http.Request) {
+	id, err := pathIndex(r)
 	if err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		s.writeError(w, r, err)
 		return
 	}
 
-	file, err := s.fileSvc.Get(r.Context(), int(id))
+	files, err := s.fileSvc.GetMetadata(r.Context(), []int{id})
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, "File not Found", http.StatusNotFound)
-			return
+		s.writeError(w, r, err)
+		return
+	}
+	if len(files) == 0 {
+		s.writeError(w, r, fmt.Errorf("file %d: %w", id, model.ErrNotFound))
+		return
+	}
+	fileMD := files[0]
+
+	offset, length, partial, err := parseRange(r.Header.Get("Range"), fileMD.Size)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	file, err := s.fileSvc.OpenRange(r.Context(), fileMD, offset, length)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	defer file.Content.Close()
+
+	// the file may take much longer to stream than the server write timeout allows
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	header := w.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("ETag", fmt.Sprintf(`"%x"`, fileMD.Hash))
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	status := http.StatusOK
+	if partial {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, fileMD.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	// once the status is written errors can only be reported by aborting the stream
+	if _, err = io.Copy(w, file.Content); err != nil {
+		s.logger(r.Context()).Error("error streaming file", zap.Int("index", id), zap.Error(err))
+	}
+}
+
+// parseRange returns the range of the file of the given size requested by the Range header, and whether it is
+// a part of the file. A missing, malformed or multiple range header is ignored and the whole file is returned,
+// a range starting past the end of the file is not satisfiable.
+func parseRange(header string, size int64) (offset, length int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size, false, nil
+	}
+
+	if first == "" {
+		// the suffix range -n is the last n bytes of the file
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, size, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, &rangeError{size: size}
 		}
-		s.log.Error("error getting file", zap.Error(err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, size, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, &rangeError{size: size}
+	}
+	return start, end - start + 1, true, nil
+}
+
+// GetProof returns the hash and the Merkle proof of a file without its content.
+func (s *Server) GetProof(w http.ResponseWriter, r *http.Request) {
+	id, err := pathIndex(r)
+	if err != nil {
+		s.writeError(w, r, err)
 		return
 	}
 
-	response := FileDownloadResponse{
-		FileName:    fmt.Sprintf("%d", id),
-		FileContent: file.Data,
-		MerkleProof: file.Metadata.MerkleProof,
+	files, err := s.fileSvc.GetMetadata(r.Context(), []int{id})
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if len(files) == 0 {
+		s.writeError(w, r, fmt.Errorf("file %d: %w", id, model.ErrNotFound))
+		return
+	}
+
+	response := FileProofResponse{
+		Index:       files[0].Index,
+		Hash:        files[0].Hash,
+		MerkleProof: files[0].MerkleProof,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Error Writing Response", http.StatusInternalServerError)
+		s.logger(r.Context()).Error("error encoding response", zap.Error(err))
+	}
+}
+
+// DeleteFile removes the metadata of a file.
+func (s *Server) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	id, err := pathIndex(r)
+	if err != nil {
+		s.writeError(w, r, err)
 		return
 	}
 
-	if _, err = w.Write(file.Data); err != nil {
-		s.log.Error("error writing file to response", zap.Error(err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if err = s.fileSvc.Delete(r.Context(), id); err != nil {
+		s.writeError(w, r, err)
 		return
 	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) UploadMultiple(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	limits := s.cfg.Limits
+	if limits.MaxRequestBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxRequestBytes)
+	}
+
 	reader, err := r.MultipartReader()
 	if err != nil {
-		s.log.Error("error getting multipart reader", zap.Error(err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		s.writeError(w, r, invalidInput("invalid multipart request: %v", err))
 		return
 	}
 
+	// a failure to read the request aborts the upload before anything is stored
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+
 	fileCh := make(chan *model.IndexedFileInput)
 	go func() {
 		defer close(fileCh)
-		i := 0
-		for {
-			part, err := reader.NextPart()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
-				s.log.Error("error getting next part", zap.Error(err))
-				return
-			}
-			if part.FileName() == "" {
-				continue
-			}
-			b := bytes.NewBuffer(nil)
-			_, _ = b.ReadFrom(part)
-
-			index := i
-			idx, err := strconv.ParseInt(part.FileName(), 10, 64)
-			if err == nil {
-				index = int(idx)
-			}
-			fileCh <- &model.IndexedFileInput{
-				Index: index,
-				Data:  b.Bytes(),
-			}
-			_ = part.Close()
-			i++
+		if err := s.readParts(ctx, reader, fileCh); err != nil {
+			cancel(err)
 		}
-
 	}()
 
-	if err := s.fileSvc.SaveStream(r.Context(), fileCh); err != nil {
-		s.log.Error("error saving file", zap.Error(err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	result, err := s.fileSvc.SaveStream(ctx, fileCh)
+	if err != nil {
+		// the upload fails with the cancellation of the context when reading the request fails
+		if cause := context.Cause(ctx); cause != nil {
+			err = cause
+		}
+		s.writeError(w, r, err)
 		return
 	}
 
 	response := FileUploadResponse{
-		Status: "Success",
+		Status:     "Success",
+		Files:      result.Files,
+		Bytes:      result.Bytes,
+		DedupFiles: result.DedupFiles,
+		DedupBytes: result.DedupBytes,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		s.log.Error("error encoding response", zap.Error(err))
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		s.logger(r.Context()).Error("error encoding response", zap.Error(err))
+	}
+}
+
+// readParts sends the files of the multipart request to fileCh, checking them against the limits.
+func (s *Server) readParts(ctx context.Context, reader *multipart.Reader, fileCh chan<- *model.IndexedFileInput) (err error) {
+	_, span := tracer.Start(ctx, "server.read_parts")
+	defer tracing.End(span, &err)
+
+	limits := s.cfg.Limits
+	i := 0
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				err = &LimitError{Limit: "max_request_bytes", Max: maxBytesErr.Limit}
+			}
+			s.logger(ctx).Error("error getting next part", zap.Error(err))
+			return err
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		if err = limits.checkFileCount(i + 1); err != nil {
+			return err
+		}
+
+		index := i
+		idx, err := strconv.ParseInt(part.FileName(), 10, 64)
+		if err == nil {
+			index = int(idx)
+		}
+		// the part is streamed to the upload as it is read
+		pr, pw := io.Pipe()
+		select {
+		case fileCh <- &model.IndexedFileInput{Index: index, Content: pr}:
+		case <-ctx.Done():
+			// the upload was aborted, the rest of the request is not read
+			return context.Cause(ctx)
+		}
+		_, err = limits.copyFile(pw, part)
+		pw.CloseWithError(err)
+		if errors.Is(err, io.ErrClosedPipe) {
+			// the upload stopped reading, it fails on its own
+			return nil
+		}
+		if err != nil {
+			s.logger(ctx).Error("error reading part", zap.Error(err))
+			return err
+		}
+		_ = part.Close()
+		i++
 	}
+	span.SetAttributes(attribute.Int("upload.files", i))
+	return nil
 }
 
 // Interface assertions.
 var (
 	_ http.HandlerFunc = (*Server)(nil).DownloadFile
+	_ http.HandlerFunc = (*Server)(nil).DownloadContent
+	_ http.HandlerFunc = (*Server)(nil).GetProof
+	_ http.HandlerFunc = (*Server)(nil).DeleteFile
 	_ http.HandlerFunc = (*Server)(nil).UploadMultiple
 )
+
+// pathIndex parses the index of the file in the path of the request.
+func pathIndex(r *http.Request) (int, error) {
+	index, err := strconv.Atoi(mux.Vars(r)["index"])
+	if err != nil || index < 0 {
+		return 0, invalidInput("invalid index %q", mux.Vars(r)["index"])
+	}
+	return index, nil
+}
@@ -3,17 +3,24 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
 	"github.com/zale144/fileserver/internal/server/model"
 	"github.com/zale144/fileserver/internal/server/service"
+	"github.com/zale144/fileserver/internal/server/storage"
 	"go.uber.org/zap"
 )
 
@@ -51,7 +58,7 @@ func TestUploadMultiple(t *testing.T) {
 			fileSvc := service.NewFile(repositorySvc, uploadService, log)
 
 			request := createFileUploadRequest(t, tt.numFiles)
-			server := Server{fileSvc: fileSvc}
+			server := Server{Dependencies: &Dependencies{fileSvc: fileSvc}}
 			server.UploadMultiple(rr, request)
 
 			if status := rr.Result().StatusCode; status != tt.wantStatusCode {
@@ -72,56 +79,60 @@ func TestDownloadFile(t *testing.T) {
 	log := zap.NewNop()
 	tests := []struct {
 		name           string
-		index          int
-		corruptFile    bool
-		uploadService  *mockStorageService
-		repositorySvc  *mockRepositoryService
-		wantError      error
+		index          string
 		wantStatusCode int
+		wantProblem    string
 	}{
 		{
 			name:           "Successful Download file",
-			index:          0,
+			index:          "2",
 			wantStatusCode: http.StatusOK,
 		}, {
 			name:           "File not found",
-			index:          99,
-			wantStatusCode: http.StatusOK,
+			index:          "99",
+			wantStatusCode: http.StatusNotFound,
+			wantProblem:    "not_found",
+		}, {
+			name:           "Invalid index",
+			index:          "abc",
+			wantStatusCode: http.StatusBadRequest,
+			wantProblem:    "invalid_input",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			repositorySvc := newMockRepositoryService()
-			uploadService := newMockStorageService(tt.corruptFile)
-			fileSvc := service.NewFile(repositorySvc, uploadService, log)
-			inCh := make(chan *model.IndexedFileInput, tt.index)
-			go func() {
-				defer close(inCh)
-				for i := 0; i <= tt.index; i++ {
-					inCh <- &model.IndexedFileInput{
-						Index: i,
-						Data:  bytes.NewBuffer([]byte(fmt.Sprintf("test%d", i))),
-					}
-				}
-
-			}()
-
-			_, err := fileSvc.SaveStream(context.Background(), inCh)
-			require.NoError(t, err)
+			fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), log)
+			saveTestFiles(t, fileSvc, 3)
 
-			req, err := http.NewRequest("GET", fmt.Sprintf("/file/%d", tt.index), nil)
+			req, err := http.NewRequest("GET", "/file/"+tt.index, nil)
 			require.NoError(t, err)
+			req.Header.Set(requestIDHeader, "request-1")
 
 			rr := httptest.NewRecorder()
-			server := Server{fileSvc: fileSvc, log: log}
+			server := Server{Dependencies: &Dependencies{fileSvc: fileSvc, log: log}}
 			router := mux.NewRouter()
+			router.Use(server.RequestLog)
 			router.HandleFunc("/file/{index}", server.DownloadFile)
 			router.ServeHTTP(rr, req)
 
-			if status := rr.Result().StatusCode; status != tt.wantStatusCode {
-				t.Errorf("handler returned wrong status code: got %v want %v", status, tt.wantStatusCode)
+			require.Equal(t, tt.wantStatusCode, rr.Code)
+			require.Equal(t, "request-1", rr.Header().Get(requestIDHeader))
+			if tt.wantProblem == "" {
+				var response FileDownloadResponse
+				require.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+				require.Equal(t, []byte("test2"), response.FileContent)
+				return
 			}
+
+			require.Equal(t, problemContentType, rr.Header().Get("Content-Type"))
+			var problem Problem
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&problem))
+			require.Equal(t, problemTypePrefix+tt.wantProblem, problem.Type)
+			require.Equal(t, tt.wantStatusCode, problem.Status)
+			require.Equal(t, "/file/"+tt.index, problem.Instance)
+			require.Equal(t, "request-1", problem.RequestID)
+			require.NotEmpty(t, problem.Detail)
 		})
 	}
 }
@@ -142,8 +153,23 @@ func createFileUploadRequest(t *testing.T, numFiles int) *http.Request {
 	return req
 }
 
+// fileInput returns the uploaded file with the given content.
+func fileInput(index int, data []byte) *model.IndexedFileInput {
+	return &model.IndexedFileInput{Index: index, Content: io.NopCloser(bytes.NewReader(data))}
+}
+
+// readContent reads the whole content of the file.
+func readContent(t *testing.T, file *model.File) []byte {
+	t.Helper()
+	defer file.Content.Close()
+	data, err := io.ReadAll(file.Content)
+	require.NoError(t, err)
+	return data
+}
+
 type mockStorageService struct {
 	m           sync.Map
+	modified    sync.Map
 	corruptFile bool
 }
 
@@ -153,43 +179,483 @@ func newMockStorageService(corruptFile bool) *mockStorageService {
 	}
 }
 
-func (m *mockStorageService) UploadMultiple(_ context.Context, dataCh <-chan *model.File) error {
-	for data := range dataCh {
-		if m.corruptFile {
-			data.Data = bytes.ReplaceAll(data.Data, []byte("test"), []byte("corrupt"))
+// UploadMultiple stores the content of the objects without checking it, so that corruptFile can corrupt it.
+func (m *mockStorageService) UploadMultiple(_ context.Context, objects <-chan *model.Object) error {
+	for object := range objects {
+		if err := m.store(object); err != nil {
+			return err
 		}
-		m.m.Store(fmt.Sprintf("%x", data.Metadata.Hash), data)
 	}
 	return nil
 }
 
-func (m *mockStorageService) Download(_ context.Context, id string) ([]byte, error) {
+func (m *mockStorageService) store(object *model.Object) error {
+	data, err := io.ReadAll(object.Content)
+	if err != nil {
+		return err
+	}
+	if m.corruptFile {
+		data = bytes.ReplaceAll(data, []byte("test"), []byte("corrupt"))
+	}
+	m.m.Store(object.Key, data)
+	m.modified.Store(object.Key, time.Now())
+	return nil
+}
+
+func (m *mockStorageService) Download(_ context.Context, id string, hash []byte) (io.ReadCloser, error) {
 	value, ok := m.m.Load(id)
 	if !ok {
-		return nil, fmt.Errorf("failed to get file from storage")
+		return nil, fmt.Errorf("object %s: %w", id, model.ErrNotFound)
+	}
+	return storage.NewVerifyingReader(io.NopCloser(bytes.NewReader(value.([]byte))), id, hash), nil
+}
+
+func (m *mockStorageService) DownloadRange(_ context.Context, id string, offset, length int64) (io.ReadCloser, error) {
+	value, ok := m.m.Load(id)
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", id, model.ErrNotFound)
+	}
+	data := value.([]byte)
+	if length < 0 || offset+length > int64(len(data)) {
+		length = int64(len(data)) - offset
+	}
+	return io.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+}
+
+func (m *mockStorageService) Delete(_ context.Context, names []string) error {
+	for _, name := range names {
+		m.m.Delete(name)
+		m.modified.Delete(name)
 	}
-	return value.(*model.File).Data, nil
+	return nil
+}
+
+// Walk lists the objects in the order of their keys, the ones stored without UploadMultiple were never modified.
+func (m *mockStorageService) Walk(_ context.Context, fn func(object model.StoredObject) error) error {
+	var objects []model.StoredObject
+	m.m.Range(func(key, value any) bool {
+		object := model.StoredObject{Key: key.(string), Size: int64(len(value.([]byte)))}
+		if modified, ok := m.modified.Load(key); ok {
+			object.LastModified = modified.(time.Time)
+		}
+		objects = append(objects, object)
+		return true
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	for _, object := range objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mockStorageService) Stat(_ context.Context, name string) (model.StoredObject, error) {
+	value, ok := m.m.Load(name)
+	if !ok {
+		return model.StoredObject{}, fmt.Errorf("object %s: %w", name, model.ErrNotFound)
+	}
+	object := model.StoredObject{Key: name, Size: int64(len(value.([]byte)))}
+	if modified, ok := m.modified.Load(name); ok {
+		object.LastModified = modified.(time.Time)
+	}
+	return object, nil
+}
+
+func (m *mockStorageService) Quarantine(ctx context.Context, names []string) error {
+	for _, name := range names {
+		if value, ok := m.m.Load(name); ok {
+			m.m.Store(model.QuarantinePrefix+name, value)
+		}
+	}
+	return m.Delete(ctx, names)
+}
+
+// objects returns the number of stored objects.
+func (m *mockStorageService) objects() int {
+	count := 0
+	m.m.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	return count
 }
 
 type mockRepositoryService struct {
 	m sync.Map
+
+	quotaMu sync.Mutex
+	usage   map[string]model.Usage
+	quotas  map[string]model.Quota
+
+	uploadsMu sync.Mutex
+	uploads   map[int64]*model.Upload
+	refcounts map[string]int64
+	objects   map[string]*mockObject
+
+	scrubMu   sync.Mutex
+	scrubbed  map[mockRepositoryKey]model.ScrubStatus
+	scrubRuns []model.ScrubReport
+}
+
+// mockObject is the tiering state of an object recorded by the repository.
+type mockObject struct {
+	ref      model.ObjectRef
+	tier     string
+	created  time.Time
+	accessed time.Time
+}
+
+type mockRepositoryKey struct {
+	tenantID string
+	index    int
 }
 
 func newMockRepositoryService() *mockRepositoryService {
-	return &mockRepositoryService{}
+	return &mockRepositoryService{
+		usage:     make(map[string]model.Usage),
+		quotas:    make(map[string]model.Quota),
+		uploads:   make(map[int64]*model.Upload),
+		refcounts: make(map[string]int64),
+		objects:   make(map[string]*mockObject),
+		scrubbed:  make(map[mockRepositoryKey]model.ScrubStatus),
+	}
+}
+
+func (m *mockRepositoryService) BeginUpload(_ context.Context, upload *model.Upload, defaults model.Quota) error {
+	if err := m.reserveQuota(upload.TenantID, upload.Usage, defaults); err != nil {
+		return err
+	}
+
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+	upload.ID = int64(len(m.uploads) + 1)
+	upload.State = model.UploadPending
+	upload.CreatedAt = time.Now()
+	record := *upload
+	m.uploads[upload.ID] = &record
+	return nil
+}
+
+func (m *mockRepositoryService) Root(_ context.Context, tenantID string) ([]byte, error) {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	var last *model.Upload
+	for _, upload := range m.uploads {
+		if upload.TenantID == tenantID && upload.State == model.UploadCommitted && upload.Root != nil && (last == nil || upload.ID > last.ID) {
+			last = upload
+		}
+	}
+	if last == nil {
+		return nil, fmt.Errorf("root of tenant %s: %w", tenantID, model.ErrNotFound)
+	}
+	return last.Root, nil
+}
+
+// CommitUpload stores the metadata all at once like the transaction of the repository,
+// nothing is stored if the context is canceled or a file conflicts with a stored one.
+func (m *mockRepositoryService) CommitUpload(ctx context.Context, upload *model.Upload, files []*model.FileMetadata) error {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	record := m.uploads[upload.ID]
+	if record.State != model.UploadPending {
+		return fmt.Errorf("upload %d is not pending: %w", upload.ID, model.ErrConflict)
+	}
+	conflicts := 0
+	for _, data := range files {
+		stored, loaded := m.m.Load(mockRepositoryKey{tenantID: data.TenantID, index: data.Index})
+		if loaded && !sameFile(stored.(*model.FileMetadata), data) {
+			conflicts++
+		}
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%d files already stored with a different content or proof: %w", conflicts, model.ErrConflict)
+	}
+	var skipped model.Usage
+	for _, data := range files {
+		if _, loaded := m.m.LoadOrStore(mockRepositoryKey{tenantID: data.TenantID, index: data.Index}, data); loaded {
+			skipped.Objects++
+			skipped.Bytes += data.Size
+		} else {
+			key := data.ObjectKey()
+			if object := m.objects[key]; object == nil || m.refcounts[key] == 0 {
+				m.objects[key] = &mockObject{
+					ref:     model.ObjectRef{TenantID: data.TenantID, Hash: data.Hash, Size: data.Size},
+					tier:    model.TierHot,
+					created: time.Now(),
+				}
+			}
+			m.refcounts[key]++
+		}
+	}
+	m.releaseQuota(upload.TenantID, skipped)
+	record.State = model.UploadCommitted
+	upload.State = model.UploadCommitted
+	return nil
+}
+
+// sameFile reports whether the files have the same content and proof, as the repository does on conflicts.
+func sameFile(a, b *model.FileMetadata) bool {
+	return bytes.Equal(a.Hash, b.Hash) && slices.EqualFunc(a.MerkleProof, b.MerkleProof, bytes.Equal)
+}
+
+func (m *mockRepositoryService) FailUpload(_ context.Context, upload *model.Upload, _ error) error {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	record := m.uploads[upload.ID]
+	if record.State != model.UploadPending {
+		return nil
+	}
+	record.State = model.UploadFailed
+	upload.State = model.UploadFailed
+	m.releaseQuota(upload.TenantID, upload.Usage)
+	return nil
+}
+
+func (m *mockRepositoryService) ReferencedKeys(_ context.Context, pendingSince time.Time) (map[string]bool, error) {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	keys := make(map[string]bool)
+	for key, refcount := range m.refcounts {
+		if refcount > 0 {
+			keys[key] = true
+		}
+	}
+	for _, upload := range m.uploads {
+		if upload.State == model.UploadPending && !upload.CreatedAt.Before(pendingSince) {
+			for _, hash := range upload.Hashes {
+				keys[model.ObjectKey(upload.TenantID, hash)] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (m *mockRepositoryService) FailAbandonedUploads(_ context.Context, before time.Time) (int, error) {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	abandoned := 0
+	for _, upload := range m.uploads {
+		if upload.State == model.UploadPending && upload.CreatedAt.Before(before) {
+			upload.State = model.UploadFailed
+			m.releaseQuota(upload.TenantID, upload.Usage)
+			abandoned++
+		}
+	}
+	return abandoned, nil
+}
+
+func (m *mockRepositoryService) HashesInUse(_ context.Context, tenantID string, hashes [][]byte, uploadID int64) (map[string]bool, error) {
+	inUse := make(map[string]bool)
+	markInUse := func(hash []byte) {
+		for _, h := range hashes {
+			if bytes.Equal(h, hash) {
+				inUse[hex.EncodeToString(hash)] = true
+			}
+		}
+	}
+
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+	for _, hash := range hashes {
+		if m.refcounts[model.ObjectKey(tenantID, hash)] > 0 {
+			markInUse(hash)
+		}
+	}
+	for _, upload := range m.uploads {
+		if upload.TenantID == tenantID && upload.State == model.UploadPending && upload.ID != uploadID {
+			for _, hash := range upload.Hashes {
+				markInUse(hash)
+			}
+		}
+	}
+	return inUse, nil
+}
+
+func (m *mockRepositoryService) StoredObjects(_ context.Context, tenantID string, hashes [][]byte) (map[string]bool, error) {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	stored := make(map[string]bool)
+	for _, hash := range hashes {
+		if m.refcounts[model.ObjectKey(tenantID, hash)] > 0 {
+			stored[hex.EncodeToString(hash)] = true
+		}
+	}
+	return stored, nil
+}
+
+func (m *mockRepositoryService) PruneObjects(_ context.Context, _ time.Time) (int, error) {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	pruned := 0
+	for key, refcount := range m.refcounts {
+		if refcount == 0 {
+			delete(m.refcounts, key)
+			pruned++
+		}
+	}
+	return pruned, nil
 }
 
-func (m *mockRepositoryService) PutMultiple(_ context.Context, md <-chan *model.FileMetadata) error {
-	for data := range md {
-		m.m.Store(data.Index, data)
+func (m *mockRepositoryService) RecordAccess(_ context.Context, tenantID string, hash []byte) error {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	if object := m.objects[model.ObjectKey(tenantID, hash)]; object != nil {
+		object.accessed = time.Now()
 	}
 	return nil
 }
 
-func (m *mockRepositoryService) Get(index int) (*model.FileMetadata, error) {
-	value, ok := m.m.Load(index)
+func (m *mockRepositoryService) TierCandidates(_ context.Context, createdBefore, accessedBefore time.Time, limit int) ([]model.ObjectRef, error) {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	var candidates []*mockObject
+	for key, object := range m.objects {
+		if object.tier != model.TierHot || m.refcounts[key] == 0 {
+			continue
+		}
+		accessed := object.accessed
+		if accessed.IsZero() {
+			accessed = object.created
+		}
+		if (!createdBefore.IsZero() && object.created.Before(createdBefore)) ||
+			(!accessedBefore.IsZero() && accessed.Before(accessedBefore)) {
+			candidates = append(candidates, object)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].created.Before(candidates[j].created) })
+
+	refs := make([]model.ObjectRef, 0, len(candidates))
+	for _, object := range candidates[:min(limit, len(candidates))] {
+		refs = append(refs, object.ref)
+	}
+	return refs, nil
+}
+
+func (m *mockRepositoryService) SetObjectTier(_ context.Context, tenantID string, hash []byte, tier string) error {
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+
+	if object := m.objects[model.ObjectKey(tenantID, hash)]; object != nil {
+		object.tier = tier
+	}
+	return nil
+}
+
+func (m *mockRepositoryService) Get(_ context.Context, tenantID string, index int) (*model.FileMetadata, error) {
+	value, ok := m.m.Load(mockRepositoryKey{tenantID: tenantID, index: index})
 	if !ok {
-		return nil, fmt.Errorf("failed to get file from repository")
+		return nil, fmt.Errorf("file %d: %w", index, model.ErrNotFound)
 	}
 	return value.(*model.FileMetadata), nil
 }
+
+func (m *mockRepositoryService) List(_ context.Context, tenantID string, from, to int) ([]*model.FileMetadata, error) {
+	var result []*model.FileMetadata
+	m.m.Range(func(key, value any) bool {
+		k := key.(mockRepositoryKey)
+		if k.tenantID == tenantID && k.index >= from && (to < 0 || k.index <= to) {
+			result = append(result, value.(*model.FileMetadata))
+		}
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result, nil
+}
+
+func (m *mockRepositoryService) GetMultiple(_ context.Context, tenantID string, indexes []int) ([]*model.FileMetadata, error) {
+	var result []*model.FileMetadata
+	for _, index := range indexes {
+		if value, ok := m.m.Load(mockRepositoryKey{tenantID: tenantID, index: index}); ok {
+			result = append(result, value.(*model.FileMetadata))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result, nil
+}
+
+func (m *mockRepositoryService) Delete(_ context.Context, tenantID string, index int) error {
+	value, ok := m.m.LoadAndDelete(mockRepositoryKey{tenantID: tenantID, index: index})
+	if !ok {
+		return fmt.Errorf("file %d: %w", index, model.ErrNotFound)
+	}
+	m.releaseQuota(tenantID, model.Usage{Bytes: value.(*model.FileMetadata).Size, Objects: 1})
+
+	m.uploadsMu.Lock()
+	defer m.uploadsMu.Unlock()
+	m.refcounts[value.(*model.FileMetadata).ObjectKey()]--
+	return nil
+}
+
+func (m *mockRepositoryService) reserveQuota(tenantID string, requested model.Usage, defaults model.Quota) error {
+	m.quotaMu.Lock()
+	defer m.quotaMu.Unlock()
+
+	quota, ok := m.quotas[tenantID]
+	if !ok {
+		quota = defaults
+	}
+	used := m.usage[tenantID]
+	if err := quota.Check(used, requested); err != nil {
+		return err
+	}
+	m.usage[tenantID] = model.Usage{Bytes: used.Bytes + requested.Bytes, Objects: used.Objects + requested.Objects}
+	return nil
+}
+
+func (m *mockRepositoryService) releaseQuota(tenantID string, usage model.Usage) {
+	m.quotaMu.Lock()
+	defer m.quotaMu.Unlock()
+
+	used := m.usage[tenantID]
+	m.usage[tenantID] = model.Usage{Bytes: used.Bytes - usage.Bytes, Objects: used.Objects - usage.Objects}
+}
+
+func (m *mockRepositoryService) BeginScrub(_ context.Context, report *model.ScrubReport) error {
+	m.scrubMu.Lock()
+	defer m.scrubMu.Unlock()
+	m.scrubRuns = append(m.scrubRuns, *report)
+	report.ID = int64(len(m.scrubRuns))
+	report.StartedAt = time.Now()
+	return nil
+}
+
+func (m *mockRepositoryService) RecordScrub(_ context.Context, fileMD *model.FileMetadata, status model.ScrubStatus) error {
+	m.scrubMu.Lock()
+	defer m.scrubMu.Unlock()
+	m.scrubbed[mockRepositoryKey{tenantID: fileMD.TenantID, index: fileMD.Index}] = status
+	return nil
+}
+
+func (m *mockRepositoryService) FinishScrub(_ context.Context, report *model.ScrubReport, _ error) error {
+	m.scrubMu.Lock()
+	defer m.scrubMu.Unlock()
+	m.scrubRuns[report.ID-1] = *report
+	return nil
+}
+
+func (m *mockRepositoryService) ListTenants(_ context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var tenants []string
+	m.m.Range(func(key, _ any) bool {
+		if k := key.(mockRepositoryKey); !seen[k.tenantID] {
+			seen[k.tenantID] = true
+			tenants = append(tenants, k.tenantID)
+		}
+		return true
+	})
+	sort.Strings(tenants)
+	return tenants, nil
+}
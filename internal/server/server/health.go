@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// readinessTimeout bounds how long the readiness probe waits for the dependencies.
+const readinessTimeout = 2 * time.Second
+
+const (
+	healthOK           = "ok"
+	healthFailing      = "failing"
+	healthShuttingDown = "shutting_down"
+)
+
+// HealthCheck checks a dependency the server needs to handle requests.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// WithReadinessChecks makes the readiness probe check the dependencies.
+func WithReadinessChecks(checks ...HealthCheck) ServerOption {
+	return func(s *Server) {
+		s.readinessChecks = append(s.readinessChecks, checks...)
+	}
+}
+
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is the outcome of a check. The error of a failing check is only logged, as the probes are not authenticated.
+type CheckResult struct {
+	Status string `json:"status"`
+}
+
+// Healthz reports that the process is alive.
+func (s *Server) Healthz(w http.ResponseWriter, _ *http.Request) {
+	s.writeHealth(w, http.StatusOK, HealthResponse{Status: healthOK})
+}
+
+// Readyz reports whether the server can handle requests, checking each of its dependencies.
+// It fails as soon as the server starts shutting down, so that no new requests are routed to it.
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	if s.shuttingDown.Load() {
+		s.writeHealth(w, http.StatusServiceUnavailable, HealthResponse{Status: healthShuttingDown})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	response := HealthResponse{
+		Status: healthOK,
+		Checks: make(map[string]CheckResult, len(s.readinessChecks)),
+	}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, check := range s.readinessChecks {
+		wg.Add(1)
+		go func(check HealthCheck) {
+			defer wg.Done()
+			result := CheckResult{Status: healthOK}
+			if err := check.Check(ctx); err != nil {
+				s.log.Warn("readiness check failed", zap.String("check", check.Name), zap.Error(err))
+				result = CheckResult{Status: healthFailing}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Checks[check.Name] = result
+			if result.Status != healthOK {
+				response.Status = healthFailing
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if response.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeHealth(w, status, response)
+}
+
+func (s *Server) writeHealth(w http.ResponseWriter, status int, response HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.log.Error("error encoding response", zap.Error(err))
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestHealthz(t *testing.T) {
+	router := Router(NewServer(NewDependencies(Config{}, nil, zap.NewNop()),
+		WithReadinessChecks(HealthCheck{Name: "database", Check: func(context.Context) error { return errors.New("down") }})))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"status":"ok"}`, rr.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("connection refused") }
+	blocking := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name         string
+		checks       []HealthCheck
+		shuttingDown bool
+		wantStatus   int
+		wantBody     HealthResponse
+	}{
+		{
+			name: "All dependencies up",
+			checks: []HealthCheck{
+				{Name: "database", Check: ok},
+				{Name: "storage", Check: ok},
+			},
+			wantStatus: http.StatusOK,
+			wantBody: HealthResponse{Status: healthOK, Checks: map[string]CheckResult{
+				"database": {Status: healthOK},
+				"storage":  {Status: healthOK},
+			}},
+		}, {
+			name: "Dependency down",
+			checks: []HealthCheck{
+				{Name: "database", Check: ok},
+				{Name: "storage", Check: failing},
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody: HealthResponse{Status: healthFailing, Checks: map[string]CheckResult{
+				"database": {Status: healthOK},
+				"storage":  {Status: healthFailing},
+			}},
+		}, {
+			name:       "Dependency timing out",
+			checks:     []HealthCheck{{Name: "migrations", Check: blocking}},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody: HealthResponse{Status: healthFailing, Checks: map[string]CheckResult{
+				"migrations": {Status: healthFailing},
+			}},
+		}, {
+			name:         "Shutting down",
+			checks:       []HealthCheck{{Name: "database", Check: ok}},
+			shuttingDown: true,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantBody:     HealthResponse{Status: healthShuttingDown},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer(NewDependencies(Config{}, nil, zap.NewNop()), WithReadinessChecks(tt.checks...))
+			srv.shuttingDown.Store(tt.shuttingDown)
+
+			rr := httptest.NewRecorder()
+			Router(srv).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			require.Equal(t, tt.wantStatus, rr.Code)
+
+			// the errors of the checks are logged, never shown to the unauthenticated callers
+			require.NotContains(t, rr.Body.String(), "connection refused")
+			require.NotContains(t, rr.Body.String(), "deadline")
+			var body HealthResponse
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+			require.Equal(t, tt.wantBody, body)
+		})
+	}
+}
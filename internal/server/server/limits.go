@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Limits bounds the size of the uploads, a zero limit means there is no limit.
+type Limits struct {
+	MaxRequestBytes    int64 `envconfig:"MAX_REQUEST_BYTES" default:"1073741824"`
+	MaxFileBytes       int64 `envconfig:"MAX_FILE_BYTES" default:"104857600"`
+	MaxFilesPerRequest int   `envconfig:"MAX_FILES_PER_REQUEST" default:"10000"`
+}
+
+// LimitError is returned when an upload exceeds one of the limits.
+type LimitError struct {
+	Limit string
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("limit %s of %d exceeded", e.Limit, e.Max)
+}
+
+// checkFileCount returns a LimitError if the upload has more than the allowed number of files.
+func (l Limits) checkFileCount(count int) error {
+	if l.MaxFilesPerRequest > 0 && count > l.MaxFilesPerRequest {
+		return &LimitError{Limit: "max_files_per_request", Max: int64(l.MaxFilesPerRequest)}
+	}
+	return nil
+}
+
+// checkFileSize returns a LimitError if the file is larger than allowed.
+func (l Limits) checkFileSize(size int64) error {
+	if l.MaxFileBytes > 0 && size > l.MaxFileBytes {
+		return &LimitError{Limit: "max_file_bytes", Max: l.MaxFileBytes}
+	}
+	return nil
+}
+
+// copyFile copies the file from r to w, failing as soon as it exceeds the file or the request size limit.
+func (l Limits) copyFile(w io.Writer, r io.Reader) (int64, error) {
+	if l.MaxFileBytes > 0 {
+		r = io.LimitReader(r, l.MaxFileBytes+1)
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return n, &LimitError{Limit: "max_request_bytes", Max: maxBytesErr.Limit}
+		}
+		return n, err
+	}
+	if err = l.checkFileSize(n); err != nil {
+		return n, err
+	}
+	return n, nil
+}
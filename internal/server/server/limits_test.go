@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	fileserverv1 "github.com/zale144/fileserver/api/fileserver/v1"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestUploadLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     Limits
+		quota      model.Quota
+		numFiles   int
+		wantStatus int
+		wantLimit  string
+	}{
+		{
+			name:       "Within limits",
+			limits:     Limits{MaxRequestBytes: 1024, MaxFileBytes: 5, MaxFilesPerRequest: 3},
+			quota:      model.Quota{MaxBytes: 15, MaxObjects: 3},
+			numFiles:   3,
+			wantStatus: http.StatusOK,
+		}, {
+			name:       "Request too large",
+			limits:     Limits{MaxRequestBytes: 100},
+			numFiles:   3,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantLimit:  "max_request_bytes",
+		}, {
+			name:       "File too large",
+			limits:     Limits{MaxFileBytes: 4},
+			numFiles:   1,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantLimit:  "max_file_bytes",
+		}, {
+			name:       "Too many files",
+			limits:     Limits{MaxFilesPerRequest: 2},
+			numFiles:   3,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantLimit:  "max_files_per_request",
+		}, {
+			name:       "Byte quota exceeded",
+			quota:      model.Quota{MaxBytes: 14},
+			numFiles:   3,
+			wantStatus: http.StatusInsufficientStorage,
+			wantLimit:  "max_bytes",
+		}, {
+			name:       "Object quota exceeded",
+			quota:      model.Quota{MaxObjects: 2},
+			numFiles:   3,
+			wantStatus: http.StatusInsufficientStorage,
+			wantLimit:  "max_objects",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageSvc := newMockStorageService(false)
+			fileSvc := service.NewFile(newMockRepositoryService(), storageSvc, zap.NewNop(), service.WithDefaultQuota(tt.quota))
+			router := Router(NewServer(NewDependencies(Config{Limits: tt.limits}, fileSvc, zap.NewNop())))
+
+			req := createFileUploadRequest(t, tt.numFiles)
+			req.URL.Path = "/file"
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			require.Equal(t, tt.wantStatus, rr.Code)
+			if tt.wantLimit == "" {
+				return
+			}
+
+			require.Equal(t, problemContentType, rr.Header().Get("Content-Type"))
+			var response Problem
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+			require.Equal(t, tt.wantStatus, response.Status)
+			require.NotNil(t, response.Limit)
+			require.Equal(t, tt.wantLimit, response.Limit.Name)
+
+			stored := 0
+			storageSvc.m.Range(func(_, _ any) bool {
+				stored++
+				return true
+			})
+			require.Zero(t, stored, "nothing must be stored when a limit is hit")
+		})
+	}
+}
+
+func TestQuotaReleasedOnDelete(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop(),
+		service.WithDefaultQuota(model.Quota{MaxObjects: 2}))
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop(), WithAuthenticator(roleAuthenticator{}))))
+
+	upload := func() int {
+		req := createFileUploadRequest(t, 2)
+		req.URL.Path = "/file"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusOK, upload())
+	require.Equal(t, http.StatusInsufficientStorage, upload())
+
+	for _, index := range []string{"0", "1"} {
+		req := httptest.NewRequest(http.MethodDelete, "/file/"+index, nil)
+		req.Header.Set(apiKeyHeader, "admin")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusNoContent, rr.Code)
+	}
+	require.Equal(t, http.StatusOK, upload())
+}
+
+func TestQuotaReleasedOnReupload(t *testing.T) {
+	repo := newMockRepositoryService()
+	fileSvc := service.NewFile(repo, newMockStorageService(false), zap.NewNop(),
+		service.WithDefaultQuota(model.Quota{MaxObjects: 4}))
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop())))
+
+	upload := func() int {
+		req := createFileUploadRequest(t, 2)
+		req.URL.Path = "/file"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// the files stored already are not counted again, so the same set can be uploaded any number of times
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, upload())
+		repo.quotaMu.Lock()
+		usage := repo.usage[auth.DefaultTenant]
+		repo.quotaMu.Unlock()
+		require.Equal(t, model.Usage{Bytes: 10, Objects: 2}, usage)
+	}
+}
+
+func TestGRPCUploadLimits(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop(),
+		service.WithDefaultQuota(model.Quota{MaxObjects: 1}))
+	client := newTestGRPCClientWithConfig(t, Config{Limits: Limits{MaxFileBytes: 8}}, fileSvc)
+
+	upload := func(chunks ...*fileserverv1.UploadRequest) error {
+		stream, err := client.Upload(context.Background())
+		require.NoError(t, err)
+		for _, chunk := range chunks {
+			if err = stream.Send(chunk); err != nil {
+				break
+			}
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+
+	err := upload(
+		&fileserverv1.UploadRequest{Index: 0, Chunk: []byte("test0")},
+		&fileserverv1.UploadRequest{Index: 0, Chunk: []byte("test0")},
+	)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	err = upload(
+		&fileserverv1.UploadRequest{Index: 0, Chunk: []byte("test0")},
+		&fileserverv1.UploadRequest{Index: 1, Chunk: []byte("test1")},
+	)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	require.NoError(t, upload(&fileserverv1.UploadRequest{Index: 0, Chunk: []byte("test0")}))
+}
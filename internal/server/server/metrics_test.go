@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(true), zap.NewNop(), service.WithMetrics(m))
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop(), WithMetrics(m))))
+
+	req := createFileUploadRequest(t, 3)
+	req.URL.Path = "/file"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/file/42", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	_, err := fileSvc.Scrub(context.Background(), "", 0)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, testutil.CollectAndCount(registry, "fileserver_upload_bytes"))
+	require.Equal(t, 1, testutil.CollectAndCount(registry, "fileserver_merkle_tree_build_duration_seconds"))
+
+	expected := `
+# HELP fileserver_errors_total Number of failed operations by error type.
+# TYPE fileserver_errors_total counter
+fileserver_errors_total{operation="get",type="not_found"} 1
+# HELP fileserver_upload_files Number of files in an upload.
+# TYPE fileserver_upload_files histogram
+fileserver_upload_files_bucket{le="1"} 0
+fileserver_upload_files_bucket{le="4"} 1
+fileserver_upload_files_bucket{le="16"} 1
+fileserver_upload_files_bucket{le="64"} 1
+fileserver_upload_files_bucket{le="256"} 1
+fileserver_upload_files_bucket{le="1024"} 1
+fileserver_upload_files_bucket{le="4096"} 1
+fileserver_upload_files_bucket{le="16384"} 1
+fileserver_upload_files_bucket{le="65536"} 1
+fileserver_upload_files_bucket{le="262144"} 1
+fileserver_upload_files_bucket{le="+Inf"} 1
+fileserver_upload_files_sum 3
+fileserver_upload_files_count 1
+# HELP fileserver_uploads_in_flight Number of uploads in progress.
+# TYPE fileserver_uploads_in_flight gauge
+fileserver_uploads_in_flight 0
+# HELP fileserver_scrub_files_total Number of stored files checked by the scrubber by outcome.
+# TYPE fileserver_scrub_files_total counter
+fileserver_scrub_files_total{status="corrupted"} 3
+# HELP fileserver_verification_failures_total Number of stored files that failed the verification.
+# TYPE fileserver_verification_failures_total counter
+fileserver_verification_failures_total{reason="corrupted"} 3
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"fileserver_errors_total", "fileserver_upload_files", "fileserver_uploads_in_flight",
+		"fileserver_scrub_files_total", "fileserver_verification_failures_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(registry, "fileserver_scrub_last_completion_timestamp_seconds"))
+
+	// the metrics are served from the injected registry, on the metrics router only
+	rr = httptest.NewRecorder()
+	MetricsRouter(m).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), "fileserver_upload_bytes_count 1")
+	require.NotContains(t, rr.Body.String(), "go_goroutines")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+
+	fileserverv1 "github.com/zale144/fileserver/api/fileserver/v1"
+	"github.com/zale144/fileserver/internal/server/auth"
+)
+
+// Action is an operation a role may be allowed to perform.
+type Action string
+
+const (
+	ActionUpload   Action = "upload"
+	ActionDownload Action = "download"
+	ActionProof    Action = "proof"
+	ActionVerify   Action = "verify"
+	ActionDelete   Action = "delete"
+	ActionAdmin    Action = "admin"
+
+	// actionAll grants every action to a role.
+	actionAll Action = "*"
+)
+
+var knownActions = map[Action]bool{
+	ActionUpload:   true,
+	ActionDownload: true,
+	ActionProof:    true,
+	ActionVerify:   true,
+	ActionDelete:   true,
+	ActionAdmin:    true,
+	actionAll:      true,
+}
+
+// grpcActions maps the gRPC methods to the actions they perform.
+var grpcActions = map[string]Action{
+	fileserverv1.FileService_Upload_FullMethodName:   ActionUpload,
+	fileserverv1.FileService_Download_FullMethodName: ActionDownload,
+	fileserverv1.FileService_GetProof_FullMethodName: ActionProof,
+	fileserverv1.FileService_GetRoot_FullMethodName:  ActionProof,
+	fileserverv1.FileService_List_FullMethodName:     ActionProof,
+}
+
+// Policy maps roles to the actions they are allowed to perform.
+type Policy struct {
+	roles map[string]map[Action]bool
+	// anyone are the actions every identity may perform, whatever its roles.
+	anyone map[Action]bool
+}
+
+// defaultPolicy is used without a policy file: every identity may upload, download, get proofs and verify,
+// but deleting files and the admin routes are reserved to the admin role.
+var defaultPolicy = &Policy{
+	roles: map[string]map[Action]bool{
+		"admin": {actionAll: true},
+	},
+	anyone: map[Action]bool{
+		ActionUpload:   true,
+		ActionDownload: true,
+		ActionProof:    true,
+		ActionVerify:   true,
+	},
+}
+
+type policyFile struct {
+	Roles map[string][]Action `yaml:"roles"`
+}
+
+// LoadPolicy reads the policy from a YAML file.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	return ParsePolicy(b)
+}
+
+// ParsePolicy parses a YAML policy of the form:
+//
+//	roles:
+//	  admin: ["*"]
+//	  ci: [upload]
+//	  auditor: [proof, verify]
+func ParsePolicy(b []byte) (*Policy, error) {
+	var pf policyFile
+	if err := yaml.Unmarshal(b, &pf); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+
+	p := &Policy{roles: make(map[string]map[Action]bool, len(pf.Roles))}
+	for role, actions := range pf.Roles {
+		p.roles[role] = make(map[Action]bool, len(actions))
+		for _, action := range actions {
+			if !knownActions[action] {
+				return nil, fmt.Errorf("unknown action %q for role %q", action, role)
+			}
+			p.roles[role][action] = true
+		}
+	}
+	return p, nil
+}
+
+// Allowed reports whether any of the roles may perform the action.
+func (p *Policy) Allowed(roles []string, action Action) bool {
+	if p.anyone[action] {
+		return true
+	}
+	for _, role := range roles {
+		actions := p.roles[role]
+		if actions[action] || actions[actionAll] {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize wraps the handler so that it is only called for identities allowed to perform the action.
+// Without a policy the default one applies, reserving the delete and admin actions to the admin role.
+func (s *Server) authorize(action Action, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed(r.Context(), s.policy, s.logger(r.Context()), action, r.Method+" "+routeTemplate(r)) {
+			next(w, r)
+			return
+		}
+
+		s.writeError(w, r, fmt.Errorf("%w: not allowed to perform the %s action", errForbidden, action))
+	})
+}
+
+func (s *GRPCServer) unaryAuthzInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !allowed(ctx, s.policy, s.logger(ctx), grpcActions[info.FullMethod], info.FullMethod) {
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) streamAuthzInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !allowed(ss.Context(), s.policy, s.logger(ss.Context()), grpcActions[info.FullMethod], info.FullMethod) {
+		return status.Error(codes.PermissionDenied, "permission denied")
+	}
+	return handler(srv, ss)
+}
+
+// allowed checks the identity in the context against the policy, logging an audit entry on denial.
+func allowed(ctx context.Context, policy *Policy, log *zap.Logger, action Action, route string) bool {
+	if policy == nil {
+		policy = defaultPolicy
+	}
+
+	identity, ok := auth.FromContext(ctx)
+	if ok && action != "" && policy.Allowed(identity.Roles, action) {
+		return true
+	}
+
+	fields := []zap.Field{
+		zap.String("audit", "authorization_denied"),
+		zap.String("action", string(action)),
+		zap.String("route", route),
+	}
+	if ok {
+		fields = append(fields,
+			zap.String("tenant", identity.TenantID),
+			zap.String("subject", identity.Subject),
+			zap.Strings("roles", identity.Roles))
+	}
+	log.Warn("access denied", fields...)
+	return false
+}
+
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
+}
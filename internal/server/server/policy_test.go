@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	fileserverv1 "github.com/zale144/fileserver/api/fileserver/v1"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+const testPolicy = `
+roles:
+  admin: ["*"]
+  uploader: [upload]
+  reader: [download, proof]
+  auditor: [proof, verify]
+`
+
+// roleAuthenticator authenticates the API keys as the roles with the same name.
+type roleAuthenticator struct{}
+
+func (roleAuthenticator) Authenticate(_ context.Context, creds auth.Credentials) (*auth.Identity, error) {
+	return &auth.Identity{TenantID: auth.DefaultTenant, Subject: creds.APIKey, Roles: []string{creds.APIKey}}, nil
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		roles   []string
+		action  Action
+		allowed bool
+		wantErr bool
+	}{
+		{
+			name:    "Wildcard",
+			policy:  testPolicy,
+			roles:   []string{"admin"},
+			action:  ActionDelete,
+			allowed: true,
+		}, {
+			name:    "Listed action",
+			policy:  testPolicy,
+			roles:   []string{"auditor"},
+			action:  ActionVerify,
+			allowed: true,
+		}, {
+			name:   "Unlisted action",
+			policy: testPolicy,
+			roles:  []string{"auditor"},
+			action: ActionUpload,
+		}, {
+			name:    "Any of the roles",
+			policy:  testPolicy,
+			roles:   []string{"unknown", "uploader"},
+			action:  ActionUpload,
+			allowed: true,
+		}, {
+			name:   "No roles",
+			policy: testPolicy,
+			action: ActionDownload,
+		}, {
+			name:    "Unknown action",
+			policy:  "roles:\n  admin: [destroy]\n",
+			wantErr: true,
+		}, {
+			name:    "Invalid YAML",
+			policy:  "roles: [",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParsePolicy([]byte(tt.policy))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.allowed, policy.Allowed(tt.roles, tt.action))
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 3)
+	router := Router(&Server{Dependencies: &Dependencies{fileSvc: fileSvc, authn: roleAuthenticator{}, policy: policy, log: zap.NewNop()}})
+
+	type route struct {
+		method string
+		path   string
+		body   func() *http.Request
+	}
+	routes := map[Action][]route{
+		ActionUpload: {{
+			method: http.MethodPost,
+			path:   "/file",
+			body: func() *http.Request {
+				req := createFileUploadRequest(t, 1)
+				req.URL.Path = "/file"
+				return req
+			},
+		}},
+		ActionDownload: {
+			{method: http.MethodGet, path: "/file/1"},
+			{method: http.MethodGet, path: "/files/archive"},
+			{method: http.MethodPost, path: "/files/archive"},
+		},
+		ActionProof:  {{method: http.MethodGet, path: "/file/1/proof"}},
+		ActionVerify: {{method: http.MethodPost, path: "/verify"}},
+		ActionDelete: {{method: http.MethodDelete, path: "/file/2"}},
+		ActionAdmin:  {{method: http.MethodPost, path: "/admin/scrub"}},
+	}
+	roles := map[string][]Action{
+		"admin":    {ActionUpload, ActionDownload, ActionProof, ActionVerify, ActionDelete, ActionAdmin},
+		"uploader": {ActionUpload},
+		"reader":   {ActionDownload, ActionProof},
+		"auditor":  {ActionProof, ActionVerify},
+		"unknown":  nil,
+	}
+
+	for role, allowedActions := range roles {
+		allowed := make(map[Action]bool, len(allowedActions))
+		for _, action := range allowedActions {
+			allowed[action] = true
+		}
+
+		for action, actionRoutes := range routes {
+			for _, rt := range actionRoutes {
+				t.Run(role+" "+rt.method+" "+rt.path, func(t *testing.T) {
+					var req *http.Request
+					if rt.body != nil {
+						req = rt.body()
+					} else {
+						req = httptest.NewRequest(rt.method, rt.path, bytes.NewReader([]byte("{}")))
+					}
+					req.Header.Set(apiKeyHeader, role)
+					rr := httptest.NewRecorder()
+					router.ServeHTTP(rr, req)
+
+					if allowed[action] {
+						require.NotEqual(t, http.StatusForbidden, rr.Code)
+					} else {
+						require.Equal(t, http.StatusForbidden, rr.Code)
+						require.Contains(t, rr.Body.String(), `"type":"urn:fileserver:problem:forbidden"`)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestAuthorizeWithoutPolicy(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 3)
+	router := Router(&Server{Dependencies: &Dependencies{fileSvc: fileSvc, authn: roleAuthenticator{}, log: zap.NewNop()}})
+
+	tests := []struct {
+		name     string
+		role     string
+		method   string
+		path     string
+		expected int
+	}{
+		{
+			name:     "Anyone gets a proof",
+			role:     "unknown",
+			method:   http.MethodGet,
+			path:     "/file/0/proof",
+			expected: http.StatusOK,
+		}, {
+			name:     "Delete without the admin role",
+			role:     "unknown",
+			method:   http.MethodDelete,
+			path:     "/file/1",
+			expected: http.StatusForbidden,
+		}, {
+			name:     "Admin route without the admin role",
+			role:     "unknown",
+			method:   http.MethodPost,
+			path:     "/admin/scrub",
+			expected: http.StatusForbidden,
+		}, {
+			name:     "Delete with the admin role",
+			role:     "admin",
+			method:   http.MethodDelete,
+			path:     "/file/2",
+			expected: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set(apiKeyHeader, tt.role)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			require.Equal(t, tt.expected, rr.Code)
+		})
+	}
+}
+
+func TestGRPCAuthorization(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	require.NoError(t, err)
+
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 2)
+	client := newTestGRPCClient(t, fileSvc, WithAuthenticator(roleAuthenticator{}), WithPolicy(policy))
+
+	withRole := func(role string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "x-api-key", role)
+	}
+
+	_, err = client.GetProof(withRole("auditor"), &fileserverv1.GetProofRequest{Index: 0})
+	require.NoError(t, err)
+	_, err = client.GetRoot(withRole("uploader"), &fileserverv1.GetRootRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := client.Download(withRole("reader"), &fileserverv1.DownloadRequest{Index: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	stream, err = client.Download(withRole("auditor"), &fileserverv1.DownloadRequest{Index: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
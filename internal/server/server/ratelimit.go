@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+)
+
+// RateLimit configures the throttling of the callers, a zero limit means there is no limit.
+type RateLimit struct {
+	// RequestsPerSecond and Burst configure the token bucket of every client.
+	RequestsPerSecond float64 `envconfig:"RATE_LIMIT_RPS" default:"10"`
+	Burst             int     `envconfig:"RATE_LIMIT_BURST" default:"20"`
+	// IPRequestsPerSecond and IPBurst configure the token bucket of every IP address, which is checked before
+	// the callers are authenticated, so that bad credentials cannot be tried, nor the authenticator loaded, at will.
+	IPRequestsPerSecond float64 `envconfig:"RATE_LIMIT_IP_RPS" default:"50"`
+	IPBurst             int     `envconfig:"RATE_LIMIT_IP_BURST" default:"100"`
+	// MaxConcurrentUploads and MaxConcurrentDownloads cap the uploads and downloads in progress across all clients.
+	MaxConcurrentUploads   int `envconfig:"MAX_CONCURRENT_UPLOADS" default:"16"`
+	MaxConcurrentDownloads int `envconfig:"MAX_CONCURRENT_DOWNLOADS" default:"64"`
+}
+
+const (
+	// limiterIdleTimeout is how long the token bucket of an idle client is kept.
+	limiterIdleTimeout = 10 * time.Minute
+	// concurrencyRetryAfter is the delay suggested to the clients rejected because of too many requests in progress.
+	concurrencyRetryAfter = time.Second
+)
+
+// clientLimiter keeps a token bucket per client.
+type clientLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiter(rps float64, burst int) *clientLimiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &clientLimiter{
+		limit:   rate.Limit(rps),
+		burst:   max(burst, 1),
+		clients: make(map[string]*clientBucket),
+	}
+}
+
+// allow takes a token from the client's bucket, otherwise it returns how long the client should wait.
+func (l *clientLimiter) allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	l.sweep(now)
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &clientBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[client] = bucket
+	}
+	bucket.lastSeen = now
+	l.mu.Unlock()
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweep forgets the idle clients, at most once per idle timeout.
+func (l *clientLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterIdleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for client, bucket := range l.clients {
+		if now.Sub(bucket.lastSeen) > limiterIdleTimeout {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// semaphore caps the number of operations in progress, a nil semaphore has no cap.
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	if size <= 0 {
+		return nil
+	}
+	return make(semaphore, size)
+}
+
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// RateLimitIP is the middleware throttling every IP address to its token bucket, before the caller is authenticated.
+func (s *Server) RateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := s.ipLimiter.allow(ipKey(r.RemoteAddr))
+		if !ok {
+			s.metrics.Throttled("ip_rate_limit", r.Method+" "+routeTemplate(r))
+			s.writeError(w, r, &throttleError{message: "rate limit exceeded", retryAfter: retryAfter})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RateLimit is the middleware throttling every client to its token bucket.
+// Clients are told apart by their identity, or by their IP address if they are anonymous.
+func (s *Server) RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := s.limiter.allow(clientKey(r.Context(), r.RemoteAddr))
+		if !ok {
+			s.metrics.Throttled("rate_limit", r.Method+" "+routeTemplate(r))
+			s.writeError(w, r, &throttleError{message: "rate limit exceeded", retryAfter: retryAfter})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// throttle rejects the request if the semaphore has no room for it.
+func (s *Server) throttle(sem semaphore, operation string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sem.tryAcquire() {
+			s.metrics.Throttled("concurrency", r.Method+" "+routeTemplate(r))
+			s.writeError(w, r, &throttleError{message: "too many " + operation + "s in progress", retryAfter: concurrencyRetryAfter})
+			return
+		}
+		defer sem.release()
+		next(w, r)
+	}
+}
+
+func (s *GRPCServer) unaryIPRateLimitInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.rateLimitIP(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) streamIPRateLimitInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.rateLimitIP(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (s *GRPCServer) unaryRateLimitInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := s.rateLimit(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) streamRateLimitInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.rateLimit(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+
+	var sem semaphore
+	switch grpcActions[info.FullMethod] {
+	case ActionUpload:
+		sem = s.uploads
+	case ActionDownload:
+		sem = s.downloads
+	}
+	operation := string(grpcActions[info.FullMethod])
+	if !sem.tryAcquire() {
+		s.metrics.Throttled("concurrency", info.FullMethod)
+		return resourceExhausted(ss.Context(), concurrencyRetryAfter, "too many "+operation+"s in progress")
+	}
+	defer sem.release()
+	return handler(srv, ss)
+}
+
+func (s *GRPCServer) rateLimitIP(ctx context.Context, method string) error {
+	if ok, retryAfter := s.ipLimiter.allow(ipKey(peerAddr(ctx))); !ok {
+		s.metrics.Throttled("ip_rate_limit", method)
+		return resourceExhausted(ctx, retryAfter, "rate limit exceeded")
+	}
+	return nil
+}
+
+func (s *GRPCServer) rateLimit(ctx context.Context, method string) error {
+	if ok, retryAfter := s.limiter.allow(clientKey(ctx, peerAddr(ctx))); !ok {
+		s.metrics.Throttled("rate_limit", method)
+		return resourceExhausted(ctx, retryAfter, "rate limit exceeded")
+	}
+	return nil
+}
+
+// peerAddr returns the address of the client of the RPC.
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// resourceExhausted tells the client when to retry in the retry-after header.
+func resourceExhausted(ctx context.Context, retryAfter time.Duration, message string) error {
+	_ = grpc.SetHeader(ctx, metadata.Pairs("retry-after", retryAfterSeconds(retryAfter)))
+	return status.Error(codes.ResourceExhausted, message)
+}
+
+// clientKey identifies the client by its identity, or by its IP address if it is anonymous.
+func clientKey(ctx context.Context, remoteAddr string) string {
+	if identity, ok := auth.FromContext(ctx); ok && identity.Subject != "" {
+		return "identity:" + identity.TenantID + "/" + identity.Subject
+	}
+	return ipKey(remoteAddr)
+}
+
+// ipKey identifies the client by its IP address.
+func ipKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	fileserverv1 "github.com/zale144/fileserver/api/fileserver/v1"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+// requireThrottled checks the throttled requests counted on the registry.
+func requireThrottled(t *testing.T, registry *prometheus.Registry, reason, route string, want int) {
+	t.Helper()
+	expected := `
+# HELP fileserver_throttled_requests_total Number of requests rejected by the rate or the concurrency limits.
+# TYPE fileserver_throttled_requests_total counter
+fileserver_throttled_requests_total{reason="` + reason + `",route="` + route + `"} ` + strconv.Itoa(want) + `
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_throttled_requests_total"))
+}
+
+func TestRateLimit(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 2)
+	registry := prometheus.NewRegistry()
+	srv := NewServer(NewDependencies(Config{RateLimit: RateLimit{RequestsPerSecond: 0.01, Burst: 2}}, fileSvc, zap.NewNop(),
+		WithAuthenticator(roleAuthenticator{}), WithMetrics(metrics.New(registry))))
+	router := Router(srv)
+
+	download := func(apiKey, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/file/1", nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set(apiKeyHeader, apiKey)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	require.Equal(t, http.StatusOK, download("alice", "10.0.0.1:1234").Code)
+	require.Equal(t, http.StatusOK, download("alice", "10.0.0.2:1234").Code)
+	rr := download("alice", "10.0.0.3:1234")
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.NotEmpty(t, rr.Header().Get("Retry-After"))
+	require.Contains(t, rr.Body.String(), `"type":"urn:fileserver:problem:too_many_requests"`)
+
+	// other identities have buckets of their own
+	require.Equal(t, http.StatusOK, download("bob", "10.0.0.1:1234").Code)
+
+	requireThrottled(t, registry, "rate_limit", "GET /file/{index}", 1)
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 2)
+	router := Router(NewServer(NewDependencies(Config{RateLimit: RateLimit{RequestsPerSecond: 0.01, Burst: 1}}, fileSvc, zap.NewNop())))
+
+	download := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/file/1", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusOK, download("10.0.0.1:1234"))
+	require.Equal(t, http.StatusTooManyRequests, download("10.0.0.1:5678"))
+	require.Equal(t, http.StatusOK, download("10.0.0.2:1234"))
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 2)
+	registry := prometheus.NewRegistry()
+	srv := NewServer(NewDependencies(Config{RateLimit: RateLimit{MaxConcurrentUploads: 1, MaxConcurrentDownloads: 1}}, fileSvc, zap.NewNop(),
+		WithMetrics(metrics.New(registry))))
+	router := Router(srv)
+
+	// an upload in progress leaves no room for another one, but does not block the downloads
+	require.True(t, srv.uploads.tryAcquire())
+
+	req := createFileUploadRequest(t, 1)
+	req.URL.Path = "/file"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.Equal(t, "1", rr.Header().Get("Retry-After"))
+	requireThrottled(t, registry, "concurrency", "POST /file", 1)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/file/1", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// the stored set is sent again, a single file would be another set, conflicting with it
+	srv.uploads.release()
+	req = createFileUploadRequest(t, 2)
+	req.URL.Path = "/file"
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 2)
+	client := newTestGRPCClientWithConfig(t, Config{RateLimit: RateLimit{RequestsPerSecond: 0.01, Burst: 1}}, fileSvc,
+		WithAuthenticator(roleAuthenticator{}))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "alice")
+	_, err := client.GetRoot(ctx, &fileserverv1.GetRootRequest{})
+	require.NoError(t, err)
+
+	var header metadata.MD
+	_, err = client.GetRoot(ctx, &fileserverv1.GetRootRequest{}, grpc.Header(&header))
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.NotEmpty(t, header.Get("retry-after"))
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 2)
+	deps := NewDependencies(Config{RateLimit: RateLimit{RequestsPerSecond: 0.01, Burst: 1}}, fileSvc, zap.NewNop(),
+		WithAuthenticator(roleAuthenticator{}))
+	router := Router(NewServer(deps))
+	client := newTestGRPCClientWithDependencies(t, deps)
+
+	// the HTTP and the gRPC APIs draw from the same budget of the caller
+	req := httptest.NewRequest(http.MethodGet, "/file/1", nil)
+	req.Header.Set(apiKeyHeader, "alice")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "alice")
+	_, err := client.GetRoot(ctx, &fileserverv1.GetRootRequest{})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+// countingAuthenticator counts the authentications it performs.
+type countingAuthenticator struct {
+	roleAuthenticator
+	calls atomic.Int32
+}
+
+func (a *countingAuthenticator) Authenticate(ctx context.Context, creds auth.Credentials) (*auth.Identity, error) {
+	a.calls.Add(1)
+	return a.roleAuthenticator.Authenticate(ctx, creds)
+}
+
+func TestRateLimitIPBeforeAuthentication(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 2)
+	registry := prometheus.NewRegistry()
+	authn := &countingAuthenticator{}
+	deps := NewDependencies(Config{RateLimit: RateLimit{IPRequestsPerSecond: 0.01, IPBurst: 2}}, fileSvc, zap.NewNop(),
+		WithAuthenticator(authn), WithMetrics(metrics.New(registry)))
+	router := Router(NewServer(deps))
+
+	download := func(apiKey, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/file/1", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(apiKeyHeader, apiKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// switching credentials does not escape the bucket of the address, which is checked before authenticating
+	require.Equal(t, http.StatusOK, download("alice", "10.0.0.1:1234"))
+	require.Equal(t, http.StatusOK, download("bob", "10.0.0.1:1234"))
+	require.Equal(t, http.StatusTooManyRequests, download("carol", "10.0.0.1:5678"))
+	require.Equal(t, int32(2), authn.calls.Load())
+	require.Equal(t, http.StatusOK, download("carol", "10.0.0.2:1234"))
+	requireThrottled(t, registry, "ip_rate_limit", "GET /file/{index}", 1)
+
+	// the gRPC clients are limited by address before authenticating too
+	client := newTestGRPCClientWithDependencies(t, NewDependencies(Config{RateLimit: RateLimit{IPRequestsPerSecond: 0.01, IPBurst: 1}},
+		fileSvc, zap.NewNop(), WithAuthenticator(authn)))
+	authn.calls.Store(0)
+	_, err := client.GetRoot(metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "alice"), &fileserverv1.GetRootRequest{})
+	require.NoError(t, err)
+	_, err = client.GetRoot(metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "bob"), &fileserverv1.GetRootRequest{})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Equal(t, int32(1), authn.calls.Load())
+}
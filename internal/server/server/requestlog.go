@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/zale144/fileserver/internal/logging"
+	"github.com/zale144/fileserver/internal/server/auth"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength bounds the request IDs accepted from the callers, longer ones are replaced.
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+// withRequestID returns a copy of the context carrying the ID of the request.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the ID of the request carried by the context.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID propagates the ID sent by the caller, or assigns a random one if it is missing or malformed.
+func newRequestID(incoming string) string {
+	if validRequestID(incoming) {
+		return incoming
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// accessLog collects what the access log entry reports about the caller,
+// whose identity is only resolved by the authentication further down the chain.
+type accessLog struct {
+	identity *auth.Identity
+}
+
+type accessLogKey struct{}
+
+// setLogIdentity records the caller's identity for the access log, and adds it to the request-scoped logger.
+func setLogIdentity(ctx context.Context, log *zap.Logger, identity *auth.Identity) context.Context {
+	if entry, ok := ctx.Value(accessLogKey{}).(*accessLog); ok {
+		entry.identity = identity
+	}
+	return logging.WithLogger(ctx, logging.FromContext(ctx, log).With(identityFields(identity)...))
+}
+
+func identityFields(identity *auth.Identity) []zap.Field {
+	if identity == nil {
+		return nil
+	}
+	return []zap.Field{zap.String("tenant", identity.TenantID), zap.String("subject", identity.Subject)}
+}
+
+// requestContext prepares the context of a request with the given ID:
+// it carries the ID, the access log entry and the logger tagged with the ID and the trace.
+func requestContext(ctx context.Context, log *zap.Logger, id string) (context.Context, *accessLog, *zap.Logger) {
+	log = log.With(zap.String("request_id", id))
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		log = log.With(zap.String("trace_id", sc.TraceID().String()))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("request.id", id))
+
+	entry := &accessLog{}
+	ctx = withRequestID(ctx, id)
+	ctx = context.WithValue(ctx, accessLogKey{}, entry)
+	return logging.WithLogger(ctx, log), entry, log
+}
+
+// logger returns the request-scoped logger carried by the context.
+func (s *Server) logger(ctx context.Context) *zap.Logger {
+	return logging.FromContext(ctx, s.log)
+}
+
+// RequestLog is the middleware assigning the request ID, logging every request once it is served,
+// and recovering the panics of the handlers into internal server errors.
+func (s *Server) RequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := newRequestID(r.Header.Get(requestIDHeader))
+		w.Header().Set(requestIDHeader, id)
+
+		ctx, entry, log := requestContext(r.Context(), s.log, id)
+		r = r.WithContext(ctx)
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				log.Error("panic serving request", zap.Any("panic", v), zap.ByteString("stack", debug.Stack()))
+				if !rec.wroteHeader {
+					s.writeError(rec, r, fmt.Errorf("panic: %v", v))
+				}
+			}
+
+			fields := []zap.Field{
+				zap.String("method", r.Method),
+				zap.String("route", routeTemplate(r)),
+				zap.Int("status", rec.status),
+				zap.Int64("bytes", rec.bytes),
+				zap.Duration("duration", time.Since(start)),
+				zap.String("client_ip", remoteHost(r.RemoteAddr)),
+			}
+			log.Info("request served", append(fields, identityFields(entry.identity)...)...)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// responseRecorder records the status and the size of the response for the access log.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (s *GRPCServer) unaryRequestLogInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	ctx, done := s.startRequest(ctx, info.FullMethod)
+	defer func() { done(recover(), &err) }()
+	return handler(ctx, req)
+}
+
+func (s *GRPCServer) streamRequestLogInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, done := s.startRequest(ss.Context(), info.FullMethod)
+	defer func() { done(recover(), &err) }()
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// startRequest is the gRPC counterpart of the RequestLog middleware, the returned function logs the call
+// and turns a recovered panic into an internal error.
+func (s *GRPCServer) startRequest(ctx context.Context, method string) (context.Context, func(panicked any, err *error)) {
+	start := time.Now()
+	var incoming string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(strings.ToLower(requestIDHeader)); len(values) > 0 {
+			incoming = values[0]
+		}
+	}
+	id := newRequestID(incoming)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestIDHeader), id))
+
+	ctx, entry, log := requestContext(ctx, s.log, id)
+	return ctx, func(panicked any, err *error) {
+		if panicked != nil {
+			log.Error("panic serving request", zap.Any("panic", panicked), zap.ByteString("stack", debug.Stack()))
+			*err = status.Error(codes.Internal, problemInternal.title)
+		}
+
+		var clientIP string
+		if p, ok := peer.FromContext(ctx); ok {
+			clientIP = remoteHost(p.Addr.String())
+		}
+		fields := []zap.Field{
+			zap.String("method", method),
+			zap.String("code", status.Code(*err).String()),
+			zap.Duration("duration", time.Since(start)),
+			zap.String("client_ip", clientIP),
+		}
+		log.Info("request served", append(fields, identityFields(entry.identity)...)...)
+	}
+}
+
+// logger returns the request-scoped logger carried by the context.
+func (s *GRPCServer) logger(ctx context.Context) *zap.Logger {
+	return logging.FromContext(ctx, s.log)
+}
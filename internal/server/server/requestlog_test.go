@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	fileserverv1 "github.com/zale144/fileserver/api/fileserver/v1"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestRequestLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		wantID    string
+	}{
+		{
+			name:      "Propagated request ID",
+			requestID: "upload-42",
+			wantID:    "upload-42",
+		}, {
+			name: "Assigned request ID",
+		}, {
+			name:      "Malformed request ID",
+			requestID: "upload 42",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.DebugLevel)
+			log := zap.New(core)
+			fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), log)
+			router := Router(NewServer(NewDependencies(Config{}, fileSvc, log)))
+
+			req := createFileUploadRequest(t, 3)
+			req.URL.Path = "/file"
+			if tt.requestID != "" {
+				req.Header.Set(requestIDHeader, tt.requestID)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			id := rr.Header().Get(requestIDHeader)
+			if tt.wantID != "" {
+				require.Equal(t, tt.wantID, id)
+			} else {
+				require.Len(t, id, 32)
+			}
+
+			served := logs.FilterMessage("request served").AllUntimed()
+			require.Len(t, served, 1)
+			fields := served[0].ContextMap()
+			require.Equal(t, id, fields["request_id"])
+			require.Equal(t, "POST", fields["method"])
+			require.Equal(t, "/file", fields["route"])
+			require.EqualValues(t, http.StatusOK, fields["status"])
+			require.EqualValues(t, rr.Body.Len(), fields["bytes"])
+			require.Equal(t, "default", fields["tenant"])
+
+			// the service logs with the logger of the request
+			uploaded := logs.FilterMessage("files uploaded").AllUntimed()
+			require.Len(t, uploaded, 1)
+			require.Equal(t, id, uploaded[0].ContextMap()["request_id"])
+			require.Equal(t, "default", uploaded[0].ContextMap()["tenant"])
+		})
+	}
+}
+
+func TestRequestLogPanic(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	srv := &Server{Dependencies: &Dependencies{log: zap.New(core)}}
+	router := mux.NewRouter()
+	router.Use(srv.RequestLog)
+	router.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(requestIDHeader, "request-1")
+	router.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	var problem Problem
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&problem))
+	require.Equal(t, problemTypePrefix+"internal_error", problem.Type)
+	require.Equal(t, "request-1", problem.RequestID)
+	require.Empty(t, problem.Detail)
+
+	panics := logs.FilterMessage("panic serving request").AllUntimed()
+	require.Len(t, panics, 1)
+	require.Equal(t, "request-1", panics[0].ContextMap()["request_id"])
+	require.Contains(t, panics[0].ContextMap()["stack"], "TestRequestLogPanic")
+
+	served := logs.FilterMessage("request served").AllUntimed()
+	require.Len(t, served, 1)
+	require.EqualValues(t, http.StatusInternalServerError, served[0].ContextMap()["status"])
+}
+
+// panickingFileService panics on every call it does not get from the embedded service.
+type panickingFileService struct {
+	fileService
+}
+
+func (panickingFileService) Root(context.Context) ([]byte, error) {
+	panic("boom")
+}
+
+func TestGRPCRequestLog(t *testing.T) {
+	client := newTestGRPCClient(t, panickingFileService{})
+
+	var header metadata.MD
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "request-1")
+	_, err := client.GetRoot(ctx, &fileserverv1.GetRootRequest{}, grpc.Header(&header))
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Equal(t, []string{"request-1"}, header.Get("x-request-id"))
+
+	// the server keeps serving after the panic
+	_, err = client.GetRoot(context.Background(), &fileserverv1.GetRootRequest{}, grpc.Header(&header))
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Len(t, header.Get("x-request-id")[0], 32)
+}
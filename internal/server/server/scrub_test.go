@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestAdminScrub(t *testing.T) {
+	repo := newMockRepositoryService()
+	fileSvc := service.NewFile(repo, newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 3)
+	saveTenantFiles(t, auth.WithIdentity(context.Background(), &auth.Identity{TenantID: "acme"}), fileSvc, [][]byte{[]byte("acme0")})
+	s := NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop(), WithAuthenticator(roleAuthenticator{})))
+	router := Router(s)
+	scrub := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/scrub", nil)
+		req.Header.Set(apiKeyHeader, "admin")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the scrub started on demand only checks the files of the caller's tenant
+	rr := scrub()
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	require.JSONEq(t, `{"status":"started","tenantId":"default"}`, rr.Body.String())
+	require.Eventually(t, func() bool {
+		return !s.scrubbing.Load()
+	}, time.Second, 10*time.Millisecond)
+
+	repo.scrubMu.Lock()
+	require.Len(t, repo.scrubRuns, 1)
+	run := repo.scrubRuns[0]
+	repo.scrubMu.Unlock()
+	require.Equal(t, auth.DefaultTenant, run.TenantID)
+	require.Equal(t, 3, run.Checked)
+	require.False(t, run.FinishedAt.IsZero())
+
+	// another scrub is refused while one is running
+	s.scrubbing.Store(true)
+	require.Equal(t, http.StatusConflict, scrub().Code)
+}
@@ -2,46 +2,209 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/tlsconfig"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 	"go.uber.org/zap"
 )
 
+// Dependencies are the dependencies shared by the HTTP and the gRPC servers, so that the callers of both APIs
+// are authenticated, authorized, rate limited and throttled the same way, and share their limits.
+type Dependencies struct {
+	fileSvc fileService
+	authn   authenticator
+	policy  *Policy
+	log     *zap.Logger
+	cfg     Config
+	metrics *metrics.Metrics
+	tls     *tls.Config
+
+	ipLimiter *clientLimiter
+	limiter   *clientLimiter
+	uploads   semaphore
+	downloads semaphore
+}
+
+// NewDependencies creates the dependencies shared by the HTTP and the gRPC servers.
+func NewDependencies(cfg Config, svc fileService, log *zap.Logger, opts ...Option) *Dependencies {
+	d := &Dependencies{
+		fileSvc:   svc,
+		log:       log,
+		cfg:       cfg,
+		ipLimiter: newClientLimiter(cfg.RateLimit.IPRequestsPerSecond, cfg.RateLimit.IPBurst),
+		limiter:   newClientLimiter(cfg.RateLimit.RequestsPerSecond, cfg.RateLimit.Burst),
+		uploads:   newSemaphore(cfg.RateLimit.MaxConcurrentUploads),
+		downloads: newSemaphore(cfg.RateLimit.MaxConcurrentDownloads),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Option configures optional dependencies shared by the servers.
+type Option func(*Dependencies)
+
+// WithAuthenticator makes the servers authenticate the callers,
+// without it every caller is anonymous and belongs to the default tenant.
+func WithAuthenticator(authn authenticator) Option {
+	return func(d *Dependencies) {
+		d.authn = authn
+	}
+}
+
+// WithPolicy makes the servers authorize the callers by their roles,
+// without it only the admin role may delete files and call the admin routes, and every caller may do the rest.
+func WithPolicy(policy *Policy) Option {
+	return func(d *Dependencies) {
+		d.policy = policy
+	}
+}
+
+// WithMetrics makes the servers record the throttled requests.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(d *Dependencies) {
+		d.metrics = m
+	}
+}
+
+// WithTLS makes the HTTP and gRPC servers serve TLS with the configuration.
+func WithTLS(cfg *tls.Config) Option {
+	return func(d *Dependencies) {
+		d.tls = cfg
+	}
+}
+
 // NewServer creates a new server.
-func NewServer(cfg Config, svc fileService, log *zap.Logger) *Server {
-	return &Server{
-		fileSvc: svc,
-		log:     log,
-		cfg:     cfg,
+func NewServer(deps *Dependencies, opts ...ServerOption) *Server {
+	s := &Server{Dependencies: deps}
+	s.jobsCtx, s.cancelJobs = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Server is the HTTP server.
 type Server struct {
-	fileSvc fileService
-	log     *zap.Logger
-	cfg     Config
+	*Dependencies
+
+	// scrubRate is the maximum number of files checked per second by the scrubs started on demand.
+	scrubRate float64
+	scrubbing atomic.Bool
+
+	// jobs are the background jobs started by the requests, like the scrubs started on demand,
+	// their context is canceled on shutdown and they are waited for along with the uploads.
+	jobs       sync.WaitGroup
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+
+	readinessChecks []HealthCheck
+	shuttingDown    atomic.Bool
+	shutdownHooks   []func(context.Context)
+}
+
+// ServerOption configures optional settings of the HTTP server.
+type ServerOption func(*Server)
+
+// WithScrubRate limits the scrubs started on demand to filesPerSecond files checked per second,
+// without it they are not limited.
+func WithScrubRate(filesPerSecond float64) ServerOption {
+	return func(s *Server) {
+		s.scrubRate = filesPerSecond
+	}
+}
+
+// WithShutdownHook runs the hook along with the shutdown of the HTTP server, with the same deadline,
+// e.g. to stop the gRPC server.
+func WithShutdownHook(hook func(context.Context)) ServerOption {
+	return func(s *Server) {
+		s.shutdownHooks = append(s.shutdownHooks, hook)
+	}
 }
 
 // Config is the configuration for the server.
 type Config struct {
-	Address    string `envconfig:"HTTP_ADDRESS" default:":8080"`
-	TimeoutSec int    `envconfig:"HTTP_TIMEOUT_SEC" default:"10"`
+	Address     string `envconfig:"HTTP_ADDRESS" default:":8080"`
+	TimeoutSec  int    `envconfig:"HTTP_TIMEOUT_SEC" default:"10"`
+	GRPCAddress string `envconfig:"GRPC_ADDRESS" default:":9090"`
+	PolicyFile  string `envconfig:"POLICY_FILE"`
+	Limits      Limits
+	RateLimit   RateLimit
+	TLS         tlsconfig.Server
+	// ShutdownDelay is how long the server keeps serving after failing the readiness probe on shutdown,
+	// giving the load balancers time to stop routing requests to it.
+	ShutdownDelay time.Duration `envconfig:"SHUTDOWN_DELAY" default:"0s"`
+	// ShutdownTimeout is how long the requests in progress, notably the uploads, are given to finish on shutdown,
+	// the uploads still running after it are aborted and rolled back.
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+	// MetricsAddress is the address /metrics is served on, apart from the API so that it is not exposed
+	// to its callers, empty disables it.
+	MetricsAddress string `envconfig:"METRICS_ADDRESS" default:":9100"`
+}
+
+// ExposedAddresses returns the addresses the API is served on that are reachable from other hosts,
+// that is all but the loopback ones.
+func (c Config) ExposedAddresses() []string {
+	var exposed []string
+	for _, address := range []string{c.Address, c.GRPCAddress} {
+		if !isLoopback(address) {
+			exposed = append(exposed, address)
+		}
+	}
+	return exposed
+}
+
+// isLoopback reports whether the address only listens on the loopback interface,
+// an address without a host listens on all of them.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func Router(s *Server) *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/file/{index}", s.DownloadFile).Methods("GET")
-	r.HandleFunc("/file", s.UploadMultiple).Methods("POST")
-	r.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
+	r.HandleFunc("/healthz", s.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", s.Readyz).Methods("GET")
+
+	api := r.NewRoute().Subrouter()
+	api.Use(otelmux.Middleware("fileserver"), s.RequestLog, s.RateLimitIP, s.Authenticate, s.RateLimit)
+	api.Handle("/file/{index}", s.authorize(ActionDownload, s.throttle(s.downloads, "download", s.DownloadFile))).Methods("GET")
+	api.Handle("/file/{index}", s.authorize(ActionDelete, s.DeleteFile)).Methods("DELETE")
+	api.Handle("/file/{index}/content", s.authorize(ActionDownload, s.throttle(s.downloads, "download", s.DownloadContent))).Methods("GET")
+	api.Handle("/file/{index}/proof", s.authorize(ActionProof, s.GetProof)).Methods("GET")
+	api.Handle("/file", s.authorize(ActionUpload, s.throttle(s.uploads, "upload", s.UploadMultiple))).Methods("POST")
+	api.Handle("/files/archive", s.authorize(ActionDownload, s.throttle(s.downloads, "download", s.DownloadArchive))).Methods("GET")
+	api.Handle("/files/archive", s.authorize(ActionDownload, s.throttle(s.downloads, "download", s.DownloadArchiveIndexes))).Methods("POST")
+	api.Handle("/verify", s.authorize(ActionVerify, s.VerifyFile)).Methods("POST")
+	api.Handle("/admin/scrub", s.authorize(ActionAdmin, s.Scrub)).Methods("POST")
+	return r
+}
+
+// MetricsRouter serves the metrics on /metrics, to be listened on the metrics address rather than the API one.
+func MetricsRouter(m *metrics.Metrics) *mux.Router {
+	r := mux.NewRouter()
+	r.Handle("/metrics", m.Handler()).Methods("GET")
 	return r
 }
 
@@ -56,15 +219,23 @@ func (s *Server) StartServer(r *mux.Router) error {
 		Addr:         s.cfg.Address,
 		WriteTimeout: timeout,
 		ReadTimeout:  timeout,
+		TLSConfig:    s.tls,
 	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if s.tls != nil {
+			// the certificates come from the TLS configuration
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			s.log.Fatal("Could not listen on", zap.String("address", s.cfg.Address), zap.Error(err))
 		}
 	}()
 
-	s.log.Info("Server is ready to handle requests", zap.String("address", s.cfg.Address))
+	s.log.Info("Server is ready to handle requests", zap.String("address", s.cfg.Address), zap.Bool("tls", s.tls != nil))
 	select {
 	case killSignal := <-interrupt:
 		switch killSignal {
@@ -76,9 +247,66 @@ func (s *Server) StartServer(r *mux.Router) error {
 	}
 
 	s.log.Info("The service is shutting down...")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		return fmt.Errorf("could not gracefully shutdown the server: %w", err)
+	s.shuttingDown.Store(true)
+	if s.cfg.ShutdownDelay > 0 {
+		s.log.Info("Waiting for the load balancers to notice the shutdown", zap.Duration("delay", s.cfg.ShutdownDelay))
+		time.Sleep(s.cfg.ShutdownDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	if err := s.shutdown(ctx, srv); err != nil {
+		return err
 	}
 	s.log.Info("Server stopped")
 	return nil
 }
+
+// shutdown stops accepting connections and uploads, and waits for the requests in progress until the context is done.
+// The uploads still running then are aborted and rolled back, and the remaining connections closed.
+func (s *Server) shutdown(ctx context.Context, srv *http.Server) error {
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	var wg sync.WaitGroup
+	for _, hook := range s.shutdownHooks {
+		wg.Add(1)
+		go func(hook func(context.Context)) {
+			defer wg.Done()
+			hook(ctx)
+		}(hook)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.stopJobs(ctx)
+	}()
+
+	report := s.fileSvc.Shutdown(ctx)
+	s.log.Info("Uploads drained", zap.Int("finished", report.Finished), zap.Int("aborted", len(report.Aborted)))
+	wg.Wait()
+
+	if err := <-shutdownErr; err != nil {
+		// the handlers of the aborted uploads are done with the rollback by now
+		_ = srv.Close()
+		return fmt.Errorf("could not gracefully shutdown the server: %w", err)
+	}
+	return nil
+}
+
+// stopJobs cancels the background jobs started by the requests and waits for them to stop until the context is done.
+func (s *Server) stopJobs(ctx context.Context) {
+	s.cancelJobs()
+	stopped := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.log.Warn("Background jobs did not stop before the shutdown deadline")
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+// blockingStorage is an in-memory storage that, once blocking, stores the first object of an upload
+// and then holds the upload until it is released or canceled.
+type blockingStorage struct {
+	*mockStorageService
+	blocking atomic.Bool
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func newBlockingStorage() *blockingStorage {
+	return &blockingStorage{
+		mockStorageService: newMockStorageService(false),
+		started:            make(chan struct{}, 1),
+		release:            make(chan struct{}),
+	}
+}
+
+func (s *blockingStorage) UploadMultiple(ctx context.Context, objects <-chan *model.Object) error {
+	if !s.blocking.Load() {
+		return s.mockStorageService.UploadMultiple(ctx, objects)
+	}
+
+	if err := s.store(<-objects); err != nil {
+		return err
+	}
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return s.mockStorageService.UploadMultiple(ctx, objects)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startUpload serves the upload request in the background, its response is sent to the returned channel.
+func startUpload(router http.Handler, req *http.Request) <-chan *httptest.ResponseRecorder {
+	respCh := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		respCh <- rr
+	}()
+	return respCh
+}
+
+func newUploadRequest(t *testing.T, numFiles int) *http.Request {
+	req := createFileUploadRequest(t, numFiles)
+	req.URL.Path = "/file"
+	return req
+}
+
+func requireProblem(t *testing.T, rr *httptest.ResponseRecorder, wantStatus int, wantType string) {
+	require.Equal(t, wantStatus, rr.Code)
+	var problem Problem
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&problem))
+	require.Equal(t, problemTypePrefix+wantType, problem.Type)
+}
+
+func TestShutdownDrainsUploads(t *testing.T) {
+	storage := newBlockingStorage()
+	storage.blocking.Store(true)
+	fileSvc := service.NewFile(newMockRepositoryService(), storage, zap.NewNop())
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop())))
+
+	respCh := startUpload(router, newUploadRequest(t, 3))
+	<-storage.started
+
+	reportCh := make(chan *model.ShutdownReport, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		reportCh <- fileSvc.Shutdown(ctx)
+	}()
+	require.Never(t, func() bool { return len(reportCh) > 0 }, 100*time.Millisecond, 10*time.Millisecond,
+		"the shutdown waits for the upload in progress")
+
+	close(storage.release)
+	report := <-reportCh
+	require.Equal(t, 1, report.Finished)
+	require.Empty(t, report.Aborted)
+	require.Equal(t, http.StatusOK, (<-respCh).Code)
+	require.Equal(t, 3, storage.objects())
+
+	// no uploads are accepted anymore
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, newUploadRequest(t, 1))
+	requireProblem(t, rr, http.StatusServiceUnavailable, "unavailable")
+}
+
+func TestShutdownAbortsUploads(t *testing.T) {
+	storage := newBlockingStorage()
+	repo := newMockRepositoryService()
+	fileSvc := service.NewFile(repo, storage, zap.NewNop())
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop())))
+
+	// the object of the committed file has the same content as the first file of the aborted upload
+	saveTestFiles(t, fileSvc, 1)
+	require.Equal(t, 1, storage.objects())
+	usage := repo.usage[auth.DefaultTenant]
+
+	storage.blocking.Store(true)
+	respCh := startUpload(router, newUploadRequest(t, 3))
+	<-storage.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report := fileSvc.Shutdown(ctx)
+	require.Equal(t, 0, report.Finished)
+	require.Equal(t, []model.AbortedUpload{{TenantID: auth.DefaultTenant, Files: 3, Bytes: 15}}, report.Aborted)
+
+	requireProblem(t, <-respCh, http.StatusServiceUnavailable, "unavailable")
+
+	// the aborted upload left nothing behind, but the committed file is intact
+	require.Equal(t, 1, storage.objects())
+	files, err := repo.List(context.Background(), auth.DefaultTenant, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	_, err = fileSvc.Open(context.Background(), files[0])
+	require.NoError(t, err)
+	require.Equal(t, usage, repo.usage[auth.DefaultTenant])
+}
+
+func TestShutdownStopsScrub(t *testing.T) {
+	repo := newMockRepositoryService()
+	fileSvc := service.NewFile(repo, newMockStorageService(false), zap.NewNop())
+	saveTestFiles(t, fileSvc, 3)
+	// the scrub checks a file every 10 seconds, so it is still running when the server shuts down
+	s := NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop(), WithAuthenticator(roleAuthenticator{})), WithScrubRate(0.1))
+	router := Router(s)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/scrub", nil)
+	req.Header.Set(apiKeyHeader, "admin")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusAccepted, rr.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.shutdown(ctx, &http.Server{}))
+	require.False(t, s.scrubbing.Load())
+
+	// the interrupted scrub recorded its run before the shutdown returned
+	repo.scrubMu.Lock()
+	defer repo.scrubMu.Unlock()
+	require.Len(t, repo.scrubRuns, 1)
+	require.Less(t, repo.scrubRuns[0].Checked, 3)
+	require.False(t, repo.scrubRuns[0].FinishedAt.IsZero())
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	router := Router(NewServer(NewDependencies(Config{}, fileSvc, zap.NewNop())))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := createFileUploadRequest(t, 3)
+	req.URL.Path = "/file"
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		require.Equal(t, traceID, span.SpanContext().TraceID().String(), span.Name())
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"/file", "server.read_parts", "service.upload", "service.receive", "merkle.build_tree"} {
+		require.Contains(t, spans, name)
+	}
+	require.Equal(t, spans["/file"].SpanContext().SpanID(), spans["service.upload"].Parent().SpanID())
+	require.Equal(t, spans["service.upload"].SpanContext().SpanID(), spans["merkle.build_tree"].Parent().SpanID())
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/service"
+)
+
+func TestUploadSpool(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     Limits
+		wantStatus int
+	}{
+		{
+			name:       "Committed",
+			wantStatus: http.StatusOK,
+		}, {
+			name:       "File too large",
+			limits:     Limits{MaxFileBytes: 4},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop(), service.WithSpoolDir(dir))
+			router := Router(NewServer(NewDependencies(Config{Limits: tt.limits}, fileSvc, zap.NewNop())))
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, newUploadRequest(t, 3))
+			require.Equal(t, tt.wantStatus, rr.Code)
+
+			// the upload is spooled to a temporary file, which is removed once the upload is done
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/model"
+	"go.uber.org/zap"
+)
+
+// VerifyRequest holds a file, given either by its content or by its hex encoded hash, and the claimed Merkle root.
+type VerifyRequest struct {
+	Index   *int   `json:"index"`
+	Content []byte `json:"content,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Root    string `json:"root"`
+}
+
+type VerifyResponse struct {
+	Index int  `json:"index"`
+	Valid bool `json:"valid"`
+}
+
+// VerifyFile checks the file against the stored Merkle proof of its index and the claimed root.
+func (s *Server) VerifyFile(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req VerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, r, invalidInput("invalid request body: %v", err))
+		return
+	}
+	if req.Index == nil {
+		s.writeError(w, r, invalidInput("index is required"))
+		return
+	}
+	if (req.Content == nil) == (req.Hash == "") {
+		s.writeError(w, r, invalidInput("exactly one of content or hash is required"))
+		return
+	}
+
+	root, err := hex.DecodeString(req.Root)
+	if err != nil || len(root) == 0 {
+		s.writeError(w, r, invalidInput("invalid root %q", req.Root))
+		return
+	}
+
+	fileHash := merkle.HashData(req.Content)
+	if req.Hash != "" {
+		if fileHash, err = hex.DecodeString(req.Hash); err != nil {
+			s.writeError(w, r, invalidInput("invalid hash %q", req.Hash))
+			return
+		}
+	}
+
+	files, err := s.fileSvc.GetMetadata(r.Context(), []int{*req.Index})
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	if len(files) == 0 {
+		s.writeError(w, r, fmt.Errorf("file %d: %w", *req.Index, model.ErrNotFound))
+		return
+	}
+
+	err = s.fileSvc.Verify(&model.File{Metadata: files[0]}, fileHash, root)
+	response := VerifyResponse{
+		Index: *req.Index,
+		Valid: err == nil,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger(r.Context()).Error("error encoding response", zap.Error(err))
+	}
+}
+
+// Interface assertions.
+var _ http.HandlerFunc = (*Server)(nil).VerifyFile
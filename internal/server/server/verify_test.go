@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/service"
+	"go.uber.org/zap"
+)
+
+func TestVerifyFile(t *testing.T) {
+	fileSvc := service.NewFile(newMockRepositoryService(), newMockStorageService(false), zap.NewNop())
+	root := saveTestFiles(t, fileSvc, 4)
+	rootHex := fmt.Sprintf("%x", root)
+	content := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name           string
+		body           string
+		wantValid      bool
+		wantStatusCode int
+	}{
+		{
+			name:           "Valid content",
+			body:           fmt.Sprintf(`{"index":1,"content":%q,"root":%q}`, content("test1"), rootHex),
+			wantValid:      true,
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Valid hash",
+			body:           fmt.Sprintf(`{"index":2,"hash":"%x","root":%q}`, merkle.HashData([]byte("test2")), rootHex),
+			wantValid:      true,
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Content of another index",
+			body:           fmt.Sprintf(`{"index":1,"content":%q,"root":%q}`, content("test2"), rootHex),
+			wantValid:      false,
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Wrong root",
+			body:           fmt.Sprintf(`{"index":0,"content":%q,"root":"%x"}`, content("test0"), merkle.HashData([]byte("root"))),
+			wantValid:      false,
+			wantStatusCode: http.StatusOK,
+		}, {
+			name:           "Missing index",
+			body:           fmt.Sprintf(`{"content":%q,"root":%q}`, content("test0"), rootHex),
+			wantStatusCode: http.StatusBadRequest,
+		}, {
+			name:           "Both content and hash",
+			body:           fmt.Sprintf(`{"index":0,"content":%q,"hash":"00","root":%q}`, content("test0"), rootHex),
+			wantStatusCode: http.StatusBadRequest,
+		}, {
+			name:           "Invalid root",
+			body:           fmt.Sprintf(`{"index":0,"content":%q,"root":"xyz"}`, content("test0")),
+			wantStatusCode: http.StatusBadRequest,
+		}, {
+			name:           "File not found",
+			body:           fmt.Sprintf(`{"index":99,"content":%q,"root":%q}`, content("test0"), rootHex),
+			wantStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/verify", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			Router(&Server{Dependencies: &Dependencies{fileSvc: fileSvc, log: zap.NewNop()}}).ServeHTTP(rr, req)
+
+			require.Equal(t, tt.wantStatusCode, rr.Code)
+			if tt.wantStatusCode != http.StatusOK {
+				return
+			}
+
+			var resp VerifyResponse
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+			require.Equal(t, tt.wantValid, resp.Valid)
+		})
+	}
+}
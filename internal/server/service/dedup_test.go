@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// countingStorage counts the objects sent to the storage.
+type countingStorage struct {
+	*memStorage
+	sent atomic.Int64
+}
+
+func (s *countingStorage) UploadMultiple(ctx context.Context, objects <-chan *model.Object) error {
+	counted := make(chan *model.Object)
+	go func() {
+		defer close(counted)
+		for object := range objects {
+			s.sent.Add(1)
+			counted <- object
+		}
+	}()
+	return s.memStorage.UploadMultiple(ctx, counted)
+}
+
+func TestUploadDedup(t *testing.T) {
+	tests := []struct {
+		name string
+		// stored are the files uploaded first, deleted are the indexes of the ones deleted afterwards
+		stored     []string
+		deleted    []int
+		data       []string
+		wantResult *model.UploadResult
+		wantSent   int64
+		wantErr    error
+	}{
+		{
+			name:       "Unique contents",
+			data:       []string{"test0", "test1", "test2"},
+			wantResult: &model.UploadResult{Files: 3, Bytes: 15},
+			wantSent:   3,
+		}, {
+			name:       "Repeated contents",
+			data:       []string{"test0", "test0", "test1"},
+			wantResult: &model.UploadResult{Files: 3, Bytes: 15, DedupFiles: 1, DedupBytes: 5},
+			wantSent:   2,
+		}, {
+			name:       "Upload sent again",
+			stored:     []string{"test0", "test1", "test2"},
+			data:       []string{"test0", "test1", "test2"},
+			wantResult: &model.UploadResult{Files: 3, Bytes: 15, DedupFiles: 3, DedupBytes: 15},
+		}, {
+			name:       "Content of a deleted file",
+			stored:     []string{"test0", "test1", "test2"},
+			deleted:    []int{2},
+			data:       []string{"test0", "test1", "test2"},
+			wantResult: &model.UploadResult{Files: 3, Bytes: 15, DedupFiles: 2, DedupBytes: 10},
+			wantSent:   1,
+		}, {
+			// the stored files have the same contents but the proofs of another set
+			name:     "Different set at the same indexes",
+			stored:   []string{"test0", "test1"},
+			data:     []string{"test0", "test1", "test2"},
+			wantSent: 1,
+			wantErr:  model.ErrConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			storage := &countingStorage{memStorage: newMemStorage()}
+			fileSvc := NewFile(newMemRepository(), storage, zap.NewNop())
+
+			if len(tt.stored) > 0 {
+				saveFiles(t, ctx, fileSvc, toBytes(tt.stored))
+			}
+			for _, index := range tt.deleted {
+				require.NoError(t, fileSvc.Delete(ctx, index))
+			}
+			storage.sent.Store(0)
+
+			result, err := fileSvc.SaveStream(ctx, sendFiles(toBytes(tt.data)))
+			require.Equal(t, tt.wantSent, storage.sent.Load())
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				// the stored files keep their proofs
+				for i, d := range tt.stored {
+					require.Equal(t, d, readFile(t, fileSvc, i))
+					file, err := fileSvc.Get(ctx, i)
+					require.NoError(t, err)
+					file.Content.Close()
+					require.Equal(t, merkle.NewTree(toBytes(tt.stored)).Proofs[i], [][]byte(file.Metadata.MerkleProof))
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantResult, result)
+
+			// every file can be read, whether its content was sent or not
+			for i, d := range tt.data {
+				require.Equal(t, d, readFile(t, fileSvc, i))
+			}
+		})
+	}
+}
+
+func TestRefcountCollection(t *testing.T) {
+	ctx := context.Background()
+	storage := newMemStorage()
+	fileSvc := NewFile(newGCRepository(), storage, zap.NewNop())
+
+	// the first two files share their content, and so their object
+	saveFiles(t, ctx, fileSvc, toBytes([]string{"test0", "test0", "test1"}))
+	require.Len(t, storage.keys(), 2)
+	shared := model.ObjectKey(auth.DefaultTenant, merkle.HashData([]byte("test0")))
+
+	collect := func() *model.GCReport {
+		report, err := fileSvc.CollectGarbage(ctx, GCOptions{GracePeriod: -time.Second})
+		require.NoError(t, err)
+		return report
+	}
+
+	// the object is kept as long as a file refers to it
+	require.NoError(t, fileSvc.Delete(ctx, 0))
+	require.Zero(t, collect().Collected)
+	_, ok := storage.load(shared)
+	require.True(t, ok)
+	require.Equal(t, "test0", readFile(t, fileSvc, 1))
+
+	// and collected once its reference count drops to zero
+	require.NoError(t, fileSvc.Delete(ctx, 1))
+	report := collect()
+	require.Equal(t, 1, report.Collected)
+	require.Equal(t, shared, report.Orphans[0].Key)
+	require.Len(t, storage.keys(), 1)
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/envelope"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/storage"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	ctx := context.Background()
+	keyring, err := envelope.ParseKeyring([]string{"k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, envelope.KeySize))}, "")
+	require.NoError(t, err)
+	backend := storage.NewMemory()
+	fileSvc := NewFile(newMemRepository(), storage.NewEncrypted(backend, keyring), zap.NewNop())
+	root := saveTestFiles(t, fileSvc, 3)
+
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("test%d", i))
+		// the backend holds the ciphertext under the key of the hash of the plaintext
+		content, err := backend.DownloadRange(ctx, testObjectKey(i), 0, -1)
+		require.NoError(t, err)
+		ciphertext, err := io.ReadAll(content)
+		content.Close()
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(ciphertext, data))
+
+		// the files are read back decrypted, and their proofs commit to the plaintext
+		file, err := fileSvc.Get(ctx, i)
+		require.NoError(t, err)
+		plaintext, err := io.ReadAll(file.Content)
+		file.Content.Close()
+		require.NoError(t, err)
+		require.Equal(t, data, plaintext)
+		require.Equal(t, merkle.HashData(data), file.Metadata.Hash)
+		require.True(t, merkle.VerifyProof(i, file.Metadata.Hash, file.Metadata.MerkleProof, root))
+	}
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// gcBatchSize is the number of orphans deleted or quarantined at once.
+const gcBatchSize = 1000
+
+// GCOptions configures a garbage collection run.
+type GCOptions struct {
+	// GracePeriod protects the objects modified, and the uploads started, more recently than that,
+	// so that the objects of the uploads in progress are not collected.
+	GracePeriod time.Duration
+	// Quarantine moves the orphans under model.QuarantinePrefix instead of deleting them.
+	Quarantine bool
+	// DryRun only reports the orphans, without collecting them nor failing the abandoned uploads.
+	DryRun bool
+}
+
+// GCOptions returns the options of the periodic garbage collection runs.
+func (c Config) GCOptions() GCOptions {
+	return GCOptions{
+		GracePeriod: c.GCGracePeriod,
+		Quarantine:  c.GCQuarantine,
+	}
+}
+
+// CollectGarbage deletes, or quarantines, the stored objects that neither a file nor a pending upload refers to,
+// that is the objects whose reference count dropped to zero and the ones left behind by the failed uploads.
+// It first marks the object keys referenced in the repository, failing the uploads pending for longer than
+// the grace period, and then sweeps the storage for the objects older than the grace period that are not marked.
+// Before collecting the orphans it checks them again, since they may have been uploaded again during the sweep.
+// Finally it forgets the objects that have been unreferenced for longer than the grace period.
+func (f *File) CollectGarbage(ctx context.Context, opts GCOptions) (_ *model.GCReport, err error) {
+	ctx, end := f.trace(ctx, "gc")
+	defer end(&err)
+
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	report := &model.GCReport{DryRun: opts.DryRun}
+	if !opts.DryRun {
+		if report.AbandonedUploads, err = f.repo.FailAbandonedUploads(ctx, cutoff); err != nil {
+			return nil, fmt.Errorf("failed to fail abandoned uploads: %w", err)
+		}
+	}
+	referenced, err := f.repo.ReferencedKeys(ctx, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get referenced objects: %w", err)
+	}
+
+	err = f.storage.Walk(ctx, func(object model.StoredObject) error {
+		report.Scanned++
+		if referenced[object.Key] || object.LastModified.After(cutoff) || strings.HasPrefix(object.Key, model.QuarantinePrefix) {
+			return nil
+		}
+		// the objects that are not the content of a file are left alone
+		if _, _, ok := model.ParseObjectKey(object.Key); ok {
+			report.Orphans = append(report.Orphans, object)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored objects: %w", err)
+	}
+
+	pruned := 0
+	if !opts.DryRun {
+		if err = f.collect(ctx, report, cutoff, opts.Quarantine); err != nil {
+			return report, err
+		}
+		if pruned, err = f.repo.PruneObjects(ctx, cutoff); err != nil {
+			return report, fmt.Errorf("failed to prune unreferenced objects: %w", err)
+		}
+	}
+	f.logger(ctx).Info("garbage collection finished",
+		zap.Bool("dry_run", opts.DryRun),
+		zap.Int("scanned", report.Scanned),
+		zap.Int("orphans", len(report.Orphans)),
+		zap.Int64("orphan_bytes", report.OrphanBytes()),
+		zap.Int("collected", report.Collected),
+		zap.Int("kept", report.Kept),
+		zap.Int("pruned", pruned),
+		zap.Int("abandoned_uploads", report.AbandonedUploads))
+	return report, nil
+}
+
+// collect deletes or quarantines the orphans of the report in batches. Right before a batch is collected,
+// the orphans referenced again, or modified after the cutoff, are kept.
+func (f *File) collect(ctx context.Context, report *model.GCReport, cutoff time.Time, quarantine bool) error {
+	action, remove := "deleted", f.storage.Delete
+	if quarantine {
+		action, remove = "quarantined", f.storage.Quarantine
+	}
+
+	for start := 0; start < len(report.Orphans); start += gcBatchSize {
+		batch := report.Orphans[start:min(start+gcBatchSize, len(report.Orphans))]
+		keys, err := f.recheckOrphans(ctx, batch, cutoff)
+		if err != nil {
+			return err
+		}
+		report.Kept += len(batch) - len(keys)
+		if len(keys) == 0 {
+			continue
+		}
+		if err = remove(ctx, keys); err != nil {
+			return fmt.Errorf("failed to collect orphaned objects: %w", err)
+		}
+		report.Collected += len(keys)
+		f.metrics.OrphansCollected(action, len(keys))
+	}
+	return nil
+}
+
+// recheckOrphans returns the keys of the orphans still unreferenced and not modified after the cutoff.
+func (f *File) recheckOrphans(ctx context.Context, orphans []model.StoredObject, cutoff time.Time) ([]string, error) {
+	referenced, err := f.repo.ReferencedKeys(ctx, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get referenced objects: %w", err)
+	}
+
+	keys := make([]string, 0, len(orphans))
+	for _, orphan := range orphans {
+		if referenced[orphan.Key] {
+			continue
+		}
+		object, err := f.storage.Stat(ctx, orphan.Key)
+		if errors.Is(err, model.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat orphaned object %s: %w", orphan.Key, err)
+		}
+		if !object.LastModified.After(cutoff) {
+			keys = append(keys, orphan.Key)
+		}
+	}
+	return keys, nil
+}
+
+// RunGC runs CollectGarbage every interval until the context is canceled.
+func (f *File) RunGC(ctx context.Context, interval time.Duration, opts GCOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := f.CollectGarbage(ctx, opts); err != nil && ctx.Err() == nil {
+			f.log.Error("failed to collect garbage", zap.Error(err))
+		}
+	}
+}
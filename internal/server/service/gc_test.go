@@ -0,0 +1,258 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// gcRepository is an in-memory repository marking the objects referenced by the files and the pending uploads.
+type gcRepository struct {
+	*memRepository
+}
+
+func newGCRepository() *gcRepository {
+	return &gcRepository{memRepository: newMemRepository()}
+}
+
+func (r *gcRepository) ReferencedKeys(_ context.Context, pendingSince time.Time) (map[string]bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make(map[string]bool)
+	for key, object := range r.objects {
+		if object.refcount > 0 {
+			keys[key] = true
+		}
+	}
+	for _, upload := range r.uploads {
+		if upload.State == model.UploadPending && !upload.CreatedAt.Before(pendingSince) {
+			for _, hash := range upload.Hashes {
+				keys[model.ObjectKey(upload.TenantID, hash)] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (r *gcRepository) FailAbandonedUploads(_ context.Context, before time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	abandoned := 0
+	for _, upload := range r.uploads {
+		if upload.State == model.UploadPending && upload.CreatedAt.Before(before) {
+			upload.State = model.UploadFailed
+			r.release(upload.TenantID, upload.Usage)
+			abandoned++
+		}
+	}
+	return abandoned, nil
+}
+
+func (r *gcRepository) PruneObjects(_ context.Context, _ time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pruned := 0
+	for key, object := range r.objects {
+		if object.refcount == 0 {
+			delete(r.objects, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// backdateUpload moves the creation of the upload back by d.
+func (r *gcRepository) backdateUpload(id int64, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploads[id].CreatedAt = r.uploads[id].CreatedAt.Add(-d)
+}
+
+// backdateObjects moves the last modification of every stored object back by d.
+func backdateObjects(storage *memStorage, d time.Duration) {
+	for _, key := range storage.keys() {
+		data, _ := storage.load(key)
+		storage.store(key, data, time.Now().Add(-d))
+	}
+}
+
+func gcTestKey(data string) string {
+	return model.ObjectKey(auth.DefaultTenant, merkle.HashData([]byte(data)))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	orphans := []string{gcTestKey("abandoned"), gcTestKey("orphan"), gcTestKey("test2")}
+	sort.Strings(orphans)
+	kept := []string{gcTestKey("test0"), gcTestKey("test1"), gcTestKey("fresh"), gcTestKey("pending"), "readme.txt", model.QuarantinePrefix + gcTestKey("old")}
+
+	tests := []struct {
+		name          string
+		opts          GCOptions
+		wantCollected int
+		wantState     model.UploadState
+		// wantLeft are the orphans left in storage after the run
+		wantLeft  []string
+		wantMoved bool
+	}{
+		{
+			name:      "Dry run",
+			opts:      GCOptions{GracePeriod: time.Hour, DryRun: true},
+			wantState: model.UploadPending,
+			wantLeft:  orphans,
+		}, {
+			name:          "Delete",
+			opts:          GCOptions{GracePeriod: time.Hour},
+			wantCollected: 3,
+			wantState:     model.UploadFailed,
+		}, {
+			name:          "Quarantine",
+			opts:          GCOptions{GracePeriod: time.Hour, Quarantine: true},
+			wantCollected: 3,
+			wantState:     model.UploadFailed,
+			wantMoved:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := prometheus.NewRegistry()
+			repo := newGCRepository()
+			storage := newMemStorage()
+			fileSvc := NewFile(repo, storage, zap.NewNop(), WithMetrics(metrics.New(registry)))
+
+			// the committed files, the last one is deleted and its object orphaned
+			saveTestFiles(t, fileSvc, 3)
+			require.NoError(t, fileSvc.Delete(ctx, 2))
+
+			store := func(data string) {
+				storage.store(gcTestKey(data), []byte(data), time.Now())
+			}
+			begin := func(data string) *model.Upload {
+				upload := &model.Upload{
+					TenantID: auth.DefaultTenant,
+					Hashes:   [][]byte{merkle.HashData([]byte(data))},
+					Usage:    model.Usage{Bytes: int64(len(data)), Objects: 1},
+				}
+				require.NoError(t, repo.BeginUpload(ctx, upload, model.Quota{}))
+				store(data)
+				return upload
+			}
+			store("orphan")
+			begin("pending")
+			abandoned := begin("abandoned")
+			repo.backdateUpload(abandoned.ID, 2*time.Hour)
+			storage.store("readme.txt", []byte("not a file's content"), time.Now())
+			storage.store(model.QuarantinePrefix+gcTestKey("old"), []byte("old"), time.Now())
+
+			// every object is older than the grace period, except for the fresh orphan
+			backdateObjects(storage, 2*time.Hour)
+			store("fresh")
+
+			report, err := fileSvc.CollectGarbage(ctx, tt.opts)
+			require.NoError(t, err)
+			require.Equal(t, 9, report.Scanned)
+			var reported []string
+			for _, orphan := range report.Orphans {
+				reported = append(reported, orphan.Key)
+			}
+			require.Equal(t, orphans, reported)
+			require.Equal(t, tt.wantCollected, report.Collected)
+			require.Equal(t, tt.wantState, repo.upload(abandoned.ID).State)
+			if tt.wantState == model.UploadFailed {
+				require.Equal(t, 1, report.AbandonedUploads)
+			}
+
+			for _, k := range kept {
+				_, ok := storage.load(k)
+				require.True(t, ok, "%s is kept", k)
+			}
+			for _, k := range orphans {
+				_, left := storage.load(k)
+				require.Equal(t, slices.Contains(tt.wantLeft, k), left, "%s left", k)
+				_, moved := storage.load(model.QuarantinePrefix + k)
+				require.Equal(t, tt.wantMoved, moved, "%s quarantined", k)
+			}
+
+			// the quota of the abandoned upload is released
+			wantUsage := model.Usage{Bytes: 10 + 7 + 9, Objects: 4}
+			if tt.wantState == model.UploadFailed {
+				wantUsage = model.Usage{Bytes: 10 + 7, Objects: 3}
+			}
+			require.Equal(t, wantUsage, repo.usage[auth.DefaultTenant])
+
+			expected := ""
+			if tt.wantCollected > 0 {
+				action := "deleted"
+				if tt.opts.Quarantine {
+					action = "quarantined"
+				}
+				expected = `
+# HELP fileserver_gc_orphans_total Number of orphaned objects collected by the garbage collection, by action.
+# TYPE fileserver_gc_orphans_total counter
+fileserver_gc_orphans_total{action="` + action + `"} 3
+`
+			}
+			require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_gc_orphans_total"))
+		})
+	}
+}
+
+// walkHookStorage runs afterWalk once the storage has been walked, before the orphans are collected.
+type walkHookStorage struct {
+	*memStorage
+	afterWalk func()
+}
+
+func (s *walkHookStorage) Walk(ctx context.Context, fn func(object model.StoredObject) error) error {
+	if err := s.memStorage.Walk(ctx, fn); err != nil {
+		return err
+	}
+	s.afterWalk()
+	return nil
+}
+
+func TestCollectGarbageRecheck(t *testing.T) {
+	ctx := context.Background()
+	storage := &walkHookStorage{memStorage: newMemStorage()}
+	fileSvc := NewFile(newGCRepository(), storage, zap.NewNop())
+
+	saveTestFiles(t, fileSvc, 3)
+	require.NoError(t, fileSvc.Delete(ctx, 2))
+	storage.store(gcTestKey("orphan"), []byte("orphan"), time.Now())
+	storage.store(gcTestKey("rewritten"), []byte("rewritten"), time.Now())
+	backdateObjects(storage.memStorage, 2*time.Hour)
+
+	// during the sweep, the deleted file is uploaded again, reusing its stored object, and another orphan is rewritten
+	storage.afterWalk = func() {
+		saveTestFiles(t, fileSvc, 3)
+		storage.store(gcTestKey("rewritten"), []byte("rewritten"), time.Now())
+	}
+
+	report, err := fileSvc.CollectGarbage(ctx, GCOptions{GracePeriod: time.Hour})
+	require.NoError(t, err)
+	require.Len(t, report.Orphans, 3)
+	require.Equal(t, 1, report.Collected)
+	require.Equal(t, 2, report.Kept)
+	_, ok := storage.load(gcTestKey("orphan"))
+	require.False(t, ok)
+	_, ok = storage.load(gcTestKey("rewritten"))
+	require.True(t, ok)
+	require.Equal(t, "test2", readFile(t, fileSvc, 2))
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestGetIntegrity(t *testing.T) {
+	corrupt := func(s *memStorage) {
+		s.store(testObjectKey(0), []byte("test0 with a flipped bit"), time.Now())
+	}
+	swap := func(s *memStorage) {
+		other, _ := s.load(testObjectKey(1))
+		s.store(testObjectKey(0), other, time.Now())
+	}
+	remove := func(s *memStorage) {
+		_ = s.Delete(context.Background(), []string{testObjectKey(0)})
+	}
+
+	tests := []struct {
+		name          string
+		tamperPrimary func(s *memStorage)
+		withReplica   bool
+		tamperReplica func(s *memStorage)
+		wantErr       error
+		wantFailures  string
+	}{
+		{
+			name: "Intact object",
+		}, {
+			name:          "Corrupted object",
+			tamperPrimary: corrupt,
+			wantErr:       model.ErrIntegrity,
+			wantFailures:  `fileserver_integrity_failures_total{backend="primary"} 1`,
+		}, {
+			name:          "Swapped object",
+			tamperPrimary: swap,
+			wantErr:       model.ErrIntegrity,
+			wantFailures:  `fileserver_integrity_failures_total{backend="primary"} 1`,
+		}, {
+			name:          "Corrupted object served from the replica",
+			tamperPrimary: corrupt,
+			withReplica:   true,
+			wantFailures:  `fileserver_integrity_failures_total{backend="primary"} 1`,
+		}, {
+			name:          "Missing object served from the replica",
+			tamperPrimary: remove,
+			withReplica:   true,
+		}, {
+			name:          "Corrupted object in the replica too",
+			tamperPrimary: corrupt,
+			withReplica:   true,
+			tamperReplica: swap,
+			wantErr:       model.ErrIntegrity,
+			wantFailures: `fileserver_integrity_failures_total{backend="primary"} 1
+fileserver_integrity_failures_total{backend="replica"} 1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			primary, replica := newMemStorage(), newMemStorage()
+			opts := []Option{WithMetrics(metrics.New(registry))}
+			if tt.withReplica {
+				opts = append(opts, WithReplica(replica))
+			}
+			fileSvc := NewFile(newMemRepository(), primary, zap.NewNop(), opts...)
+			saveTestFiles(t, fileSvc, 2)
+
+			// the replica is a copy of the primary
+			for _, key := range primary.keys() {
+				data, _ := primary.load(key)
+				replica.store(key, data, time.Now())
+			}
+			if tt.tamperPrimary != nil {
+				tt.tamperPrimary(primary)
+			}
+			if tt.tamperReplica != nil {
+				tt.tamperReplica(replica)
+			}
+
+			if tt.wantErr != nil {
+				_, err := fileSvc.Get(context.Background(), 0)
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.Equal(t, "test0", readFile(t, fileSvc, 0))
+			}
+
+			expected := ""
+			if tt.wantFailures != "" {
+				expected = `
+# HELP fileserver_integrity_failures_total Number of downloaded objects whose content did not match the hash of their file, by storage backend.
+# TYPE fileserver_integrity_failures_total counter
+` + tt.wantFailures + "\n"
+			}
+			require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_integrity_failures_total"))
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// MigrateObjectKeys moves the objects stored under their bare content hash, before the object keys were scoped
+// to the tenants, to the keys of the default tenant, which owns the files uploaded back then.
+// Every object is checked against its hash while it is copied, and deleted once the copy is stored,
+// so the migration can be run again after a failure.
+func (f *File) MigrateObjectKeys(ctx context.Context) (_ *model.KeyMigrationReport, err error) {
+	ctx, end := f.trace(ctx, "migrate_object_keys")
+	defer end(&err)
+
+	report := &model.KeyMigrationReport{}
+	var legacy []string
+	err = f.storage.Walk(ctx, func(object model.StoredObject) error {
+		report.Scanned++
+		if _, ok := legacyObjectHash(object.Key); ok {
+			legacy = append(legacy, object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored objects: %w", err)
+	}
+
+	for _, key := range legacy {
+		if err = f.migrateObjectKey(ctx, key); err != nil {
+			if ctx.Err() != nil {
+				return report, fmt.Errorf("object key migration aborted: %w", ctx.Err())
+			}
+			f.logger(ctx).Error("failed to migrate object key", zap.String("key", key), zap.Error(err))
+			report.Failed++
+			continue
+		}
+		report.Migrated++
+	}
+	f.logger(ctx).Info("object key migration finished",
+		zap.Int("scanned", report.Scanned),
+		zap.Int("migrated", report.Migrated),
+		zap.Int("failed", report.Failed))
+	return report, nil
+}
+
+// migrateObjectKey copies the legacy object to the key of the default tenant and deletes it.
+func (f *File) migrateObjectKey(ctx context.Context, key string) error {
+	hash, _ := legacyObjectHash(key)
+	content, err := f.storage.Download(ctx, key, hash)
+	if errors.Is(err, model.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download object: %w", err)
+	}
+	defer content.Close()
+
+	objects := make(chan *model.Object, 1)
+	objects <- &model.Object{Key: model.ObjectKey(auth.DefaultTenant, hash), Size: -1, Hash: hash, Content: content}
+	close(objects)
+	if err = f.storage.UploadMultiple(ctx, objects); err != nil {
+		return fmt.Errorf("failed to store object: %w", err)
+	}
+	if err = f.storage.Delete(ctx, []string{key}); err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	return nil
+}
+
+// legacyObjectHash returns the content hash of the object stored under it, and false if the key
+// is not a bare content hash.
+func legacyObjectHash(key string) ([]byte, bool) {
+	if strings.Contains(key, "/") {
+		return nil, false
+	}
+	hash, err := hex.DecodeString(key)
+	if err != nil || len(hash) == 0 || hex.EncodeToString(hash) != key {
+		return nil, false
+	}
+	return hash, true
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestMigrateObjectKeys(t *testing.T) {
+	ctx := context.Background()
+	storage := newMemStorage()
+	fileSvc := NewFile(newMemRepository(), storage, zap.NewNop())
+	saveTestFiles(t, fileSvc, 3)
+
+	// the objects stored before the tenants were introduced are keyed by their bare content hash
+	for i := 0; i < 3; i++ {
+		data, ok := storage.load(testObjectKey(i))
+		require.True(t, ok)
+		require.NoError(t, storage.Delete(ctx, []string{testObjectKey(i)}))
+		storage.store(fmt.Sprintf("%x", merkle.HashData(data)), data, time.Now())
+	}
+	_, err := fileSvc.Get(ctx, 0)
+	require.ErrorIs(t, err, model.ErrNotFound)
+	// a legacy object that does not hash to its key is left in place
+	corrupt := fmt.Sprintf("%x", merkle.HashData([]byte("lost")))
+	storage.store(corrupt, []byte("corrupt"), time.Now())
+	storage.store("readme.txt", []byte("not a file"), time.Now())
+
+	report, err := fileSvc.MigrateObjectKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.KeyMigrationReport{Scanned: 5, Migrated: 3, Failed: 1}, report)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, fmt.Sprintf("test%d", i), readFile(t, fileSvc, i))
+	}
+	_, ok := storage.load(corrupt)
+	require.True(t, ok)
+	_, ok = storage.load("readme.txt")
+	require.True(t, ok)
+
+	// the migrated objects are not moved again
+	report, err = fileSvc.MigrateObjectKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.KeyMigrationReport{Scanned: 5, Failed: 1}, report)
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// Scrub re-hashes the stored objects of the files of the tenant, or of every tenant if tenantID is empty,
+// and verifies their stored proofs against the root recorded for the tenant. At most filesPerSecond files are checked per second,
+// zero means there is no limit. The outcome of every file and the results of the run are recorded in the repository.
+func (f *File) Scrub(ctx context.Context, tenantID string, filesPerSecond float64) (_ *model.ScrubReport, err error) {
+	ctx, end := f.trace(ctx, "scrub")
+	defer end(&err)
+
+	report := &model.ScrubReport{TenantID: tenantID}
+	if err = f.repo.BeginScrub(ctx, report); err != nil {
+		return nil, fmt.Errorf("failed to begin scrub: %w", err)
+	}
+	defer func() {
+		report.FinishedAt = time.Now()
+		if finishErr := f.repo.FinishScrub(context.WithoutCancel(ctx), report, err); finishErr != nil {
+			f.logger(ctx).Error("failed to record scrub results", zap.Int64("scrub", report.ID), zap.Error(finishErr))
+		}
+		if err == nil {
+			f.metrics.ScrubCompleted(report.FinishedAt)
+		}
+	}()
+
+	tenants := []string{tenantID}
+	if tenantID == "" {
+		if tenants, err = f.repo.ListTenants(ctx); err != nil {
+			return report, fmt.Errorf("failed to list tenants: %w", err)
+		}
+	}
+
+	limit := rate.Inf
+	if filesPerSecond > 0 {
+		limit = rate.Limit(filesPerSecond)
+	}
+	limiter := rate.NewLimiter(limit, 1)
+	for _, tenant := range tenants {
+		if err = f.scrubTenant(ctx, tenant, limiter, report); err != nil {
+			return report, err
+		}
+	}
+
+	f.logger(ctx).Info("scrub finished",
+		zap.Int64("scrub", report.ID),
+		zap.Int("checked", report.Checked),
+		zap.Int("failed", len(report.Failures)),
+		zap.Int("errors", report.Errors),
+		zap.Int("repaired_shards", report.RepairedShards),
+		zap.Duration("duration", time.Since(report.StartedAt)))
+	return report, nil
+}
+
+func (f *File) scrubTenant(ctx context.Context, tenantID string, limiter *rate.Limiter, report *model.ScrubReport) error {
+	files, err := f.repo.List(ctx, tenantID, 0, -1)
+	if err != nil {
+		return fmt.Errorf("failed to list files from repo: %w", err)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	root, err := f.tenantRoot(ctx, tenantID, files[0])
+	if err != nil {
+		return err
+	}
+
+	log := f.logger(ctx).With(zap.String("tenant", tenantID))
+	for _, fileMD := range files {
+		if err = limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		f.repairShards(ctx, log, fileMD, report)
+		status, err := f.scrubFile(ctx, fileMD, root)
+		if err != nil {
+			log.Warn("failed to scrub stored file", zap.Int("index", fileMD.Index), zap.Error(err))
+			report.Errors++
+			continue
+		}
+		report.Checked++
+		f.metrics.FileScrubbed(string(status))
+		if status != model.ScrubOK {
+			log.Error("stored file failed the scrub", zap.Int("index", fileMD.Index), zap.String("status", string(status)))
+			f.metrics.VerificationFailed(string(status))
+			report.Failures = append(report.Failures, model.ScrubFailure{TenantID: tenantID, Index: fileMD.Index, Status: status})
+		}
+		if err = f.repo.RecordScrub(ctx, fileMD, status); err != nil {
+			return fmt.Errorf("failed to record scrub of file %d: %w", fileMD.Index, err)
+		}
+	}
+	return nil
+}
+
+// repairShards rebuilds the missing and damaged shards of the object of the file if it is erasure-coded, so that
+// the scrub checks the object as repaired. The objects without a recorded layout, e.g. migrated to the cold tier
+// or missing, are left to the check.
+func (f *File) repairShards(ctx context.Context, log *zap.Logger, fileMD *model.FileMetadata, report *model.ScrubReport) {
+	if f.shards == nil {
+		return
+	}
+	repaired, err := f.shards.RepairShards(ctx, fileMD.ObjectKey())
+	report.RepairedShards += repaired
+	if repaired > 0 {
+		log.Info("repaired shards of stored file", zap.Int("index", fileMD.Index), zap.Int("shards", repaired))
+	}
+	if err != nil && !errors.Is(err, model.ErrNotFound) {
+		log.Warn("failed to repair shards of stored file", zap.Int("index", fileMD.Index), zap.Error(err))
+	}
+}
+
+// scrubFile checks the stored object of the file against the hash in its metadata, and its proof against the root.
+// Only the primary storage is checked, never the replica. An error means the file could not be checked.
+func (f *File) scrubFile(ctx context.Context, fileMD *model.FileMetadata, root []byte) (model.ScrubStatus, error) {
+	content, err := f.storage.Download(ctx, fileMD.ObjectKey(), fileMD.Hash)
+	if err == nil {
+		// the object is only verified once it is read to its end
+		_, err = io.Copy(io.Discard, content)
+		content.Close()
+	}
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		return model.ScrubMissing, nil
+	case errors.Is(err, model.ErrIntegrity):
+		return model.ScrubCorrupted, nil
+	case err != nil:
+		return "", err
+	}
+	if !merkle.VerifyProof(fileMD.Index, fileMD.Hash, fileMD.MerkleProof, root) {
+		return model.ScrubInvalidProof, nil
+	}
+	return model.ScrubOK, nil
+}
+
+// RunScrubber runs Scrub over the files of every tenant every interval until the context is canceled.
+func (f *File) RunScrubber(ctx context.Context, interval time.Duration, filesPerSecond float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := f.Scrub(ctx, "", filesPerSecond); err != nil && ctx.Err() == nil {
+			f.log.Error("failed to scrub stored files", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// scrubRepository is an in-memory repository recording the scrub runs and the outcome of every checked file.
+type scrubRepository struct {
+	*memRepository
+
+	scrubMu  sync.Mutex
+	runs     []model.ScrubReport
+	scrubbed map[fileKey]model.ScrubStatus
+}
+
+func newScrubRepository() *scrubRepository {
+	return &scrubRepository{memRepository: newMemRepository(), scrubbed: make(map[fileKey]model.ScrubStatus)}
+}
+
+func (r *scrubRepository) ListTenants(_ context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var tenants []string
+	for key := range r.files {
+		if !seen[key.tenantID] {
+			seen[key.tenantID] = true
+			tenants = append(tenants, key.tenantID)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+func (r *scrubRepository) BeginScrub(_ context.Context, report *model.ScrubReport) error {
+	r.scrubMu.Lock()
+	defer r.scrubMu.Unlock()
+	r.runs = append(r.runs, *report)
+	report.ID = int64(len(r.runs))
+	report.StartedAt = time.Now()
+	return nil
+}
+
+func (r *scrubRepository) RecordScrub(_ context.Context, fileMD *model.FileMetadata, status model.ScrubStatus) error {
+	r.scrubMu.Lock()
+	defer r.scrubMu.Unlock()
+	r.scrubbed[fileKey{tenantID: fileMD.TenantID, index: fileMD.Index}] = status
+	return nil
+}
+
+func (r *scrubRepository) FinishScrub(_ context.Context, report *model.ScrubReport, _ error) error {
+	r.scrubMu.Lock()
+	defer r.scrubMu.Unlock()
+	r.runs[report.ID-1] = *report
+	return nil
+}
+
+// tamperProof flips a bit of the proof of the stored file.
+func (r *scrubRepository) tamperProof(tenantID string, index int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := fileKey{tenantID: tenantID, index: index}
+	tampered := *r.files[key]
+	tampered.MerkleProof = model.ByteaArray{append([]byte{}, tampered.MerkleProof[0]...)}
+	tampered.MerkleProof[0][0] ^= 0xff
+	r.files[key] = &tampered
+}
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name         string
+		tamper       func(repo *scrubRepository, storage *memStorage)
+		tenantID     string
+		wantChecked  int
+		wantFailures []model.ScrubFailure
+	}{
+		{
+			name:        "Intact files",
+			wantChecked: 4,
+		}, {
+			name:        "Corrupted objects",
+			tamper:      corruptObjects,
+			wantChecked: 4,
+			wantFailures: []model.ScrubFailure{
+				{TenantID: "acme", Index: 0, Status: model.ScrubCorrupted},
+				{TenantID: auth.DefaultTenant, Index: 0, Status: model.ScrubCorrupted},
+				{TenantID: auth.DefaultTenant, Index: 1, Status: model.ScrubCorrupted},
+				{TenantID: auth.DefaultTenant, Index: 2, Status: model.ScrubCorrupted},
+			},
+		}, {
+			name: "Missing object",
+			tamper: func(_ *scrubRepository, storage *memStorage) {
+				_ = storage.Delete(context.Background(), []string{testObjectKey(1)})
+			},
+			wantChecked:  4,
+			wantFailures: []model.ScrubFailure{{TenantID: auth.DefaultTenant, Index: 1, Status: model.ScrubMissing}},
+		}, {
+			name: "Invalid proof",
+			tamper: func(repo *scrubRepository, _ *memStorage) {
+				repo.tamperProof(auth.DefaultTenant, 2)
+			},
+			wantChecked:  4,
+			wantFailures: []model.ScrubFailure{{TenantID: auth.DefaultTenant, Index: 2, Status: model.ScrubInvalidProof}},
+		}, {
+			// the files are checked against the recorded root, not one derived from the tampered proof
+			name: "Invalid proof of the first file",
+			tamper: func(repo *scrubRepository, _ *memStorage) {
+				repo.tamperProof(auth.DefaultTenant, 0)
+			},
+			wantChecked:  4,
+			wantFailures: []model.ScrubFailure{{TenantID: auth.DefaultTenant, Index: 0, Status: model.ScrubInvalidProof}},
+		}, {
+			name:        "Single tenant",
+			tamper:      corruptObjects,
+			tenantID:    "acme",
+			wantChecked: 1,
+			wantFailures: []model.ScrubFailure{
+				{TenantID: "acme", Index: 0, Status: model.ScrubCorrupted},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newScrubRepository()
+			storage := newMemStorage()
+			fileSvc := NewFile(repo, storage, zap.NewNop())
+			saveTestFiles(t, fileSvc, 3)
+			acme := auth.WithIdentity(context.Background(), &auth.Identity{TenantID: "acme"})
+			saveFiles(t, acme, fileSvc, [][]byte{[]byte("test-acme")})
+			if tt.tamper != nil {
+				tt.tamper(repo, storage)
+			}
+
+			report, err := fileSvc.Scrub(context.Background(), tt.tenantID, 0)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantChecked, report.Checked)
+			require.Equal(t, tt.wantFailures, report.Failures)
+			require.Zero(t, report.Errors)
+
+			// the outcome of every checked file and the results of the run are recorded
+			require.Len(t, repo.scrubbed, tt.wantChecked)
+			for _, failure := range tt.wantFailures {
+				require.Equal(t, failure.Status, repo.scrubbed[fileKey{tenantID: failure.TenantID, index: failure.Index}])
+			}
+			require.Len(t, repo.runs, 1)
+			run := repo.runs[0]
+			require.Equal(t, tt.tenantID, run.TenantID)
+			require.Equal(t, tt.wantChecked, run.Checked)
+			require.False(t, run.FinishedAt.Before(run.StartedAt))
+		})
+	}
+}
+
+// corruptObjects changes the content of every stored object.
+func corruptObjects(_ *scrubRepository, storage *memStorage) {
+	for _, key := range storage.keys() {
+		data, _ := storage.load(key)
+		storage.store(key, bytes.ReplaceAll(data, []byte("test"), []byte("corrupt")), time.Now())
+	}
+}
+
+// fixedShardRepairer rebuilds the number of shards set for every object.
+type fixedShardRepairer struct {
+	repaired map[string]int
+	errs     map[string]error
+	called   []string
+}
+
+func (r *fixedShardRepairer) RepairShards(_ context.Context, name string) (int, error) {
+	r.called = append(r.called, name)
+	return r.repaired[name], r.errs[name]
+}
+
+func TestScrubRepairsShards(t *testing.T) {
+	repo := newScrubRepository()
+	repairer := &fixedShardRepairer{repaired: make(map[string]int), errs: make(map[string]error)}
+	fileSvc := NewFile(repo, newMemStorage(), zap.NewNop(), WithShardRepair(repairer))
+	saveTestFiles(t, fileSvc, 3)
+
+	// an object has shards rebuilt, another one has no recorded layout and the last one cannot be repaired
+	keys := []string{testObjectKey(0), testObjectKey(1), testObjectKey(2)}
+	repairer.repaired[keys[0]] = 2
+	repairer.errs[keys[1]] = model.ErrNotFound
+	repairer.errs[keys[2]] = errors.New("shard location unavailable")
+
+	report, err := fileSvc.Scrub(context.Background(), "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Checked)
+	require.Empty(t, report.Failures)
+	require.Equal(t, 2, report.RepairedShards)
+	require.ElementsMatch(t, keys, repairer.called)
+	require.Equal(t, 2, repo.runs[0].RepairedShards)
+}
+
+func TestScrubRate(t *testing.T) {
+	fileSvc := NewFile(newScrubRepository(), newMemStorage(), zap.NewNop())
+	saveTestFiles(t, fileSvc, 3)
+
+	start := time.Now()
+	report, err := fileSvc.Scrub(context.Background(), "", 20)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Checked)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond, "3 files at 20 files per second")
+
+	// a canceled run stops before checking every file
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	report, err = fileSvc.Scrub(ctx, "", 20)
+	require.Error(t, err)
+	require.Less(t, report.Checked, 3)
+}
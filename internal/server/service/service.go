@@ -2,136 +2,622 @@ package service
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"sync"
+	"io"
+	"time"
 
 	"github.com/zale144/fileserver/internal/merkle"
 	"go.uber.org/zap"
 
+	"github.com/zale144/fileserver/internal/logging"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/metrics"
 	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Config is the configuration for the file service.
+type Config struct {
+	// ScrubInterval is the interval of the scrub runs over the stored files, zero disables them.
+	ScrubInterval time.Duration `envconfig:"SCRUB_INTERVAL" default:"0"`
+	// ScrubRate is the maximum number of files checked per second by the scrub runs, zero means there is no limit.
+	ScrubRate float64 `envconfig:"SCRUB_RATE" default:"100"`
+	// GCInterval is the interval of the garbage collection of the orphaned objects, zero disables it.
+	GCInterval    time.Duration `envconfig:"GC_INTERVAL" default:"0"`
+	GCGracePeriod time.Duration `envconfig:"GC_GRACE_PERIOD" default:"24h"`
+	GCQuarantine  bool          `envconfig:"GC_QUARANTINE" default:"false"`
+	// QuotaMaxBytes and QuotaMaxObjects are the default quotas of the tenants, zero means there is no limit.
+	QuotaMaxBytes   int64 `envconfig:"QUOTA_MAX_BYTES" default:"0"`
+	QuotaMaxObjects int64 `envconfig:"QUOTA_MAX_OBJECTS" default:"0"`
+	// TierInterval is the interval of the migrations of the objects to the cold storage tier, zero disables them.
+	// TierAge and TierIdle migrate the objects created, or last read, longer ago than that, zero disables the condition.
+	// TierBatchSize is the maximum number of objects migrated by a run.
+	TierInterval  time.Duration `envconfig:"TIER_INTERVAL" default:"0"`
+	TierAge       time.Duration `envconfig:"TIER_AGE" default:"0"`
+	TierIdle      time.Duration `envconfig:"TIER_IDLE" default:"168h"`
+	TierBatchSize int           `envconfig:"TIER_BATCH_SIZE" default:"1000"`
+	// UploadSpoolDir is the directory of the temporary files holding the uploads until they are stored,
+	// empty means the default directory for temporary files.
+	UploadSpoolDir string `envconfig:"UPLOAD_SPOOL_DIR"`
+}
+
+// DefaultQuota returns the quota of the tenants without one of their own.
+func (c Config) DefaultQuota() model.Quota {
+	return model.Quota{
+		MaxBytes:   c.QuotaMaxBytes,
+		MaxObjects: c.QuotaMaxObjects,
+	}
+}
+
 type File struct {
 	repo    fileRepository
 	storage fileStorage
 	log     *zap.Logger
+	quota   model.Quota
+	metrics *metrics.Metrics
+	replica fileReader
+	// spoolDir is the directory of the temporary files of the uploads.
+	spoolDir string
+	tiers    tierStorage
+	shards   shardRepairer
+
+	uploads uploads
+}
+
+// Option configures optional settings of the file service.
+type Option func(*File)
+
+// WithMetrics makes the file service record the metrics of the uploads, the Merkle trees and the verifications.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(f *File) {
+		f.metrics = m
+	}
+}
+
+// WithDefaultQuota sets the quota of the tenants without one of their own,
+// without it only the quotas set for the individual tenants are enforced.
+func WithDefaultQuota(quota model.Quota) Option {
+	return func(f *File) {
+		f.quota = quota
+	}
+}
+
+// WithReplica makes the downloads fall back to the replica when an object is missing from the storage,
+// or does not hash to the hash of its file.
+func WithReplica(replica fileReader) Option {
+	return func(f *File) {
+		f.replica = replica
+	}
+}
+
+// WithSpoolDir sets the directory of the temporary files holding the uploads until they are stored,
+// and the files read by Get once they are verified.
+func WithSpoolDir(dir string) Option {
+	return func(f *File) {
+		f.spoolDir = dir
+	}
+}
+
+// WithTiers makes the service record the reads of the objects, and migrate them to the cold tier of the storage
+// with MigrateObjects.
+func WithTiers(tiers tierStorage) Option {
+	return func(f *File) {
+		f.tiers = tiers
+	}
 }
 
 type fileRepository interface {
-	Get(index int) (*model.FileMetadata, error)
-	PutMultiple(ctx context.Context, md <-chan *model.FileMetadata) error
+	Get(ctx context.Context, tenantID string, index int) (*model.FileMetadata, error)
+	List(ctx context.Context, tenantID string, from, to int) ([]*model.FileMetadata, error)
+	GetMultiple(ctx context.Context, tenantID string, indexes []int) ([]*model.FileMetadata, error)
+	ListTenants(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, tenantID string, index int) error
+	Root(ctx context.Context, tenantID string) ([]byte, error)
+	BeginUpload(ctx context.Context, upload *model.Upload, defaults model.Quota) error
+	CommitUpload(ctx context.Context, upload *model.Upload, files []*model.FileMetadata) error
+	FailUpload(ctx context.Context, upload *model.Upload, cause error) error
+	HashesInUse(ctx context.Context, tenantID string, hashes [][]byte, uploadID int64) (map[string]bool, error)
+	StoredObjects(ctx context.Context, tenantID string, hashes [][]byte) (map[string]bool, error)
+	BeginScrub(ctx context.Context, report *model.ScrubReport) error
+	RecordScrub(ctx context.Context, fileMD *model.FileMetadata, status model.ScrubStatus) error
+	FinishScrub(ctx context.Context, report *model.ScrubReport, runErr error) error
+	ReferencedKeys(ctx context.Context, pendingSince time.Time) (map[string]bool, error)
+	FailAbandonedUploads(ctx context.Context, before time.Time) (int, error)
+	PruneObjects(ctx context.Context, before time.Time) (int, error)
+	RecordAccess(ctx context.Context, tenantID string, hash []byte) error
+	TierCandidates(ctx context.Context, createdBefore, accessedBefore time.Time, limit int) ([]model.ObjectRef, error)
+	SetObjectTier(ctx context.Context, tenantID string, hash []byte, tier string) error
+}
+
+// fileReader downloads objects, verifying that their content hashes to the given hash once it is read to its end.
+type fileReader interface {
+	Download(ctx context.Context, path string, hash []byte) (io.ReadCloser, error)
+}
+
+// WithShardRepair makes the scrubs rebuild the missing and damaged shards of the erasure-coded objects
+// before checking them.
+func WithShardRepair(shards shardRepairer) Option {
+	return func(f *File) {
+		f.shards = shards
+	}
 }
 
 type fileStorage interface {
-	Download(ctx context.Context, path string) ([]byte, error)
-	UploadMultiple(ctx context.Context, dataCh <-chan *model.File) error
+	fileReader
+	DownloadRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+	UploadMultiple(ctx context.Context, objects <-chan *model.Object) error
+	Delete(ctx context.Context, names []string) error
+	Walk(ctx context.Context, fn func(object model.StoredObject) error) error
+	Stat(ctx context.Context, name string) (model.StoredObject, error)
+	Quarantine(ctx context.Context, names []string) error
+}
+
+// tierStorage moves objects from the hot tier of the storage to the cold one.
+type tierStorage interface {
+	CopyToCold(ctx context.Context, name string, hash []byte, size int64) error
+	DeleteHot(ctx context.Context, names []string) error
+}
+
+// shardRepairer rebuilds the missing and damaged shards of an erasure-coded object, returning how many it rebuilt.
+type shardRepairer interface {
+	RepairShards(ctx context.Context, name string) (int, error)
 }
 
-func NewFile(repo fileRepository, storage fileStorage, log *zap.Logger) *File {
-	return &File{
+func NewFile(repo fileRepository, storage fileStorage, log *zap.Logger, opts ...Option) *File {
+	f := &File{
 		repo:    repo,
 		storage: storage,
 		log:     log,
 	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
 }
 
-func (f *File) Get(ctx context.Context, index int) (*model.File, error) {
-	fileMD, err := f.repo.Get(index)
+// Get reads the whole content of the file with the given index into a temporary file, failing with a *model.IntegrityError
+// if it does not hash to the hash of the file. A missing or corrupted object is read from the replica if there is one.
+func (f *File) Get(ctx context.Context, index int) (_ *model.File, err error) {
+	ctx, end := f.trace(ctx, "get")
+	defer end(&err)
+
+	fileMD, err := f.repo.Get(ctx, auth.TenantID(ctx), index)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file from repo: %w", err)
 	}
 
-	hash := fmt.Sprintf("%x", fileMD.Hash)
-	data, err := f.storage.Download(ctx, hash)
+	content, err := f.read(ctx, f.storage, fileMD)
+	if errors.Is(err, model.ErrIntegrity) {
+		f.logger(ctx).Error("stored file failed the integrity check", zap.Int("index", fileMD.Index), zap.Error(err))
+		f.metrics.IntegrityFailure("primary")
+	}
+	if f.replica != nil && (errors.Is(err, model.ErrIntegrity) || errors.Is(err, model.ErrNotFound)) {
+		content, err = f.readReplica(ctx, fileMD, err)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file from storage: %w", err)
 	}
+	f.recordAccess(ctx, fileMD)
 
-	file := &model.File{
-		Data:     data,
+	return &model.File{
+		Content:  content,
 		Metadata: fileMD,
+	}, nil
+}
+
+// read reads the whole content of the file from the backend into a temporary file, so that it is verified
+// before it is returned without being held in memory.
+func (f *File) read(ctx context.Context, backend fileReader, fileMD *model.FileMetadata) (io.ReadCloser, error) {
+	content, err := backend.Download(ctx, fileMD.ObjectKey(), fileMD.Hash)
+	if err != nil {
+		return nil, err
 	}
+	defer content.Close()
+	return spoolContent(f.spoolDir, content)
+}
 
-	return file, nil
+// readReplica reads the content of the file from the replica, the primary error is returned if the replica fails too.
+func (f *File) readReplica(ctx context.Context, fileMD *model.FileMetadata, primaryErr error) (io.ReadCloser, error) {
+	content, err := f.read(ctx, f.replica, fileMD)
+	if err != nil {
+		if errors.Is(err, model.ErrIntegrity) {
+			f.metrics.IntegrityFailure("replica")
+		}
+		f.logger(ctx).Error("failed to get file from replica", zap.Int("index", fileMD.Index), zap.Error(err))
+		return nil, primaryErr
+	}
+	f.logger(ctx).Warn("served file from replica", zap.Int("index", fileMD.Index), zap.NamedError("primary_error", primaryErr))
+	return content, nil
+}
+
+// Open streams the content of the file described by fileMD from storage. The content fails with a *model.IntegrityError
+// instead of io.EOF if it does not hash to the hash of the file, which cannot be retracted once it is partly sent:
+// only a missing object is read from the replica, unlike with Get.
+func (f *File) Open(ctx context.Context, fileMD *model.FileMetadata) (*model.File, error) {
+	content, err := f.storage.Download(ctx, fileMD.ObjectKey(), fileMD.Hash)
+	if f.replica != nil && errors.Is(err, model.ErrNotFound) {
+		var replicaErr error
+		if content, replicaErr = f.replica.Download(ctx, fileMD.ObjectKey(), fileMD.Hash); replicaErr != nil {
+			f.logger(ctx).Error("failed to get file from replica", zap.Int("index", fileMD.Index), zap.Error(replicaErr))
+		} else {
+			f.logger(ctx).Warn("served file from replica", zap.Int("index", fileMD.Index), zap.NamedError("primary_error", err))
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file from storage: %w", err)
+	}
+	f.recordAccess(ctx, fileMD)
+
+	return &model.File{
+		Content:  &checkedContent{ReadCloser: content, onIntegrityError: f.integrityFailure(ctx, fileMD)},
+		Metadata: fileMD,
+	}, nil
 }
 
-func (f *File) SaveStream(ctx context.Context, inCh chan *model.IndexedFileInput) error {
-	fileCh := make(chan *model.File, 1)
-	fileMDCh := make(chan *model.FileMetadata, 1)
-	errCh := make(chan error, 1)
-	wg := &sync.WaitGroup{}
+// OpenRange streams length bytes of the content of the file from offset, a negative length reads to the end.
+// A part of the content cannot be checked against the hash of the file, so the range covering the whole file
+// is streamed as by Open.
+func (f *File) OpenRange(ctx context.Context, fileMD *model.FileMetadata, offset, length int64) (*model.File, error) {
+	if offset < 0 || offset > fileMD.Size {
+		return nil, fmt.Errorf("offset %d of file %d of %d bytes: %w", offset, fileMD.Index, fileMD.Size, model.ErrInvalidInput)
+	}
+	if length < 0 || offset+length > fileMD.Size {
+		length = fileMD.Size - offset
+	}
+	if offset == 0 && length == fileMD.Size {
+		return f.Open(ctx, fileMD)
+	}
 
-	data, proofs := getMerkleProofs(inCh)
+	content, err := f.storage.DownloadRange(ctx, fileMD.ObjectKey(), offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file from storage: %w", err)
+	}
+	f.recordAccess(ctx, fileMD)
+	return &model.File{Content: content, Metadata: fileMD}, nil
+}
 
-	go func(data [][]byte, proofs [][][]byte) {
-		defer func() {
-			close(fileCh)
-			close(fileMDCh)
-		}()
-		toFile(ctx, data, proofs, fileCh, fileMDCh)
-	}(data, proofs)
+// integrityFailure returns the function recording that the content of the file streamed by Open is corrupted.
+func (f *File) integrityFailure(ctx context.Context, fileMD *model.FileMetadata) func(err error) {
+	return func(err error) {
+		f.logger(ctx).Error("stored file failed the integrity check", zap.Int("index", fileMD.Index), zap.Error(err))
+		f.metrics.IntegrityFailure("primary")
+	}
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := f.storage.UploadMultiple(ctx, fileCh); err != nil {
-			f.log.Error("failed to save file", zap.Error(err))
-			errCh <- err
-			return
+// checkedContent reports the integrity error of the content once, when it is read.
+type checkedContent struct {
+	io.ReadCloser
+	onIntegrityError func(err error)
+}
+
+func (c *checkedContent) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if errors.Is(err, model.ErrIntegrity) && c.onIntegrityError != nil {
+		c.onIntegrityError(err)
+		c.onIntegrityError = nil
+	}
+	return n, err
+}
+
+// List returns the metadata of the files with indexes in the [from, to] range.
+// A negative to means there is no upper bound.
+func (f *File) List(ctx context.Context, from, to int) (_ []*model.FileMetadata, err error) {
+	ctx, end := f.trace(ctx, "list")
+	defer end(&err)
+
+	if from < 0 {
+		return nil, fmt.Errorf("negative index %d: %w", from, model.ErrInvalidInput)
+	}
+	files, err := f.repo.List(ctx, auth.TenantID(ctx), from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files from repo: %w", err)
+	}
+	return files, nil
+}
+
+// Root returns the Merkle root of the stored files, as recorded when they were uploaded.
+// A first file whose proof does not lead to the root is reported, the recorded root is returned all the same.
+func (f *File) Root(ctx context.Context) (_ []byte, err error) {
+	ctx, end := f.trace(ctx, "root")
+	defer end(&err)
+
+	tenantID := auth.TenantID(ctx)
+	files, err := f.repo.List(ctx, tenantID, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get first file from repo: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files stored: %w", model.ErrNotFound)
+	}
+	first := files[0]
+	root, err := f.tenantRoot(ctx, tenantID, first)
+	if err != nil {
+		return nil, err
+	}
+	if !merkle.VerifyProof(first.Index, first.Hash, first.MerkleProof, root) {
+		f.logger(ctx).Error("stored proof does not match the root", zap.Int("index", first.Index))
+		f.metrics.VerificationFailed("proof")
+	}
+	return root, nil
+}
+
+// tenantRoot returns the root recorded by the last committed upload of the tenant. The tenants whose files were
+// uploaded before the roots were recorded fall back to the root derived from the proof of the given file.
+func (f *File) tenantRoot(ctx context.Context, tenantID string, file *model.FileMetadata) ([]byte, error) {
+	root, err := f.repo.Root(ctx, tenantID)
+	if errors.Is(err, model.ErrNotFound) {
+		f.logger(ctx).Warn("no root recorded, deriving it from a stored proof", zap.String("tenant", tenantID))
+		return merkle.RootFromProof(file.Index, file.Hash, file.MerkleProof), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get root from repo: %w", err)
+	}
+	return root, nil
+}
+
+// GetMetadata returns the metadata of the files with the given indexes.
+func (f *File) GetMetadata(ctx context.Context, indexes []int) (_ []*model.FileMetadata, err error) {
+	ctx, end := f.trace(ctx, "get_metadata")
+	defer end(&err)
+
+	files, err := f.repo.GetMultiple(ctx, auth.TenantID(ctx), indexes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get files from repo: %w", err)
+	}
+	return files, nil
+}
+
+// Delete removes the file with the given index.
+func (f *File) Delete(ctx context.Context, index int) (err error) {
+	ctx, end := f.trace(ctx, "delete")
+	defer end(&err)
+
+	if err := f.repo.Delete(ctx, auth.TenantID(ctx), index); err != nil {
+		return fmt.Errorf("failed to delete file from repo: %w", err)
+	}
+	return nil
+}
+
+// SaveStream stores the uploaded files, the contents already stored for the tenant are not stored again.
+func (f *File) SaveStream(ctx context.Context, inCh chan *model.IndexedFileInput) (_ *model.UploadResult, err error) {
+	ctx, end := f.trace(ctx, "upload")
+	defer end(&err)
+	defer f.metrics.TrackUpload()()
+
+	ctx, upload, err := f.beginUpload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer f.endUpload(upload)
+
+	spool, err := newSpool(f.spoolDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload spool: %w", err)
+	}
+	defer func() {
+		if err := spool.Close(); err != nil {
+			f.logger(ctx).Warn("failed to remove upload spool", zap.Error(err))
 		}
 	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := f.repo.PutMultiple(ctx, fileMDCh); err != nil {
-			f.log.Error("failed to save file metadata", zap.Error(err))
-			errCh <- err
-			return
+	files, err := receive(ctx, inCh, spool)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("upload aborted: %w", context.Cause(ctx))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive files: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files uploaded: %w", model.ErrInvalidInput)
+	}
+	tree := f.buildTree(ctx, files)
+
+	tenantID := auth.TenantID(ctx)
+	usage := model.Usage{Objects: int64(len(files))}
+	for _, file := range files {
+		usage.Bytes += file.size
+	}
+	f.setUploadUsage(upload, usage)
+	f.metrics.ObserveUpload(len(files), usage.Bytes)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("upload.files", len(files)), attribute.Int64("upload.bytes", usage.Bytes))
+
+	// the upload is recorded as pending, with its quota reserved, before anything is written,
+	// so that the objects it stages can be compensated for if it fails
+	record := &model.Upload{TenantID: tenantID, Hashes: make([][]byte, len(files)), Root: tree.Root.Hash, Usage: usage}
+	for i, file := range files {
+		file.metadata = &model.FileMetadata{
+			TenantID:    tenantID,
+			Index:       i,
+			Hash:        file.hash,
+			MerkleProof: tree.Proofs[i],
+			Size:        file.size,
 		}
-	}()
+		record.Hashes[i] = file.hash
+	}
+	if err := f.repo.BeginUpload(ctx, record, f.quota); err != nil {
+		return nil, fmt.Errorf("failed to reserve quota: %w", err)
+	}
+
+	result, err := f.commit(ctx, record, spool, files)
+	if err != nil {
+		// the upload fails with the cancellation of the context when it is aborted by the shutdown
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		f.compensate(context.WithoutCancel(ctx), record, err)
+		return nil, fmt.Errorf("failed to save file: %w", err)
+	}
+	f.metrics.ObserveDedup(result.DedupFiles, result.DedupBytes)
+	f.logger(ctx).Info("files uploaded", zap.Int64("upload", record.ID), zap.Int("files", len(files)), zap.Int64("bytes", usage.Bytes),
+		zap.Int("dedup_files", result.DedupFiles), zap.Int64("dedup_bytes", result.DedupBytes))
+	return result, nil
+}
+
+// commit stores the objects of the pending upload that are not stored yet, and only once all of them are stored
+// commits the metadata of its files, which makes them visible all at once.
+func (f *File) commit(ctx context.Context, record *model.Upload, spool *spool, files []*spooledFile) (*model.UploadResult, error) {
+	unique, result, err := f.dedup(ctx, record, files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check stored objects: %w", err)
+	}
+	if len(unique) > 0 {
+		if err = f.storeObjects(ctx, spool, unique); err != nil {
+			return nil, fmt.Errorf("failed to store objects: %w", err)
+		}
+	}
+
+	metadata := make([]*model.FileMetadata, len(files))
+	for i, file := range files {
+		metadata[i] = file.metadata
+	}
+	if err = f.repo.CommitUpload(ctx, record, metadata); err != nil {
+		return nil, fmt.Errorf("failed to commit file metadata: %w", err)
+	}
+	return result, nil
+}
+
+// dedup returns the files whose content must be stored, skipping the contents a file of the tenant refers to already
+// and the repeated contents of the upload. The objects skipped cannot be collected while the upload is pending,
+// since the pending upload refers to them too.
+func (f *File) dedup(ctx context.Context, record *model.Upload, files []*spooledFile) ([]*spooledFile, *model.UploadResult, error) {
+	stored, err := f.repo.StoredObjects(ctx, record.TenantID, record.Hashes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &model.UploadResult{Files: len(files), Bytes: record.Usage.Bytes}
+	unique := make([]*spooledFile, 0, len(files))
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		encoded := hex.EncodeToString(file.hash)
+		if stored[encoded] || seen[encoded] {
+			result.DedupFiles++
+			result.DedupBytes += file.size
+			continue
+		}
+		seen[encoded] = true
+		unique = append(unique, file)
+	}
+	return unique, result, nil
+}
 
+// storeObjects streams the content of the files from the spool to storage, the sender stops as soon as the storage returns.
+// The storage checks the content against the size and the hash of the file.
+func (f *File) storeObjects(ctx context.Context, spool *spool, files []*spooledFile) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objects := make(chan *model.Object, 1)
 	go func() {
-		wg.Wait()
-		close(errCh)
+		defer close(objects)
+		for _, file := range files {
+			object := &model.Object{
+				Key:     file.metadata.ObjectKey(),
+				Size:    file.size,
+				Hash:    file.hash,
+				Content: spool.section(file.offset, file.size),
+			}
+			select {
+			case objects <- object:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
+	return f.storage.UploadMultiple(ctx, objects)
+}
+
+// compensate marks the failed upload as such, which releases its quota, and deletes the objects it stored
+// that neither the files of the tenant nor its other pending uploads refer to.
+// If the upload cannot be marked failed it stays pending, and its objects are left in place.
+func (f *File) compensate(ctx context.Context, record *model.Upload, cause error) {
+	log := f.logger(ctx).With(zap.Int64("upload", record.ID))
+	log.Error("upload failed", zap.Error(cause))
+
+	if err := f.repo.FailUpload(ctx, record, cause); err != nil {
+		log.Error("failed to mark upload as failed", zap.Error(err))
+		return
+	}
+
+	inUse, err := f.repo.HashesInUse(ctx, record.TenantID, record.Hashes, record.ID)
+	if err != nil {
+		log.Error("failed to delete the objects of the failed upload", zap.Error(err))
+		return
+	}
 
-	for err := range errCh {
-		if err != nil {
-			return fmt.Errorf("failed to save file: %w", err)
+	var keys []string
+	seen := make(map[string]bool)
+	for _, hash := range record.Hashes {
+		encoded := hex.EncodeToString(hash)
+		if inUse[encoded] || seen[encoded] {
+			continue
 		}
+		seen[encoded] = true
+		keys = append(keys, model.ObjectKey(record.TenantID, hash))
 	}
-	return nil
+	if len(keys) == 0 {
+		return
+	}
+	if err = f.storage.Delete(ctx, keys); err != nil {
+		log.Error("failed to delete the objects of the failed upload", zap.Error(err))
+		return
+	}
+	log.Info("deleted the objects of the failed upload", zap.Int("objects", len(keys)))
 }
 
-func toFile(ctx context.Context, data [][]byte, proofs [][][]byte, fileCh chan *model.File, fileMDCh chan *model.FileMetadata) {
-	for i, d := range data {
-		hash := merkle.HashData(d)
-		file := &model.File{
-			Data: d,
-			Metadata: &model.FileMetadata{
-				Index:       i,
-				Hash:        hash,
-				MerkleProof: proofs[i],
-			},
-		}
+// spooledFile is an uploaded file whose content is held by the spool of its upload.
+type spooledFile struct {
+	offset   int64
+	size     int64
+	hash     []byte
+	metadata *model.FileMetadata
+}
+
+// receive writes the content of the uploaded files to the spool as they are received, it stops receiving
+// when the context is canceled. The content being read is closed when the context is canceled, so that its writer
+// does not wait for the rest of it to be read.
+func receive(ctx context.Context, inCh chan *model.IndexedFileInput, spool *spool) (_ []*spooledFile, err error) {
+	ctx, span := tracer.Start(ctx, "service.receive")
+	defer tracing.End(span, &err)
+
+	var files []*spooledFile
+	for {
 		select {
+		case file, ok := <-inCh:
+			if !ok {
+				return files, nil
+			}
+			stop := context.AfterFunc(ctx, func() { file.Content.Close() })
+			offset, size, hash, err := spool.add(file.Content)
+			stop()
+			file.Content.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file %d: %w", len(files), err)
+			}
+			files = append(files, &spooledFile{offset: offset, size: size, hash: hash})
 		case <-ctx.Done():
-			return
-		default:
+			return files, nil
 		}
-		fileCh <- file
-		fileMDCh <- file.Metadata
 	}
 }
 
-func getMerkleProofs(inCh chan *model.IndexedFileInput) ([][]byte, [][][]byte) {
-	var data [][]byte
-	for file := range inCh {
-		data = append(data, file.Data)
+// buildTree builds the Merkle tree of the files from their hashes.
+func (f *File) buildTree(ctx context.Context, files []*spooledFile) *merkle.Tree {
+	_, span := tracer.Start(ctx, "merkle.build_tree", trace.WithAttributes(attribute.Int("merkle.leaves", len(files))))
+	defer span.End()
+
+	hashes := make([][]byte, len(files))
+	for i, file := range files {
+		hashes[i] = file.hash
 	}
-	tree := merkle.NewTree(data)
-	return data, tree.Proofs
+	defer f.metrics.ObserveTree(time.Now())
+	return merkle.NewTreeFromHashes(hashes)
 }
 
 func (f *File) Verify(fileMD *model.File, fileHash, root []byte) error {
@@ -139,7 +625,47 @@ func (f *File) Verify(fileMD *model.File, fileHash, root []byte) error {
 	proof := fileMD.Metadata.MerkleProof
 	valid := merkle.VerifyProof(index, fileHash, proof, root)
 	if !valid {
-		return fmt.Errorf("file verification failed")
+		f.metrics.VerificationFailed("proof")
+		return fmt.Errorf("file %d does not match the Merkle root: %w", index, model.ErrIntegrity)
 	}
 	return nil
 }
+
+// logger returns the request-scoped logger carried by the context, tagged with the request ID and the caller.
+func (f *File) logger(ctx context.Context) *zap.Logger {
+	return logging.FromContext(ctx, f.log)
+}
+
+var tracer = otel.Tracer("github.com/zale144/fileserver/internal/server/service")
+
+// trace starts the span of the operation, the returned function ends it and counts the error of the operation by its type.
+func (f *File) trace(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	ctx, span := tracer.Start(ctx, "service."+operation, trace.WithAttributes(attribute.String("tenant.id", auth.TenantID(ctx))))
+	return ctx, func(err *error) {
+		if *err != nil {
+			f.metrics.Error(operation, errorType(*err))
+		}
+		tracing.End(span, err)
+	}
+}
+
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, model.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, model.ErrConflict):
+		return "conflict"
+	case errors.Is(err, model.ErrIntegrity):
+		return "integrity"
+	case errors.Is(err, model.ErrQuotaExceeded):
+		return "quota"
+	case errors.Is(err, model.ErrInvalidInput):
+		return "invalid_input"
+	case errors.Is(err, model.ErrUnavailable):
+		return "unavailable"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "internal"
+	}
+}
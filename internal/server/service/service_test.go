@@ -0,0 +1,411 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/storage"
+)
+
+// memRepository is an in-memory repository of the files, their objects and the lifecycle of their uploads,
+// which the fakes of the other concerns embed. The methods of the repository it does not implement panic.
+type memRepository struct {
+	fileRepository
+
+	mu      sync.Mutex
+	files   map[fileKey]*model.FileMetadata
+	uploads map[int64]*model.Upload
+	objects map[string]*memObject
+	usage   map[string]model.Usage
+}
+
+type fileKey struct {
+	tenantID string
+	index    int
+}
+
+// memObject is a stored object, referenced by refcount files.
+type memObject struct {
+	ref      model.ObjectRef
+	refcount int64
+	tier     string
+	created  time.Time
+	accessed time.Time
+}
+
+func newMemRepository() *memRepository {
+	return &memRepository{
+		files:   make(map[fileKey]*model.FileMetadata),
+		uploads: make(map[int64]*model.Upload),
+		objects: make(map[string]*memObject),
+		usage:   make(map[string]model.Usage),
+	}
+}
+
+func (r *memRepository) Get(_ context.Context, tenantID string, index int) (*model.FileMetadata, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fileMD, ok := r.files[fileKey{tenantID: tenantID, index: index}]
+	if !ok {
+		return nil, fmt.Errorf("file %d: %w", index, model.ErrNotFound)
+	}
+	return fileMD, nil
+}
+
+func (r *memRepository) List(_ context.Context, tenantID string, from, to int) ([]*model.FileMetadata, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var files []*model.FileMetadata
+	for key, fileMD := range r.files {
+		if key.tenantID == tenantID && key.index >= from && (to < 0 || key.index <= to) {
+			files = append(files, fileMD)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Index < files[j].Index })
+	return files, nil
+}
+
+func (r *memRepository) Delete(_ context.Context, tenantID string, index int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := fileKey{tenantID: tenantID, index: index}
+	fileMD, ok := r.files[key]
+	if !ok {
+		return fmt.Errorf("file %d: %w", index, model.ErrNotFound)
+	}
+	delete(r.files, key)
+	r.release(tenantID, model.Usage{Bytes: fileMD.Size, Objects: 1})
+	r.objects[fileMD.ObjectKey()].refcount--
+	return nil
+}
+
+func (r *memRepository) Root(_ context.Context, tenantID string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var last *model.Upload
+	for _, upload := range r.uploads {
+		if upload.TenantID == tenantID && upload.State == model.UploadCommitted && upload.Root != nil && (last == nil || upload.ID > last.ID) {
+			last = upload
+		}
+	}
+	if last == nil {
+		return nil, fmt.Errorf("root of tenant %s: %w", tenantID, model.ErrNotFound)
+	}
+	return last.Root, nil
+}
+
+func (r *memRepository) BeginUpload(_ context.Context, upload *model.Upload, defaults model.Quota) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	used := r.usage[upload.TenantID]
+	if err := defaults.Check(used, upload.Usage); err != nil {
+		return err
+	}
+	r.usage[upload.TenantID] = model.Usage{Bytes: used.Bytes + upload.Usage.Bytes, Objects: used.Objects + upload.Usage.Objects}
+
+	upload.ID = int64(len(r.uploads) + 1)
+	upload.State = model.UploadPending
+	upload.CreatedAt = time.Now()
+	record := *upload
+	r.uploads[upload.ID] = &record
+	return nil
+}
+
+// CommitUpload stores the metadata all at once like the transaction of the repository, nothing is stored
+// if the context is canceled or a file conflicts with a stored one.
+func (r *memRepository) CommitUpload(ctx context.Context, upload *model.Upload, files []*model.FileMetadata) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	record := r.uploads[upload.ID]
+	if record.State != model.UploadPending {
+		return fmt.Errorf("upload %d is not pending: %w", upload.ID, model.ErrConflict)
+	}
+	for _, fileMD := range files {
+		stored, ok := r.files[fileKey{tenantID: fileMD.TenantID, index: fileMD.Index}]
+		if ok && !(bytes.Equal(stored.Hash, fileMD.Hash) && slices.EqualFunc(stored.MerkleProof, fileMD.MerkleProof, bytes.Equal)) {
+			return fmt.Errorf("file %d already stored with a different content or proof: %w", fileMD.Index, model.ErrConflict)
+		}
+	}
+	var skipped model.Usage
+	for _, fileMD := range files {
+		key := fileKey{tenantID: fileMD.TenantID, index: fileMD.Index}
+		if _, ok := r.files[key]; ok {
+			skipped.Objects++
+			skipped.Bytes += fileMD.Size
+			continue
+		}
+		r.files[key] = fileMD
+		object := r.objects[fileMD.ObjectKey()]
+		if object == nil || object.refcount == 0 {
+			object = &memObject{
+				ref:     model.ObjectRef{TenantID: fileMD.TenantID, Hash: fileMD.Hash, Size: fileMD.Size},
+				tier:    model.TierHot,
+				created: time.Now(),
+			}
+			r.objects[fileMD.ObjectKey()] = object
+		}
+		object.refcount++
+	}
+	r.release(upload.TenantID, skipped)
+	record.State = model.UploadCommitted
+	upload.State = model.UploadCommitted
+	return nil
+}
+
+func (r *memRepository) FailUpload(_ context.Context, upload *model.Upload, _ error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record := r.uploads[upload.ID]
+	if record.State != model.UploadPending {
+		return nil
+	}
+	record.State = model.UploadFailed
+	upload.State = model.UploadFailed
+	r.release(upload.TenantID, upload.Usage)
+	return nil
+}
+
+func (r *memRepository) HashesInUse(_ context.Context, tenantID string, hashes [][]byte, uploadID int64) (map[string]bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	inUse := make(map[string]bool)
+	for _, hash := range hashes {
+		if object := r.objects[model.ObjectKey(tenantID, hash)]; object != nil && object.refcount > 0 {
+			inUse[hex.EncodeToString(hash)] = true
+		}
+	}
+	for _, upload := range r.uploads {
+		if upload.TenantID != tenantID || upload.State != model.UploadPending || upload.ID == uploadID {
+			continue
+		}
+		for _, hash := range upload.Hashes {
+			if slices.ContainsFunc(hashes, func(h []byte) bool { return bytes.Equal(h, hash) }) {
+				inUse[hex.EncodeToString(hash)] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+func (r *memRepository) StoredObjects(_ context.Context, tenantID string, hashes [][]byte) (map[string]bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored := make(map[string]bool)
+	for _, hash := range hashes {
+		if object := r.objects[model.ObjectKey(tenantID, hash)]; object != nil && object.refcount > 0 {
+			stored[hex.EncodeToString(hash)] = true
+		}
+	}
+	return stored, nil
+}
+
+// release releases the usage of the quota of the tenant, the lock must be held.
+func (r *memRepository) release(tenantID string, usage model.Usage) {
+	used := r.usage[tenantID]
+	r.usage[tenantID] = model.Usage{Bytes: used.Bytes - usage.Bytes, Objects: used.Objects - usage.Objects}
+}
+
+// upload returns the recorded state of the upload with the given ID.
+func (r *memRepository) upload(id int64) model.Upload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.uploads[id]
+}
+
+// memStorage is an in-memory storage that stores the objects without checking their content,
+// so that the tests can tamper with it.
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string]memStored
+}
+
+type memStored struct {
+	data     []byte
+	modified time.Time
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string]memStored)}
+}
+
+func (s *memStorage) Download(_ context.Context, name string, hash []byte) (io.ReadCloser, error) {
+	data, ok := s.load(name)
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", name, model.ErrNotFound)
+	}
+	return storage.NewVerifyingReader(io.NopCloser(bytes.NewReader(data)), name, hash), nil
+}
+
+func (s *memStorage) DownloadRange(_ context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	data, ok := s.load(name)
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", name, model.ErrNotFound)
+	}
+	if length < 0 || offset+length > int64(len(data)) {
+		length = int64(len(data)) - offset
+	}
+	return io.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+}
+
+func (s *memStorage) UploadMultiple(_ context.Context, objects <-chan *model.Object) error {
+	for object := range objects {
+		data, err := io.ReadAll(object.Content)
+		if err != nil {
+			return err
+		}
+		s.store(object.Key, data, time.Now())
+	}
+	return nil
+}
+
+func (s *memStorage) Delete(_ context.Context, names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		delete(s.objects, name)
+	}
+	return nil
+}
+
+// Walk lists the objects in the order of their keys.
+func (s *memStorage) Walk(_ context.Context, fn func(object model.StoredObject) error) error {
+	s.mu.Lock()
+	objects := make([]model.StoredObject, 0, len(s.objects))
+	for name, object := range s.objects {
+		objects = append(objects, model.StoredObject{Key: name, Size: int64(len(object.data)), LastModified: object.modified})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	for _, object := range objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) Stat(_ context.Context, name string) (model.StoredObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[name]
+	if !ok {
+		return model.StoredObject{}, fmt.Errorf("object %s: %w", name, model.ErrNotFound)
+	}
+	return model.StoredObject{Key: name, Size: int64(len(object.data)), LastModified: object.modified}, nil
+}
+
+func (s *memStorage) Quarantine(_ context.Context, names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		if object, ok := s.objects[name]; ok {
+			s.objects[model.QuarantinePrefix+name] = object
+			delete(s.objects, name)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) store(name string, data []byte, modified time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[name] = memStored{data: data, modified: modified}
+}
+
+func (s *memStorage) load(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[name]
+	return object.data, ok
+}
+
+// keys returns the keys of the stored objects, in order.
+func (s *memStorage) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for name := range s.objects {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// saveTestFiles uploads the files "test0", "test1"... of the default tenant, and returns their Merkle root.
+func saveTestFiles(t *testing.T, fileSvc *File, numFiles int) []byte {
+	data := make([][]byte, numFiles)
+	for i := range data {
+		data[i] = []byte(fmt.Sprintf("test%d", i))
+	}
+	saveFiles(t, context.Background(), fileSvc, data)
+	return merkle.NewTree(data).Root.Hash
+}
+
+// saveFiles uploads the files with the contents, of the tenant of the context.
+func saveFiles(t *testing.T, ctx context.Context, fileSvc *File, data [][]byte) {
+	t.Helper()
+	_, err := fileSvc.SaveStream(ctx, sendFiles(data))
+	require.NoError(t, err)
+}
+
+// sendFiles sends the files with the contents, indexed in order.
+func sendFiles(data [][]byte) chan *model.IndexedFileInput {
+	inCh := make(chan *model.IndexedFileInput)
+	go func() {
+		defer close(inCh)
+		for i, d := range data {
+			inCh <- &model.IndexedFileInput{Index: i, Content: io.NopCloser(bytes.NewReader(d))}
+		}
+	}()
+	return inCh
+}
+
+// testObjectKey returns the key of the object of the file saved by saveTestFiles with the index.
+func testObjectKey(index int) string {
+	return model.ObjectKey(auth.DefaultTenant, merkle.HashData([]byte(fmt.Sprintf("test%d", index))))
+}
+
+// readFile reads the whole content of the file through the service.
+func readFile(t *testing.T, fileSvc *File, index int) string {
+	t.Helper()
+	file, err := fileSvc.Get(context.Background(), index)
+	require.NoError(t, err)
+	defer file.Content.Close()
+	data, err := io.ReadAll(file.Content)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func toBytes(data []string) [][]byte {
+	result := make([][]byte, len(data))
+	for i, d := range data {
+		result[i] = []byte(d)
+	}
+	return result
+}
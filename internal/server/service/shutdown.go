@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// errShuttingDown is the cause of the uploads refused or aborted by the shutdown.
+var errShuttingDown = fmt.Errorf("the server is shutting down: %w", model.ErrUnavailable)
+
+// uploads tracks the uploads in progress, so that the shutdown can wait for them or abort them.
+type uploads struct {
+	mu       sync.Mutex
+	closing  bool
+	inFlight map[*upload]struct{}
+	wg       sync.WaitGroup
+}
+
+type upload struct {
+	tenantID string
+	usage    model.Usage
+	cancel   context.CancelCauseFunc
+}
+
+// beginUpload registers the upload, unless the service is shutting down.
+// The returned context is canceled if the upload is aborted by the shutdown.
+func (f *File) beginUpload(ctx context.Context) (context.Context, *upload, error) {
+	f.uploads.mu.Lock()
+	defer f.uploads.mu.Unlock()
+	if f.uploads.closing {
+		return nil, nil, errShuttingDown
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	u := &upload{tenantID: auth.TenantID(ctx), cancel: cancel}
+	if f.uploads.inFlight == nil {
+		f.uploads.inFlight = make(map[*upload]struct{})
+	}
+	f.uploads.inFlight[u] = struct{}{}
+	f.uploads.wg.Add(1)
+	return ctx, u, nil
+}
+
+// endUpload unregisters the upload once it is done, including its rollback.
+func (f *File) endUpload(u *upload) {
+	u.cancel(nil)
+	f.uploads.mu.Lock()
+	delete(f.uploads.inFlight, u)
+	f.uploads.mu.Unlock()
+	f.uploads.wg.Done()
+}
+
+func (f *File) setUploadUsage(u *upload, usage model.Usage) {
+	f.uploads.mu.Lock()
+	defer f.uploads.mu.Unlock()
+	u.usage = usage
+}
+
+// Shutdown stops accepting uploads and waits for the ones in progress to finish until the context is done,
+// the remaining ones are then aborted and rolled back. It returns once every upload is done.
+func (f *File) Shutdown(ctx context.Context) *model.ShutdownReport {
+	f.uploads.mu.Lock()
+	f.uploads.closing = true
+	pending := len(f.uploads.inFlight)
+	f.uploads.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		f.uploads.wg.Wait()
+		close(done)
+	}()
+
+	report := &model.ShutdownReport{}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		f.uploads.mu.Lock()
+		for u := range f.uploads.inFlight {
+			report.Aborted = append(report.Aborted, model.AbortedUpload{
+				TenantID: u.tenantID,
+				Files:    int(u.usage.Objects),
+				Bytes:    u.usage.Bytes,
+			})
+			u.cancel(errShuttingDown)
+		}
+		f.uploads.mu.Unlock()
+		<-done
+	}
+	report.Finished = pending - len(report.Aborted)
+
+	for _, aborted := range report.Aborted {
+		f.log.Warn("upload aborted by the shutdown",
+			zap.String("tenant", aborted.TenantID),
+			zap.Int("files", aborted.Files),
+			zap.Int64("bytes", aborted.Bytes))
+	}
+	return report
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/zale144/fileserver/internal/merkle"
+)
+
+// spool holds the content of the files of an upload in a temporary file, so that the upload is not held in memory
+// while its Merkle tree is built and its objects are stored.
+type spool struct {
+	file *os.File
+	size int64
+}
+
+// newSpool creates the temporary file of the spool in dir, or in the default directory for temporary files if dir is empty.
+func newSpool(dir string) (*spool, error) {
+	file, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{file: file}, nil
+}
+
+// add appends the content read from r, and returns where it was written along with its size and hash.
+func (s *spool) add(r io.Reader) (offset, size int64, hash []byte, err error) {
+	hasher := merkle.NewHasher()
+	size, err = io.Copy(s.file, io.TeeReader(r, hasher))
+	offset = s.size
+	s.size += size
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return offset, size, hasher.Sum(nil), nil
+}
+
+// section returns a reader of the content added at offset, the readers of several sections can be read concurrently.
+func (s *spool) section(offset, size int64) io.Reader {
+	return io.NewSectionReader(s.file, offset, size)
+}
+
+// Close removes the temporary file.
+func (s *spool) Close() error {
+	return errors.Join(s.file.Close(), os.Remove(s.file.Name()))
+}
+
+// spoolContent copies the content to a temporary file in dir, and returns the file rewound to its start.
+// The file is removed once it is closed.
+func spoolContent(dir string, content io.Reader) (io.ReadCloser, error) {
+	file, err := os.CreateTemp(dir, "download-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &tempFile{File: file}
+	if _, err = io.Copy(file, content); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, errors.Join(err, spooled.Close())
+	}
+	return spooled, nil
+}
+
+// tempFile is a temporary file removed once it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	return errors.Join(t.File.Close(), os.Remove(t.Name()))
+}
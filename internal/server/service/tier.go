@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// TierOptions configures a migration run of the objects to the cold tier.
+type TierOptions struct {
+	// Age migrates the objects created longer ago than that, and Idle the ones not read for longer than that.
+	// Zero disables the condition.
+	Age  time.Duration
+	Idle time.Duration
+	// Limit is the maximum number of objects migrated by a run.
+	Limit int
+	// DryRun only reports the objects that would be migrated.
+	DryRun bool
+}
+
+// TierOptions returns the options of the periodic migration runs.
+func (c Config) TierOptions() TierOptions {
+	return TierOptions{
+		Age:   c.TierAge,
+		Idle:  c.TierIdle,
+		Limit: c.TierBatchSize,
+	}
+}
+
+// MigrateObjects moves the objects of the hot tier that are older, or idle for longer, than allowed to the cold tier.
+// Every object is copied and verified, deleted from the hot tier and only then recorded as cold, so that an interrupted
+// migration is completed by the next run. The reads find the object in either tier meanwhile.
+func (f *File) MigrateObjects(ctx context.Context, opts TierOptions) (_ *model.TierReport, err error) {
+	ctx, end := f.trace(ctx, "tier")
+	defer end(&err)
+
+	if f.tiers == nil {
+		return nil, fmt.Errorf("no cold storage tier configured: %w", model.ErrInvalidInput)
+	}
+	if opts.Age <= 0 && opts.Idle <= 0 {
+		return nil, fmt.Errorf("neither an age nor an idle period set: %w", model.ErrInvalidInput)
+	}
+	if opts.Limit <= 0 {
+		return nil, fmt.Errorf("invalid batch size %d: %w", opts.Limit, model.ErrInvalidInput)
+	}
+
+	now := time.Now()
+	var createdBefore, accessedBefore time.Time
+	if opts.Age > 0 {
+		createdBefore = now.Add(-opts.Age)
+	}
+	if opts.Idle > 0 {
+		accessedBefore = now.Add(-opts.Idle)
+	}
+	candidates, err := f.repo.TierCandidates(ctx, createdBefore, accessedBefore, opts.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get objects to migrate: %w", err)
+	}
+
+	report := &model.TierReport{DryRun: opts.DryRun, Candidates: candidates}
+	if !opts.DryRun {
+		for _, object := range candidates {
+			if err = ctx.Err(); err != nil {
+				return report, err
+			}
+			if err = f.migrate(ctx, object); err != nil {
+				f.logger(ctx).Error("failed to migrate object", zap.String("object", object.Key()), zap.Error(err))
+				report.Failed++
+				continue
+			}
+			report.Migrated++
+			report.Bytes += object.Size
+		}
+		f.metrics.ObjectsMigrated(report.Migrated, report.Bytes)
+	}
+	f.logger(ctx).Info("tier migration finished",
+		zap.Bool("dry_run", opts.DryRun),
+		zap.Int("candidates", len(candidates)),
+		zap.Int("migrated", report.Migrated),
+		zap.Int64("migrated_bytes", report.Bytes),
+		zap.Int("failed", report.Failed))
+	return report, nil
+}
+
+// migrate moves the object to the cold tier.
+func (f *File) migrate(ctx context.Context, object model.ObjectRef) error {
+	key := object.Key()
+	if err := f.tiers.CopyToCold(ctx, key, object.Hash, object.Size); err != nil {
+		return err
+	}
+	if err := f.tiers.DeleteHot(ctx, []string{key}); err != nil {
+		return fmt.Errorf("failed to delete object from the hot tier: %w", err)
+	}
+	if err := f.repo.SetObjectTier(ctx, object.TenantID, object.Hash, model.TierCold); err != nil {
+		return fmt.Errorf("failed to record the tier of the object: %w", err)
+	}
+	return nil
+}
+
+// recordAccess records that the object of the file was read, which keeps it in the hot tier for the idle period.
+// The access times are only needed, and recorded, when the objects are tiered.
+func (f *File) recordAccess(ctx context.Context, fileMD *model.FileMetadata) {
+	if f.tiers == nil {
+		return
+	}
+	if err := f.repo.RecordAccess(ctx, fileMD.TenantID, fileMD.Hash); err != nil && !errors.Is(err, context.Canceled) {
+		f.logger(ctx).Warn("failed to record the access of the object", zap.Int("index", fileMD.Index), zap.Error(err))
+	}
+}
+
+// RunTiering runs MigrateObjects every interval until the context is canceled.
+func (f *File) RunTiering(ctx context.Context, interval time.Duration, opts TierOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := f.MigrateObjects(ctx, opts); err != nil && ctx.Err() == nil {
+			f.log.Error("failed to migrate objects", zap.Error(err))
+		}
+	}
+}
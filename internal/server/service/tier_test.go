@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/server/storage"
+)
+
+// tierRepository is an in-memory repository recording the tier and the last access of the objects.
+type tierRepository struct {
+	*memRepository
+}
+
+func newTierRepository() *tierRepository {
+	return &tierRepository{memRepository: newMemRepository()}
+}
+
+func (r *tierRepository) RecordAccess(_ context.Context, tenantID string, hash []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if object := r.objects[model.ObjectKey(tenantID, hash)]; object != nil {
+		object.accessed = time.Now()
+	}
+	return nil
+}
+
+func (r *tierRepository) TierCandidates(_ context.Context, createdBefore, accessedBefore time.Time, limit int) ([]model.ObjectRef, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var candidates []*memObject
+	for _, object := range r.objects {
+		if object.tier != model.TierHot || object.refcount == 0 {
+			continue
+		}
+		accessed := object.accessed
+		if accessed.IsZero() {
+			accessed = object.created
+		}
+		if (!createdBefore.IsZero() && object.created.Before(createdBefore)) ||
+			(!accessedBefore.IsZero() && accessed.Before(accessedBefore)) {
+			candidates = append(candidates, object)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].created.Before(candidates[j].created) })
+
+	refs := make([]model.ObjectRef, 0, len(candidates))
+	for _, object := range candidates[:min(limit, len(candidates))] {
+		refs = append(refs, object.ref)
+	}
+	return refs, nil
+}
+
+func (r *tierRepository) SetObjectTier(_ context.Context, tenantID string, hash []byte, tier string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if object := r.objects[model.ObjectKey(tenantID, hash)]; object != nil {
+		object.tier = tier
+	}
+	return nil
+}
+
+// tier returns the tier of the object.
+func (r *tierRepository) tier(key string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.objects[key].tier
+}
+
+// backdate moves the creation and the last access of the object back by d.
+func (r *tierRepository) backdate(key string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	object := r.objects[key]
+	object.created = object.created.Add(-d)
+	if !object.accessed.IsZero() {
+		object.accessed = object.accessed.Add(-d)
+	}
+}
+
+func TestMigrateObjects(t *testing.T) {
+	tests := []struct {
+		name string
+		opts TierOptions
+		// backdated are the indexes of the files whose objects are made two hours old
+		backdated []int
+		// read are the indexes of the files read after being backdated
+		read           []int
+		wantCandidates []int
+		wantMigrated   int
+	}{
+		{
+			name:           "Age",
+			opts:           TierOptions{Age: time.Hour, Limit: 10},
+			backdated:      []int{0, 2},
+			read:           []int{0},
+			wantCandidates: []int{0, 2},
+			wantMigrated:   2,
+		}, {
+			name:           "Idle",
+			opts:           TierOptions{Idle: time.Hour, Limit: 10},
+			backdated:      []int{0, 1, 2},
+			read:           []int{1},
+			wantCandidates: []int{0, 2},
+			wantMigrated:   2,
+		}, {
+			name:           "Limit",
+			opts:           TierOptions{Age: time.Hour, Limit: 1},
+			backdated:      []int{0, 1, 2},
+			wantCandidates: []int{0},
+			wantMigrated:   1,
+		}, {
+			name:           "Dry run",
+			opts:           TierOptions{Idle: time.Hour, Limit: 10, DryRun: true},
+			backdated:      []int{1},
+			wantCandidates: []int{1},
+		}, {
+			name:      "Nothing to migrate",
+			opts:      TierOptions{Age: time.Hour, Idle: time.Hour, Limit: 10},
+			backdated: []int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := prometheus.NewRegistry()
+			repo := newTierRepository()
+			hot, cold := storage.NewMemory(), storage.NewMemory()
+			tiered := storage.NewTiered(hot, cold)
+			fileSvc := NewFile(repo, tiered, zap.NewNop(), WithTiers(tiered), WithMetrics(metrics.New(registry)))
+
+			saveTestFiles(t, fileSvc, 3)
+			for _, index := range tt.backdated {
+				repo.backdate(testObjectKey(index), 2*time.Hour)
+			}
+			for _, index := range tt.read {
+				readFile(t, fileSvc, index)
+			}
+
+			report, err := fileSvc.MigrateObjects(ctx, tt.opts)
+			require.NoError(t, err)
+			var candidates []string
+			for _, object := range report.Candidates {
+				candidates = append(candidates, object.Key())
+			}
+			var wantCandidates []string
+			for _, index := range tt.wantCandidates {
+				wantCandidates = append(wantCandidates, testObjectKey(index))
+			}
+			require.Equal(t, wantCandidates, candidates)
+			require.Equal(t, tt.wantMigrated, report.Migrated)
+			require.Equal(t, int64(5*tt.wantMigrated), report.Bytes)
+			require.Zero(t, report.Failed)
+
+			for index := 0; index < 3; index++ {
+				migrated := !tt.opts.DryRun && slices.Contains(tt.wantCandidates, index)
+				wantTier, inHot, inCold := model.TierHot, true, false
+				if migrated {
+					wantTier, inHot, inCold = model.TierCold, false, true
+				}
+				require.Equal(t, wantTier, repo.tier(testObjectKey(index)), "file %d", index)
+				_, err = hot.Stat(ctx, testObjectKey(index))
+				require.Equal(t, inHot, err == nil, "file %d in the hot tier", index)
+				_, err = cold.Stat(ctx, testObjectKey(index))
+				require.Equal(t, inCold, err == nil, "file %d in the cold tier", index)
+
+				// the files are read from either tier
+				require.Equal(t, fmt.Sprintf("test%d", index), readFile(t, fileSvc, index))
+			}
+
+			expected := `
+# HELP fileserver_tier_migrated_objects_total Number of objects migrated from the hot to the cold storage tier.
+# TYPE fileserver_tier_migrated_objects_total counter
+fileserver_tier_migrated_objects_total ` + fmt.Sprint(tt.wantMigrated) + `
+`
+			require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_tier_migrated_objects_total"))
+		})
+	}
+}
+
+func TestMigrateObjectsInvalid(t *testing.T) {
+	tiered := storage.NewTiered(storage.NewMemory(), storage.NewMemory())
+
+	tests := []struct {
+		name string
+		opts []Option
+		tier TierOptions
+	}{
+		{
+			name: "No cold tier",
+			tier: TierOptions{Age: time.Hour, Limit: 10},
+		}, {
+			name: "No age nor idle period",
+			opts: []Option{WithTiers(tiered)},
+			tier: TierOptions{Limit: 10},
+		}, {
+			name: "No batch size",
+			opts: []Option{WithTiers(tiered)},
+			tier: TierOptions{Idle: time.Hour},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSvc := NewFile(newTierRepository(), tiered, zap.NewNop(), tt.opts...)
+			_, err := fileSvc.MigrateObjects(context.Background(), tt.tier)
+			require.ErrorIs(t, err, model.ErrInvalidInput)
+		})
+	}
+}
+
+func TestTierReads(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	repo := newTierRepository()
+	tiered := storage.NewTiered(storage.NewMemory(), storage.NewMemory(), storage.WithMetrics(m))
+	fileSvc := NewFile(repo, tiered, zap.NewNop(), WithTiers(tiered), WithMetrics(m))
+
+	saveTestFiles(t, fileSvc, 2)
+	repo.backdate(testObjectKey(0), 2*time.Hour)
+	_, err := fileSvc.MigrateObjects(ctx, TierOptions{Age: time.Hour, Limit: 10})
+	require.NoError(t, err)
+
+	readFile(t, fileSvc, 0)
+	readFile(t, fileSvc, 1)
+	readFile(t, fileSvc, 1)
+
+	expected := `
+# HELP fileserver_tier_reads_total Number of objects read from the tiered storage, by the tier holding them.
+# TYPE fileserver_tier_reads_total counter
+fileserver_tier_reads_total{tier="cold"} 1
+fileserver_tier_reads_total{tier="hot"} 2
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_tier_reads_total"))
+}
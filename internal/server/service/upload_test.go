@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/auth"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+var errInjected = errors.New("injected fault")
+
+// faultyStorage is an in-memory storage that fails the upload once it stored storeBefore objects,
+// and the deletion of objects.
+type faultyStorage struct {
+	*memStorage
+	uploadErr   error
+	storeBefore int
+	deleteErr   error
+}
+
+func (s *faultyStorage) UploadMultiple(ctx context.Context, objects <-chan *model.Object) error {
+	if s.uploadErr == nil {
+		return s.memStorage.UploadMultiple(ctx, objects)
+	}
+	stored := 0
+	for object := range objects {
+		if stored == s.storeBefore {
+			return s.uploadErr
+		}
+		data, err := io.ReadAll(object.Content)
+		if err != nil {
+			return err
+		}
+		s.store(object.Key, data, time.Now())
+		stored++
+	}
+	return nil
+}
+
+func (s *faultyStorage) Delete(ctx context.Context, names []string) error {
+	if s.deleteErr != nil {
+		return s.deleteErr
+	}
+	return s.memStorage.Delete(ctx, names)
+}
+
+// faultyRepository is an in-memory repository failing the steps of the upload lifecycle.
+// With commitApplied the metadata is committed even though the commit fails, like when its response is lost.
+type faultyRepository struct {
+	*memRepository
+	beginErr, commitErr, failErr error
+	commitApplied                bool
+}
+
+func (r *faultyRepository) BeginUpload(ctx context.Context, upload *model.Upload, defaults model.Quota) error {
+	if r.beginErr != nil {
+		return r.beginErr
+	}
+	return r.memRepository.BeginUpload(ctx, upload, defaults)
+}
+
+func (r *faultyRepository) CommitUpload(ctx context.Context, upload *model.Upload, files []*model.FileMetadata) error {
+	if r.commitErr == nil {
+		return r.memRepository.CommitUpload(ctx, upload, files)
+	}
+	if r.commitApplied {
+		if err := r.memRepository.CommitUpload(ctx, upload, files); err != nil {
+			return err
+		}
+	}
+	return r.commitErr
+}
+
+func (r *faultyRepository) FailUpload(ctx context.Context, upload *model.Upload, cause error) error {
+	if r.failErr != nil {
+		return r.failErr
+	}
+	return r.memRepository.FailUpload(ctx, upload, cause)
+}
+
+func TestUploadLifecycle(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage *faultyStorage
+		repo    *faultyRepository
+		// pending records another pending upload of the tenant with the same content as the second file
+		pending     bool
+		wantErr     error
+		wantState   model.UploadState
+		wantObjects int
+		wantFiles   int
+		wantUsage   model.Usage
+	}{
+		{
+			name:        "Committed",
+			wantState:   model.UploadCommitted,
+			wantObjects: 3,
+			wantFiles:   3,
+			wantUsage:   model.Usage{Bytes: 15, Objects: 3},
+		}, {
+			name:    "Begin fails",
+			repo:    &faultyRepository{beginErr: errInjected},
+			wantErr: errInjected,
+		}, {
+			name:      "Storage fails after the first object",
+			storage:   &faultyStorage{uploadErr: errInjected, storeBefore: 1},
+			wantErr:   errInjected,
+			wantState: model.UploadFailed,
+		}, {
+			name:      "Metadata commit fails",
+			repo:      &faultyRepository{commitErr: errInjected},
+			wantErr:   errInjected,
+			wantState: model.UploadFailed,
+		}, {
+			name:        "Metadata commit applied but reported failed",
+			repo:        &faultyRepository{commitErr: errInjected, commitApplied: true},
+			wantErr:     errInjected,
+			wantState:   model.UploadCommitted,
+			wantObjects: 3,
+			wantFiles:   3,
+			wantUsage:   model.Usage{Bytes: 15, Objects: 3},
+		}, {
+			name:        "Object shared with a pending upload",
+			repo:        &faultyRepository{commitErr: errInjected},
+			pending:     true,
+			wantErr:     errInjected,
+			wantState:   model.UploadFailed,
+			wantObjects: 1,
+			wantUsage:   model.Usage{Bytes: 5, Objects: 1},
+		}, {
+			name:        "Deleting the objects fails",
+			storage:     &faultyStorage{deleteErr: errInjected},
+			repo:        &faultyRepository{commitErr: errInjected},
+			wantErr:     errInjected,
+			wantState:   model.UploadFailed,
+			wantObjects: 3,
+		}, {
+			name:        "Marking the upload failed fails",
+			repo:        &faultyRepository{commitErr: errInjected, failErr: errInjected},
+			wantErr:     errInjected,
+			wantState:   model.UploadPending,
+			wantObjects: 3,
+			wantUsage:   model.Usage{Bytes: 15, Objects: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := tt.storage
+			if storage == nil {
+				storage = &faultyStorage{}
+			}
+			storage.memStorage = newMemStorage()
+			repo := tt.repo
+			if repo == nil {
+				repo = &faultyRepository{}
+			}
+			repo.memRepository = newMemRepository()
+			fileSvc := NewFile(repo, storage, zap.NewNop())
+
+			ctx := context.Background()
+			if tt.pending {
+				pending := &model.Upload{
+					TenantID: auth.DefaultTenant,
+					Hashes:   [][]byte{merkle.HashData([]byte("test1"))},
+					Usage:    model.Usage{Bytes: 5, Objects: 1},
+				}
+				require.NoError(t, repo.memRepository.BeginUpload(ctx, pending, model.Quota{}))
+				// the pending upload stored its object already
+				storage.store(model.ObjectKey(auth.DefaultTenant, pending.Hashes[0]), []byte("test1"), time.Now())
+			}
+
+			_, err := fileSvc.SaveStream(ctx, sendFiles(toBytes([]string{"test0", "test1", "test2"})))
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			uploads := len(repo.uploads)
+			if tt.wantState == "" {
+				require.Zero(t, uploads, "no upload is recorded")
+			} else {
+				require.Equal(t, tt.wantState, repo.upload(int64(uploads)).State)
+			}
+			require.Len(t, storage.keys(), tt.wantObjects)
+			files, err := repo.List(ctx, auth.DefaultTenant, 0, -1)
+			require.NoError(t, err)
+			require.Len(t, files, tt.wantFiles)
+			require.Equal(t, tt.wantUsage, repo.usage[auth.DefaultTenant])
+		})
+	}
+}
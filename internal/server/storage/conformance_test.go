@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestMemory(t *testing.T) {
+	testConformance(t, func(t *testing.T) Storage {
+		return NewMemory()
+	})
+}
+
+func TestFilesystem(t *testing.T) {
+	testConformance(t, func(t *testing.T) Storage {
+		store, err := NewFilesystem(t.TempDir())
+		require.NoError(t, err)
+		return store
+	})
+}
+
+// TestMinIO runs the conformance suite against the MinIO at STORAGE_TEST_MINIO_ENDPOINT, e.g. the one of docker-compose.
+func TestMinIO(t *testing.T) {
+	endpoint := os.Getenv("STORAGE_TEST_MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("STORAGE_TEST_MINIO_ENDPOINT is not set")
+	}
+	testConformance(t, func(t *testing.T) Storage {
+		store, err := NewFile(Config{
+			BucketName:      "fileserver-conformance",
+			Endpoint:        endpoint,
+			AccessKeyID:     "minio",
+			SecretAccessKey: "minio123",
+		})
+		require.NoError(t, err)
+		require.NoError(t, store.MakeBucket())
+		return store
+	})
+}
+
+// testConformance checks the behavior every backend must have. The backends may hold objects of other runs,
+// so every test stores its objects under a tenant of its own.
+func testConformance(t *testing.T, newStorage func(t *testing.T) Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store Storage, tenantID string)
+	}{
+		{name: "Ping", test: testPing},
+		{name: "Upload and download", test: testUploadDownload},
+		{name: "Overwrite", test: testOverwrite},
+		{name: "Missing object", test: testMissing},
+		{name: "Corrupted object", test: testCorrupted},
+		{name: "Rejected upload", test: testRejectedUpload},
+		{name: "Rejected overwrite", test: testRejectedOverwrite},
+		{name: "Range", test: testRange},
+		{name: "Stat", test: testStat},
+		{name: "Delete", test: testDelete},
+		{name: "Walk", test: testWalk},
+		{name: "Walk stops", test: testWalkStops},
+		{name: "Quarantine", test: testQuarantine},
+		{name: "Canceled upload", test: testCanceledUpload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenantID := fmt.Sprintf("conformance-%d", time.Now().UnixNano())
+			tt.test(t, newStorage(t), tenantID)
+		})
+	}
+}
+
+func testPing(t *testing.T, store Storage, _ string) {
+	require.NoError(t, store.Ping(context.Background()))
+}
+
+func testUploadDownload(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	files := newFiles(tenantID, "test0", "test1", "test2")
+	require.NoError(t, upload(ctx, store, files...))
+
+	for _, file := range files {
+		data, err := download(ctx, store, file)
+		require.NoError(t, err)
+		require.Equal(t, file.data, data)
+	}
+}
+
+func testOverwrite(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	file := newFiles(tenantID, "test0")[0]
+	require.NoError(t, upload(ctx, store, file))
+	require.NoError(t, upload(ctx, store, file))
+
+	data, err := download(ctx, store, file)
+	require.NoError(t, err)
+	require.Equal(t, file.data, data)
+	require.Len(t, walk(t, store, tenantID), 1)
+}
+
+func testMissing(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	hash := merkle.HashData([]byte("missing"))
+	key := model.ObjectKey(tenantID, hash)
+	_, err := store.Download(ctx, key, hash)
+	require.ErrorIs(t, err, model.ErrNotFound)
+	_, err = store.DownloadRange(ctx, key, 0, -1)
+	require.ErrorIs(t, err, model.ErrNotFound)
+	_, err = store.Stat(ctx, key)
+	require.ErrorIs(t, err, model.ErrNotFound)
+}
+
+func testCorrupted(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	// the content does not hash to the hash the object is keyed by, it is stored without a hash to check it against
+	file := newFiles(tenantID, "test0")[0]
+	corrupt := []byte("corrupt0")
+	err := store.UploadMultiple(ctx, objects(&model.Object{Key: file.key, Size: -1, Content: bytes.NewReader(corrupt)}))
+	require.NoError(t, err)
+
+	// the corruption is only noticed once the whole object is read
+	content, err := store.Download(ctx, file.key, file.hash)
+	require.NoError(t, err)
+	defer content.Close()
+	_, err = io.ReadAll(content)
+	require.ErrorIs(t, err, model.ErrIntegrity)
+	var integrityErr *model.IntegrityError
+	require.True(t, errors.As(err, &integrityErr))
+	require.Equal(t, file.hash, integrityErr.Expected)
+	require.Equal(t, merkle.HashData(corrupt), integrityErr.Actual)
+}
+
+func testRejectedUpload(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	file := newFiles(tenantID, "test0")[0]
+
+	// the content does not hash to its hash
+	err := store.UploadMultiple(ctx, objects(&model.Object{
+		Key: file.key, Size: 8, Hash: file.hash, Content: bytes.NewReader([]byte("corrupt0")),
+	}))
+	require.ErrorIs(t, err, model.ErrIntegrity)
+	// the content is shorter than its size
+	err = store.UploadMultiple(ctx, objects(&model.Object{
+		Key: file.key, Size: 10, Hash: file.hash, Content: bytes.NewReader(file.data),
+	}))
+	require.Error(t, err)
+
+	_, err = store.Stat(ctx, file.key)
+	require.ErrorIs(t, err, model.ErrNotFound)
+}
+
+func testRejectedOverwrite(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	file := newFiles(tenantID, "test0")[0]
+	require.NoError(t, upload(ctx, store, file))
+
+	// the stored object is kept when a new upload of it does not match its hash
+	err := store.UploadMultiple(ctx, objects(&model.Object{
+		Key: file.key, Size: 8, Hash: file.hash, Content: bytes.NewReader([]byte("corrupt0")),
+	}))
+	require.ErrorIs(t, err, model.ErrIntegrity)
+
+	data, err := download(ctx, store, file)
+	require.NoError(t, err)
+	require.Equal(t, file.data, data)
+	require.Len(t, walk(t, store, tenantID), 1)
+}
+
+func testRange(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	file := newFiles(tenantID, "0123456789")[0]
+	require.NoError(t, upload(ctx, store, file))
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{offset: 0, length: -1, want: "0123456789"},
+		{offset: 2, length: 3, want: "234"},
+		{offset: 7, length: -1, want: "789"},
+		{offset: 7, length: 10, want: "789"},
+		{offset: 10, length: -1, want: ""},
+		{offset: 4, length: 0, want: ""},
+	}
+	for _, tt := range tests {
+		content, err := store.DownloadRange(ctx, file.key, tt.offset, tt.length)
+		require.NoError(t, err)
+		data, err := io.ReadAll(content)
+		require.NoError(t, content.Close())
+		require.NoError(t, err)
+		require.Equal(t, tt.want, string(data), "offset %d, length %d", tt.offset, tt.length)
+	}
+
+	_, err := store.DownloadRange(ctx, file.key, 11, -1)
+	require.ErrorIs(t, err, model.ErrInvalidInput)
+}
+
+func testStat(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Minute)
+	file := newFiles(tenantID, "test22")[0]
+	require.NoError(t, upload(ctx, store, file))
+
+	object, err := store.Stat(ctx, file.key)
+	require.NoError(t, err)
+	require.Equal(t, file.key, object.Key)
+	require.Equal(t, int64(len(file.data)), object.Size)
+	require.True(t, object.LastModified.After(start))
+}
+
+func testDelete(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	files := newFiles(tenantID, "test0", "test1")
+	require.NoError(t, upload(ctx, store, files...))
+
+	missing := model.ObjectKey(tenantID, merkle.HashData([]byte("missing")))
+	require.NoError(t, store.Delete(ctx, []string{files[0].key, missing}))
+
+	_, err := download(ctx, store, files[0])
+	require.ErrorIs(t, err, model.ErrNotFound)
+	_, err = download(ctx, store, files[1])
+	require.NoError(t, err)
+}
+
+func testWalk(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Minute)
+	files := newFiles(tenantID, "test0", "test1", "test22")
+	require.NoError(t, upload(ctx, store, files...))
+
+	objects := walk(t, store, tenantID)
+	require.Len(t, objects, len(files))
+	for _, file := range files {
+		object, ok := objects[file.key]
+		require.True(t, ok, "object %s is listed", file.key)
+		require.Equal(t, int64(len(file.data)), object.Size)
+		require.True(t, object.LastModified.After(start), "object %s has its modification time", object.Key)
+	}
+}
+
+func testWalkStops(t *testing.T, store Storage, tenantID string) {
+	require.NoError(t, upload(context.Background(), store, newFiles(tenantID, "test0", "test1")...))
+
+	stop := errors.New("stop")
+	calls := 0
+	err := store.Walk(context.Background(), func(model.StoredObject) error {
+		calls++
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+	require.Equal(t, 1, calls)
+}
+
+func testQuarantine(t *testing.T, store Storage, tenantID string) {
+	ctx := context.Background()
+	files := newFiles(tenantID, "test0", "test1")
+	require.NoError(t, upload(ctx, store, files...))
+
+	key := files[0].key
+	require.NoError(t, store.Quarantine(ctx, []string{key}))
+
+	_, err := download(ctx, store, files[0])
+	require.ErrorIs(t, err, model.ErrNotFound)
+	quarantined := &testFile{key: model.QuarantinePrefix + key, hash: files[0].hash, data: files[0].data}
+	data, err := download(ctx, store, quarantined)
+	require.NoError(t, err)
+	require.Equal(t, files[0].data, data)
+
+	objects := walk(t, store, model.QuarantinePrefix+tenantID)
+	require.Len(t, objects, 1)
+	require.Contains(t, objects, model.QuarantinePrefix+key)
+}
+
+func testCanceledUpload(t *testing.T, store Storage, tenantID string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// nothing is ever sent, the upload must return when its context is canceled
+	require.Error(t, store.UploadMultiple(ctx, make(chan *model.Object)))
+	require.Empty(t, walk(t, store, tenantID))
+}
+
+// testFile is the content of an object, along with its key and hash.
+type testFile struct {
+	key  string
+	hash []byte
+	data []byte
+}
+
+func newFiles(tenantID string, contents ...string) []*testFile {
+	files := make([]*testFile, len(contents))
+	for i, content := range contents {
+		hash := merkle.HashData([]byte(content))
+		files[i] = &testFile{key: model.ObjectKey(tenantID, hash), hash: hash, data: []byte(content)}
+	}
+	return files
+}
+
+func upload(ctx context.Context, store Storage, files ...*testFile) error {
+	uploads := make([]*model.Object, len(files))
+	for i, file := range files {
+		uploads[i] = &model.Object{
+			Key:     file.key,
+			Size:    int64(len(file.data)),
+			Hash:    file.hash,
+			Content: bytes.NewReader(file.data),
+		}
+	}
+	return store.UploadMultiple(ctx, objects(uploads...))
+}
+
+// objects returns a closed channel holding the objects.
+func objects(uploads ...*model.Object) <-chan *model.Object {
+	ch := make(chan *model.Object, len(uploads))
+	for _, object := range uploads {
+		ch <- object
+	}
+	close(ch)
+	return ch
+}
+
+// download reads the whole object, verifying it against its hash.
+func download(ctx context.Context, store Storage, file *testFile) ([]byte, error) {
+	content, err := store.Download(ctx, file.key, file.hash)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
+
+// walk returns the objects under the prefix, keyed by their key.
+func walk(t *testing.T, store Storage, prefix string) map[string]model.StoredObject {
+	objects := make(map[string]model.StoredObject)
+	err := store.Walk(context.Background(), func(object model.StoredObject) error {
+		if strings.HasPrefix(object.Key, prefix+"/") {
+			objects[object.Key] = object
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return objects
+}
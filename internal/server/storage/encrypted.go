@@ -0,0 +1,676 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/envelope"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// An encrypted object starts with a header holding the ID of the master key and the data key of the object
+// wrapped by it, followed by the content in segments encrypted with the data key. The header has a fixed size,
+// so that the size of the content follows from the size of the object.
+const (
+	encryptionMagic = "FSE1"
+	headerSize      = len(encryptionMagic) + envelope.MaxKeyIDLength + envelope.WrappedSize
+	// segmentSize is the size of the plaintext of a segment, every segment is followed by its tag.
+	segmentSize = 64 << 10
+	tagSize     = 16
+)
+
+// errNotEncrypted is the error of an object without the header, stored before the encryption was enabled.
+var errNotEncrypted = errors.New("not encrypted")
+
+// Encrypted encrypts the objects at rest in the backend with AES-256-GCM, every object with a data key of its own
+// wrapped by the current master key of the keyring. The content is authenticated segment by segment, so that
+// ranges are decrypted without reading the whole object, and the hashes of the objects remain the ones
+// of their plaintext. The objects stored before the encryption was enabled have no header, they are read
+// as plaintext until RotateKeys encrypts them.
+type Encrypted struct {
+	backend Storage
+	keyring *envelope.Keyring
+	metrics *metrics.Metrics
+	log     *zap.Logger
+}
+
+// NewEncrypted creates the storage encrypting the objects stored in the backend with the keys of the keyring.
+func NewEncrypted(backend Storage, keyring *envelope.Keyring, opts ...Option) *Encrypted {
+	o := newOptions(opts)
+	return &Encrypted{
+		backend: backend,
+		keyring: keyring,
+		metrics: o.metrics,
+		log:     o.logger,
+	}
+}
+
+// Backend returns the backend holding the encrypted objects.
+func (e *Encrypted) Backend() Storage {
+	return e.backend
+}
+
+// Ping checks that the backend is reachable.
+func (e *Encrypted) Ping(ctx context.Context) error {
+	return e.backend.Ping(ctx)
+}
+
+// Download streams the decrypted object, verifying it against the hash as it is read.
+func (e *Encrypted) Download(ctx context.Context, name string, hash []byte) (_ io.ReadCloser, err error) {
+	ctx, end := e.trace(ctx, "download", attribute.String("storage.object", name))
+	defer end(&err)
+
+	content, err := e.backend.DownloadRange(ctx, name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	aead, header, err := e.readHeader(content, name)
+	if errors.Is(err, errNotEncrypted) {
+		// the object is read from its start again, through the bytes read as its header
+		e.metrics.UnencryptedRead()
+		plaintext := &rangeReader{Reader: io.MultiReader(bytes.NewReader(header), content), Closer: content}
+		return NewVerifyingReader(plaintext, name, hash), nil
+	}
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	return NewVerifyingReader(&decryptingReader{content: content, name: name, aead: aead}, name, hash), nil
+}
+
+// DownloadRange streams length bytes of the decrypted object from offset, a negative length reads to the end.
+// Only the segments holding the range are read.
+func (e *Encrypted) DownloadRange(ctx context.Context, name string, offset, length int64) (_ io.ReadCloser, err error) {
+	ctx, end := e.trace(ctx, "download_range", attribute.String("storage.object", name))
+	defer end(&err)
+
+	header, err := e.backend.DownloadRange(ctx, name, 0, int64(headerSize))
+	if err != nil {
+		return nil, err
+	}
+	aead, _, err := e.readHeader(header, name)
+	header.Close()
+	if errors.Is(err, errNotEncrypted) {
+		e.metrics.UnencryptedRead()
+		return e.backend.DownloadRange(ctx, name, offset, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := e.backend.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	size, ok := plaintextSize(object.Size)
+	if !ok {
+		return nil, fmt.Errorf("encrypted object %s has %d bytes: %w", name, object.Size, model.ErrIntegrity)
+	}
+	if offset < 0 || offset > size {
+		return nil, fmt.Errorf("offset %d of object %s of %d bytes: %w", offset, name, size, model.ErrInvalidInput)
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	segment := offset / segmentSize
+	content, err := e.backend.DownloadRange(ctx, name, int64(headerSize)+segment*(segmentSize+tagSize), -1)
+	if err != nil {
+		return nil, err
+	}
+	reader := &decryptingReader{
+		content: content,
+		name:    name,
+		aead:    aead,
+		segment: segment,
+		skip:    int(offset % segmentSize),
+	}
+	return &rangeReader{Reader: io.LimitReader(reader, length), Closer: reader}, nil
+}
+
+// Stat describes the object, with the size of its plaintext. The start of the object is read to tell
+// whether it is encrypted, since an object stored before the encryption was enabled is its own plaintext.
+func (e *Encrypted) Stat(ctx context.Context, name string) (_ model.StoredObject, err error) {
+	ctx, end := e.trace(ctx, "stat", attribute.String("storage.object", name))
+	defer end(&err)
+
+	encrypted, err := e.encrypted(ctx, name)
+	if err != nil {
+		return model.StoredObject{}, err
+	}
+	object, err := e.backend.Stat(ctx, name)
+	if err != nil || !encrypted {
+		return object, err
+	}
+	size, ok := plaintextSize(object.Size)
+	if !ok {
+		return model.StoredObject{}, fmt.Errorf("encrypted object %s has %d bytes: %w", name, object.Size, model.ErrIntegrity)
+	}
+	object.Size = size
+	return object, nil
+}
+
+// encrypted reports whether the object starts with the header of an encrypted object.
+func (e *Encrypted) encrypted(ctx context.Context, name string) (bool, error) {
+	content, err := e.backend.DownloadRange(ctx, name, 0, int64(len(encryptionMagic)))
+	if err != nil {
+		return false, err
+	}
+	defer content.Close()
+	magic, err := io.ReadAll(content)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return string(magic) == encryptionMagic, nil
+}
+
+// UploadMultiple encrypts the objects and streams them to the backend. An object whose content does not match
+// its size or hash is abandoned before the backend stores it.
+func (e *Encrypted) UploadMultiple(ctx context.Context, objects <-chan *model.Object) (err error) {
+	ctx, end := e.trace(ctx, "upload")
+	defer end(&err)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < uploadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case object, ok := <-objects:
+					if !ok {
+						return
+					}
+					if err := e.put(ctx, object); err != nil {
+						cancel(err)
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err = context.Cause(ctx); err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+	return nil
+}
+
+// put encrypts the object with a new data key, and streams it to the backend through a pipe.
+func (e *Encrypted) put(ctx context.Context, object *model.Object) error {
+	key, wrapped, err := e.keyring.NewDataKey()
+	if err != nil {
+		return err
+	}
+	aead, err := envelope.NewAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	size := int64(-1)
+	if object.Size >= 0 {
+		size = ciphertextSize(object.Size)
+	}
+	content, writer := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := e.backend.UploadMultiple(ctx, single(&model.Object{Key: object.Key, Size: size, Content: content}))
+		// the writes to a backend that gave up on the object fail with its error instead of blocking
+		if err != nil {
+			content.CloseWithError(err)
+		} else {
+			content.CloseWithError(errors.New("backend stopped reading"))
+		}
+		uploaded <- err
+	}()
+
+	err = encrypt(object, marshalHeader(e.keyring.CurrentID(), wrapped), aead, writer)
+	writer.CloseWithError(err)
+	if uploadErr := <-uploaded; err == nil {
+		err = uploadErr
+	}
+	return err
+}
+
+// encrypt writes the header and the encrypted content of the object to the writer. It returns an error
+// before the writer gets the end of the content if the content does not match its hints.
+func encrypt(object *model.Object, header []byte, aead cipher.AEAD, w io.Writer) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	hasher := merkle.NewHasher()
+	var size int64
+	plaintext, next := make([]byte, segmentSize), make([]byte, segmentSize)
+	sealed := make([]byte, 0, segmentSize+tagSize)
+	nonce := make([]byte, aead.NonceSize())
+	n, err := readSegment(object.Content, plaintext)
+	for segment := int64(0); ; segment++ {
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", object.Key, err)
+		}
+		// a segment is the final one if it is short, or if the content ends right after it
+		final, m := n < segmentSize, 0
+		if !final {
+			m, err = readSegment(object.Content, next)
+			final = m == 0 && err == nil
+		}
+
+		hasher.Write(plaintext[:n])
+		size += int64(n)
+		sealed = aead.Seal(sealed[:0], segmentNonce(nonce, segment), plaintext[:n], segmentAAD(final))
+		if final {
+			// the content is checked before its end is written
+			if err := checkContent(object, size, hasher.Sum(nil)); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		plaintext, next, n = next, plaintext, m
+	}
+}
+
+// readSegment reads a segment, or what is left of the content if it is shorter.
+func readSegment(r io.Reader, segment []byte) (int, error) {
+	n, err := io.ReadFull(r, segment)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	return n, err
+}
+
+// segmentNonce returns the nonce of the segment. The data keys encrypt a single object each, so the nonces
+// only have to differ between its segments.
+func segmentNonce(nonce []byte, segment int64) []byte {
+	clear(nonce)
+	binary.BigEndian.PutUint64(nonce, uint64(segment))
+	return nonce
+}
+
+// segmentAAD authenticates whether the segment is the final one, so that a truncated object does not decrypt.
+func segmentAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// ciphertextSize returns the size of the encrypted object of the plaintext size, an empty one still has a segment.
+func ciphertextSize(size int64) int64 {
+	segments := max(1, (size+segmentSize-1)/segmentSize)
+	return int64(headerSize) + size + segments*tagSize
+}
+
+// plaintextSize returns the size of the plaintext of the encrypted object of the size, and false if no plaintext
+// encrypts to that size.
+func plaintextSize(size int64) (int64, bool) {
+	body := size - int64(headerSize)
+	if body < tagSize {
+		return 0, false
+	}
+	full, rest := body/(segmentSize+tagSize), body%(segmentSize+tagSize)
+	if rest == 0 {
+		return full * segmentSize, true
+	}
+	if rest < tagSize {
+		return 0, false
+	}
+	return full*segmentSize + rest - tagSize, true
+}
+
+// marshalHeader returns the header of an object whose data key is wrapped by the master key of the ID.
+func marshalHeader(keyID string, wrapped []byte) []byte {
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, keyID...)
+	header = append(header, make([]byte, envelope.MaxKeyIDLength-len(keyID))...)
+	return append(header, wrapped...)
+}
+
+// parseHeader returns the ID of the master key and the wrapped data key of the header,
+// or errNotEncrypted if the object does not start with a header.
+func parseHeader(header []byte, name string) (string, []byte, error) {
+	if !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return "", nil, fmt.Errorf("object %s: %w", name, errNotEncrypted)
+	}
+	if len(header) != headerSize {
+		return "", nil, fmt.Errorf("encrypted object %s has a truncated header: %w", name, model.ErrIntegrity)
+	}
+	keyID := header[len(encryptionMagic) : len(encryptionMagic)+envelope.MaxKeyIDLength]
+	keyID = bytes.TrimRight(keyID, "\x00")
+	return string(keyID), header[len(encryptionMagic)+envelope.MaxKeyIDLength:], nil
+}
+
+// readHeader reads the header of the object, and returns the cipher of its data key along with the bytes read
+// as the header, which are the start of the plaintext of an object failing with errNotEncrypted.
+func (e *Encrypted) readHeader(content io.Reader, name string) (cipher.AEAD, []byte, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(content, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	header = header[:n]
+	keyID, wrapped, err := parseHeader(header, name)
+	if err != nil {
+		return nil, header, err
+	}
+	key, err := e.keyring.Unwrap(keyID, wrapped)
+	if err != nil {
+		return nil, header, fmt.Errorf("object %s: %w", name, err)
+	}
+	aead, err := envelope.NewAEAD(key)
+	return aead, header, err
+}
+
+// decryptingReader decrypts the segments of an object from the given one.
+type decryptingReader struct {
+	content io.ReadCloser
+	name    string
+	aead    cipher.AEAD
+	segment int64
+	// skip is the number of bytes of the first segment to skip.
+	skip      int
+	sealed    []byte
+	plaintext []byte
+	pending   []byte
+	done      bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// next decrypts the next segment, and checks that the object ends after the final one.
+func (r *decryptingReader) next() error {
+	if r.sealed == nil {
+		r.sealed = make([]byte, segmentSize+tagSize)
+		r.plaintext = make([]byte, 0, segmentSize)
+	}
+	n, err := io.ReadFull(r.content, r.sealed)
+	switch {
+	case err == io.EOF:
+		return r.corrupted("is truncated")
+	case err != nil && err != io.ErrUnexpectedEOF:
+		return fmt.Errorf("failed to read %s: %w", r.name, err)
+	}
+
+	// a short segment can only be the final one, a full one may be as well
+	nonce := segmentNonce(make([]byte, r.aead.NonceSize()), r.segment)
+	final := n < len(r.sealed)
+	plaintext, err := r.aead.Open(r.plaintext[:0], nonce, r.sealed[:n], segmentAAD(final))
+	if err != nil && !final {
+		final = true
+		plaintext, err = r.aead.Open(r.plaintext[:0], nonce, r.sealed[:n], segmentAAD(final))
+	}
+	if err != nil {
+		return r.corrupted(fmt.Sprintf("fails the authentication of segment %d", r.segment))
+	}
+	if final {
+		if n, _ := r.content.Read(make([]byte, 1)); n > 0 {
+			return r.corrupted("has data after its final segment")
+		}
+		r.done = true
+	}
+	r.pending = plaintext[min(r.skip, len(plaintext)):]
+	r.skip = 0
+	r.segment++
+	return nil
+}
+
+func (r *decryptingReader) corrupted(reason string) error {
+	return fmt.Errorf("encrypted object %s %s: %w", r.name, reason, model.ErrIntegrity)
+}
+
+func (r *decryptingReader) Close() error {
+	return r.content.Close()
+}
+
+// Delete removes the objects, the ones that do not exist are ignored.
+func (e *Encrypted) Delete(ctx context.Context, names []string) error {
+	return e.backend.Delete(ctx, names)
+}
+
+// Walk calls fn for every object, with the size of its plaintext. The start of the objects whose size is the one
+// of an encrypted object is read to tell whether they are, since an object stored before the encryption was enabled
+// is its own plaintext.
+func (e *Encrypted) Walk(ctx context.Context, fn func(object model.StoredObject) error) (err error) {
+	ctx, end := e.trace(ctx, "walk")
+	defer end(&err)
+
+	return e.backend.Walk(ctx, func(object model.StoredObject) error {
+		size, ok := plaintextSize(object.Size)
+		if !ok {
+			return fn(object)
+		}
+		encrypted, err := e.encrypted(ctx, object.Key)
+		switch {
+		case errors.Is(err, model.ErrNotFound):
+			// deleted since it was listed
+			return nil
+		case err != nil:
+			return err
+		case encrypted:
+			object.Size = size
+		}
+		return fn(object)
+	})
+}
+
+// Quarantine moves the objects under model.QuarantinePrefix, they stay decryptable there.
+func (e *Encrypted) Quarantine(ctx context.Context, names []string) error {
+	return e.backend.Quarantine(ctx, names)
+}
+
+// RotateKeys re-wraps the data keys of the objects wrapped by another master key than the current one with
+// the current one. Only the headers of the objects change, their content is copied as it is, still encrypted.
+// The objects stored before the encryption was enabled are encrypted in place with a new data key.
+// The quarantined objects are left as they are. Every object is copied to a temporary file and checked
+// before it is rewritten, and the rewritten objects get a new modification time, which only delays
+// the collection of the orphaned ones by the grace period of the garbage collection.
+func (e *Encrypted) RotateKeys(ctx context.Context) (_ *model.KeyRotationReport, err error) {
+	ctx, end := e.trace(ctx, "rotate_keys", attribute.String("encryption.key_id", e.keyring.CurrentID()))
+	defer end(&err)
+
+	var names []string
+	err = e.backend.Walk(ctx, func(object model.StoredObject) error {
+		if !strings.HasPrefix(object.Key, model.QuarantinePrefix) {
+			names = append(names, object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	report := &model.KeyRotationReport{}
+	for _, name := range names {
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Scanned++
+		rotated, err := e.rotateKey(ctx, name)
+		if errors.Is(err, errNotEncrypted) {
+			if err = e.encryptInPlace(ctx, name); err == nil {
+				report.Encrypted++
+				continue
+			}
+		}
+		switch {
+		case errors.Is(err, model.ErrNotFound):
+			// deleted since it was listed
+		case err != nil:
+			e.log.Error("failed to rotate the key of object", zap.String("object", name), zap.Error(err))
+			report.Failed++
+		case rotated:
+			report.Rotated++
+		}
+	}
+	return report, nil
+}
+
+// rotateKey re-wraps the data key of the object with the current master key, if it is wrapped by another one.
+// The object is rewritten from a copy whose segments are authenticated, and whose plaintext is verified against
+// the hash in its key if it is the content of a file, so that a read cut short or a corrupted object is not stored.
+func (e *Encrypted) rotateKey(ctx context.Context, name string) (bool, error) {
+	current, err := e.currentKey(ctx, name)
+	if err != nil || current {
+		return false, err
+	}
+
+	object, err := e.spool(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer object.Close()
+
+	// the header is read from the copy, in case the object changed since it was checked
+	aead, header, err := e.readHeader(object, name)
+	if err != nil {
+		return false, err
+	}
+	keyID, wrapped, _ := parseHeader(header, name)
+	if keyID == e.keyring.CurrentID() {
+		return false, nil
+	}
+	reader := io.ReadCloser(&decryptingReader{content: io.NopCloser(object), name: name, aead: aead})
+	if _, hash, ok := model.ParseObjectKey(name); ok {
+		reader = NewVerifyingReader(reader, name, hash)
+	}
+	if _, err = io.Copy(io.Discard, reader); err != nil {
+		return false, err
+	}
+	if wrapped, err = e.keyring.Rewrap(keyID, wrapped); err != nil {
+		return false, fmt.Errorf("object %s: %w", name, err)
+	}
+
+	if _, err = object.Seek(int64(headerSize), io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to read the copy of %s: %w", name, err)
+	}
+	rewritten := io.MultiReader(bytes.NewReader(marshalHeader(e.keyring.CurrentID(), wrapped)), object)
+	if err = e.backend.UploadMultiple(ctx, single(&model.Object{Key: name, Size: object.size, Content: rewritten})); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// currentKey reports whether the data key of the object is wrapped by the current master key,
+// reading only its header.
+func (e *Encrypted) currentKey(ctx context.Context, name string) (bool, error) {
+	content, err := e.backend.DownloadRange(ctx, name, 0, int64(headerSize))
+	if err != nil {
+		return false, err
+	}
+	defer content.Close()
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(content, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("failed to read the header of %s: %w", name, err)
+	}
+	keyID, _, err := parseHeader(header[:n], name)
+	if err != nil {
+		return false, err
+	}
+	return keyID == e.keyring.CurrentID(), nil
+}
+
+// encryptInPlace encrypts the object stored before the encryption was enabled from a copy of it, verified
+// against the hash in its key if it is the content of a file.
+func (e *Encrypted) encryptInPlace(ctx context.Context, name string) error {
+	object, err := e.spool(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	_, hash, _ := model.ParseObjectKey(name)
+	return e.put(ctx, &model.Object{Key: name, Size: object.size, Hash: hash, Content: object})
+}
+
+// spooledObject is the copy of an object in a temporary file, removed when it is closed.
+type spooledObject struct {
+	*os.File
+	size int64
+}
+
+func (o *spooledObject) Close() error {
+	err := o.File.Close()
+	if removeErr := os.Remove(o.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// spool copies the object to a temporary file, checking that the copy has the size the backend reports,
+// so that an object is not rewritten from a read cut short.
+func (e *Encrypted) spool(ctx context.Context, name string) (*spooledObject, error) {
+	stored, err := e.backend.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := e.backend.DownloadRange(ctx, name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	file, err := os.CreateTemp("", "rotate-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the copy of %s: %w", name, err)
+	}
+	object := &spooledObject{File: file}
+	if object.size, err = io.Copy(file, content); err != nil {
+		object.Close()
+		return nil, fmt.Errorf("failed to copy %s: %w", name, err)
+	}
+	if object.size != stored.Size {
+		object.Close()
+		return nil, fmt.Errorf("copy of %s has %d bytes instead of %d: %w", name, object.size, stored.Size, model.ErrIntegrity)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		object.Close()
+		return nil, fmt.Errorf("failed to read the copy of %s: %w", name, err)
+	}
+	return object, nil
+}
+
+func (e *Encrypted) trace(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(err *error)) {
+	return startOperation(ctx, e.metrics, "encrypted_"+operation, attrs...)
+}
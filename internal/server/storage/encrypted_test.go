@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/envelope"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestEncrypted(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			return NewEncrypted(NewMemory(), newTestKeyring(t, "k1"))
+		})
+	})
+	t.Run("Filesystem", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			store, err := NewFilesystem(t.TempDir())
+			require.NoError(t, err)
+			return NewEncrypted(store, newTestKeyring(t, "k1"))
+		})
+	})
+	t.Run("Erasure-coded", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			keyring := newTestKeyring(t, "k1")
+			backends := make([]Storage, 3)
+			for i := range backends {
+				backends[i] = NewEncrypted(NewMemory(), keyring)
+			}
+			return newTestErasure(t, 2, 1, backends...)
+		})
+	})
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemory()
+	store := NewEncrypted(backend, newTestKeyring(t, "k1"))
+	// the sizes around the boundaries of the segments
+	sizes := []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3 * segmentSize, 3*segmentSize + 100}
+	for _, size := range sizes {
+		file := newTestFile("acme", size)
+		require.NoError(t, upload(ctx, store, file))
+
+		stored, err := backend.Stat(ctx, file.key)
+		require.NoError(t, err)
+		require.Equal(t, ciphertextSize(int64(size)), stored.Size, "size %d", size)
+		plaintext, ok := plaintextSize(stored.Size)
+		require.True(t, ok)
+		require.Equal(t, int64(size), plaintext)
+
+		// the backend only holds the ciphertext, which the store decrypts back to the content
+		ciphertext, err := readAll(backend.DownloadRange(ctx, file.key, 0, -1))
+		require.NoError(t, err)
+		if size >= 16 {
+			require.False(t, bytes.Contains(ciphertext, file.data[:16]), "size %d", size)
+		}
+		data, err := download(ctx, store, file)
+		require.NoError(t, err)
+		require.Equal(t, file.data, data, "size %d", size)
+	}
+
+	_, ok := plaintextSize(int64(headerSize) + 10)
+	require.False(t, ok)
+	_, ok = plaintextSize(int64(headerSize) + segmentSize + tagSize + 5)
+	require.False(t, ok)
+}
+
+func TestEncryptedRange(t *testing.T) {
+	ctx := context.Background()
+	store := NewEncrypted(NewMemory(), newTestKeyring(t, "k1"))
+	file := newTestFile("acme", 3*segmentSize+100)
+	require.NoError(t, upload(ctx, store, file))
+
+	tests := []struct {
+		name           string
+		offset, length int64
+	}{
+		{name: "First segment", offset: 10, length: 100},
+		{name: "Across segments", offset: segmentSize - 10, length: segmentSize + 20},
+		{name: "Segment boundary", offset: 2 * segmentSize, length: 10},
+		{name: "To the end", offset: 3*segmentSize + 50, length: -1},
+		{name: "Past the end", offset: 3 * segmentSize, length: segmentSize},
+		{name: "Empty", offset: 3*segmentSize + 100, length: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := readAll(store.DownloadRange(ctx, file.key, tt.offset, tt.length))
+			require.NoError(t, err)
+			end := int64(len(file.data))
+			if tt.length >= 0 {
+				end = min(end, tt.offset+tt.length)
+			}
+			require.Equal(t, file.data[tt.offset:end], data)
+		})
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	ctx := context.Background()
+	file := newTestFile("acme", 2*segmentSize+100)
+	tests := []struct {
+		name   string
+		tamper func(ciphertext []byte) []byte
+	}{
+		{name: "Flipped bit", tamper: func(ciphertext []byte) []byte {
+			ciphertext[headerSize+segmentSize+10] ^= 1
+			return ciphertext
+		}},
+		{name: "Truncated at a segment", tamper: func(ciphertext []byte) []byte {
+			return ciphertext[:headerSize+2*(segmentSize+tagSize)]
+		}},
+		{name: "Swapped segments", tamper: func(ciphertext []byte) []byte {
+			first := bytes.Clone(ciphertext[headerSize : headerSize+segmentSize+tagSize])
+			copy(ciphertext[headerSize:], ciphertext[headerSize+segmentSize+tagSize:headerSize+2*(segmentSize+tagSize)])
+			copy(ciphertext[headerSize+segmentSize+tagSize:], first)
+			return ciphertext
+		}},
+		{name: "Wrong key ID", tamper: func(ciphertext []byte) []byte {
+			ciphertext[len(encryptionMagic)] = 'x'
+			return ciphertext
+		}},
+		// an object without the header is read as plaintext, which the encrypted content does not hash to
+		{name: "Header stripped", tamper: func(ciphertext []byte) []byte {
+			return ciphertext[headerSize:]
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemory()
+			keyring := newTestKeyring(t, "k1")
+			store := NewEncrypted(backend, keyring)
+			require.NoError(t, upload(ctx, store, file))
+
+			ciphertext, err := readAll(backend.DownloadRange(ctx, file.key, 0, -1))
+			require.NoError(t, err)
+			require.NoError(t, backend.UploadMultiple(ctx, objects(&model.Object{
+				Key: file.key, Size: -1, Content: bytes.NewReader(tt.tamper(ciphertext)),
+			})))
+
+			_, err = download(ctx, store, file)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestEncryptedLegacyObject(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+	backend := NewMemory()
+	file := newTestFile("acme", segmentSize+100)
+	// the object was stored before the encryption was enabled
+	require.NoError(t, upload(ctx, backend, file))
+	store := NewEncrypted(backend, newTestKeyring(t, "k1"), WithMetrics(metrics.New(registry)))
+
+	data, err := download(ctx, store, file)
+	require.NoError(t, err)
+	require.Equal(t, file.data, data)
+	data, err = readAll(store.DownloadRange(ctx, file.key, 10, 20))
+	require.NoError(t, err)
+	require.Equal(t, file.data[10:30], data)
+	object, err := store.Stat(ctx, file.key)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(file.data)), object.Size)
+	requireUnencryptedReads(t, registry, 2)
+
+	// the rotation encrypts it in place
+	report, err := store.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.KeyRotationReport{Scanned: 1, Encrypted: 1}, report)
+	stored, err := readAll(backend.DownloadRange(ctx, file.key, 0, -1))
+	require.NoError(t, err)
+	require.Equal(t, encryptionMagic, string(stored[:len(encryptionMagic)]))
+	require.Equal(t, ciphertextSize(int64(len(file.data))), int64(len(stored)))
+
+	data, err = download(ctx, store, file)
+	require.NoError(t, err)
+	require.Equal(t, file.data, data)
+	requireUnencryptedReads(t, registry, 2)
+}
+
+func requireUnencryptedReads(t *testing.T, registry *prometheus.Registry, want int) {
+	t.Helper()
+	expected := fmt.Sprintf(`
+# HELP fileserver_unencrypted_reads_total Number of objects read as plaintext because they were stored before the encryption was enabled.
+# TYPE fileserver_unencrypted_reads_total counter
+fileserver_unencrypted_reads_total %d
+`, want)
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_unencrypted_reads_total"))
+}
+
+func TestEncryptedRotateKeys(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemory()
+	files := []*testFile{newTestFile("acme", 100), newTestFile("acme", segmentSize+1)}
+	old := NewEncrypted(backend, newTestKeyring(t, "k1"))
+	require.NoError(t, upload(ctx, old, files[0]))
+
+	// the objects written once the new key is current are wrapped by it
+	rotated := NewEncrypted(backend, newTestKeyring(t, "k1", "k2"))
+	require.NoError(t, upload(ctx, rotated, files[1]))
+	before, err := readAll(backend.DownloadRange(ctx, files[0].key, int64(headerSize), -1))
+	require.NoError(t, err)
+
+	report, err := rotated.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.KeyRotationReport{Scanned: 2, Rotated: 1}, report)
+
+	// the content is left as it is, encrypted with the same data key
+	after, err := readAll(backend.DownloadRange(ctx, files[0].key, int64(headerSize), -1))
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	header, err := readAll(backend.DownloadRange(ctx, files[0].key, 0, int64(headerSize)))
+	require.NoError(t, err)
+	keyID, _, err := parseHeader(header, files[0].key)
+	require.NoError(t, err)
+	require.Equal(t, "k2", keyID)
+
+	// the old master key can be dropped once every data key is re-wrapped
+	current := NewEncrypted(backend, newTestKeyring(t, "k2"))
+	for _, file := range files {
+		data, err := download(ctx, current, file)
+		require.NoError(t, err)
+		require.Equal(t, file.data, data)
+	}
+	report, err = current.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.KeyRotationReport{Scanned: 2}, report)
+
+	// the data keys wrapped by an unknown master key cannot be re-wrapped
+	require.NoError(t, upload(ctx, old, files[0]))
+	report, err = current.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.KeyRotationReport{Scanned: 2, Failed: 1}, report)
+}
+
+func TestEncryptedRotateKeysChecksCopy(t *testing.T) {
+	ctx := context.Background()
+	file := newTestFile("acme", 2*segmentSize+100)
+	tests := []struct {
+		name string
+		// store stores the object in the backend, and returns the backend the rotation reads it from
+		store func(t *testing.T, backend *Memory) Storage
+	}{
+		{
+			name: "Corrupted object",
+			store: func(t *testing.T, backend *Memory) Storage {
+				require.NoError(t, upload(ctx, NewEncrypted(backend, newTestKeyring(t, "k1")), file))
+				ciphertext, err := readAll(backend.DownloadRange(ctx, file.key, 0, -1))
+				require.NoError(t, err)
+				ciphertext[headerSize+segmentSize+10] ^= 1
+				require.NoError(t, backend.UploadMultiple(ctx, objects(&model.Object{
+					Key: file.key, Size: -1, Content: bytes.NewReader(ciphertext),
+				})))
+				return backend
+			},
+		}, {
+			name: "Read cut short",
+			store: func(t *testing.T, backend *Memory) Storage {
+				require.NoError(t, upload(ctx, NewEncrypted(backend, newTestKeyring(t, "k1")), file))
+				return truncatingStorage{Storage: backend, size: int64(headerSize + segmentSize + tagSize)}
+			},
+		}, {
+			name: "Plaintext read cut short",
+			store: func(t *testing.T, backend *Memory) Storage {
+				require.NoError(t, upload(ctx, backend, file))
+				return truncatingStorage{Storage: backend, size: segmentSize}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemory()
+			store := NewEncrypted(tt.store(t, backend), newTestKeyring(t, "k1", "k2"))
+			before, err := readAll(backend.DownloadRange(ctx, file.key, 0, -1))
+			require.NoError(t, err)
+
+			report, err := store.RotateKeys(ctx)
+			require.NoError(t, err)
+			require.Equal(t, &model.KeyRotationReport{Scanned: 1, Failed: 1}, report)
+
+			// the object is left as it was
+			after, err := readAll(backend.DownloadRange(ctx, file.key, 0, -1))
+			require.NoError(t, err)
+			require.Equal(t, before, after)
+		})
+	}
+}
+
+func TestEncryptedRotateKeysQuarantine(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemory()
+	files := []*testFile{newTestFile("acme", 100), newTestFile("acme", 200)}
+	require.NoError(t, upload(ctx, NewEncrypted(backend, newTestKeyring(t, "k1")), files...))
+	require.NoError(t, backend.Quarantine(ctx, []string{files[1].key}))
+
+	report, err := NewEncrypted(backend, newTestKeyring(t, "k1", "k2")).RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.KeyRotationReport{Scanned: 1, Rotated: 1}, report)
+
+	// the quarantined object is left wrapped by the old master key
+	header, err := readAll(backend.DownloadRange(ctx, model.QuarantinePrefix+files[1].key, 0, int64(headerSize)))
+	require.NoError(t, err)
+	keyID, _, err := parseHeader(header, files[1].key)
+	require.NoError(t, err)
+	require.Equal(t, "k1", keyID)
+}
+
+func TestEncryptedWalk(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemory()
+	encrypted := newTestFile("acme", 100)
+	// the plaintext has the size of an encrypted object, but no header
+	legacy := newTestFile("acme", headerSize+tagSize+10)
+	require.NoError(t, upload(ctx, backend, legacy))
+	store := NewEncrypted(backend, newTestKeyring(t, "k1"))
+	require.NoError(t, upload(ctx, store, encrypted))
+
+	sizes := make(map[string]int64)
+	for key, object := range walk(t, store, "acme") {
+		sizes[key] = object.Size
+	}
+	require.Equal(t, map[string]int64{
+		encrypted.key: int64(len(encrypted.data)),
+		legacy.key:    int64(len(legacy.data)),
+	}, sizes)
+}
+
+// truncatingStorage cuts the whole object reads of the storage short after size bytes.
+type truncatingStorage struct {
+	Storage
+	size int64
+}
+
+func (s truncatingStorage) DownloadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	content, err := s.Storage.DownloadRange(ctx, name, offset, length)
+	if err != nil || length >= 0 {
+		return content, err
+	}
+	return &rangeReader{Reader: io.LimitReader(content, s.size), Closer: content}, nil
+}
+
+func TestNewEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("k2:"+testMasterKey("k2")+"\n"), 0o600))
+	store, err := New(Config{
+		Backend:           BackendMemory,
+		ColdBackend:       BackendMemory,
+		EncryptionKeys:    []string{"k1:" + testMasterKey("k1")},
+		EncryptionKeyFile: path,
+	})
+	require.NoError(t, err)
+
+	// every tier encrypts its objects with the last master key
+	encrypted := Encryption(store)
+	require.Len(t, encrypted, 2)
+	for _, backend := range encrypted {
+		require.Equal(t, "k2", backend.keyring.CurrentID())
+	}
+	for _, backend := range Backends(store) {
+		require.IsType(t, &Memory{}, backend)
+	}
+
+	_, err = New(Config{Backend: BackendMemory, EncryptionKeys: []string{"k1:short"}})
+	require.Error(t, err)
+	store, err = New(Config{Backend: BackendMemory})
+	require.NoError(t, err)
+	require.Empty(t, Encryption(store))
+}
+
+func newTestKeyring(t *testing.T, ids ...string) *envelope.Keyring {
+	entries := make([]string, len(ids))
+	for i, id := range ids {
+		entries[i] = id + ":" + testMasterKey(id)
+	}
+	keyring, err := envelope.ParseKeyring(entries, "")
+	require.NoError(t, err)
+	return keyring
+}
+
+// testMasterKey returns the master key of the ID, the same for every keyring.
+func testMasterKey(id string) string {
+	key := make([]byte, envelope.KeySize)
+	copy(key, id)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func readAll(content io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
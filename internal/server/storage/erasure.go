@@ -0,0 +1,740 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zale144/fileserver/internal/erasure"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// maxBlockSize is the size of the blocks of the shards the objects are cut in. The objects smaller than a stripe
+// of them are cut in blocks just large enough, so that their shards are not mostly padding.
+const maxBlockSize = 64 << 10
+
+// ShardIndex records the layout of the erasure-coded objects, and the location and the hash of their shards.
+type ShardIndex interface {
+	SaveCodedObject(ctx context.Context, object *model.CodedObject) error
+	GetCodedObject(ctx context.Context, key string) (*model.CodedObject, error)
+	DeleteCodedObjects(ctx context.Context, keys []string) error
+}
+
+// Erasure stores every object as data and parity shards, Reed-Solomon coded and spread over the backends,
+// and records where they are in the shard index. An object is read back as long as no more of its shards
+// than its parity shards are lost, and RepairShards rebuilds the missing and damaged ones.
+type Erasure struct {
+	backends []Storage
+	coder    *erasure.Coder
+	index    ShardIndex
+	metrics  *metrics.Metrics
+}
+
+// NewErasure creates the storage coding the objects in dataShards data and parityShards parity shards over the backends.
+// With fewer backends than shards, some backends hold several shards of an object, and losing one of them loses
+// all of these shards.
+func NewErasure(backends []Storage, dataShards, parityShards int, index ShardIndex, opts ...Option) (*Erasure, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("no shard locations")
+	}
+	if index == nil {
+		return nil, errors.New("no shard index")
+	}
+	coder, err := erasure.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &Erasure{
+		backends: backends,
+		coder:    coder,
+		index:    index,
+		metrics:  newOptions(opts).metrics,
+	}, nil
+}
+
+// Locations returns the backends the shards are spread over.
+func (e *Erasure) Locations() []Storage {
+	return e.backends
+}
+
+// Ping checks that every backend is reachable, the objects cannot be written otherwise.
+func (e *Erasure) Ping(ctx context.Context) error {
+	for i, backend := range e.backends {
+		if err := backend.Ping(ctx); err != nil {
+			return fmt.Errorf("shard location %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Download streams the object, decoding it from its data shards or reconstructing it from the others.
+func (e *Erasure) Download(ctx context.Context, name string, hash []byte) (io.ReadCloser, error) {
+	object, err := e.index.GetCodedObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := e.read(ctx, object, 0, object.Size)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifyingReader(content, name, hash), nil
+}
+
+// DownloadRange streams length bytes of the object from offset, a negative length reads to the end.
+// Only the stripes holding the range are read.
+func (e *Erasure) DownloadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	object, err := e.index.GetCodedObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > object.Size {
+		return nil, fmt.Errorf("offset %d of object %s of %d bytes: %w", offset, name, object.Size, model.ErrInvalidInput)
+	}
+	if length < 0 || offset+length > object.Size {
+		length = object.Size - offset
+	}
+	return e.read(ctx, object, offset, length)
+}
+
+// read opens the stripes of the object holding length bytes from offset.
+func (e *Erasure) read(ctx context.Context, object *model.CodedObject, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	stripeSize := int64(object.DataShards) * int64(object.BlockSize)
+	stripes, err := e.openStripes(ctx, object, offset/stripeSize, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &codedReader{stripes: stripes, skip: offset % stripeSize, remaining: length}, nil
+}
+
+// Stat describes the object from its layout.
+func (e *Erasure) Stat(ctx context.Context, name string) (model.StoredObject, error) {
+	object, err := e.index.GetCodedObject(ctx, name)
+	if err != nil {
+		return model.StoredObject{}, err
+	}
+	return model.StoredObject{Key: name, Size: object.Size, LastModified: object.UpdatedAt}, nil
+}
+
+// UploadMultiple codes every object and streams its shards to their backends, then records its layout.
+// An object is only stored once every one of its shards is.
+func (e *Erasure) UploadMultiple(ctx context.Context, objects <-chan *model.Object) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < uploadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case object, ok := <-objects:
+					if !ok {
+						return
+					}
+					if err := e.put(ctx, object); err != nil {
+						cancel(err)
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+	return nil
+}
+
+// put streams the shards of the object to their backends through a pipe each. The shards of an object whose content
+// does not match its size or hash are abandoned before they are stored.
+func (e *Erasure) put(ctx context.Context, object *model.Object) error {
+	total := e.coder.DataShards() + e.coder.ParityShards()
+	shards := make([]model.Shard, total)
+	writers := make([]*io.PipeWriter, total)
+	hashers := make([]hash.Hash, total)
+	errs := make([]error, total)
+	var wg sync.WaitGroup
+	for i := range shards {
+		location := e.location(object.Key, i)
+		shards[i] = model.Shard{Index: i, Location: location}
+		hashers[i] = merkle.NewHasher()
+		content, writer := io.Pipe()
+		writers[i] = writer
+		wg.Add(1)
+		go func(i int, backend Storage) {
+			defer wg.Done()
+			err := backend.UploadMultiple(ctx, single(&model.Object{Key: shardKey(object.Key, i), Size: -1, Content: content}))
+			if err != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			}
+			// the writes to a backend that gave up on the shard fail instead of blocking
+			content.CloseWithError(errors.New("shard location stopped reading"))
+		}(i, e.backends[location])
+	}
+
+	blockSize := codedBlockSize(object.Size, e.coder.DataShards())
+	size, err := e.encode(object, blockSize, writers, hashers)
+	for _, writer := range writers {
+		writer.CloseWithError(err)
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if err = errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to store the shards of %s: %w", object.Key, err)
+	}
+
+	coded := &model.CodedObject{
+		Key:          object.Key,
+		Size:         size,
+		DataShards:   e.coder.DataShards(),
+		ParityShards: e.coder.ParityShards(),
+		BlockSize:    blockSize,
+		Shards:       shards,
+	}
+	for i := range shards {
+		shards[i].Size = coded.Stripes() * int64(blockSize)
+		shards[i].Hash = hashers[i].Sum(nil)
+	}
+	if err = e.index.SaveCodedObject(ctx, coded); err != nil {
+		return fmt.Errorf("failed to record the shards of %s: %w", object.Key, err)
+	}
+	return nil
+}
+
+// encode cuts the content of the object in stripes, and writes the data and parity blocks of every stripe
+// to the writers of their shards. It returns the size of the content, or an error if it does not match its hints.
+func (e *Erasure) encode(object *model.Object, blockSize int, writers []*io.PipeWriter, hashers []hash.Hash) (int64, error) {
+	dataShards := e.coder.DataShards()
+	stripe := make([]byte, dataShards*blockSize)
+	blocks := make([][]byte, len(writers))
+	for i := dataShards; i < len(blocks); i++ {
+		blocks[i] = make([]byte, blockSize)
+	}
+
+	hasher := merkle.NewHasher()
+	var size int64
+	for {
+		n, err := io.ReadFull(object.Content, stripe)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return size, fmt.Errorf("failed to read %s: %w", object.Key, err)
+		}
+		hasher.Write(stripe[:n])
+		size += int64(n)
+
+		// the last stripe is padded with zeros
+		clear(stripe[n:])
+		for i := 0; i < dataShards; i++ {
+			blocks[i] = stripe[i*blockSize : (i+1)*blockSize]
+		}
+		if err := e.coder.Encode(blocks); err != nil {
+			return size, err
+		}
+		for i, block := range blocks {
+			if _, err := writers[i].Write(block); err != nil {
+				return size, fmt.Errorf("failed to write shard %d of %s: %w", i, object.Key, err)
+			}
+			hashers[i].Write(block)
+		}
+		if n < len(stripe) {
+			break
+		}
+	}
+	return size, checkContent(object, size, hasher.Sum(nil))
+}
+
+// codedBlockSize returns the size of the blocks of an object of the given size, a negative one if it is unknown.
+func codedBlockSize(size int64, dataShards int) int {
+	if size < 0 {
+		return maxBlockSize
+	}
+	block := (size + int64(dataShards) - 1) / int64(dataShards)
+	return int(max(1, min(block, maxBlockSize)))
+}
+
+// location returns the backend of the shard of the object. The shards of an object go to consecutive backends,
+// from one picked by its key so that the first shards of the objects do not all go to the same backend.
+func (e *Erasure) location(name string, shard int) int {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(name))
+	return (int(hasher.Sum32()%uint32(len(e.backends))) + shard) % len(e.backends)
+}
+
+// shardKey returns the key of the shard of the object in its backend.
+func shardKey(name string, shard int) string {
+	return name + "." + strconv.Itoa(shard)
+}
+
+// parseShardKey returns the object and the index of the shard stored under the key, and false if it is not a shard.
+func parseShardKey(key string) (string, int, bool) {
+	i := strings.LastIndexByte(key, '.')
+	if i <= strings.LastIndexByte(key, '/') {
+		return "", 0, false
+	}
+	shard, err := strconv.Atoi(key[i+1:])
+	if err != nil || shard < 0 || shard >= erasure.MaxShards {
+		return "", 0, false
+	}
+	return key[:i], shard, true
+}
+
+// Delete removes the layouts of the objects and their shards from every backend, the ones that do not exist
+// are ignored. The layouts go first, so that the shards left by a failure are still listed by Walk.
+func (e *Erasure) Delete(ctx context.Context, names []string) error {
+	shards := e.coder.DataShards() + e.coder.ParityShards()
+	for _, name := range names {
+		object, err := e.index.GetCodedObject(ctx, name)
+		if err != nil && !errors.Is(err, model.ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			shards = max(shards, len(object.Shards))
+		}
+	}
+	if err := e.index.DeleteCodedObjects(ctx, names); err != nil {
+		return fmt.Errorf("failed to delete the shards of the objects from the index: %w", err)
+	}
+
+	// an object written with fewer backends may have its shards anywhere
+	keys := make([]string, 0, len(names)*shards)
+	for _, name := range names {
+		for i := 0; i < shards; i++ {
+			keys = append(keys, shardKey(name, i))
+		}
+	}
+	var errs []error
+	for i, backend := range e.backends {
+		if err := backend.Delete(ctx, keys); err != nil {
+			errs = append(errs, fmt.Errorf("shard location %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Walk calls fn for every object with a shard in a backend, in the order of their keys, along with the latest
+// modification time of its shards. The size of an object whose layout was never recorded, e.g. left by
+// an interrupted upload, is the size of its shards.
+func (e *Erasure) Walk(ctx context.Context, fn func(object model.StoredObject) error) error {
+	objects := make(map[string]*model.StoredObject)
+	for i, backend := range e.backends {
+		err := backend.Walk(ctx, func(shard model.StoredObject) error {
+			name, _, ok := parseShardKey(shard.Key)
+			if !ok {
+				return nil
+			}
+			object := objects[name]
+			if object == nil {
+				object = &model.StoredObject{Key: name}
+				objects[name] = object
+			}
+			object.Size += shard.Size
+			if shard.LastModified.After(object.LastModified) {
+				object.LastModified = shard.LastModified
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list shard location %d: %w", i, err)
+		}
+	}
+
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		object := objects[name]
+		coded, err := e.index.GetCodedObject(ctx, name)
+		switch {
+		case err == nil:
+			object.Size = coded.Size
+		case !errors.Is(err, model.ErrNotFound):
+			return err
+		}
+		if err = fn(*object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine moves the shards of the objects under model.QuarantinePrefix, along with their layouts.
+// The objects that do not exist are ignored.
+func (e *Erasure) Quarantine(ctx context.Context, names []string) error {
+	for _, name := range names {
+		object, err := e.index.GetCodedObject(ctx, name)
+		if errors.Is(err, model.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, shard := range object.Shards {
+			backend, err := e.backend(shard)
+			if err != nil {
+				return err
+			}
+			key := shardKey(name, shard.Index)
+			if _, err = backend.Stat(ctx, key); errors.Is(err, model.ErrNotFound) {
+				continue
+			}
+			if err = backend.Quarantine(ctx, []string{key}); err != nil {
+				return fmt.Errorf("failed to quarantine shard %d of %s: %w", shard.Index, name, err)
+			}
+		}
+
+		quarantined := *object
+		quarantined.Key = model.QuarantinePrefix + name
+		if err = e.index.SaveCodedObject(ctx, &quarantined); err != nil {
+			return fmt.Errorf("failed to record the quarantine of %s: %w", name, err)
+		}
+		if err = e.index.DeleteCodedObjects(ctx, []string{name}); err != nil {
+			return fmt.Errorf("failed to record the quarantine of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// RepairShards verifies every shard of the object against the hash recorded in the index, and rebuilds
+// the missing and damaged ones from the others. It returns the number of shards rebuilt. The shards
+// whose backend cannot be reached are neither read nor rebuilt.
+func (e *Erasure) RepairShards(ctx context.Context, name string) (repaired int, err error) {
+	object, err := e.index.GetCodedObject(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	// excluded are the shards not to read the others from, the damaged ones are rebuilt
+	excluded := make([]bool, len(object.Shards))
+	var damaged []int
+	var errs []error
+	for i, shard := range object.Shards {
+		err := e.verifyShard(ctx, name, shard)
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, model.ErrNotFound), errors.Is(err, model.ErrIntegrity):
+			damaged = append(damaged, i)
+		default:
+			errs = append(errs, fmt.Errorf("shard %d: %w", shard.Index, err))
+		}
+		excluded[i] = true
+	}
+	if len(damaged) == 0 {
+		return 0, errors.Join(errs...)
+	}
+
+	rebuilt, err := e.rebuild(ctx, object, excluded, damaged)
+	for _, i := range damaged {
+		if rebuilt[i] {
+			e.metrics.ShardRepair(repairRepaired)
+			repaired++
+		} else {
+			e.metrics.ShardRepair(repairFailed)
+		}
+	}
+	return repaired, errors.Join(append(errs, err)...)
+}
+
+// verifyShard reads the shard to its end, verifying it against its hash.
+func (e *Erasure) verifyShard(ctx context.Context, name string, shard model.Shard) error {
+	backend, err := e.backend(shard)
+	if err != nil {
+		return err
+	}
+	return verifyCopy(ctx, backend, shardKey(name, shard.Index), shard.Hash)
+}
+
+// rebuild reconstructs the damaged shards of the object from the ones not excluded, and streams them to their
+// backends, which verify them against their recorded size and hash. It returns which shards were rebuilt.
+func (e *Erasure) rebuild(ctx context.Context, object *model.CodedObject, excluded []bool, damaged []int) ([]bool, error) {
+	rebuilt := make([]bool, len(object.Shards))
+	stripes, err := e.openStripes(ctx, object, 0, excluded)
+	if err != nil {
+		return rebuilt, fmt.Errorf("failed to rebuild the shards of %s: %w", object.Key, err)
+	}
+	defer stripes.Close()
+
+	writers := make(map[int]*io.PipeWriter, len(damaged))
+	errs := make([]error, len(object.Shards))
+	var wg sync.WaitGroup
+	for _, i := range damaged {
+		shard := object.Shards[i]
+		backend, err := e.backend(shard)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		content, writer := io.Pipe()
+		writers[i] = writer
+		wg.Add(1)
+		go func(i int, shard model.Shard, backend Storage) {
+			defer wg.Done()
+			errs[i] = backend.UploadMultiple(ctx, single(&model.Object{
+				Key: shardKey(object.Key, shard.Index), Size: shard.Size, Hash: shard.Hash, Content: content,
+			}))
+			content.CloseWithError(errors.New("shard location stopped reading"))
+		}(i, shard, backend)
+	}
+
+	var readErr error
+	for s := int64(0); s < object.Stripes() && readErr == nil && len(writers) > 0; s++ {
+		var blocks [][]byte
+		if blocks, readErr = stripes.next(true); readErr != nil {
+			break
+		}
+		for i, writer := range writers {
+			if _, err := writer.Write(blocks[i]); err != nil {
+				delete(writers, i)
+			}
+		}
+	}
+	for _, writer := range writers {
+		writer.CloseWithError(readErr)
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, i := range damaged {
+		if readErr == nil && errs[i] == nil {
+			rebuilt[i] = true
+			continue
+		}
+		if errs[i] != nil {
+			failed = append(failed, fmt.Errorf("shard %d: %w", object.Shards[i].Index, errs[i]))
+		}
+	}
+	if readErr != nil {
+		failed = append(failed, fmt.Errorf("failed to rebuild the shards of %s: %w", object.Key, readErr))
+	}
+	return rebuilt, errors.Join(failed...)
+}
+
+// backend returns the backend of the shard.
+func (e *Erasure) backend(shard model.Shard) (Storage, error) {
+	if shard.Location < 0 || shard.Location >= len(e.backends) {
+		return nil, fmt.Errorf("shard %d at unknown location %d", shard.Index, shard.Location)
+	}
+	return e.backends[shard.Location], nil
+}
+
+// stripeReader reads the stripes of an erasure-coded object from its shards, and reconstructs the blocks
+// of the shards it cannot read from the others.
+type stripeReader struct {
+	ctx     context.Context
+	e       *Erasure
+	object  *model.CodedObject
+	coder   *erasure.Coder
+	readers []io.ReadCloser
+	// errs holds why the shards that cannot be read cannot be.
+	errs    []error
+	stripe  int64
+	blocks  [][]byte
+	buffers [][]byte
+	// reconstructed is set once a block of a data shard was reconstructed.
+	reconstructed bool
+}
+
+var errExcluded = errors.New("excluded")
+
+// openStripes opens the shards of the object, but the excluded ones, to read its stripes from the given one.
+func (e *Erasure) openStripes(ctx context.Context, object *model.CodedObject, stripe int64, excluded []bool) (*stripeReader, error) {
+	coder := e.coder
+	if object.DataShards != coder.DataShards() || object.ParityShards != coder.ParityShards() {
+		var err error
+		if coder, err = erasure.New(object.DataShards, object.ParityShards); err != nil {
+			return nil, err
+		}
+	}
+	if len(object.Shards) != object.DataShards+object.ParityShards {
+		return nil, fmt.Errorf("object %s has %d shards recorded instead of %d",
+			object.Key, len(object.Shards), object.DataShards+object.ParityShards)
+	}
+
+	r := &stripeReader{
+		ctx:     ctx,
+		e:       e,
+		object:  object,
+		coder:   coder,
+		readers: make([]io.ReadCloser, len(object.Shards)),
+		errs:    make([]error, len(object.Shards)),
+		stripe:  stripe,
+		blocks:  make([][]byte, len(object.Shards)),
+		buffers: make([][]byte, len(object.Shards)),
+	}
+	for i := range excluded {
+		if excluded[i] {
+			r.errs[i] = errExcluded
+		}
+	}
+	if err := r.open(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens shards at the current stripe, the data shards first, until as many as the data shards are open.
+func (r *stripeReader) open() error {
+	open := 0
+	for _, reader := range r.readers {
+		if reader != nil {
+			open++
+		}
+	}
+	for i, shard := range r.object.Shards {
+		if open >= r.object.DataShards {
+			return nil
+		}
+		if r.readers[i] != nil || r.errs[i] != nil {
+			continue
+		}
+		backend, err := r.e.backend(shard)
+		if err == nil {
+			r.readers[i], err = backend.DownloadRange(r.ctx, shardKey(r.object.Key, shard.Index), r.stripe*int64(r.object.BlockSize), -1)
+		}
+		if err != nil {
+			r.errs[i] = fmt.Errorf("shard %d: %w", shard.Index, err)
+			continue
+		}
+		r.buffers[i] = make([]byte, r.object.BlockSize)
+		open++
+	}
+	if open < r.object.DataShards {
+		var errs []error
+		for _, err := range r.errs {
+			if err != nil && err != errExcluded {
+				errs = append(errs, err)
+			}
+		}
+		return fmt.Errorf("%d shards of %s readable, %d needed: %w", open, r.object.Key, r.object.DataShards, errors.Join(errs...))
+	}
+	return nil
+}
+
+// next reads the next stripe, and returns the blocks of its data shards, reconstructing the ones that cannot be read.
+// With all set, the blocks of the parity shards are returned as well.
+func (r *stripeReader) next(all bool) ([][]byte, error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+	clear(r.blocks)
+	for {
+		read := 0
+		for i, reader := range r.readers {
+			if r.blocks[i] != nil {
+				read++
+				continue
+			}
+			if reader == nil {
+				continue
+			}
+			if _, err := io.ReadFull(reader, r.buffers[i]); err != nil {
+				reader.Close()
+				r.readers[i] = nil
+				r.errs[i] = fmt.Errorf("shard %d: %w", r.object.Shards[i].Index, err)
+				continue
+			}
+			r.blocks[i] = r.buffers[i]
+			read++
+		}
+		if read >= r.object.DataShards {
+			break
+		}
+		// the shards that failed are replaced by others, opened at the stripe
+		if err := r.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	missingData := false
+	for i := 0; i < r.object.DataShards; i++ {
+		missingData = missingData || r.blocks[i] == nil
+	}
+	missingParity := false
+	for i := r.object.DataShards; i < len(r.blocks); i++ {
+		missingParity = missingParity || r.blocks[i] == nil
+	}
+	if missingData || all && missingParity {
+		if err := r.coder.Reconstruct(r.blocks, !all); err != nil {
+			return nil, err
+		}
+	}
+	r.reconstructed = r.reconstructed || missingData
+	r.stripe++
+	return r.blocks, nil
+}
+
+// Close closes the shards.
+func (r *stripeReader) Close() error {
+	for _, reader := range r.readers {
+		if reader != nil {
+			reader.Close()
+		}
+	}
+	return nil
+}
+
+// codedReader reads a range of the content of an erasure-coded object from its stripes.
+type codedReader struct {
+	stripes *stripeReader
+	// skip is the number of bytes of the first stripe before the range.
+	skip      int64
+	remaining int64
+	pending   []byte
+	stripe    []byte
+}
+
+func (r *codedReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(r.pending) == 0 {
+		reconstructed := r.stripes.reconstructed
+		blocks, err := r.stripes.next(false)
+		if err != nil {
+			return 0, err
+		}
+		if r.stripes.reconstructed && !reconstructed {
+			r.stripes.e.metrics.ReconstructedRead()
+		}
+		r.stripe = r.stripe[:0]
+		for _, block := range blocks[:r.stripes.object.DataShards] {
+			r.stripe = append(r.stripe, block...)
+		}
+		r.pending = r.stripe[r.skip:]
+		r.skip = 0
+	}
+	n := copy(p[:min(int64(len(p)), r.remaining)], r.pending)
+	r.pending = r.pending[n:]
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+func (r *codedReader) Close() error {
+	return r.stripes.Close()
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestErasure(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			return newTestErasure(t, 4, 2, NewMemory(), NewMemory(), NewMemory(), NewMemory(), NewMemory(), NewMemory())
+		})
+	})
+	t.Run("Filesystem", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			backends := make([]Storage, 3)
+			for i := range backends {
+				store, err := NewFilesystem(t.TempDir())
+				require.NoError(t, err)
+				backends[i] = store
+			}
+			return newTestErasure(t, 2, 1, backends...)
+		})
+	})
+}
+
+func TestNewErasure(t *testing.T) {
+	_, err := NewErasure(nil, 4, 2, newShardIndex())
+	require.Error(t, err)
+	_, err = NewErasure([]Storage{NewMemory()}, 4, 2, nil)
+	require.Error(t, err)
+	_, err = NewErasure([]Storage{NewMemory()}, 0, 2, newShardIndex())
+	require.Error(t, err)
+	_, err = NewErasure([]Storage{NewMemory()}, 200, 100, newShardIndex())
+	require.Error(t, err)
+}
+
+func TestErasureLayout(t *testing.T) {
+	ctx := context.Background()
+	store := newTestErasure(t, 4, 2, newFlaky(), newFlaky(), newFlaky(), newFlaky(), newFlaky(), newFlaky())
+	file := newTestFile("acme", 1000)
+	require.NoError(t, upload(ctx, store, file))
+
+	object, err := store.index.GetCodedObject(ctx, file.key)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), object.Size)
+	require.Equal(t, 250, object.BlockSize)
+	require.Len(t, object.Shards, 6)
+
+	// every shard is on a backend of its own, and hashes to its recorded hash
+	locations := make(map[int]bool)
+	for _, shard := range object.Shards {
+		locations[shard.Location] = true
+		require.Equal(t, int64(250), shard.Size)
+		data, err := download(ctx, store.backends[shard.Location], &testFile{key: shardKey(file.key, shard.Index), hash: shard.Hash})
+		require.NoError(t, err)
+		require.Len(t, data, 250)
+		if shard.Index < 4 {
+			require.Equal(t, file.data[shard.Index*250:(shard.Index+1)*250], data)
+		}
+	}
+	require.Len(t, locations, 6)
+}
+
+func TestErasureReconstruct(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// down are the backends that cannot be reached, lost the ones whose shards are deleted
+		down, lost        []int
+		wantReconstructed bool
+		wantErr           bool
+	}{
+		{name: "All shards"},
+		{name: "Parity shard down", down: []int{5}},
+		{name: "Data shard down", down: []int{0}, wantReconstructed: true},
+		{name: "Data shards lost", lost: []int{1, 3}, wantReconstructed: true},
+		{name: "Down and lost", down: []int{2}, lost: []int{4}, wantReconstructed: true},
+		{name: "Too many shards missing", down: []int{0}, lost: []int{1, 2}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			backends := make([]*flakyStorage, 6)
+			stores := make([]Storage, len(backends))
+			for i := range backends {
+				backends[i] = newFlaky()
+				stores[i] = backends[i]
+			}
+			store := newTestErasure(t, 4, 2, stores...)
+			store.metrics = metrics.New(registry)
+			// several stripes, the last one partial
+			file := newTestFile("acme", 4*maxBlockSize*2+1234)
+			require.NoError(t, upload(ctx, store, file))
+
+			object, err := store.index.GetCodedObject(ctx, file.key)
+			require.NoError(t, err)
+			for _, i := range tt.down {
+				backends[object.Shards[i].Location].down.Store(true)
+			}
+			for _, i := range tt.lost {
+				require.NoError(t, backends[object.Shards[i].Location].Delete(ctx, []string{shardKey(file.key, i)}))
+			}
+
+			data, err := download(ctx, store, file)
+			if tt.wantErr {
+				require.ErrorIs(t, err, model.ErrNotFound)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, file.data, data)
+
+			reconstructed := 0
+			if tt.wantReconstructed {
+				reconstructed = 1
+			}
+			expected := fmt.Sprintf(`
+# HELP fileserver_erasure_reconstructed_reads_total Number of erasure-coded objects read by reconstructing missing data shards.
+# TYPE fileserver_erasure_reconstructed_reads_total counter
+fileserver_erasure_reconstructed_reads_total %d
+`, reconstructed)
+			require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_erasure_reconstructed_reads_total"))
+
+			// a range across the stripes
+			offset := int64(4*maxBlockSize - 10)
+			content, err := store.DownloadRange(ctx, file.key, offset, 4*maxBlockSize+20)
+			require.NoError(t, err)
+			defer content.Close()
+			data, err = io.ReadAll(content)
+			require.NoError(t, err)
+			require.Equal(t, file.data[offset:offset+4*maxBlockSize+20], data)
+		})
+	}
+}
+
+func TestErasureRepairShards(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+	backends := []*flakyStorage{newFlaky(), newFlaky(), newFlaky(), newFlaky(), newFlaky()}
+	store := newTestErasure(t, 3, 2, backends[0], backends[1], backends[2], backends[3], backends[4])
+	store.metrics = metrics.New(registry)
+	file := newTestFile("acme", 3*maxBlockSize+100)
+	require.NoError(t, upload(ctx, store, file))
+
+	repaired, err := store.RepairShards(ctx, file.key)
+	require.NoError(t, err)
+	require.Zero(t, repaired)
+
+	// a shard is lost, another one is damaged without a change of size
+	object, err := store.index.GetCodedObject(ctx, file.key)
+	require.NoError(t, err)
+	lost, damaged := object.Shards[0], object.Shards[4]
+	require.NoError(t, backends[lost.Location].Delete(ctx, []string{shardKey(file.key, lost.Index)}))
+	require.NoError(t, backends[damaged.Location].UploadMultiple(ctx, objects(&model.Object{
+		Key: shardKey(file.key, damaged.Index), Size: -1, Content: bytes.NewReader(make([]byte, damaged.Size)),
+	})))
+
+	repaired, err = store.RepairShards(ctx, file.key)
+	require.NoError(t, err)
+	require.Equal(t, 2, repaired)
+	for _, shard := range object.Shards {
+		_, err = download(ctx, backends[shard.Location], &testFile{key: shardKey(file.key, shard.Index), hash: shard.Hash})
+		require.NoError(t, err, "shard %d", shard.Index)
+	}
+
+	// a shard whose backend is down is left alone
+	backends[object.Shards[1].Location].down.Store(true)
+	require.NoError(t, backends[lost.Location].Delete(ctx, []string{shardKey(file.key, lost.Index)}))
+	repaired, err = store.RepairShards(ctx, file.key)
+	require.ErrorIs(t, err, errUnavailable)
+	require.Equal(t, 1, repaired)
+
+	// too many shards lost to rebuild any
+	backends[object.Shards[1].Location].down.Store(false)
+	for _, shard := range object.Shards[:3] {
+		require.NoError(t, backends[shard.Location].Delete(ctx, []string{shardKey(file.key, shard.Index)}))
+	}
+	repaired, err = store.RepairShards(ctx, file.key)
+	require.Error(t, err)
+	require.Zero(t, repaired)
+
+	expected := `
+# HELP fileserver_erasure_shard_repairs_total Number of missing or damaged shards of erasure-coded objects rebuilt, by status.
+# TYPE fileserver_erasure_shard_repairs_total counter
+fileserver_erasure_shard_repairs_total{status="failed"} 3
+fileserver_erasure_shard_repairs_total{status="repaired"} 3
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_erasure_shard_repairs_total"))
+}
+
+func TestParseShardKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		name   string
+		shard  int
+		wantOK bool
+	}{
+		{key: "acme/abc.0", name: "acme/abc", shard: 0, wantOK: true},
+		{key: "_quarantine/acme/abc.12", name: "_quarantine/acme/abc", shard: 12, wantOK: true},
+		{key: "acme/abc"},
+		{key: "acme.1/abc"},
+		{key: "acme/abc.x"},
+		{key: "acme/abc.-1"},
+		{key: "acme/abc.256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			name, shard, ok := parseShardKey(tt.key)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.name, name)
+			require.Equal(t, tt.shard, shard)
+		})
+	}
+}
+
+func newTestErasure(t *testing.T, dataShards, parityShards int, backends ...Storage) *Erasure {
+	store, err := NewErasure(backends, dataShards, parityShards, newShardIndex())
+	require.NoError(t, err)
+	return store
+}
+
+// newTestFile returns a file of random content of the given size.
+func newTestFile(tenantID string, size int) *testFile {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	hash := merkle.HashData(data)
+	return &testFile{key: model.ObjectKey(tenantID, hash), hash: hash, data: data}
+}
+
+// shardIndex is an in-memory ShardIndex.
+type shardIndex struct {
+	mu      sync.Mutex
+	objects map[string]model.CodedObject
+}
+
+func newShardIndex() *shardIndex {
+	return &shardIndex{objects: make(map[string]model.CodedObject)}
+}
+
+func (s *shardIndex) SaveCodedObject(_ context.Context, object *model.CodedObject) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object.UpdatedAt = time.Now()
+	stored := *object
+	stored.Shards = append([]model.Shard(nil), object.Shards...)
+	s.objects[object.Key] = stored
+	return nil
+}
+
+func (s *shardIndex) GetCodedObject(_ context.Context, key string) (*model.CodedObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", key, model.ErrNotFound)
+	}
+	object.Shards = append([]model.Shard(nil), object.Shards...)
+	return &object, nil
+}
+
+func (s *shardIndex) DeleteCodedObjects(_ context.Context, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.objects, key)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// tempPrefix is the prefix of the files being written, they are renamed to their object once complete.
+const tempPrefix = ".tmp-"
+
+// Filesystem is the local filesystem backend. The object tenant/0a1b2c... is stored in the file
+// tenant/0a/1b/0a1b2c... of the directory, so that no directory holds too many files.
+// Objects are written to a temporary file that is synced and then renamed, so that they are either complete or missing.
+type Filesystem struct {
+	dir     string
+	metrics *metrics.Metrics
+}
+
+// NewFilesystem creates the backend storing the objects under dir, creating dir if it does not exist.
+func NewFilesystem(dir string, opts ...Option) (*Filesystem, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &Filesystem{
+		dir:     dir,
+		metrics: newOptions(opts).metrics,
+	}, nil
+}
+
+// Ping checks that the directory exists.
+func (f *Filesystem) Ping(ctx context.Context) (err error) {
+	_, end := f.trace(ctx, "ping")
+	defer end(&err)
+
+	info, err := os.Stat(f.dir)
+	if err != nil {
+		return fmt.Errorf("failed to check storage directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", f.dir)
+	}
+	return nil
+}
+
+// Download streams the object, and the reader returns a *model.IntegrityError if it does not hash to the expected hash.
+func (f *Filesystem) Download(ctx context.Context, name string, hash []byte) (_ io.ReadCloser, err error) {
+	_, end := f.trace(ctx, "download", attribute.String("storage.object", name))
+	defer end(&err)
+
+	file, err := f.open(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifyingReader(file, name, hash), nil
+}
+
+// DownloadRange streams length bytes of the object from offset, a negative length reads to the end.
+func (f *Filesystem) DownloadRange(ctx context.Context, name string, offset, length int64) (_ io.ReadCloser, err error) {
+	_, end := f.trace(ctx, "download_range", attribute.String("storage.object", name))
+	defer end(&err)
+
+	file, err := f.open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size()
+	if offset < 0 || offset > size {
+		file.Close()
+		return nil, fmt.Errorf("offset %d of object %s of %d bytes: %w", offset, name, size, model.ErrInvalidInput)
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return rangeReader{Reader: io.NewSectionReader(file, offset, length), Closer: file}, nil
+}
+
+// Stat describes the object.
+func (f *Filesystem) Stat(ctx context.Context, name string) (_ model.StoredObject, err error) {
+	_, end := f.trace(ctx, "stat", attribute.String("storage.object", name))
+	defer end(&err)
+
+	p, err := f.path(name)
+	if err != nil {
+		return model.StoredObject{}, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return model.StoredObject{}, fmt.Errorf("object %s: %w", name, model.ErrNotFound)
+	}
+	if err != nil {
+		return model.StoredObject{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return model.StoredObject{Key: name, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+func (f *Filesystem) open(name string) (*os.File, error) {
+	p, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("object %s: %w", name, model.ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return file, nil
+}
+
+func (f *Filesystem) UploadMultiple(ctx context.Context, objects <-chan *model.Object) (err error) {
+	ctx, end := f.trace(ctx, "upload")
+	defer end(&err)
+
+	for {
+		select {
+		case object, ok := <-objects:
+			if !ok {
+				return nil
+			}
+			if err = f.write(object); err != nil {
+				return fmt.Errorf("failed to upload file: %w", err)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("failed to upload file: %w", ctx.Err())
+		}
+	}
+}
+
+// write streams the object to a temporary file next to it, checks and syncs it, and renames it to the object.
+func (f *Filesystem) write(object *model.Object) error {
+	p, err := f.path(object.Key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(p)
+	if err = os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+	hasher := merkle.NewHasher()
+	size, err := io.Copy(tmp, io.TeeReader(object.Content, hasher))
+	if err == nil {
+		err = checkContent(object, size, hasher.Sum(nil))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Delete removes the objects, the ones that do not exist are ignored.
+func (f *Filesystem) Delete(ctx context.Context, names []string) (err error) {
+	_, end := f.trace(ctx, "delete", attribute.Int("storage.objects", len(names)))
+	defer end(&err)
+
+	for _, name := range names {
+		p, pathErr := f.path(name)
+		if pathErr != nil {
+			err = errors.Join(err, pathErr)
+			continue
+		}
+		if removeErr := os.Remove(p); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			err = errors.Join(err, fmt.Errorf("failed to remove %s: %w", name, removeErr))
+		}
+	}
+	return err
+}
+
+// Walk calls fn for every object in the lexical order of their files, it stops at the first error returned by fn.
+func (f *Filesystem) Walk(ctx context.Context, fn func(object model.StoredObject) error) (err error) {
+	ctx, end := f.trace(ctx, "walk")
+	defer end(&err)
+
+	err = filepath.WalkDir(f.dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(f.dir, p)
+		if err != nil {
+			return err
+		}
+		key, ok := objectKey(filepath.ToSlash(rel))
+		if !ok {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // deleted while walking
+		}
+		if err != nil {
+			return err
+		}
+		return fn(model.StoredObject{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	return nil
+}
+
+// Quarantine moves the objects under model.QuarantinePrefix, the ones that do not exist are ignored.
+func (f *Filesystem) Quarantine(ctx context.Context, names []string) (err error) {
+	_, end := f.trace(ctx, "quarantine", attribute.Int("storage.objects", len(names)))
+	defer end(&err)
+
+	for _, name := range names {
+		src, err := f.path(name)
+		if err != nil {
+			return err
+		}
+		dst, err := f.path(model.QuarantinePrefix + name)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+			return fmt.Errorf("failed to quarantine %s: %w", name, err)
+		}
+		if err = os.Rename(src, dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to quarantine %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// path returns the file of the object, the keys escaping the directory are invalid.
+func (f *Filesystem) path(name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) || strings.HasPrefix(path.Base(name), tempPrefix) {
+		return "", fmt.Errorf("invalid object key %q: %w", name, model.ErrInvalidInput)
+	}
+	dir, base := path.Split(name)
+	first, second := shard(base)
+	return filepath.Join(f.dir, filepath.FromSlash(dir), first, second, base), nil
+}
+
+// shard returns the two directory levels of the file named base, taken from its first four characters.
+func shard(base string) (string, string) {
+	padded := base + "____"
+	return padded[:2], padded[2:4]
+}
+
+// objectKey returns the key of the object stored in the file at the slash-separated path, relative to the directory,
+// and false if the file is not in the directory of its shard.
+func objectKey(rel string) (string, bool) {
+	parts := strings.Split(rel, "/")
+	n := len(parts)
+	if n < 3 {
+		return "", false
+	}
+	base := parts[n-1]
+	if first, second := shard(base); parts[n-3] != first || parts[n-2] != second {
+		return "", false
+	}
+	return path.Join(append(parts[:n-3], base)...), true
+}
+
+// syncDir syncs the directory, so that the files renamed into it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (f *Filesystem) trace(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(err *error)) {
+	return startOperation(ctx, f.metrics, operation, append(attrs,
+		attribute.String("storage.backend", BackendFilesystem), attribute.String("storage.dir", f.dir))...)
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestFilesystemLayout(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFilesystem(dir)
+	require.NoError(t, err)
+
+	file := newFiles("acme", "test0")[0]
+	require.NoError(t, upload(context.Background(), store, file))
+
+	// the object is sharded by the first bytes of its hash, and no temporary file is left behind
+	key := file.key
+	name := filepath.Base(key)
+	shardDir := filepath.Join(dir, "acme", name[:2], name[2:4])
+	entries, err := os.ReadDir(shardDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, name, entries[0].Name())
+
+	// the files that are not in the directory of their shard are not objects
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "acme", "readme.txt"), []byte("readme"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(shardDir, tempPrefix+"123"), []byte("partial"), 0o600))
+	objects := walk(t, store, "acme")
+	require.Len(t, objects, 1)
+	require.Contains(t, objects, key)
+}
+
+func TestFilesystemInvalidKey(t *testing.T) {
+	store, err := NewFilesystem(t.TempDir())
+	require.NoError(t, err)
+
+	for _, key := range []string{"../escape/0a1b2c", "/absolute/0a1b2c", "acme/" + tempPrefix + "0a1b2c", ""} {
+		_, err = store.Download(context.Background(), key, nil)
+		require.ErrorIs(t, err, model.ErrInvalidInput, key)
+		_, err = store.Stat(context.Background(), key)
+		require.ErrorIs(t, err, model.ErrInvalidInput, key)
+	}
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Memory is the in-memory backend, meant for development and tests: its objects are lost when the process exits.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	metrics *metrics.Metrics
+}
+
+type memoryObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func NewMemory(opts ...Option) *Memory {
+	return &Memory{
+		objects: make(map[string]memoryObject),
+		metrics: newOptions(opts).metrics,
+	}
+}
+
+// Ping always succeeds.
+func (m *Memory) Ping(context.Context) error {
+	return nil
+}
+
+// Download streams the object, and the reader returns a *model.IntegrityError if it does not hash to the expected hash.
+func (m *Memory) Download(ctx context.Context, name string, hash []byte) (_ io.ReadCloser, err error) {
+	_, end := m.trace(ctx, "download", attribute.String("storage.object", name))
+	defer end(&err)
+
+	object, err := m.object(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewVerifyingReader(io.NopCloser(bytes.NewReader(object.data)), name, hash), nil
+}
+
+// DownloadRange streams length bytes of the object from offset, a negative length reads to the end.
+func (m *Memory) DownloadRange(ctx context.Context, name string, offset, length int64) (_ io.ReadCloser, err error) {
+	_, end := m.trace(ctx, "download_range", attribute.String("storage.object", name))
+	defer end(&err)
+
+	object, err := m.object(name)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(object.data))
+	if offset < 0 || offset > size {
+		return nil, fmt.Errorf("offset %d of object %s of %d bytes: %w", offset, name, size, model.ErrInvalidInput)
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return io.NopCloser(bytes.NewReader(object.data[offset : offset+length])), nil
+}
+
+// Stat describes the object.
+func (m *Memory) Stat(ctx context.Context, name string) (_ model.StoredObject, err error) {
+	_, end := m.trace(ctx, "stat", attribute.String("storage.object", name))
+	defer end(&err)
+
+	object, err := m.object(name)
+	if err != nil {
+		return model.StoredObject{}, err
+	}
+	return model.StoredObject{Key: name, Size: int64(len(object.data)), LastModified: object.modified}, nil
+}
+
+func (m *Memory) object(name string) (memoryObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[name]
+	if !ok {
+		return memoryObject{}, fmt.Errorf("object %s: %w", name, model.ErrNotFound)
+	}
+	return object, nil
+}
+
+func (m *Memory) UploadMultiple(ctx context.Context, objects <-chan *model.Object) (err error) {
+	ctx, end := m.trace(ctx, "upload")
+	defer end(&err)
+
+	for {
+		select {
+		case object, ok := <-objects:
+			if !ok {
+				return nil
+			}
+			if err = m.store(object); err != nil {
+				return fmt.Errorf("failed to upload file: %w", err)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("failed to upload file: %w", ctx.Err())
+		}
+	}
+}
+
+func (m *Memory) store(object *model.Object) error {
+	data, err := io.ReadAll(object.Content)
+	if err != nil {
+		return err
+	}
+	if err = checkContent(object, int64(len(data)), merkle.HashData(data)); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[object.Key] = memoryObject{data: data, modified: time.Now()}
+	return nil
+}
+
+// Delete removes the objects, the ones that do not exist are ignored.
+func (m *Memory) Delete(ctx context.Context, names []string) (err error) {
+	_, end := m.trace(ctx, "delete", attribute.Int("storage.objects", len(names)))
+	defer end(&err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		delete(m.objects, name)
+	}
+	return nil
+}
+
+// Walk calls fn for every object in the order of their keys, it stops at the first error returned by fn.
+// The objects stored or deleted while walking may or may not be seen.
+func (m *Memory) Walk(ctx context.Context, fn func(object model.StoredObject) error) (err error) {
+	ctx, end := m.trace(ctx, "walk")
+	defer end(&err)
+
+	m.mu.RLock()
+	objects := make([]model.StoredObject, 0, len(m.objects))
+	for key, object := range m.objects {
+		objects = append(objects, model.StoredObject{Key: key, Size: int64(len(object.data)), LastModified: object.modified})
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	for _, object := range objects {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine moves the objects under model.QuarantinePrefix, the ones that do not exist are ignored.
+func (m *Memory) Quarantine(ctx context.Context, names []string) (err error) {
+	_, end := m.trace(ctx, "quarantine", attribute.Int("storage.objects", len(names)))
+	defer end(&err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		if object, ok := m.objects[name]; ok {
+			m.objects[model.QuarantinePrefix+name] = object
+			delete(m.objects, name)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) trace(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(err *error)) {
+	return startOperation(ctx, m.metrics, operation, append(attrs, attribute.String("storage.backend", BackendMemory))...)
+}
@@ -3,31 +3,195 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/zale144/fileserver/internal/envelope"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/metrics"
 	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/tlsconfig"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// uploadWorkers is the number of objects uploaded at once.
+const uploadWorkers = 10
+
+// stagingPrefix is the prefix of the keys the objects are uploaded to, they are copied to their own key
+// once their content is verified, so that an object failing the verification never replaces a stored one.
+const stagingPrefix = "_staging/"
+
+// File is the MinIO backend, it stores the objects in a bucket.
 type File struct {
 	minio      *minio.Client
 	bucketName string
+	metrics    *metrics.Metrics
 }
 
 type Config struct {
-	BucketName      string `envconfig:"BUCKET_NAME" default:"fileserver"`
-	Endpoint        string `envconfig:"MINIO_ENDPOINT" default:"localhost:9000"`
-	AccessKeyID     string `envconfig:"MINIO_ACCESS_KEY" default:"minio"`
-	SecretAccessKey string `envconfig:"MINIO_SECRET_KEY" default:"minio123"`
+	// Backend selects the storage of the objects: minio, filesystem or memory.
+	// The filesystem backend stores them under Dir, the memory one loses them when the server stops.
+	Backend string `envconfig:"STORAGE_BACKEND" default:"minio"`
+	Dir     string `envconfig:"STORAGE_DIR" default:"data"`
+	// ColdBackend enables the tiering of the objects: they are written to the backend above, the hot tier,
+	// and migrated to the cold tier once they get old or idle, either the ColdBucketName bucket of the same MinIO
+	// or the ColdDir directory.
+	ColdBackend    string `envconfig:"STORAGE_COLD_BACKEND"`
+	ColdBucketName string `envconfig:"COLD_BUCKET_NAME" default:"fileserver-cold"`
+	ColdDir        string `envconfig:"STORAGE_COLD_DIR" default:"data-cold"`
+	// Replicas enables the replication of the objects on several MinIO endpoints or directories, depending on the
+	// backend, in place of Endpoint or Dir. An object is written to every replica and stored once WriteQuorum of them
+	// stored it, a majority by default. It is read from the fastest healthy replica, and the missing or divergent
+	// copies are repaired in the background, and by a reconciliation of the replicas every RepairInterval.
+	Replicas       []string      `envconfig:"STORAGE_REPLICAS"`
+	WriteQuorum    int           `envconfig:"STORAGE_WRITE_QUORUM" default:"0"`
+	RepairInterval time.Duration `envconfig:"STORAGE_REPAIR_INTERVAL" default:"1h"`
+	// ShardLocations enables the erasure coding of the objects over several MinIO endpoints or directories,
+	// in place of Endpoint or Dir, exclusive of Replicas. An object is cut in DataShards data shards and ParityShards
+	// parity shards spread over the locations, and is read back as long as no more than ParityShards are lost.
+	// The layout of the objects is recorded in PostgreSQL, and the scrubs rebuild the missing and damaged shards.
+	ShardLocations []string `envconfig:"STORAGE_SHARD_LOCATIONS"`
+	DataShards     int      `envconfig:"STORAGE_DATA_SHARDS" default:"4"`
+	ParityShards   int      `envconfig:"STORAGE_PARITY_SHARDS" default:"2"`
+	// EncryptionKeys enables the encryption of the objects at rest, every object with a data key of its own wrapped
+	// by a master key. The master keys are "<ID>:<base64 key>" entries, given here or one per line in EncryptionKeyFile,
+	// and the one of EncryptionKeyID, the last one by default, wraps the data keys of the objects written.
+	EncryptionKeys    []string `envconfig:"ENCRYPTION_KEYS"`
+	EncryptionKeyFile string   `envconfig:"ENCRYPTION_KEY_FILE"`
+	EncryptionKeyID   string   `envconfig:"ENCRYPTION_KEY_ID"`
+	BucketName        string   `envconfig:"BUCKET_NAME" default:"fileserver"`
+	Endpoint          string   `envconfig:"MINIO_ENDPOINT" default:"localhost:9000"`
+	AccessKeyID       string   `envconfig:"MINIO_ACCESS_KEY" default:"minio"`
+	SecretAccessKey   string   `envconfig:"MINIO_SECRET_KEY" default:"minio123"`
+	// Secure connects to MinIO over TLS, trusting the CAs in CAFile besides the system ones.
+	Secure             bool   `envconfig:"MINIO_SECURE" default:"false"`
+	CAFile             string `envconfig:"MINIO_CA_FILE"`
+	InsecureSkipVerify bool   `envconfig:"MINIO_TLS_SKIP_VERIFY" default:"false"`
+	// ReplicaEndpoint and ReplicaBucketName locate a replica of the bucket, e.g. kept in sync by the bucket replication
+	// of MinIO, that the downloads fall back to when an object is missing or corrupted.
+	// The replica shares the credentials and the TLS settings of the primary, unless it has credentials of its own.
+	ReplicaEndpoint        string `envconfig:"REPLICA_MINIO_ENDPOINT"`
+	ReplicaBucketName      string `envconfig:"REPLICA_BUCKET_NAME"`
+	ReplicaAccessKeyID     string `envconfig:"REPLICA_MINIO_ACCESS_KEY"`
+	ReplicaSecretAccessKey string `envconfig:"REPLICA_MINIO_SECRET_KEY"`
+}
+
+// Cold returns the configuration of the cold tier, and false if the objects are not tiered.
+func (c Config) Cold() (Config, bool) {
+	if c.ColdBackend == "" {
+		return Config{}, false
+	}
+	cold := c
+	cold.Backend = c.ColdBackend
+	cold.BucketName = c.ColdBucketName
+	cold.Dir = c.ColdDir
+	cold.ColdBackend = ""
+	cold.ReplicaEndpoint = ""
+	cold.Replicas = nil
+	cold.ShardLocations = nil
+	return cold, true
+}
+
+// ReplicaConfigs returns the configurations of the replicas, and false if the objects are not replicated.
+func (c Config) ReplicaConfigs() ([]Config, bool) {
+	return c.locationConfigs(c.Replicas)
+}
+
+// ShardConfigs returns the configurations of the shard locations, and false if the objects are not erasure-coded.
+func (c Config) ShardConfigs() ([]Config, bool) {
+	return c.locationConfigs(c.ShardLocations)
+}
+
+// locationConfigs returns the configurations of the backend at every one of the locations.
+func (c Config) locationConfigs(locations []string) ([]Config, bool) {
+	if len(locations) == 0 {
+		return nil, false
+	}
+	configs := make([]Config, len(locations))
+	for i, location := range locations {
+		config := c
+		config.Replicas = nil
+		config.ShardLocations = nil
+		config.ColdBackend = ""
+		config.ReplicaEndpoint = ""
+		switch c.Backend {
+		case BackendMinIO:
+			config.Endpoint = location
+		case BackendFilesystem:
+			config.Dir = location
+		}
+		configs[i] = config
+	}
+	return configs, true
+}
+
+// Keyring returns the master keys encrypting the objects, and nil if the objects are not encrypted.
+func (c Config) Keyring() (*envelope.Keyring, error) {
+	entries := c.EncryptionKeys
+	if c.EncryptionKeyFile != "" {
+		fileEntries, err := envelope.ReadKeyEntries(c.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries[:len(entries):len(entries)], fileEntries...)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return envelope.ParseKeyring(entries, c.EncryptionKeyID)
+}
+
+// Replica returns the configuration of the replica, and false if no replica is configured. The replica is a copy
+// of the bucket, so it has the settings of the primary, e.g. its TLS settings and master keys, except for its location.
+func (c Config) Replica() (Config, bool) {
+	if c.ReplicaEndpoint == "" {
+		return Config{}, false
+	}
+	replica := c
+	replica.Backend = BackendMinIO
+	replica.Endpoint = c.ReplicaEndpoint
+	if c.ReplicaBucketName != "" {
+		replica.BucketName = c.ReplicaBucketName
+	}
+	if c.ReplicaAccessKeyID != "" {
+		replica.AccessKeyID = c.ReplicaAccessKeyID
+		replica.SecretAccessKey = c.ReplicaSecretAccessKey
+	}
+	replica.ColdBackend = ""
+	replica.Replicas = nil
+	replica.ShardLocations = nil
+	replica.ReplicaEndpoint = ""
+	return replica, true
 }
 
-func NewFile(config Config) (*File, error) {
+func NewFile(config Config, opts ...Option) (*File, error) {
+	transport, err := minio.DefaultTransport(config.Secure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create minio transport: %w", err)
+	}
+	if config.Secure {
+		tlsCfg, err := tlsconfig.Client{CAFile: config.CAFile, InsecureSkipVerify: config.InsecureSkipVerify}.Config()
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure minio TLS: %w", err)
+		}
+		if tlsCfg != nil {
+			transport.TLSClientConfig = tlsCfg
+		}
+	}
+
 	minioClient, err := minio.New(config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, ""),
-		Secure: false,
+		Creds:     credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, ""),
+		Secure:    config.Secure,
+		Transport: transport,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create minio client: %w", err)
@@ -36,49 +200,219 @@ func NewFile(config Config) (*File, error) {
 	return &File{
 		minio:      minioClient,
 		bucketName: config.BucketName,
+		metrics:    newOptions(opts).metrics,
 	}, nil
 }
 
-func (f *File) Download(ctx context.Context, name string) ([]byte, error) {
+// Ping checks that MinIO is reachable and the bucket exists.
+func (f *File) Ping(ctx context.Context) (err error) {
+	ctx, end := f.trace(ctx, "ping")
+	defer end(&err)
+
+	exists, err := f.minio.BucketExists(ctx, f.bucketName)
+	if err != nil {
+		return fmt.Errorf("failed to check bucket: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", f.bucketName)
+	}
+	return nil
+}
+
+// Download streams the object, and the reader returns a *model.IntegrityError if it does not hash to the expected hash.
+func (f *File) Download(ctx context.Context, name string, hash []byte) (_ io.ReadCloser, err error) {
+	ctx, end := f.trace(ctx, "download", attribute.String("storage.object", name))
+	defer end(&err)
+
 	object, err := f.minio.GetObject(ctx, f.bucketName, name, minio.GetObjectOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file: %w", err)
 	}
+	// the object is requested lazily, stat it to report a missing object now rather than on the first read
+	if _, err = object.Stat(); err != nil {
+		object.Close()
+		return nil, f.objectError(name, err)
+	}
+	return NewVerifyingReader(object, name, hash), nil
+}
+
+// DownloadRange streams length bytes of the object from offset, a negative length reads to the end.
+func (f *File) DownloadRange(ctx context.Context, name string, offset, length int64) (_ io.ReadCloser, err error) {
+	ctx, end := f.trace(ctx, "download_range", attribute.String("storage.object", name))
+	defer end(&err)
+
+	info, err := f.minio.StatObject(ctx, f.bucketName, name, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, f.objectError(name, err)
+	}
+	if offset < 0 || offset > info.Size {
+		return nil, fmt.Errorf("offset %d of object %s of %d bytes: %w", offset, name, info.Size, model.ErrInvalidInput)
+	}
+	if length < 0 || offset+length > info.Size {
+		length = info.Size - offset
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
 
-	buf := new(bytes.Buffer)
-	if _, err = buf.ReadFrom(object); err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+	opts := minio.GetObjectOptions{}
+	if err = opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, fmt.Errorf("failed to set range: %w", err)
 	}
-	return buf.Bytes(), nil
+	object, err := f.minio.GetObject(ctx, f.bucketName, name, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	return object, nil
+}
+
+// Stat describes the object.
+func (f *File) Stat(ctx context.Context, name string) (_ model.StoredObject, err error) {
+	ctx, end := f.trace(ctx, "stat", attribute.String("storage.object", name))
+	defer end(&err)
+
+	info, err := f.minio.StatObject(ctx, f.bucketName, name, minio.StatObjectOptions{})
+	if err != nil {
+		return model.StoredObject{}, f.objectError(name, err)
+	}
+	return model.StoredObject{Key: name, Size: info.Size, LastModified: info.LastModified}, nil
 }
 
-func (f *File) UploadMultiple(ctx context.Context, dataCh <-chan *model.File) error {
-	opts := minio.SnowballOptions{
-		Opts: minio.PutObjectOptions{
-			ContentType:           "application/octet-stream",
-			ConcurrentStreamParts: true,
-			NumThreads:            10,
-		},
+func (f *File) objectError(name string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("object %s: %w", name, model.ErrNotFound)
 	}
-	objects := make(chan minio.SnowballObject, 1)
+	return fmt.Errorf("failed to stat file: %w", err)
+}
 
-	go func() {
-		defer close(objects)
-		for data := range dataCh {
-			objects <- minio.SnowballObject{
-				Key:     fmt.Sprintf("%x", data.Metadata.Hash),
-				Size:    int64(len(data.Data)),
-				Content: bytes.NewBuffer(data.Data),
+// UploadMultiple streams uploadWorkers objects at once, and stops at the first one that fails.
+func (f *File) UploadMultiple(ctx context.Context, objects <-chan *model.Object) (err error) {
+	ctx, end := f.trace(ctx, "upload")
+	defer end(&err)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < uploadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case object, ok := <-objects:
+					if !ok {
+						return
+					}
+					if err := f.put(ctx, object); err != nil {
+						cancel(err)
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
 			}
+		}()
+	}
+	wg.Wait()
+
+	if err = context.Cause(ctx); err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+	return nil
+}
+
+// put streams the object to a staging key, and copies it to its key once its content matches its hints.
+// The staging object is removed either way.
+func (f *File) put(ctx context.Context, object *model.Object) (err error) {
+	suffix := make([]byte, 8)
+	if _, err = rand.Read(suffix); err != nil {
+		return fmt.Errorf("failed to generate a staging key: %w", err)
+	}
+	staging := stagingPrefix + object.Key + "." + hex.EncodeToString(suffix)
+	defer func() {
+		removeErr := f.minio.RemoveObject(context.WithoutCancel(ctx), f.bucketName, staging, minio.RemoveObjectOptions{})
+		if removeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to remove %s: %w", staging, removeErr))
 		}
 	}()
 
-	if err := f.minio.PutObjectsSnowball(ctx, f.bucketName, opts, objects); err != nil {
-		return fmt.Errorf("failed to upload file: %w", err)
+	hasher := merkle.NewHasher()
+	info, err := f.minio.PutObject(ctx, f.bucketName, staging, io.TeeReader(object.Content, hasher), object.Size,
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	if err = checkContent(object, info.Size, hasher.Sum(nil)); err != nil {
+		return err
+	}
+
+	dst := minio.CopyDestOptions{Bucket: f.bucketName, Object: object.Key}
+	src := minio.CopySrcOptions{Bucket: f.bucketName, Object: staging}
+	if _, err = f.minio.CopyObject(ctx, dst, src); err != nil {
+		return fmt.Errorf("failed to copy %s to its key: %w", object.Key, err)
 	}
 	return nil
 }
 
+// Delete removes the objects, the ones that do not exist are ignored.
+func (f *File) Delete(ctx context.Context, names []string) (err error) {
+	ctx, end := f.trace(ctx, "delete", attribute.Int("storage.objects", len(names)))
+	defer end(&err)
+
+	objects := make(chan minio.ObjectInfo, len(names))
+	for _, name := range names {
+		objects <- minio.ObjectInfo{Key: name}
+	}
+	close(objects)
+
+	for removeErr := range f.minio.RemoveObjects(ctx, f.bucketName, objects, minio.RemoveObjectsOptions{}) {
+		err = errors.Join(err, fmt.Errorf("failed to remove %s: %w", removeErr.ObjectName, removeErr.Err))
+	}
+	return err
+}
+
+// Walk calls fn for every object of the bucket but the staging ones, it stops at the first error returned by fn.
+func (f *File) Walk(ctx context.Context, fn func(object model.StoredObject) error) (err error) {
+	ctx, end := f.trace(ctx, "walk")
+	defer end(&err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range f.minio.ListObjects(ctx, f.bucketName, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("failed to list objects: %w", object.Err)
+		}
+		if strings.HasPrefix(object.Key, stagingPrefix) {
+			continue
+		}
+		if err = fn(model.StoredObject{Key: object.Key, Size: object.Size, LastModified: object.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quarantine moves the objects under model.QuarantinePrefix, where they are kept until they are deleted by hand.
+func (f *File) Quarantine(ctx context.Context, names []string) (err error) {
+	ctx, end := f.trace(ctx, "quarantine", attribute.Int("storage.objects", len(names)))
+	defer end(&err)
+
+	for _, name := range names {
+		dst := minio.CopyDestOptions{Bucket: f.bucketName, Object: model.QuarantinePrefix + name}
+		src := minio.CopySrcOptions{Bucket: f.bucketName, Object: name}
+		if _, err = f.minio.CopyObject(ctx, dst, src); err != nil {
+			return fmt.Errorf("failed to quarantine %s: %w", name, err)
+		}
+	}
+	return f.Delete(ctx, names)
+}
+
+func (f *File) trace(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, func(err *error)) {
+	return startOperation(ctx, f.metrics, operation, append(attrs,
+		attribute.String("storage.backend", BackendMinIO), attribute.String("storage.bucket", f.bucketName))...)
+}
+
 func (f *File) MakeBucket() error {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
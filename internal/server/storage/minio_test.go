@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaConfig(t *testing.T) {
+	primary := Config{
+		Backend:            BackendMinIO,
+		ColdBackend:        BackendMinIO,
+		ColdBucketName:     "fileserver-cold",
+		EncryptionKeys:     []string{"k1:key"},
+		BucketName:         "fileserver",
+		Endpoint:           "primary:9000",
+		AccessKeyID:        "minio",
+		SecretAccessKey:    "minio123",
+		Secure:             true,
+		CAFile:             "ca.pem",
+		InsecureSkipVerify: true,
+	}
+
+	tests := []struct {
+		name    string
+		replica Config
+		want    Config
+		wantOK  bool
+	}{
+		{
+			name: "No replica",
+		}, {
+			name:    "Replica of the bucket",
+			replica: Config{ReplicaEndpoint: "replica:9000"},
+			want: Config{
+				Backend:            BackendMinIO,
+				ColdBucketName:     "fileserver-cold",
+				EncryptionKeys:     []string{"k1:key"},
+				BucketName:         "fileserver",
+				Endpoint:           "replica:9000",
+				AccessKeyID:        "minio",
+				SecretAccessKey:    "minio123",
+				Secure:             true,
+				CAFile:             "ca.pem",
+				InsecureSkipVerify: true,
+			},
+			wantOK: true,
+		}, {
+			name: "Replica with a bucket and credentials of its own",
+			replica: Config{
+				ReplicaEndpoint:        "replica:9000",
+				ReplicaBucketName:      "fileserver-replica",
+				ReplicaAccessKeyID:     "replica",
+				ReplicaSecretAccessKey: "replica123",
+			},
+			want: Config{
+				Backend:                BackendMinIO,
+				ColdBucketName:         "fileserver-cold",
+				EncryptionKeys:         []string{"k1:key"},
+				BucketName:             "fileserver-replica",
+				Endpoint:               "replica:9000",
+				AccessKeyID:            "replica",
+				SecretAccessKey:        "replica123",
+				Secure:                 true,
+				CAFile:                 "ca.pem",
+				InsecureSkipVerify:     true,
+				ReplicaBucketName:      "fileserver-replica",
+				ReplicaAccessKeyID:     "replica",
+				ReplicaSecretAccessKey: "replica123",
+			},
+			wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := primary
+			config.ReplicaEndpoint = tt.replica.ReplicaEndpoint
+			config.ReplicaBucketName = tt.replica.ReplicaBucketName
+			config.ReplicaAccessKeyID = tt.replica.ReplicaAccessKeyID
+			config.ReplicaSecretAccessKey = tt.replica.ReplicaSecretAccessKey
+
+			// the replica has the settings of the primary, but is neither tiered nor replicated itself
+			replica, ok := config.Replica()
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.want, replica)
+		})
+	}
+}
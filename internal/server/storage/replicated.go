@@ -0,0 +1,619 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+const (
+	// repairQueueSize is the number of objects waiting for a repair, the ones found damaged while it is full
+	// are left to the next reconciliation.
+	repairQueueSize = 1024
+	// latencyWeight is the weight of the past in the moving average of the latency of a replica.
+	latencyWeight = 8
+)
+
+// The statuses of the repairs of the replicas.
+const (
+	repairRepaired = "repaired"
+	repairFailed   = "failed"
+)
+
+// ReferenceIndex tells the objects the files and the pending uploads refer to.
+type ReferenceIndex interface {
+	ReferencedKeys(ctx context.Context, pendingSince time.Time) (map[string]bool, error)
+}
+
+// Replicated writes every object to all of its replicas and reads it from the fastest healthy one.
+// A write succeeds once the write quorum of replicas stored the object, the copies missing from the others,
+// and the ones a read finds corrupted, are repaired in the background by RunRepair.
+type Replicated struct {
+	replicas []*replica
+	quorum   int
+	metrics  *metrics.Metrics
+	log      *zap.Logger
+	// references, if set, keeps the reconciliation from restoring the objects left behind by a deletion
+	// that failed on some of the replicas.
+	references ReferenceIndex
+	repairs    chan string
+	queued     sync.Map
+}
+
+// replica is a backend of the replicated storage along with what the reads learned about it.
+type replica struct {
+	Storage
+	name    string
+	healthy atomic.Bool
+	// latency is the moving average of the time it took to open an object, in nanoseconds.
+	latency atomic.Int64
+	// divergent holds the names of the objects whose copy failed the verification, they are read from the other
+	// replicas until they are repaired.
+	divergent sync.Map
+}
+
+// NewReplicated creates the storage replicating the objects on the backends. A quorum of zero is a majority of them.
+func NewReplicated(backends []Storage, quorum int, opts ...Option) (*Replicated, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("no replicas")
+	}
+	if quorum <= 0 {
+		quorum = len(backends)/2 + 1
+	}
+	if quorum > len(backends) {
+		return nil, fmt.Errorf("write quorum of %d over %d replicas", quorum, len(backends))
+	}
+
+	o := newOptions(opts)
+	r := &Replicated{
+		replicas:   make([]*replica, len(backends)),
+		quorum:     quorum,
+		metrics:    o.metrics,
+		log:        o.logger,
+		references: o.references,
+		repairs:    make(chan string, repairQueueSize),
+	}
+	for i, backend := range backends {
+		r.replicas[i] = &replica{Storage: backend, name: strconv.Itoa(i)}
+		r.replicas[i].healthy.Store(true)
+	}
+	return r, nil
+}
+
+// Replicas returns the backends of the replicas.
+func (r *Replicated) Replicas() []Storage {
+	backends := make([]Storage, len(r.replicas))
+	for i, replica := range r.replicas {
+		backends[i] = replica.Storage
+	}
+	return backends
+}
+
+// Ping checks that at least the write quorum of replicas is reachable.
+func (r *Replicated) Ping(ctx context.Context) error {
+	var errs []error
+	for _, replica := range r.replicas {
+		err := replica.Ping(ctx)
+		replica.healthy.Store(err == nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %w", replica.name, err))
+		}
+	}
+	if len(r.replicas)-len(errs) < r.quorum {
+		return fmt.Errorf("fewer replicas reachable than the write quorum of %d: %w", r.quorum, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Download streams the object from the fastest replica holding it. The reader verifies it, a replica whose copy
+// fails the verification is not read from again until the copy is repaired.
+func (r *Replicated) Download(ctx context.Context, name string, hash []byte) (io.ReadCloser, error) {
+	return r.read(ctx, name, func(replica *replica) (io.ReadCloser, error) {
+		content, err := replica.Download(ctx, name, hash)
+		if err != nil {
+			return nil, err
+		}
+		return &replicaReader{ReadCloser: content, replicated: r, replica: replica, name: name}, nil
+	})
+}
+
+// DownloadRange streams the range of the object from the fastest replica holding it.
+func (r *Replicated) DownloadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	return r.read(ctx, name, func(replica *replica) (io.ReadCloser, error) {
+		return replica.DownloadRange(ctx, name, offset, length)
+	})
+}
+
+// read opens the object on the replicas, in the order of preference, until one of them holds it.
+// The object is queued for a repair if a replica preferred to the one serving it is missing it.
+func (r *Replicated) read(ctx context.Context, name string, open func(replica *replica) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	var errs []error
+	missing := false
+	for _, replica := range r.ordered(name) {
+		start := time.Now()
+		content, err := open(replica)
+		r.observe(replica, start, err)
+		if err == nil {
+			if missing {
+				r.queueRepair(name)
+			}
+			r.metrics.ReplicaRead(replica.name)
+			return content, nil
+		}
+		if errors.Is(err, model.ErrInvalidInput) || ctx.Err() != nil {
+			return nil, err
+		}
+		missing = missing || errors.Is(err, model.ErrNotFound)
+		errs = append(errs, fmt.Errorf("replica %s: %w", replica.name, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Stat describes the object from the fastest replica holding it.
+func (r *Replicated) Stat(ctx context.Context, name string) (model.StoredObject, error) {
+	var errs []error
+	for _, replica := range r.ordered(name) {
+		start := time.Now()
+		object, err := replica.Stat(ctx, name)
+		r.observe(replica, start, err)
+		if err == nil {
+			return object, nil
+		}
+		if errors.Is(err, model.ErrInvalidInput) || ctx.Err() != nil {
+			return model.StoredObject{}, err
+		}
+		errs = append(errs, fmt.Errorf("replica %s: %w", replica.name, err))
+	}
+	return model.StoredObject{}, errors.Join(errs...)
+}
+
+// ordered returns the replicas in the order the object is read from them: the healthy ones first, the fastest first,
+// and the ones whose copy of the object is known to be corrupted last.
+func (r *Replicated) ordered(name string) []*replica {
+	replicas := make([]*replica, len(r.replicas))
+	copy(replicas, r.replicas)
+	rank := func(replica *replica) int {
+		rank := 0
+		if _, divergent := replica.divergent.Load(name); divergent {
+			rank += 2
+		}
+		if !replica.healthy.Load() {
+			rank++
+		}
+		return rank
+	}
+	sort.SliceStable(replicas, func(i, j int) bool {
+		if ri, rj := rank(replicas[i]), rank(replicas[j]); ri != rj {
+			return ri < rj
+		}
+		return replicas[i].latency.Load() < replicas[j].latency.Load()
+	})
+	return replicas
+}
+
+// observe records the outcome of an operation of the replica: an error other than a missing object or an invalid
+// request makes it unhealthy, and a success updates its latency.
+func (r *Replicated) observe(replica *replica, start time.Time, err error) {
+	switch {
+	case err == nil:
+		sample := int64(time.Since(start))
+		latency := replica.latency.Load()
+		if latency == 0 {
+			latency = sample
+		}
+		replica.latency.Store(latency + (sample-latency)/latencyWeight)
+		replica.healthy.Store(true)
+	case errors.Is(err, model.ErrNotFound), errors.Is(err, model.ErrInvalidInput), errors.Is(err, context.Canceled):
+		replica.healthy.Store(true)
+	default:
+		replica.healthy.Store(false)
+	}
+}
+
+// replicaReader reads a copy of an object, and marks the copy for a repair if it fails the verification.
+type replicaReader struct {
+	io.ReadCloser
+	replicated *Replicated
+	replica    *replica
+	name       string
+}
+
+func (r *replicaReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, model.ErrIntegrity) {
+		r.replica.divergent.Store(r.name, struct{}{})
+		r.replicated.queueRepair(r.name)
+		err = fmt.Errorf("replica %s: %w", r.replica.name, err)
+	}
+	return n, err
+}
+
+// UploadMultiple writes every object to all the replicas at once, and fails if fewer than the write quorum stored it.
+func (r *Replicated) UploadMultiple(ctx context.Context, objects <-chan *model.Object) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < uploadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case object, ok := <-objects:
+					if !ok {
+						return
+					}
+					if err := r.put(ctx, object); err != nil {
+						cancel(err)
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+	return nil
+}
+
+// put streams the object to every replica through a pipe of its own. A replica that fails is dropped,
+// the others go on, and the object is queued for a repair if it is stored on the write quorum but not on every replica.
+func (r *Replicated) put(ctx context.Context, object *model.Object) error {
+	writers := make([]*io.PipeWriter, len(r.replicas))
+	errs := make([]error, len(r.replicas))
+	var wg sync.WaitGroup
+	for i, target := range r.replicas {
+		content, writer := io.Pipe()
+		writers[i] = writer
+		wg.Add(1)
+		go func(i int, target *replica) {
+			defer wg.Done()
+			err := target.UploadMultiple(ctx, single(&model.Object{
+				Key: object.Key, Size: object.Size, Hash: object.Hash, Content: content,
+			}))
+			if err != nil {
+				errs[i] = fmt.Errorf("replica %s: %w", target.name, err)
+			}
+			// the writes to a replica that gave up on the object fail instead of blocking
+			content.CloseWithError(errors.New("replica stopped reading"))
+		}(i, target)
+	}
+
+	fan := &fanOut{writers: writers, failed: make([]bool, len(writers))}
+	_, copyErr := io.Copy(fan, object.Content)
+	for _, writer := range writers {
+		writer.CloseWithError(copyErr)
+	}
+	wg.Wait()
+
+	stored := 0
+	for i, err := range errs {
+		if err == nil && fan.failed[i] {
+			errs[i] = fmt.Errorf("replica %s stopped reading %s", r.replicas[i].name, object.Key)
+		}
+		if errs[i] == nil {
+			stored++
+		}
+	}
+	if copyErr != nil && !errors.Is(copyErr, errNoReplicaLeft) {
+		return fmt.Errorf("failed to read %s: %w", object.Key, copyErr)
+	}
+	if stored < r.quorum {
+		return fmt.Errorf("%s stored on %d replicas, fewer than the write quorum of %d: %w",
+			object.Key, stored, r.quorum, errors.Join(errs...))
+	}
+	if stored < len(r.replicas) {
+		r.log.Warn("object not stored on every replica", zap.String("object", object.Key),
+			zap.Int("stored", stored), zap.Error(errors.Join(errs...)))
+		r.metrics.DegradedWrite()
+		r.queueRepair(object.Key)
+	}
+	return nil
+}
+
+var errNoReplicaLeft = errors.New("every replica failed")
+
+// fanOut writes to every writer, dropping the ones that fail so that the writes to the others go on.
+type fanOut struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	written := false
+	for i, writer := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+		if _, err := writer.Write(p); err != nil {
+			f.failed[i] = true
+			continue
+		}
+		written = true
+	}
+	if !written {
+		return 0, errNoReplicaLeft
+	}
+	return len(p), nil
+}
+
+// single returns a closed channel holding the object.
+func single(object *model.Object) <-chan *model.Object {
+	objects := make(chan *model.Object, 1)
+	objects <- object
+	close(objects)
+	return objects
+}
+
+// Delete removes the objects from every replica.
+func (r *Replicated) Delete(ctx context.Context, names []string) error {
+	var errs []error
+	for _, replica := range r.replicas {
+		if err := replica.Delete(ctx, names); err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %w", replica.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Walk calls fn once for every object of any replica. The replicas that cannot be listed are skipped,
+// unless none can.
+func (r *Replicated) Walk(ctx context.Context, fn func(object model.StoredObject) error) error {
+	seen := make(map[string]bool)
+	var fnErr error
+	var errs []error
+	for _, replica := range r.replicas {
+		err := replica.Walk(ctx, func(object model.StoredObject) error {
+			if seen[object.Key] {
+				return nil
+			}
+			seen[object.Key] = true
+			fnErr = fn(object)
+			return fnErr
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			r.log.Warn("failed to list replica", zap.String("replica", replica.name), zap.Error(err))
+			errs = append(errs, fmt.Errorf("replica %s: %w", replica.name, err))
+		}
+	}
+	if len(errs) == len(r.replicas) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Quarantine moves the objects under model.QuarantinePrefix on every replica holding them.
+func (r *Replicated) Quarantine(ctx context.Context, names []string) error {
+	var errs []error
+	for _, replica := range r.replicas {
+		var held []string
+		for _, name := range names {
+			_, err := replica.Stat(ctx, name)
+			switch {
+			case err == nil:
+				held = append(held, name)
+			case !errors.Is(err, model.ErrNotFound):
+				errs = append(errs, fmt.Errorf("replica %s: failed to quarantine %s: %w", replica.name, name, err))
+			}
+		}
+		if len(held) == 0 {
+			continue
+		}
+		if err := replica.Quarantine(ctx, held); err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %w", replica.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// queueRepair queues the object for a repair by RunRepair, unless it is queued already.
+func (r *Replicated) queueRepair(name string) {
+	if _, queued := r.queued.LoadOrStore(name, struct{}{}); queued {
+		return
+	}
+	select {
+	case r.repairs <- name:
+	default:
+		r.queued.Delete(name)
+		r.log.Debug("repair queue full", zap.String("object", name))
+	}
+}
+
+// Repair checks the copy of the object on every replica against the hash in its key, and replaces the missing and
+// corrupted copies by a verified one. It returns the number of copies replaced. The replicas that cannot be reached
+// are left for a later repair.
+func (r *Replicated) Repair(ctx context.Context, name string) (repaired int, err error) {
+	_, hash, ok := model.ParseObjectKey(name)
+	if !ok || strings.HasPrefix(name, model.QuarantinePrefix) {
+		return 0, fmt.Errorf("object %s is not keyed by its hash: %w", name, model.ErrInvalidInput)
+	}
+
+	var source *replica
+	var damaged []*replica
+	var errs []error
+	corrupted := false
+	for _, replica := range r.replicas {
+		err := verifyCopy(ctx, replica, name, hash)
+		switch {
+		case err == nil:
+			if source == nil {
+				source = replica
+			}
+		case errors.Is(err, model.ErrNotFound):
+			damaged = append(damaged, replica)
+		case errors.Is(err, model.ErrIntegrity):
+			corrupted = true
+			damaged = append(damaged, replica)
+		default:
+			errs = append(errs, fmt.Errorf("replica %s: %w", replica.name, err))
+		}
+	}
+	if source == nil {
+		if corrupted {
+			errs = append(errs, fmt.Errorf("no replica holds a verified copy of %s: %w", name, model.ErrIntegrity))
+		}
+		// an object missing from every replica was deleted
+		return 0, errors.Join(errs...)
+	}
+
+	for _, replica := range damaged {
+		if err := copyObject(ctx, source, replica, name, hash); err != nil {
+			r.metrics.ReplicaRepair(repairFailed)
+			errs = append(errs, fmt.Errorf("failed to repair replica %s: %w", replica.name, err))
+			continue
+		}
+		replica.divergent.Delete(name)
+		r.metrics.ReplicaRepair(repairRepaired)
+		repaired++
+	}
+	return repaired, errors.Join(errs...)
+}
+
+// verifyCopy reads the copy of the object held by the replica to its end, verifying it against the hash.
+func verifyCopy(ctx context.Context, replica Storage, name string, hash []byte) error {
+	content, err := replica.Download(ctx, name, hash)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = io.Copy(io.Discard, content)
+	return err
+}
+
+// copyObject copies the object from the source replica to the target one, verifying it on the way.
+func copyObject(ctx context.Context, source, target Storage, name string, hash []byte) error {
+	content, err := source.Download(ctx, name, hash)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return target.UploadMultiple(ctx, single(&model.Object{Key: name, Size: -1, Hash: hash, Content: content}))
+}
+
+// Reconcile lists the objects of every replica and repairs the ones missing from a replica, or whose size
+// differs between the replicas. The copies corrupted without a change of size are repaired once a read finds them.
+// With a reference index, the divergent objects that neither a file nor a pending upload refers to are not repaired,
+// since they are what a deletion or a garbage collection failing on some of the replicas left behind.
+func (r *Replicated) Reconcile(ctx context.Context) (*model.RepairReport, error) {
+	type listing struct {
+		replicas int
+		sizes    map[int64]bool
+	}
+	objects := make(map[string]*listing)
+	for _, replica := range r.replicas {
+		err := replica.Walk(ctx, func(object model.StoredObject) error {
+			if strings.HasPrefix(object.Key, model.QuarantinePrefix) {
+				return nil
+			}
+			if _, _, ok := model.ParseObjectKey(object.Key); !ok {
+				return nil
+			}
+			l := objects[object.Key]
+			if l == nil {
+				l = &listing{sizes: make(map[int64]bool)}
+				objects[object.Key] = l
+			}
+			l.replicas++
+			l.sizes[object.Size] = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list replica %s: %w", replica.name, err)
+		}
+	}
+
+	// the references are read once the replicas are listed, so that the objects uploaded meanwhile are referenced
+	var referenced map[string]bool
+	if r.references != nil {
+		var err error
+		if referenced, err = r.references.ReferencedKeys(ctx, time.Time{}); err != nil {
+			return nil, fmt.Errorf("failed to get referenced objects: %w", err)
+		}
+	}
+
+	report := &model.RepairReport{Scanned: len(objects)}
+	for name, l := range objects {
+		if l.replicas == len(r.replicas) && len(l.sizes) == 1 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Divergent++
+		if r.references != nil && !referenced[name] {
+			report.Unreferenced++
+			continue
+		}
+		repaired, err := r.Repair(ctx, name)
+		report.Repaired += repaired
+		if err != nil {
+			r.log.Error("failed to repair object", zap.String("object", name), zap.Error(err))
+			report.Failed++
+		}
+	}
+	return report, nil
+}
+
+// RunRepair repairs the objects queued by the reads and the writes as they come, and reconciles the replicas
+// every interval, until the context is canceled. A zero interval disables the reconciliation.
+func (r *Replicated) RunRepair(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case name := <-r.repairs:
+			r.queued.Delete(name)
+			repaired, err := r.Repair(ctx, name)
+			if err != nil && ctx.Err() == nil {
+				r.log.Error("failed to repair object", zap.String("object", name), zap.Error(err))
+			} else if repaired > 0 {
+				r.log.Info("repaired object", zap.String("object", name), zap.Int("replicas", repaired))
+			}
+		case <-tick:
+			report, err := r.Reconcile(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					r.log.Error("failed to reconcile replicas", zap.Error(err))
+				}
+				continue
+			}
+			r.log.Info("replicas reconciled",
+				zap.Int("scanned", report.Scanned),
+				zap.Int("divergent", report.Divergent),
+				zap.Int("repaired", report.Repaired),
+				zap.Int("failed", report.Failed),
+				zap.Int("unreferenced", report.Unreferenced))
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestReplicated(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			return newTestReplicated(t, 0, NewMemory(), NewMemory(), NewMemory())
+		})
+	})
+	t.Run("Filesystem", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			backends := make([]Storage, 3)
+			for i := range backends {
+				store, err := NewFilesystem(t.TempDir())
+				require.NoError(t, err)
+				backends[i] = store
+			}
+			return newTestReplicated(t, 0, backends...)
+		})
+	})
+}
+
+func TestNewReplicated(t *testing.T) {
+	_, err := NewReplicated(nil, 0)
+	require.Error(t, err)
+	_, err = NewReplicated([]Storage{NewMemory(), NewMemory()}, 3)
+	require.Error(t, err)
+
+	store, err := NewReplicated([]Storage{NewMemory(), NewMemory(), NewMemory(), NewMemory()}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, store.quorum)
+}
+
+func TestReplicatedWriteQuorum(t *testing.T) {
+	tests := []struct {
+		name   string
+		quorum int
+		// down are the replicas that cannot be reached
+		down         []int
+		wantErr      bool
+		wantDegraded int
+	}{
+		{name: "Every replica", quorum: 2},
+		{name: "Quorum", quorum: 2, down: []int{1}, wantDegraded: 1},
+		{name: "Below quorum", quorum: 2, down: []int{0, 2}, wantErr: true},
+		{name: "Every replica required", quorum: 3, down: []int{2}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := prometheus.NewRegistry()
+			backends := []*flakyStorage{newFlaky(), newFlaky(), newFlaky()}
+			store := newTestReplicated(t, tt.quorum, backends[0], backends[1], backends[2])
+			store.metrics = metrics.New(registry)
+			for _, i := range tt.down {
+				backends[i].down.Store(true)
+			}
+
+			file := newFiles("acme", "test0")[0]
+			err := upload(ctx, store, file)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				data, err := download(ctx, store, file)
+				require.NoError(t, err)
+				require.Equal(t, file.data, data)
+			}
+
+			for i, backend := range backends {
+				_, err = backend.Storage.Stat(ctx, file.key)
+				down := backend.down.Load()
+				require.Equal(t, down, errors.Is(err, model.ErrNotFound), "replica %d", i)
+			}
+			require.Len(t, store.repairs, tt.wantDegraded)
+			expected := fmt.Sprintf(`
+# HELP fileserver_replica_degraded_writes_total Number of objects written to the write quorum but not to every replica.
+# TYPE fileserver_replica_degraded_writes_total counter
+fileserver_replica_degraded_writes_total %d
+`, tt.wantDegraded)
+			require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_replica_degraded_writes_total"))
+
+			// the replicas back up receive their copies once the queued objects are repaired
+			for _, backend := range backends {
+				backend.down.Store(false)
+			}
+			if tt.wantDegraded > 0 {
+				repaired, err := store.Repair(ctx, <-store.repairs)
+				require.NoError(t, err)
+				require.Equal(t, len(tt.down), repaired)
+				for _, backend := range backends {
+					_, err = download(ctx, backend, file)
+					require.NoError(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicatedPing(t *testing.T) {
+	backends := []*flakyStorage{newFlaky(), newFlaky(), newFlaky()}
+	store := newTestReplicated(t, 2, backends[0], backends[1], backends[2])
+	require.NoError(t, store.Ping(context.Background()))
+
+	backends[0].down.Store(true)
+	require.NoError(t, store.Ping(context.Background()))
+	backends[2].down.Store(true)
+	require.ErrorIs(t, store.Ping(context.Background()), errUnavailable)
+}
+
+func TestReplicatedRead(t *testing.T) {
+	ctx := context.Background()
+	backends := []*flakyStorage{newFlaky(), newFlaky(), newFlaky()}
+	store := newTestReplicated(t, 0, backends[0], backends[1], backends[2])
+	files := newFiles("acme", "test0", "test1", "test2")
+	require.NoError(t, upload(ctx, store, files...))
+	// replica 0 is the fastest, then replica 1
+	for i, replica := range store.replicas {
+		replica.latency.Store(int64(i+1) * int64(time.Millisecond))
+	}
+
+	t.Run("Unreachable replica", func(t *testing.T) {
+		backends[0].down.Store(true)
+		defer backends[0].down.Store(false)
+
+		data, err := download(ctx, store, files[0])
+		require.NoError(t, err)
+		require.Equal(t, files[0].data, data)
+		// the replica is read from last until it succeeds again
+		require.Same(t, store.replicas[0], store.ordered(files[0].key)[2])
+		require.Empty(t, store.repairs)
+	})
+
+	t.Run("Missing copy", func(t *testing.T) {
+		file := files[1]
+		require.NoError(t, backends[1].Delete(ctx, []string{file.key}))
+		store.replicas[0].healthy.Store(false)
+		defer store.replicas[0].healthy.Store(true)
+
+		data, err := download(ctx, store, file)
+		require.NoError(t, err)
+		require.Equal(t, file.data, data)
+
+		require.Equal(t, file.key, <-store.repairs)
+		repaired, err := store.Repair(ctx, file.key)
+		require.NoError(t, err)
+		require.Equal(t, 1, repaired)
+		_, err = download(ctx, backends[1], file)
+		require.NoError(t, err)
+	})
+
+	t.Run("Corrupted copy", func(t *testing.T) {
+		file := files[2]
+		corrupt(t, backends[0], file, "corrupt")
+
+		// the copy fails the verification once, then the other replicas serve the object
+		_, err := download(ctx, store, file)
+		require.ErrorIs(t, err, model.ErrIntegrity)
+		data, err := download(ctx, store, file)
+		require.NoError(t, err)
+		require.Equal(t, file.data, data)
+
+		require.Equal(t, file.key, <-store.repairs)
+		repaired, err := store.Repair(ctx, file.key)
+		require.NoError(t, err)
+		require.Equal(t, 1, repaired)
+		_, err = download(ctx, backends[0], file)
+		require.NoError(t, err)
+		require.Same(t, store.replicas[0], store.ordered(file.key)[0])
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		backends[0].down.Store(true)
+		defer backends[0].down.Store(false)
+
+		content, err := store.DownloadRange(ctx, files[0].key, 1, 3)
+		require.NoError(t, err)
+		defer content.Close()
+		data, err := io.ReadAll(content)
+		require.NoError(t, err)
+		require.Equal(t, "est", string(data))
+	})
+}
+
+func TestReplicatedRepairLost(t *testing.T) {
+	ctx := context.Background()
+	backends := []*flakyStorage{newFlaky(), newFlaky()}
+	store := newTestReplicated(t, 0, backends[0], backends[1])
+	file := newFiles("acme", "test0")[0]
+	require.NoError(t, upload(ctx, store, file))
+
+	// no replica holds a verified copy
+	corrupt(t, backends[0], file, "corrupt0")
+	corrupt(t, backends[1], file, "corrupt1")
+	repaired, err := store.Repair(ctx, file.key)
+	require.ErrorIs(t, err, model.ErrIntegrity)
+	require.Zero(t, repaired)
+
+	// an object deleted from every replica has nothing to repair
+	require.NoError(t, store.Delete(ctx, []string{file.key}))
+	repaired, err = store.Repair(ctx, file.key)
+	require.NoError(t, err)
+	require.Zero(t, repaired)
+
+	_, err = store.Repair(ctx, model.QuarantinePrefix+file.key)
+	require.ErrorIs(t, err, model.ErrInvalidInput)
+}
+
+func TestReplicatedReconcile(t *testing.T) {
+	ctx := context.Background()
+	registry := prometheus.NewRegistry()
+	backends := []*flakyStorage{newFlaky(), newFlaky(), newFlaky()}
+	store := newTestReplicated(t, 0, backends[0], backends[1], backends[2])
+	store.metrics = metrics.New(registry)
+
+	files := newFiles("acme", "test0", "test1", "test2")
+	require.NoError(t, upload(ctx, store, files...))
+	// a copy is missing, another one has another size, and the quarantined objects are left alone
+	require.NoError(t, backends[1].Delete(ctx, []string{files[0].key}))
+	corrupt(t, backends[2], files[1], "corrupted")
+	quarantined := model.QuarantinePrefix + files[2].key
+	require.NoError(t, backends[0].UploadMultiple(ctx, objects(&model.Object{
+		Key: quarantined, Size: -1, Content: bytes.NewReader(files[2].data),
+	})))
+
+	report, err := store.Reconcile(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.RepairReport{Scanned: 3, Divergent: 2, Repaired: 2}, report)
+
+	for _, backend := range backends {
+		for _, file := range files {
+			data, err := download(ctx, backend, file)
+			require.NoError(t, err)
+			require.Equal(t, file.data, data)
+		}
+	}
+	_, err = backends[1].Stat(ctx, quarantined)
+	require.ErrorIs(t, err, model.ErrNotFound)
+
+	expected := `
+# HELP fileserver_replica_repairs_total Number of missing or divergent replicas of objects repaired, by status.
+# TYPE fileserver_replica_repairs_total counter
+fileserver_replica_repairs_total{status="repaired"} 2
+`
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fileserver_replica_repairs_total"))
+
+	// a replica that cannot be listed fails the reconciliation
+	backends[2].down.Store(true)
+	_, err = store.Reconcile(ctx)
+	require.ErrorIs(t, err, errUnavailable)
+}
+
+// referenceIndex refers to the keys it holds.
+type referenceIndex map[string]bool
+
+func (i referenceIndex) ReferencedKeys(context.Context, time.Time) (map[string]bool, error) {
+	return i, nil
+}
+
+func TestReplicatedReconcileUnreferenced(t *testing.T) {
+	ctx := context.Background()
+	backends := []*flakyStorage{newFlaky(), newFlaky(), newFlaky()}
+	files := newFiles("acme", "test0", "test1")
+	store, err := NewReplicated([]Storage{backends[0], backends[1], backends[2]}, 0,
+		WithReferences(referenceIndex{files[0].key: true}))
+	require.NoError(t, err)
+	require.NoError(t, upload(ctx, store, files...))
+
+	// both objects are missing from a replica, but only the first one is still referenced:
+	// the second one was deleted from the other replicas by a failed deletion
+	require.NoError(t, backends[1].Delete(ctx, []string{files[0].key}))
+	require.NoError(t, backends[0].Delete(ctx, []string{files[1].key}))
+	require.NoError(t, backends[2].Delete(ctx, []string{files[1].key}))
+
+	report, err := store.Reconcile(ctx)
+	require.NoError(t, err)
+	require.Equal(t, &model.RepairReport{Scanned: 2, Divergent: 2, Repaired: 1, Unreferenced: 1}, report)
+
+	data, err := download(ctx, backends[1], files[0])
+	require.NoError(t, err)
+	require.Equal(t, files[0].data, data)
+	for _, backend := range []*flakyStorage{backends[0], backends[2]} {
+		_, err = backend.Stat(ctx, files[1].key)
+		require.ErrorIs(t, err, model.ErrNotFound)
+	}
+}
+
+func TestReplicatedRunRepair(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backends := []*flakyStorage{newFlaky(), newFlaky(), newFlaky()}
+	store := newTestReplicated(t, 0, backends[0], backends[1], backends[2])
+	file := newFiles("acme", "test0")[0]
+
+	backends[2].down.Store(true)
+	require.NoError(t, upload(ctx, store, file))
+	backends[2].down.Store(false)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		store.RunRepair(ctx, 0)
+	}()
+	require.Eventually(t, func() bool {
+		_, err := download(ctx, backends[2], file)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func newTestReplicated(t *testing.T, quorum int, backends ...Storage) *Replicated {
+	store, err := NewReplicated(backends, quorum)
+	require.NoError(t, err)
+	return store
+}
+
+// corrupt replaces the copy of the file held by the backend by the content.
+func corrupt(t *testing.T, backend Storage, file *testFile, content string) {
+	require.NoError(t, backend.UploadMultiple(context.Background(), objects(&model.Object{
+		Key: file.key, Size: -1, Content: strings.NewReader(content),
+	})))
+}
+
+var errUnavailable = errors.New("replica unavailable")
+
+// flakyStorage is an in-memory backend that fails every operation while it is down.
+type flakyStorage struct {
+	Storage
+	down atomic.Bool
+}
+
+func newFlaky() *flakyStorage {
+	return &flakyStorage{Storage: NewMemory()}
+}
+
+func (f *flakyStorage) check() error {
+	if f.down.Load() {
+		return errUnavailable
+	}
+	return nil
+}
+
+func (f *flakyStorage) Ping(ctx context.Context) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Storage.Ping(ctx)
+}
+
+func (f *flakyStorage) Download(ctx context.Context, name string, hash []byte) (io.ReadCloser, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Storage.Download(ctx, name, hash)
+}
+
+func (f *flakyStorage) DownloadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.Storage.DownloadRange(ctx, name, offset, length)
+}
+
+func (f *flakyStorage) Stat(ctx context.Context, name string) (model.StoredObject, error) {
+	if err := f.check(); err != nil {
+		return model.StoredObject{}, err
+	}
+	return f.Storage.Stat(ctx, name)
+}
+
+func (f *flakyStorage) UploadMultiple(ctx context.Context, objects <-chan *model.Object) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Storage.UploadMultiple(ctx, objects)
+}
+
+func (f *flakyStorage) Delete(ctx context.Context, names []string) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Storage.Delete(ctx, names)
+}
+
+func (f *flakyStorage) Walk(ctx context.Context, fn func(object model.StoredObject) error) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Storage.Walk(ctx, fn)
+}
+
+func (f *flakyStorage) Quarantine(ctx context.Context, names []string) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.Storage.Quarantine(ctx, names)
+}
@@ -0,0 +1,312 @@
+// Package storage holds the backends storing the content of the files as objects keyed by tenant and hash.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/zale144/fileserver/internal/envelope"
+	"github.com/zale144/fileserver/internal/merkle"
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+	"github.com/zale144/fileserver/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// The storage backends selected by Config.Backend.
+const (
+	BackendMinIO      = "minio"
+	BackendFilesystem = "filesystem"
+	BackendMemory     = "memory"
+)
+
+// Storage is implemented by every storage backend.
+type Storage interface {
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+	// Download streams the object, verifying it as it is read: the reader returns a *model.IntegrityError
+	// instead of io.EOF if the content does not hash to the hash.
+	Download(ctx context.Context, name string, hash []byte) (io.ReadCloser, error)
+	// DownloadRange streams length bytes of the object from offset, a negative length reads to the end.
+	// A part of the object cannot be verified against its hash.
+	DownloadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// Stat describes the object.
+	Stat(ctx context.Context, name string) (model.StoredObject, error)
+	// UploadMultiple stores the objects until the channel is closed, an object stored already is overwritten.
+	// An object whose content does not match its size or hash is not stored.
+	UploadMultiple(ctx context.Context, objects <-chan *model.Object) error
+	// Delete removes the objects, the ones that do not exist are ignored.
+	Delete(ctx context.Context, names []string) error
+	// Walk calls fn for every object, it stops at the first error returned by fn.
+	Walk(ctx context.Context, fn func(object model.StoredObject) error) error
+	// Quarantine moves the objects under model.QuarantinePrefix.
+	Quarantine(ctx context.Context, names []string) error
+}
+
+// New creates the backend selected by the configuration, replicated if replicas are configured or erasure-coded
+// if shard locations are, and tiered with the cold backend if one is configured. Every backend encrypts
+// the objects it holds if master keys are configured.
+func New(config Config, opts ...Option) (Storage, error) {
+	keyring, err := config.Keyring()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load master keys: %w", err)
+	}
+	if keyring != nil {
+		opts = append(opts[:len(opts):len(opts)], func(o *options) {
+			o.keyring = keyring
+		})
+	}
+
+	hot, err := newDistributed(config, opts...)
+	if err != nil {
+		return nil, err
+	}
+	coldConfig, ok := config.Cold()
+	if !ok {
+		return hot, nil
+	}
+	cold, err := newBackend(coldConfig, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cold tier: %w", err)
+	}
+	return NewTiered(hot, cold, opts...), nil
+}
+
+// Backends returns the backends of the storage, the hot and the cold ones of a tiered storage,
+// the replicas of a replicated one, the shard locations of an erasure-coded one and the ones holding
+// the encrypted objects.
+func Backends(store Storage) []Storage {
+	parts := components(store)
+	if len(parts) == 0 {
+		return []Storage{store}
+	}
+	var backends []Storage
+	for _, part := range parts {
+		backends = append(backends, Backends(part)...)
+	}
+	return backends
+}
+
+// Encryption returns the backends of the storage encrypting the objects, none if the objects are not encrypted.
+func Encryption(store Storage) []*Encrypted {
+	if encrypted, ok := store.(*Encrypted); ok {
+		return []*Encrypted{encrypted}
+	}
+	var encrypted []*Encrypted
+	for _, part := range components(store) {
+		encrypted = append(encrypted, Encryption(part)...)
+	}
+	return encrypted
+}
+
+// components returns the storages the storage is made of, none for a backend.
+func components(store Storage) []Storage {
+	switch store := store.(type) {
+	case *Tiered:
+		hot, cold := store.Tiers()
+		return []Storage{hot, cold}
+	case *Replicated:
+		return store.Replicas()
+	case *Erasure:
+		return store.Locations()
+	case *Encrypted:
+		return []Storage{store.Backend()}
+	default:
+		return nil
+	}
+}
+
+// Replication returns the replicated storage, the hot tier of a tiered storage, and false if the objects are not replicated.
+func Replication(store Storage) (*Replicated, bool) {
+	if tiered, ok := store.(*Tiered); ok {
+		store, _ = tiered.Tiers()
+	}
+	replicated, ok := store.(*Replicated)
+	return replicated, ok
+}
+
+// ErasureCoding returns the erasure-coded storage, the hot tier of a tiered storage, and false if the objects are not erasure-coded.
+func ErasureCoding(store Storage) (*Erasure, bool) {
+	if tiered, ok := store.(*Tiered); ok {
+		store, _ = tiered.Tiers()
+	}
+	coded, ok := store.(*Erasure)
+	return coded, ok
+}
+
+// newDistributed creates the backend selected by the configuration, or one on every replica or shard location
+// if replicas or shard locations are configured.
+func newDistributed(config Config, opts ...Option) (Storage, error) {
+	replicaConfigs, replicated := config.ReplicaConfigs()
+	shardConfigs, coded := config.ShardConfigs()
+	switch {
+	case replicated && coded:
+		return nil, errors.New("both replicas and shard locations are configured")
+	case replicated:
+		replicas, err := newBackends(replicaConfigs, "replica", opts...)
+		if err != nil {
+			return nil, err
+		}
+		return NewReplicated(replicas, config.WriteQuorum, opts...)
+	case coded:
+		locations, err := newBackends(shardConfigs, "shard location", opts...)
+		if err != nil {
+			return nil, err
+		}
+		return NewErasure(locations, config.DataShards, config.ParityShards, newOptions(opts).shardIndex, opts...)
+	default:
+		return newBackend(config, opts...)
+	}
+}
+
+// newBackends creates a backend per configuration.
+func newBackends(configs []Config, kind string, opts ...Option) ([]Storage, error) {
+	backends := make([]Storage, len(configs))
+	for i, config := range configs {
+		backend, err := newBackend(config, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("%s %d: %w", kind, i, err)
+		}
+		backends[i] = backend
+	}
+	return backends, nil
+}
+
+// newBackend creates the backend selected by the configuration, encrypted if the options hold a keyring.
+func newBackend(config Config, opts ...Option) (Storage, error) {
+	var backend Storage
+	var err error
+	switch config.Backend {
+	case BackendMinIO:
+		backend, err = NewFile(config, opts...)
+	case BackendFilesystem:
+		backend, err = NewFilesystem(config.Dir, opts...)
+	case BackendMemory:
+		backend = NewMemory(opts...)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if keyring := newOptions(opts).keyring; keyring != nil {
+		return NewEncrypted(backend, keyring, opts...), nil
+	}
+	return backend, nil
+}
+
+// NewVerifyingReader hashes the content as it is read, and returns a *model.IntegrityError instead of io.EOF
+// if it does not hash to the expected hash.
+func NewVerifyingReader(content io.ReadCloser, key string, expected []byte) io.ReadCloser {
+	return &verifyingReader{content: content, key: key, expected: expected, hasher: merkle.NewHasher()}
+}
+
+type verifyingReader struct {
+	content  io.ReadCloser
+	key      string
+	expected []byte
+	hasher   hash.Hash
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF {
+		if actual := r.hasher.Sum(nil); !bytes.Equal(actual, r.expected) {
+			return n, &model.IntegrityError{Key: r.key, Expected: r.expected, Actual: actual}
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.content.Close()
+}
+
+// checkContent returns an error if the content of the object, of the given size and hash, does not match its hints.
+func checkContent(object *model.Object, size int64, actual []byte) error {
+	if object.Size >= 0 && size != object.Size {
+		return fmt.Errorf("object %s has %d bytes instead of %d", object.Key, size, object.Size)
+	}
+	if object.Hash != nil && !bytes.Equal(actual, object.Hash) {
+		return &model.IntegrityError{Key: object.Key, Expected: object.Hash, Actual: actual}
+	}
+	return nil
+}
+
+// rangeReader reads a range of an object, closing the object along with it.
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+type options struct {
+	metrics    *metrics.Metrics
+	logger     *zap.Logger
+	shardIndex ShardIndex
+	references ReferenceIndex
+	// keyring encrypts the objects of the backends created by New.
+	keyring *envelope.Keyring
+}
+
+// Option configures optional dependencies of the storage.
+type Option func(*options)
+
+// WithMetrics makes the storage record the latency of its operations.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithLogger sets the logger of the background work of the storage, e.g. the repairs of the replicas.
+func WithLogger(logger *zap.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithShardIndex sets the index recording the layout of the erasure-coded objects, required by the erasure coding.
+func WithShardIndex(index ShardIndex) Option {
+	return func(o *options) {
+		o.shardIndex = index
+	}
+}
+
+// WithReferences sets the index of the referenced objects, so that the reconciliation of the replicas
+// does not restore the objects no file refers to anymore.
+func WithReferences(references ReferenceIndex) Option {
+	return func(o *options) {
+		o.references = references
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{logger: zap.NewNop()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+var tracer = otel.Tracer("github.com/zale144/fileserver/internal/server/storage")
+
+// startOperation starts the span of the operation, the returned function ends it and records the latency of the operation.
+func startOperation(ctx context.Context, m *metrics.Metrics, operation string, attrs ...attribute.KeyValue) (context.Context, func(err *error)) {
+	ctx, span := tracer.Start(ctx, "storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	start := time.Now()
+	return ctx, func(err *error) {
+		m.ObserveStorage(operation, start, *err)
+		tracing.End(span, err)
+	}
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zale144/fileserver/internal/server/metrics"
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+// Tiered writes the objects to a hot backend and reads them from whichever of the hot and the cold backends holds them.
+// The objects are moved to the cold backend by CopyToCold and DeleteHot, the repository records which tier holds them.
+type Tiered struct {
+	hot, cold Storage
+	metrics   *metrics.Metrics
+}
+
+// NewTiered creates the storage tiering the objects between the hot and the cold backends.
+func NewTiered(hot, cold Storage, opts ...Option) *Tiered {
+	return &Tiered{
+		hot:     hot,
+		cold:    cold,
+		metrics: newOptions(opts).metrics,
+	}
+}
+
+// Tiers returns the hot and the cold backends.
+func (t *Tiered) Tiers() (hot, cold Storage) {
+	return t.hot, t.cold
+}
+
+// Ping checks that both backends are reachable.
+func (t *Tiered) Ping(ctx context.Context) error {
+	if err := t.hot.Ping(ctx); err != nil {
+		return fmt.Errorf("hot tier: %w", err)
+	}
+	if err := t.cold.Ping(ctx); err != nil {
+		return fmt.Errorf("cold tier: %w", err)
+	}
+	return nil
+}
+
+// Download streams the object from the hot backend, or from the cold one if it was migrated.
+func (t *Tiered) Download(ctx context.Context, name string, hash []byte) (io.ReadCloser, error) {
+	content, err := t.hot.Download(ctx, name, hash)
+	if errors.Is(err, model.ErrNotFound) {
+		t.metrics.TierRead(model.TierCold)
+		return t.cold.Download(ctx, name, hash)
+	}
+	if err == nil {
+		t.metrics.TierRead(model.TierHot)
+	}
+	return content, err
+}
+
+// DownloadRange streams the range of the object from the hot backend, or from the cold one if it was migrated.
+func (t *Tiered) DownloadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	content, err := t.hot.DownloadRange(ctx, name, offset, length)
+	if errors.Is(err, model.ErrNotFound) {
+		t.metrics.TierRead(model.TierCold)
+		return t.cold.DownloadRange(ctx, name, offset, length)
+	}
+	if err == nil {
+		t.metrics.TierRead(model.TierHot)
+	}
+	return content, err
+}
+
+// Stat describes the object from the hot backend, or from the cold one if it was migrated.
+func (t *Tiered) Stat(ctx context.Context, name string) (model.StoredObject, error) {
+	object, err := t.hot.Stat(ctx, name)
+	if errors.Is(err, model.ErrNotFound) {
+		return t.cold.Stat(ctx, name)
+	}
+	return object, err
+}
+
+// UploadMultiple stores the objects in the hot backend.
+func (t *Tiered) UploadMultiple(ctx context.Context, objects <-chan *model.Object) error {
+	return t.hot.UploadMultiple(ctx, objects)
+}
+
+// Delete removes the objects from both backends.
+func (t *Tiered) Delete(ctx context.Context, names []string) error {
+	return errors.Join(t.hot.Delete(ctx, names), t.cold.Delete(ctx, names))
+}
+
+// Walk calls fn for every object of the hot backend and then of the cold one. An object being migrated
+// may be in both backends, in which case it is seen twice.
+func (t *Tiered) Walk(ctx context.Context, fn func(object model.StoredObject) error) error {
+	if err := t.hot.Walk(ctx, fn); err != nil {
+		return err
+	}
+	return t.cold.Walk(ctx, fn)
+}
+
+// Quarantine moves the objects under model.QuarantinePrefix in the backend holding them.
+func (t *Tiered) Quarantine(ctx context.Context, names []string) error {
+	var hot, cold []string
+	for _, name := range names {
+		_, err := t.hot.Stat(ctx, name)
+		switch {
+		case err == nil:
+			hot = append(hot, name)
+		case errors.Is(err, model.ErrNotFound):
+			cold = append(cold, name)
+		default:
+			return fmt.Errorf("failed to quarantine %s: %w", name, err)
+		}
+	}
+
+	if len(hot) > 0 {
+		if err := t.hot.Quarantine(ctx, hot); err != nil {
+			return err
+		}
+	}
+	for _, name := range cold {
+		// the objects in neither backend are ignored
+		if _, err := t.cold.Stat(ctx, name); errors.Is(err, model.ErrNotFound) {
+			continue
+		}
+		if err := t.cold.Quarantine(ctx, []string{name}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyToCold copies the object from the hot backend to the cold one, verifying it against its hash and size on the way.
+// An object that is only in the cold backend already was copied by an interrupted migration, and is left alone.
+func (t *Tiered) CopyToCold(ctx context.Context, name string, hash []byte, size int64) error {
+	content, err := t.hot.Download(ctx, name, hash)
+	if errors.Is(err, model.ErrNotFound) {
+		if _, statErr := t.cold.Stat(ctx, name); statErr == nil {
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read object from the hot tier: %w", err)
+	}
+	defer content.Close()
+
+	if err = t.cold.UploadMultiple(ctx, single(&model.Object{Key: name, Size: size, Hash: hash, Content: content})); err != nil {
+		return fmt.Errorf("failed to write object to the cold tier: %w", err)
+	}
+	return nil
+}
+
+// DeleteHot removes the objects from the hot backend once they are copied to the cold one.
+func (t *Tiered) DeleteHot(ctx context.Context, names []string) error {
+	return t.hot.Delete(ctx, names)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zale144/fileserver/internal/server/model"
+)
+
+func TestTiered(t *testing.T) {
+	testConformance(t, func(t *testing.T) Storage {
+		return NewTiered(NewMemory(), NewMemory())
+	})
+}
+
+func TestTieredMigration(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := NewMemory(), NewMemory()
+	store := NewTiered(hot, cold)
+
+	files := newFiles("acme", "test0", "test1")
+	require.NoError(t, upload(ctx, store, files...))
+	require.Len(t, walk(t, hot, "acme"), 2)
+	require.Empty(t, walk(t, cold, "acme"))
+
+	migrated := files[0]
+	size := int64(len(migrated.data))
+	require.NoError(t, store.CopyToCold(ctx, migrated.key, migrated.hash, size))
+	require.NoError(t, store.DeleteHot(ctx, []string{migrated.key}))
+	// copying again, as a run interrupted after the deletion does, is a no-op
+	require.NoError(t, store.CopyToCold(ctx, migrated.key, migrated.hash, size))
+
+	require.Len(t, walk(t, hot, "acme"), 1)
+	require.Len(t, walk(t, cold, "acme"), 1)
+
+	// the migrated object is read from the cold backend
+	for _, file := range files {
+		data, err := download(ctx, store, file)
+		require.NoError(t, err)
+		require.Equal(t, file.data, data)
+	}
+	object, err := store.Stat(ctx, migrated.key)
+	require.NoError(t, err)
+	require.Equal(t, size, object.Size)
+
+	// an object in neither backend cannot be migrated
+	missing := newFiles("acme", "missing")[0]
+	err = store.CopyToCold(ctx, missing.key, missing.hash, int64(len(missing.data)))
+	require.ErrorIs(t, err, model.ErrNotFound)
+
+	// deleting removes the objects from both backends
+	require.NoError(t, store.Delete(ctx, []string{files[0].key, files[1].key}))
+	require.Empty(t, walk(t, store, "acme"))
+}
+
+func TestTieredCopyVerifies(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := NewMemory(), NewMemory()
+	store := NewTiered(hot, cold)
+
+	// the object in the hot backend does not match its hash
+	file := newFiles("acme", "test0")[0]
+	require.NoError(t, hot.UploadMultiple(ctx, objects(&model.Object{Key: file.key, Size: -1, Content: strings.NewReader("corrupt")})))
+
+	err := store.CopyToCold(ctx, file.key, file.hash, -1)
+	require.ErrorIs(t, err, model.ErrIntegrity)
+	require.Empty(t, walk(t, cold, "acme"))
+}
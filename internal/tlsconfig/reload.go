@@ -0,0 +1,159 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Reloader serves the server certificate and the client CAs from their files,
+// picking up the changes without restarting the server, e.g. when the certificates are renewed.
+type Reloader struct {
+	cfg Server
+	log *zap.Logger
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// loaded holds the contents of the files the current certificate and CAs were loaded from.
+	loaded []byte
+}
+
+// NewReloader loads the certificate and the client CAs of the configuration.
+func NewReloader(cfg Server, log *zap.Logger) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("both the certificate and the key file are required")
+	}
+	r := &Reloader{
+		cfg: cfg,
+		log: log,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the configuration of the server, every handshake uses the latest certificate and client CAs.
+func (r *Reloader) TLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+	}
+	if r.cfg.ClientCAFile != "" {
+		// the client certificates are verified against the current CAs by verifyClient rather than by the
+		// handshake itself, which would only ever use the CAs set in the configuration
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		if r.cfg.ClientCertOptional {
+			cfg.ClientAuth = tls.RequestClientCert
+		}
+		cfg.VerifyConnection = r.verifyClient
+	}
+	return cfg
+}
+
+// Run reloads the files every interval if they changed, until the context is canceled.
+// A failed reload is logged and the previous certificate stays in use.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.reload()
+		if err != nil {
+			r.log.Error("failed to reload TLS certificates", zap.Error(err))
+			continue
+		}
+		if reloaded {
+			r.log.Info("reloaded TLS certificates", zap.String("cert_file", r.cfg.CertFile))
+		}
+	}
+}
+
+// reload loads the files again if their contents changed since they were last loaded.
+func (r *Reloader) reload() (bool, error) {
+	var contents [][]byte
+	for _, path := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		contents = append(contents, b)
+	}
+	loaded := bytes.Join(contents, []byte{0})
+
+	r.mu.RLock()
+	unchanged := bytes.Equal(loaded, r.loaded)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return false, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(contents[2]) {
+			return false, errors.New("no certificates found in client CA file " + r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.loaded = loaded
+	return true, nil
+}
+
+// verifyClient verifies the certificate presented by the client against the current client CAs.
+func (r *Reloader) verifyClient(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		if r.cfg.ClientCertOptional {
+			return nil
+		}
+		return errors.New("client certificate required")
+	}
+
+	r.mu.RLock()
+	roots := r.clientCAs
+	r.mu.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify client certificate: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Package tlsconfig builds the TLS configurations of the server, of its connections to MinIO and of the CLI.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Server is the TLS configuration of the HTTP and gRPC servers, TLS is disabled without a certificate.
+type Server struct {
+	CertFile string `envconfig:"TLS_CERT_FILE"`
+	KeyFile  string `envconfig:"TLS_KEY_FILE"`
+	// ClientCAFile enables mutual TLS, the clients must present a certificate signed by one of its CAs.
+	ClientCAFile string `envconfig:"TLS_CLIENT_CA_FILE"`
+	// ClientCertOptional lets the clients without a certificate through, those presenting one are still verified.
+	ClientCertOptional bool `envconfig:"TLS_CLIENT_CERT_OPTIONAL" default:"false"`
+	// ReloadInterval is how often the files are checked for changes.
+	ReloadInterval time.Duration `envconfig:"TLS_RELOAD_INTERVAL" default:"30s"`
+}
+
+// Enabled tells whether the server is configured to serve TLS.
+func (c Server) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// Client is the TLS configuration for connecting to a server.
+type Client struct {
+	// CAFile is the bundle of the CAs trusted besides the system ones.
+	CAFile string
+	// CertFile and KeyFile are the certificate presented to the servers requiring mutual TLS.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables the verification of the server certificate, it is only meant for testing.
+	InsecureSkipVerify bool
+}
+
+// Config returns the TLS configuration described by c, which is nil if c is empty.
+func (c Client) Config() (*tls.Config, error) {
+	if c == (Client{}) {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err = appendCerts(pool, c.CAFile); err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// appendCerts adds the PEM certificates of the file to the pool.
+func appendCerts(pool *x509.CertPool, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return errors.New("no certificates found in CA file " + path)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testCA issues the certificates of the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a leaf certificate with the given serial number and usage.
+func (ca *testCA) issue(t *testing.T, serial int64, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, dir, name string, b []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+	return path
+}
+
+// startServer serves TLS with the configuration of the reloader.
+func startServer(t *testing.T, r *Reloader) string {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	// StartTLS would add a certificate of its own, taking precedence over the reloaded one
+	srv.Listener = tls.NewListener(srv.Listener, r.TLSConfig())
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return strings.Replace(srv.URL, "http://", "https://", 1)
+}
+
+// serverSerial connects to the server and returns the serial number of the certificate it presented.
+func serverSerial(t *testing.T, url string, client Client) int64 {
+	tlsCfg, err := client.Config()
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	resp, err := httpClient.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.pem", ca.pem)
+	serverCert, serverKey := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, 3, x509.ExtKeyUsageClientAuth)
+	strangerCert, strangerKey := otherCA.issue(t, 4, x509.ExtKeyUsageClientAuth)
+
+	server := Server{
+		CertFile:     writeFile(t, dir, "server.pem", serverCert),
+		KeyFile:      writeFile(t, dir, "server.key", serverKey),
+		ClientCAFile: caFile,
+	}
+	client := Client{
+		CAFile:   caFile,
+		CertFile: writeFile(t, dir, "client.pem", clientCert),
+		KeyFile:  writeFile(t, dir, "client.key", clientKey),
+	}
+	stranger := Client{
+		CAFile:   caFile,
+		CertFile: writeFile(t, dir, "stranger.pem", strangerCert),
+		KeyFile:  writeFile(t, dir, "stranger.key", strangerKey),
+	}
+
+	tests := []struct {
+		name     string
+		optional bool
+		client   Client
+		wantErr  bool
+	}{
+		{
+			name:   "Trusted client certificate",
+			client: client,
+		}, {
+			name:    "Missing client certificate",
+			client:  Client{CAFile: caFile},
+			wantErr: true,
+		}, {
+			name:     "Missing optional client certificate",
+			optional: true,
+			client:   Client{CAFile: caFile},
+		}, {
+			name:    "Untrusted client certificate",
+			client:  stranger,
+			wantErr: true,
+		}, {
+			name:     "Untrusted optional client certificate",
+			optional: true,
+			client:   stranger,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := server
+			cfg.ClientCertOptional = tt.optional
+			r, err := NewReloader(cfg, zap.NewNop())
+			require.NoError(t, err)
+			url := startServer(t, r)
+
+			tlsCfg, err := tt.client.Config()
+			require.NoError(t, err)
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+			resp, err := httpClient.Get(url)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	cert, key := ca.issue(t, 2, x509.ExtKeyUsageServerAuth)
+	cfg := Server{
+		CertFile: writeFile(t, dir, "server.pem", cert),
+		KeyFile:  writeFile(t, dir, "server.key", key),
+	}
+	client := Client{CAFile: writeFile(t, dir, "ca.pem", ca.pem)}
+
+	r, err := NewReloader(cfg, zap.NewNop())
+	require.NoError(t, err)
+	url := startServer(t, r)
+	require.EqualValues(t, 2, serverSerial(t, url, client))
+
+	reloaded, err := r.reload()
+	require.NoError(t, err)
+	require.False(t, reloaded, "unchanged files are not reloaded")
+
+	// a renewed certificate is served without restarting
+	cert, key = ca.issue(t, 5, x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "server.pem", cert)
+	writeFile(t, dir, "server.key", key)
+	reloaded, err = r.reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.EqualValues(t, 5, serverSerial(t, url, client))
+
+	// a broken certificate keeps the previous one in use
+	writeFile(t, dir, "server.pem", []byte("not a certificate"))
+	_, err = r.reload()
+	require.Error(t, err)
+	require.EqualValues(t, 5, serverSerial(t, url, client))
+}
+
+func TestClientConfig(t *testing.T) {
+	tlsCfg, err := Client{}.Config()
+	require.NoError(t, err)
+	require.Nil(t, tlsCfg)
+
+	dir := t.TempDir()
+	_, err = Client{CAFile: writeFile(t, dir, "ca.pem", []byte("not a certificate"))}.Config()
+	require.Error(t, err)
+
+	_, err = Client{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "missing.key")}.Config()
+	require.Error(t, err)
+
+	_, err = NewReloader(Server{CertFile: filepath.Join(dir, "server.pem")}, zap.NewNop())
+	require.Error(t, err)
+}